@@ -0,0 +1,311 @@
+// Package ccp copies files to and from a chili-copy server, for programs
+// that embed the client instead of running ccp_client.
+//
+//	c := ccp.NewClient("backup-host:5678")
+//	res, err := c.UploadFile(ctx, "/data/db.tar", "/backups/db.tar", &ccp.Options{Durable: true})
+//
+// Errors the server responds with are returned as *ServerError, whose Type
+// tells why the server refused.
+package ccp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/common/mux"
+	"github.com/chili-copy/common/protocol"
+)
+
+const (
+	DefaultChunkSize   = 16 * 1024 * 1024
+	DefaultMemoryLimit = 64 * 1024 * 1024
+	DefaultRetries     = 3
+	DefaultDialTimeout = 30 * time.Second
+	// DefaultIOTimeout leaves time for the server to stitch large
+	// multipart copies, during which no data moves.
+	DefaultIOTimeout = 5 * time.Minute
+)
+
+// TimeoutError is returned when the server took too long to connect to,
+// or moved no data for too long. See Client.SetTimeouts.
+type TimeoutError = common.TimeoutError
+
+// ServerError is an error response from the server. Its Type is one of the
+// protocol.Error* values, eg. protocol.ErrorInsufficientSpace, and Message
+// may tell the cause. Requests failing with Retryable errors are retried.
+type ServerError = protocol.ServerError
+
+var (
+	// ErrChecksumMismatch means the data arrived, but its checksum differs
+	// at the two ends.
+	ErrChecksumMismatch = errors.New("checksum mismatch from server")
+	// ErrUnexpectedResponse means the server answered with an op that
+	// makes no sense at that point of the exchange.
+	ErrUnexpectedResponse = errors.New("unknown opType received")
+)
+
+// ProgressFunc is called with the bytes moved so far and the total. Calls
+// do not overlap, but may come from different goroutines.
+type ProgressFunc func(done uint64, total uint64)
+
+type Options struct {
+	// ChunkSize is the part size of multipart copies. Files smaller than it
+	// are copied in one go. Default is DefaultChunkSize.
+	ChunkSize uint64
+	// Workers is the number of parts moved at a time. Default is the
+	// number of CPUs.
+	Workers int
+	// Auto tunes the part size and the parts sent at a time of multipart
+	// uploads to the link, within the limits the server advertises, in
+	// place of ChunkSize and Workers. ChunkSize still decides which files
+	// are copied in one go.
+	Auto bool
+	// Durable asks the server to fsync uploaded files before reporting
+	// success. Result.Durable tells whether it did.
+	Durable bool
+	// ZeroCopy sends with sendfile when the source is an *os.File.
+	ZeroCopy bool
+	// MemoryLimit bounds the memory used for buffers. Default is
+	// DefaultMemoryLimit.
+	MemoryLimit uint64
+	// FanOutPolicy is what UploadToAll does with servers falling behind the
+	// others. Default is FanOutWait.
+	FanOutPolicy FanOutPolicy
+	// Retries is how many times a request is sent again when the server
+	// fails it with a retryable error, such as another copy to the same
+	// path being in progress. Default is DefaultRetries, and a negative
+	// value turns retries off.
+	Retries  int
+	Progress ProgressFunc
+	// ConfirmedProgress has Upload call Progress with the bytes of a part,
+	// or of a whole single copy, once the server confirmed getting them,
+	// rather than as they are sent.
+	ConfirmedProgress bool
+}
+
+func (o *Options) withDefaults() Options {
+	opts := Options{}
+	if o != nil {
+		opts = *o
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+	if opts.Workers < 1 {
+		opts.Workers = runtime.NumCPU()
+	}
+	if opts.MemoryLimit == 0 {
+		opts.MemoryLimit = DefaultMemoryLimit
+	}
+	if opts.FanOutPolicy == "" {
+		opts.FanOutPolicy = FanOutWait
+	}
+	if opts.Retries == 0 {
+		opts.Retries = DefaultRetries
+	} else if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+	return opts
+}
+
+type Result struct {
+	// Checksum is the hex MD5 of the file, or for multipart copies the MD5
+	// of the MD5s of its parts. Both ends computed it.
+	Checksum string
+	Bytes    uint64
+	Parts    int
+	// ChunkSize and Workers are those multipart uploads ended with, the
+	// ones picked last in auto mode.
+	ChunkSize uint64
+	Workers   int
+	// Durable is true if the server fsynced an uploaded file.
+	Durable  bool
+	Duration time.Duration
+}
+
+type FileInfo struct {
+	// Name is the name of the file in its directory, only set by List.
+	Name    string
+	Size    uint64
+	ModTime time.Time
+}
+
+type Client struct {
+	network     string
+	address     string
+	dialTimeout time.Duration
+	ioTimeout   time.Duration
+	multiplex   bool
+	muxLock     sync.Mutex
+	session     *mux.Session // shared by requests when multiplexed
+	log         *logger.Logger
+}
+
+// NewClient returns a client for the server at address, eg. "host:5678",
+// or "unix:///run/ccp.sock" for one on a unix socket.
+func NewClient(address string) *Client {
+	network, addr := common.SplitAddress(address)
+	return &Client{network: network, address: addr, dialTimeout: DefaultDialTimeout, ioTimeout: DefaultIOTimeout,
+		log: logger.With("remote", address)}
+}
+
+// SetTimeouts sets how long connecting to the server may take, and how long
+// a request may wait for the server to move any data, DefaultDialTimeout
+// and DefaultIOTimeout unless set. 0 never times out.
+func (c *Client) SetTimeouts(dialTimeout time.Duration, ioTimeout time.Duration) {
+	c.dialTimeout = dialTimeout
+	c.ioTimeout = ioTimeout
+}
+
+// SetMultiplex makes requests, such as the parts of a copy, share a single
+// connection as streams of it instead of connecting for each, for networks
+// that limit the connections of a client. Close closes that connection.
+// Servers that do not support it fail requests with ErrorUnknownOp.
+func (c *Client) SetMultiplex(multiplex bool) {
+	c.multiplex = multiplex
+}
+
+// Close closes the connection multiplexed requests share, if any. The
+// client connects again if used after.
+func (c *Client) Close() error {
+	c.muxLock.Lock()
+	defer c.muxLock.Unlock()
+	if c.session != nil {
+		c.session.Close()
+		c.session = nil
+	}
+	return nil
+}
+
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	if c.multiplex {
+		return c.openStream(ctx)
+	}
+	return common.GetConnectionContext(ctx, c.network, c.address, c.dialTimeout, c.ioTimeout)
+}
+
+// openStream opens a stream on the shared connection, connecting it first
+// if there is none or the server closed it.
+func (c *Client) openStream(ctx context.Context) (net.Conn, error) {
+	c.muxLock.Lock()
+	defer c.muxLock.Unlock()
+	if c.session == nil || c.session.IsClosed() {
+		session, err := c.dialMux(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.session = session
+	}
+	stream, err := c.session.Open()
+	if err != nil {
+		return nil, err
+	}
+	if c.ioTimeout > 0 {
+		return common.NewTimeoutConn(stream, c.ioTimeout, 0), nil
+	}
+	return stream, nil
+}
+
+// dialMux connects and asks the server to carry requests as streams.
+func (c *Client) dialMux(ctx context.Context) (*mux.Session, error) {
+	conn, err := common.GetConnectionContext(ctx, c.network, c.address, c.dialTimeout, 0)
+	if err != nil {
+		return nil, err
+	}
+	if c.ioTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.ioTimeout))
+	}
+	stop := common.WatchContext(ctx, conn)
+	var opType protocol.OpType
+	var headerBytes []byte
+	err = common.SendBytesToConn(conn, protocol.PrepareMuxRequestOpHeader(mux.DefaultWindow))
+	if err == nil {
+		opType, headerBytes, err = common.GetOpTypeAndHeaderFromConn(conn)
+	}
+	stop()
+	conn.SetDeadline(time.Time{})
+	if err == nil && ctx.Err() == nil {
+		switch opType {
+		case protocol.MuxAcceptOpType:
+			c.log.Info("sharing one connection for requests")
+			window := protocol.NewMuxOp(headerBytes).GetWindow()
+			return mux.NewSession(conn, true, mux.DefaultWindow, window, c.ioTimeout), nil
+		case protocol.ErrorResponseOpType:
+			err = protocol.NewServerError(headerBytes)
+		default:
+			err = ErrUnexpectedResponse
+		}
+	}
+	conn.Close()
+	return nil, ctxErrOr(ctx, err)
+}
+
+func (c *Client) SetLogger(log *logger.Logger) {
+	c.log = log
+}
+
+// UploadFile uploads the file at localPath to remotePath.
+func (c *Client) UploadFile(ctx context.Context, localPath string, remotePath string, opts *Options) (*Result, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return c.Upload(ctx, f, fi.Size(), remotePath, opts)
+}
+
+// DownloadFile downloads remotePath to the file at localPath, creating or
+// truncating it.
+func (c *Client) DownloadFile(ctx context.Context, remotePath string, localPath string, opts *Options) (*Result, error) {
+	f, err := os.OpenFile(localPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.Download(ctx, remotePath, f, opts)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		return nil, cerr
+	}
+	return res, err
+}
+
+// ctxErrOr returns ctx's error if it is done, as that is why err happened,
+// otherwise err.
+func ctxErrOr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// progress adds up bytes moved by concurrent workers for a ProgressFunc.
+type progress struct {
+	lock  sync.Mutex
+	done  uint64
+	total uint64
+	fn    ProgressFunc
+}
+
+func newProgress(total uint64, fn ProgressFunc) *progress {
+	return &progress{total: total, fn: fn}
+}
+
+func (p *progress) add(n uint64) {
+	if p.fn == nil || n == 0 {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.done += n
+	p.fn(p.done, p.total)
+}
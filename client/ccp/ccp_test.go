@@ -0,0 +1,59 @@
+package ccp
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestWithDefaults(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *Options
+		want Options
+	}{
+		{"nil", nil, Options{ChunkSize: DefaultChunkSize, Workers: runtime.NumCPU(), MemoryLimit: DefaultMemoryLimit,
+			FanOutPolicy: FanOutWait, Retries: DefaultRetries}},
+		{"set", &Options{ChunkSize: 10, Workers: 2, MemoryLimit: 100, FanOutPolicy: FanOutDrop, Retries: 5},
+			Options{ChunkSize: 10, Workers: 2, MemoryLimit: 100, FanOutPolicy: FanOutDrop, Retries: 5}},
+		{"retries off", &Options{Retries: -1, Workers: -3}, Options{ChunkSize: DefaultChunkSize,
+			Workers: runtime.NumCPU(), MemoryLimit: DefaultMemoryLimit, FanOutPolicy: FanOutWait, Retries: 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.withDefaults(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("withDefaults() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProgress(t *testing.T) {
+	tests := []struct {
+		name string
+		adds []uint64
+		want []uint64
+	}{
+		{"adds up", []uint64{10, 20, 70}, []uint64{10, 30, 100}},
+		{"skips nothing moved", []uint64{10, 0, 5}, []uint64{10, 15}},
+		{"none", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []uint64
+			p := newProgress(100, func(done uint64, total uint64) {
+				if total != 100 {
+					t.Errorf("progress total = %d, want 100", total)
+				}
+				got = append(got, done)
+			})
+			for _, n := range tt.adds {
+				p.add(n)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("progress calls = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	newProgress(100, nil).add(10)
+}
@@ -0,0 +1,594 @@
+package ccp_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/chili-copy/client/ccp"
+	"github.com/chili-copy/client/multipart"
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/protocol"
+	"github.com/chili-copy/server/controller"
+)
+
+// startServer serves a controller storing files under a temporary root, on
+// a local port or unix socket for network "tcp" or "unix".
+func startServer(t *testing.T, network string) (address string, root string, stop func()) {
+	root, err := ioutil.TempDir("", "ccp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := controller.NewChiliController()
+	cc.SetRoot(root)
+	cc.SetScratchDir(root)
+	cc.MakeAcceptedConnQ(10)
+	cc.CreateAcceptedConnHandlers(4)
+	address = "127.0.0.1:0"
+	if network == "unix" {
+		address = filepath.Join(root, "ccp.sock")
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address = ln.Addr().String()
+	if network == "unix" {
+		address = "unix://" + address
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			cc.AddConnToQ(conn)
+		}
+	}()
+	return address, root, func() {
+		ln.Close()
+		os.RemoveAll(root)
+	}
+}
+
+func testData(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 13)
+	}
+	return b
+}
+
+// checksum is what both ends report for data sent in parts of chunkSize.
+func checksum(data []byte, chunkSize int) string {
+	if len(data) < chunkSize {
+		sum := md5.Sum(data)
+		return hex.EncodeToString(sum[:])
+	}
+	var digests [][]byte
+	for off := 0; off < len(data); off += chunkSize {
+		end := off + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := md5.Sum(data[off:end])
+		digests = append(digests, sum[:])
+	}
+	return hex.EncodeToString(common.CombinePartDigests(digests))
+}
+
+func TestUploadDownload(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		chunkSize uint64
+		zeroCopy  bool
+		multiplex bool
+		wantParts int
+	}{
+		{"empty", 0, 1000, false, false, 1},
+		{"single copy", 999, 1000, false, false, 1},
+		{"single copy zero copy", 999, 1000, true, false, 1},
+		{"one full part", 1000, 1000, false, false, 1},
+		{"parts", 3500, 1000, false, false, 4},
+		{"parts multiplexed", 3500, 1000, false, true, 4},
+	}
+	address, root, stop := startServer(t, "tcp")
+	defer stop()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := ccp.NewClient(address)
+			client.SetMultiplex(tt.multiplex)
+			defer client.Close()
+			data := testData(tt.size)
+			local := filepath.Join(root, "local")
+			remote := "/remote"
+			if err := ioutil.WriteFile(local, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			var progressed uint64
+			opts := &ccp.Options{ChunkSize: tt.chunkSize, Workers: 3, ZeroCopy: tt.zeroCopy,
+				Progress: func(done uint64, total uint64) { progressed = done }}
+			res, err := client.UploadFile(context.Background(), local, remote, opts)
+			if err != nil {
+				t.Fatalf("UploadFile() error = %v", err)
+			}
+			want := checksum(data, int(tt.chunkSize))
+			if res.Checksum != want || res.Bytes != uint64(tt.size) || res.Parts != tt.wantParts {
+				t.Errorf("UploadFile() = %s of %d bytes in %d parts, want %s of %d in %d", res.Checksum, res.Bytes,
+					res.Parts, want, tt.size, tt.wantParts)
+			}
+			if progressed != uint64(tt.size) {
+				t.Errorf("upload progress ended at %d bytes, want %d", progressed, tt.size)
+			}
+			fi, err := client.Stat(context.Background(), remote)
+			if err != nil || fi.Size != uint64(tt.size) {
+				t.Fatalf("Stat() = %+v, %v, want %d bytes", fi, err, tt.size)
+			}
+			downloaded := filepath.Join(root, "downloaded")
+			progressed = 0
+			res, err = client.DownloadFile(context.Background(), remote, downloaded, opts)
+			if err != nil {
+				t.Fatalf("DownloadFile() error = %v", err)
+			}
+			if res.Checksum != want || res.Parts != tt.wantParts {
+				t.Errorf("DownloadFile() = %s in %d parts, want %s in %d", res.Checksum, res.Parts, want, tt.wantParts)
+			}
+			if got, _ := ioutil.ReadFile(downloaded); !bytes.Equal(got, data) {
+				t.Errorf("downloaded %d bytes that differ from the %d uploaded", len(got), len(data))
+			}
+			if progressed != uint64(tt.size) {
+				t.Errorf("download progress ended at %d bytes, want %d", progressed, tt.size)
+			}
+		})
+	}
+}
+
+func TestUploadConfirmedProgress(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		path    string
+		wantErr bool
+		want    []uint64
+	}{
+		{"single copy", 999, "/confirmed", false, []uint64{999}},
+		{"parts", 3500, "/confirmed", false, []uint64{1000, 2000, 3000, 3500}},
+		// the data is sent, but the server fails to write it under a file
+		{"rejected single copy", 999, "/confirmed/file", true, nil},
+	}
+	address, _, stop := startServer(t, "tcp")
+	defer stop()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := ccp.NewClient(address)
+			var mu sync.Mutex
+			var reported []uint64
+			// Workers: 1 confirms the parts in order, the last one short.
+			_, err := client.Upload(context.Background(), bytes.NewReader(testData(tt.size)), int64(tt.size), tt.path,
+				&ccp.Options{ChunkSize: 1000, Workers: 1, Retries: -1, ConfirmedProgress: true,
+					Progress: func(done uint64, total uint64) {
+						mu.Lock()
+						defer mu.Unlock()
+						reported = append(reported, done)
+					}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Upload() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(reported, tt.want) {
+				t.Errorf("progress reported %v, want %v", reported, tt.want)
+			}
+		})
+	}
+}
+
+// flakyReadServer serves stat and read requests for data, failing the
+// first fails reads with a retryable error once their data is sent.
+func flakyReadServer(t *testing.T, data []byte, fails int) (address string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(conn)
+				if err != nil {
+					return
+				}
+				if opType == protocol.StatRequestOpType {
+					common.SendBytesToConn(conn, protocol.PrepareStatResponseOpHeader(uint64(len(data)), 0))
+					return
+				}
+				ro := protocol.NewReadOp(headerBytes)
+				part := data[ro.GetOffset() : ro.GetOffset()+ro.GetLength()]
+				common.SendBytesToConn(conn, protocol.PrepareReadResponseOpHeader(ro.GetLength()))
+				common.SendBytesToConn(conn, part)
+				mu.Lock()
+				fail := fails > 0
+				fails--
+				mu.Unlock()
+				if fail {
+					common.SendBytesToConn(conn, protocol.PrepareErrorResponseOpHeader(
+						&protocol.ServerError{Type: protocol.ErrorServerBusy, Retryable: true}))
+					return
+				}
+				sum := md5.Sum(part)
+				common.SendBytesToConn(conn, protocol.PrepareCopySuccessResponseOpHeader(sum[:],
+					protocol.SingleCopySuccessResponseOpType, 0))
+			}(conn)
+		}
+	}()
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+func TestDownloadRetryProgress(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		fails int
+	}{
+		{"no retries", 3500, 0},
+		{"ranges read again", 3500, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testData(tt.size)
+			address, stop := flakyReadServer(t, data, tt.fails)
+			defer stop()
+			dir, err := ioutil.TempDir("", "ccp")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			var mu sync.Mutex
+			var progressed uint64
+			_, err = ccp.NewClient(address).DownloadFile(context.Background(), "/flaky", filepath.Join(dir, "local"),
+				&ccp.Options{ChunkSize: 1000, Workers: 2, Retries: tt.fails,
+					Progress: func(done uint64, total uint64) {
+						mu.Lock()
+						defer mu.Unlock()
+						if done > total {
+							t.Errorf("progress at %d bytes of %d", done, total)
+						}
+						progressed = done
+					}})
+			if err != nil {
+				t.Fatalf("DownloadFile() error = %v", err)
+			}
+			if progressed != uint64(tt.size) {
+				t.Errorf("download progress ended at %d bytes, want %d", progressed, tt.size)
+			}
+			if got, _ := ioutil.ReadFile(filepath.Join(dir, "local")); !bytes.Equal(got, data) {
+				t.Errorf("downloaded %d bytes that differ from the %d served", len(got), tt.size)
+			}
+		})
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	address, _, stop := startServer(t, "tcp")
+	defer stop()
+	client := ccp.NewClient(address)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name     string
+		run      func() error
+		wantType protocol.ErrType
+		wantErr  error
+	}{
+		{"stat missing file", func() error {
+			_, err := client.Stat(context.Background(), "/missing")
+			return err
+		}, protocol.ErrorFileNotFound, nil},
+		{"download missing file", func() error {
+			_, err := client.Download(context.Background(), "/missing", nil, nil)
+			return err
+		}, protocol.ErrorFileNotFound, nil},
+		{"upload to a missing dir", func() error {
+			_, err := client.Upload(context.Background(), bytes.NewReader(testData(10)), 10,
+				"/no/such/file", nil)
+			return err
+		}, protocol.ErrorWritingSingleCopy, nil},
+		{"upload cancelled", func() error {
+			_, err := client.Upload(cancelled, bytes.NewReader(testData(10)), 10, "/file", nil)
+			return err
+		}, 0, context.Canceled},
+		{"multipart upload cancelled", func() error {
+			_, err := client.Upload(cancelled, bytes.NewReader(testData(5000)), 5000, "/file",
+				&ccp.Options{ChunkSize: 1000})
+			return err
+		}, 0, context.Canceled},
+		{"delete missing file", func() error {
+			return client.Delete(context.Background(), "/missing")
+		}, protocol.ErrorFileNotFound, nil},
+		{"list missing dir", func() error {
+			_, err := client.List(context.Background(), "/missing")
+			return err
+		}, protocol.ErrorFileNotFound, nil},
+		{"stat cancelled", func() error {
+			_, err := client.Stat(cancelled, "/file")
+			return err
+		}, 0, context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.run()
+			if tt.wantErr != nil {
+				if err != tt.wantErr {
+					t.Errorf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			se, ok := err.(*ccp.ServerError)
+			if !ok || se.Type != tt.wantType {
+				t.Errorf("error = %v, want a server error of type %s", err, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestDeleteList(t *testing.T) {
+	address, root, stop := startServer(t, "tcp")
+	defer stop()
+	client := ccp.NewClient(address)
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(root, "dir", name), testData(10), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "dir", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		delete string
+		want   []string
+	}{
+		{"files only", "", []string{"a", "b"}},
+		{"after delete", "/dir/a", []string{"b"}},
+		{"empty", "/dir/b", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.delete != "" {
+				if err := client.Delete(context.Background(), tt.delete); err != nil {
+					t.Fatalf("Delete() error = %v", err)
+				}
+			}
+			files, err := client.List(context.Background(), "/dir")
+			if err != nil {
+				t.Fatalf("List() error = %v", err)
+			}
+			var names []string
+			for _, fi := range files {
+				if fi.Size != 10 {
+					t.Errorf("List() has %s of %d bytes, want 10", fi.Name, fi.Size)
+				}
+				names = append(names, fi.Name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("List() = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadAuto(t *testing.T) {
+	address, root, stop := startServer(t, "tcp")
+	defer stop()
+	for _, size := range []int{1500, 10 << 20} {
+		data := testData(size)
+		res, err := ccp.NewClient(address).Upload(context.Background(), bytes.NewReader(data), int64(size), "/auto",
+			&ccp.Options{ChunkSize: 1000, Auto: true})
+		if err != nil {
+			t.Fatalf("Upload() of %d bytes error = %v", size, err)
+		}
+		if res.Parts < 1 || res.Workers < 1 || res.ChunkSize < 1<<20 {
+			t.Errorf("Upload() of %d bytes = %d parts with %d workers of %d bytes", size, res.Parts, res.Workers,
+				res.ChunkSize)
+		}
+		if got, _ := ioutil.ReadFile(filepath.Join(root, "auto")); !bytes.Equal(got, data) {
+			t.Errorf("server holds %d bytes that differ from the %d uploaded", len(got), size)
+		}
+	}
+}
+
+func TestUploadToAll(t *testing.T) {
+	first, firstRoot, stop := startServer(t, "tcp")
+	defer stop()
+	second, secondRoot, stop := startServer(t, "tcp")
+	defer stop()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+	roots := map[string]string{first: firstRoot, second: secondRoot}
+	tests := []struct {
+		name        string
+		size        int
+		memoryLimit uint64
+		addresses   []string
+		wantFailed  []bool
+	}{
+		{"single copy", 999, 0, []string{first, second}, []bool{false, false}},
+		{"parts", 3500, 0, []string{first, second}, []bool{false, false}},
+		{"a chunk at a time", 3500, 1000, []string{first, second}, []bool{false, false}},
+		{"one server down", 3500, 0, []string{down, first}, []bool{true, false}},
+		{"one server down single copy", 999, 0, []string{first, down}, []bool{false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var clients []*ccp.Client
+			for _, address := range tt.addresses {
+				clients = append(clients, ccp.NewClient(address))
+			}
+			data := testData(tt.size)
+			var progressed uint64
+			results, err := ccp.UploadToAll(context.Background(), clients, bytes.NewReader(data), int64(tt.size),
+				"/fanned", &ccp.Options{ChunkSize: 1000, Workers: 2, MemoryLimit: tt.memoryLimit, Retries: -1,
+					Progress: func(done uint64, total uint64) { progressed = done }})
+			if err != nil {
+				t.Fatalf("UploadToAll() error = %v", err)
+			}
+			want := checksum(data, 1000)
+			succeeded := 0
+			for i, r := range results {
+				if failed := r.Err != nil; failed != tt.wantFailed[i] {
+					t.Fatalf("upload to %s error = %v, want failed %v", tt.addresses[i], r.Err, tt.wantFailed[i])
+				}
+				if r.Err != nil {
+					continue
+				}
+				succeeded++
+				if got, _ := ioutil.ReadFile(filepath.Join(roots[tt.addresses[i]], "fanned")); !bytes.Equal(got, data) {
+					t.Errorf("%s holds %d bytes that differ from the %d uploaded", tt.addresses[i], len(got), tt.size)
+				}
+				if r.Result.Checksum != want || r.Result.Bytes != uint64(tt.size) {
+					t.Errorf("upload to %s = %s of %d bytes, want %s of %d", tt.addresses[i], r.Result.Checksum,
+						r.Result.Bytes, want, tt.size)
+				}
+			}
+			if want := uint64(succeeded * tt.size); progressed != want {
+				t.Errorf("progress ended at %d bytes, want %d", progressed, want)
+			}
+		})
+	}
+}
+
+// readSizes records the largest read of its ReaderAt.
+type readSizes struct {
+	*bytes.Reader
+	lock    sync.Mutex
+	largest int
+}
+
+func (r *readSizes) ReadAt(b []byte, off int64) (int, error) {
+	r.lock.Lock()
+	if len(b) > r.largest {
+		r.largest = len(b)
+	}
+	r.lock.Unlock()
+	return r.Reader.ReadAt(b, off)
+}
+
+func TestUploadToAllSingleCopyMemory(t *testing.T) {
+	first, firstRoot, stop := startServer(t, "tcp")
+	defer stop()
+	second, secondRoot, stop := startServer(t, "tcp")
+	defer stop()
+	tests := []struct {
+		name        string
+		memoryLimit uint64
+		// wantLargest is the largest read of the file.
+		wantLargest int
+	}{
+		{"fits the limit", 1 << 20, 200000},
+		{"streamed", 1000, multipart.MinBufferSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testData(200000)
+			src := &readSizes{Reader: bytes.NewReader(data)}
+			results, err := ccp.UploadToAll(context.Background(), []*ccp.Client{ccp.NewClient(first),
+				ccp.NewClient(second)}, src, int64(len(data)), "/fanned",
+				&ccp.Options{ChunkSize: 1 << 20, MemoryLimit: tt.memoryLimit})
+			if err != nil {
+				t.Fatalf("UploadToAll() error = %v", err)
+			}
+			for i, root := range []string{firstRoot, secondRoot} {
+				if results[i].Err != nil {
+					t.Fatalf("upload %d error = %v", i, results[i].Err)
+				}
+				if got, _ := ioutil.ReadFile(filepath.Join(root, "fanned")); !bytes.Equal(got, data) {
+					t.Errorf("server %d holds %d bytes that differ from the %d uploaded", i, len(got), len(data))
+				}
+			}
+			if src.largest != tt.wantLargest {
+				t.Errorf("largest read = %d bytes, want %d", src.largest, tt.wantLargest)
+			}
+		})
+	}
+}
+
+func TestUploadToAllInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		clients []*ccp.Client
+		opts    *ccp.Options
+	}{
+		{"no destinations", nil, nil},
+		{"unknown policy", []*ccp.Client{ccp.NewClient("127.0.0.1:1")}, &ccp.Options{FanOutPolicy: "sometimes"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ccp.UploadToAll(context.Background(), tt.clients, bytes.NewReader(nil), 0, "/file",
+				tt.opts); err == nil {
+				t.Error("UploadToAll() succeeded")
+			}
+		})
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		multiplex bool
+	}{
+		{"single copy", 999, false},
+		{"parts", 3500, false},
+		{"parts multiplexed", 3500, true},
+	}
+	address, root, stop := startServer(t, "unix")
+	defer stop()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := ccp.NewClient(address)
+			client.SetMultiplex(tt.multiplex)
+			defer client.Close()
+			data := testData(tt.size)
+			local := filepath.Join(root, "local")
+			if err := ioutil.WriteFile(local, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			opts := &ccp.Options{ChunkSize: 1000, Workers: 3}
+			res, err := client.UploadFile(context.Background(), local, "/remote", opts)
+			if err != nil {
+				t.Fatalf("UploadFile() over %s error = %v", address, err)
+			}
+			if want := checksum(data, 1000); res.Checksum != want {
+				t.Errorf("UploadFile() = %s, want %s", res.Checksum, want)
+			}
+			downloaded := filepath.Join(root, "downloaded")
+			if _, err := client.DownloadFile(context.Background(), "/remote", downloaded, opts); err != nil {
+				t.Fatalf("DownloadFile() error = %v", err)
+			}
+			if got, _ := ioutil.ReadFile(downloaded); !bytes.Equal(got, data) {
+				t.Errorf("downloaded %d bytes that differ from the %d uploaded", len(got), len(data))
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package ccp
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"github.com/chili-copy/client/multipart"
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/common/protocol"
+)
+
+// Stat returns the size and modification time of remotePath.
+func (c *Client) Stat(ctx context.Context, remotePath string) (*FileInfo, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, ctxErrOr(ctx, err)
+	}
+	defer conn.Close()
+	defer common.WatchContext(ctx, conn)()
+	if err := common.SendBytesToConn(conn, protocol.PrepareStatRequestOpHeader(remotePath)); err != nil {
+		return nil, ctxErrOr(ctx, err)
+	}
+	opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(conn)
+	if err != nil {
+		return nil, ctxErrOr(ctx, err)
+	}
+	switch opType {
+	case protocol.StatResponseOpType:
+		sr := protocol.NewStatResponseOp(headerBytes)
+		return &FileInfo{Size: sr.GetFileSize(), ModTime: time.Unix(0, sr.GetModTime())}, nil
+	case protocol.ErrorResponseOpType:
+		return nil, protocol.NewServerError(headerBytes)
+	default:
+		return nil, ErrUnexpectedResponse
+	}
+}
+
+type fileRange struct {
+	offset uint64
+	length uint64
+}
+
+type rangeResult struct {
+	index  int
+	digest []byte
+	err    error
+}
+
+// Download copies remotePath from the server into dst. Files of at least
+// opts.ChunkSize are read in ranges of that size by opts.Workers workers,
+// each written to dst at its offset.
+func (c *Client) Download(ctx context.Context, remotePath string, dst io.WriterAt, opts *Options) (*Result, error) {
+	start := time.Now()
+	o := opts.withDefaults()
+	log := c.log.With("path", remotePath, "op", protocol.ReadRequestOpType)
+	var fi *FileInfo
+	err := common.Retry(ctx, o.Retries, log, func() error {
+		var err error
+		fi, err = c.Stat(ctx, remotePath)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var ranges []fileRange
+	for offset := uint64(0); offset < fi.Size || len(ranges) == 0; offset += o.ChunkSize {
+		length := fi.Size - offset
+		if length > o.ChunkSize {
+			length = o.ChunkSize
+		}
+		ranges = append(ranges, fileRange{offset, length})
+	}
+	log.Info("downloading file", "bytes", fi.Size, "parts", len(ranges))
+	workers := o.Workers
+	if workers > len(ranges) {
+		workers = len(ranges)
+	}
+	bufferSize := multipart.BufferSize(o.MemoryLimit, workers)
+	p := newProgress(fi.Size, o.Progress)
+	jobs := make(chan int, len(ranges))
+	results := make(chan rangeResult, len(ranges))
+	for w := 0; w < workers; w++ {
+		go func() {
+			buf := make([]byte, bufferSize)
+			for i := range jobs {
+				if err := ctx.Err(); err != nil {
+					results <- rangeResult{i, nil, err}
+					continue
+				}
+				// Only bytes written again by a retry that go past what
+				// earlier attempts wrote count as progress.
+				rp := &multipart.RetryProgress{Progress: p.add}
+				var digest []byte
+				err := common.Retry(ctx, o.Retries, log, func() error {
+					var err error
+					rp.Restart()
+					digest, err = c.readRange(ctx, remotePath, ranges[i], dst, buf, rp.Add, log)
+					return err
+				})
+				results <- rangeResult{i, digest, err}
+			}
+		}()
+	}
+	for i := range ranges {
+		jobs <- i
+	}
+	close(jobs)
+	digests := make([][]byte, len(ranges))
+	var firstErr error
+	for range ranges {
+		r := <-results
+		if r.err != nil && firstErr == nil {
+			firstErr = r.err
+		}
+		digests[r.index] = r.digest
+	}
+	if firstErr != nil {
+		return nil, ctxErrOr(ctx, firstErr)
+	}
+	// Files of at least a chunk are uploaded in parts, so their checksum
+	// is that of the parts even if there is only one.
+	csum := digests[0]
+	if fi.Size >= o.ChunkSize {
+		csum = common.CombinePartDigests(digests)
+	}
+	res := &Result{Checksum: hex.EncodeToString(csum), Bytes: fi.Size, Parts: len(ranges), Duration: time.Since(start)}
+	log.Info("successfully downloaded", "csum", res.Checksum, "bytes", res.Bytes, "parts", res.Parts, "duration", res.Duration)
+	return res, nil
+}
+
+// readRange writes one range of remotePath to dst and returns its digest,
+// after checking it against the one the server computed while sending. An
+// error the server sends in place of that checksum is returned as a
+// *ServerError, so a retryable one gets the range read again.
+func (c *Client) readRange(ctx context.Context, remotePath string, r fileRange, dst io.WriterAt, buf []byte, progress func(n uint64), log *logger.Logger) ([]byte, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, ctxErrOr(ctx, err)
+	}
+	defer conn.Close()
+	defer common.WatchContext(ctx, conn)()
+	if err := common.SendBytesToConn(conn, protocol.PrepareReadRequestOpHeader(remotePath, r.offset, r.length)); err != nil {
+		return nil, err
+	}
+	opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(conn)
+	if err != nil {
+		return nil, err
+	}
+	switch opType {
+	case protocol.ReadResponseOpType:
+		if protocol.ParseReadResponseLength(headerBytes) != r.length {
+			return nil, ErrUnexpectedResponse
+		}
+	case protocol.ErrorResponseOpType:
+		return nil, protocol.NewServerError(headerBytes)
+	default:
+		return nil, ErrUnexpectedResponse
+	}
+	digest := md5.New()
+	w := io.MultiWriter(&offsetWriter{dst, int64(r.offset), progress}, digest)
+	n, err := io.CopyBuffer(w, io.LimitReader(conn, int64(r.length)), buf)
+	if err != nil {
+		return nil, err
+	}
+	if n != int64(r.length) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	opType, headerBytes, err = common.GetOpTypeAndHeaderFromConn(conn)
+	if err != nil {
+		return nil, err
+	}
+	switch opType {
+	case protocol.SingleCopySuccessResponseOpType:
+	case protocol.ErrorResponseOpType:
+		return nil, protocol.NewServerError(headerBytes)
+	default:
+		return nil, ErrUnexpectedResponse
+	}
+	csum := digest.Sum(nil)
+	if protocol.NewSingleCopySuccessResponseOp(headerBytes).GetCsum() != hex.EncodeToString(csum) {
+		log.Error("checksum mismatch from server", "offset", r.offset, "bytes", r.length)
+		return nil, ErrChecksumMismatch
+	}
+	return csum, nil
+}
+
+// offsetWriter writes sequentially to w from offset on.
+type offsetWriter struct {
+	w        io.WriterAt
+	offset   int64
+	progress func(n uint64)
+}
+
+func (ow *offsetWriter) Write(b []byte) (int, error) {
+	n, err := ow.w.WriteAt(b, ow.offset)
+	ow.offset += int64(n)
+	ow.progress(uint64(n))
+	return n, err
+}
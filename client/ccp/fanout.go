@@ -0,0 +1,513 @@
+package ccp
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/chili-copy/client/multipart"
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/common/protocol"
+	"github.com/google/uuid"
+)
+
+// FanOutPolicy is what UploadToAll does with servers falling behind the
+// others.
+type FanOutPolicy string
+
+const (
+	// FanOutWait keeps sending to every server, so once the chunks read
+	// ahead fill the memory limit, the slowest one sets the pace of all.
+	FanOutWait FanOutPolicy = "wait"
+	// FanOutDrop drops the servers another one is waiting for: those that
+	// have yet to get the oldest chunk held in memory, when another server
+	// got all chunks read and reading on needs that memory.
+	FanOutDrop FanOutPolicy = "drop"
+)
+
+// ErrFellBehind is the error of servers FanOutDrop dropped.
+var ErrFellBehind = errors.New("dropped for falling behind the other destinations")
+
+// DestinationResult is how the upload to one server of UploadToAll went.
+type DestinationResult struct {
+	// Result is nil if the upload failed with Err.
+	Result *Result
+	Err    error
+}
+
+// UploadFileToAll uploads the file at localPath to remotePath on the
+// servers of clients. See UploadToAll.
+func UploadFileToAll(ctx context.Context, clients []*Client, localPath string, remotePath string, opts *Options) ([]DestinationResult, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return UploadToAll(ctx, clients, f, fi.Size(), remotePath, opts)
+}
+
+// UploadToAll copies size bytes of src to remotePath on the servers of
+// clients at once, reading and hashing each chunk a single time for all of
+// them, as well as files smaller than opts.ChunkSize that fit in
+// opts.MemoryLimit. Larger ones are read for each server. Chunks are held in memory until every server got them, as many as
+// fit in opts.MemoryLimit but at least one, and opts.FanOutPolicy decides
+// whether a slow server holds up the others. All servers get the same
+// parts, so Auto and ZeroCopy are not used, and Progress counts the bytes
+// sent to all servers against size times their number. Results are in the
+// order of clients. The error is only set if no upload was started.
+func UploadToAll(ctx context.Context, clients []*Client, src io.ReaderAt, size int64, remotePath string, opts *Options) ([]DestinationResult, error) {
+	o := opts.withDefaults()
+	if len(clients) == 0 {
+		return nil, errors.New("no destinations to upload to")
+	}
+	if o.FanOutPolicy != FanOutWait && o.FanOutPolicy != FanOutDrop {
+		return nil, fmt.Errorf("unknown fan-out policy %q", o.FanOutPolicy)
+	}
+	f := &fanOut{src: src, size: uint64(size), remotePath: remotePath, o: o,
+		progress: newProgress(uint64(size)*uint64(len(clients)), o.Progress), released: make(chan struct{}, 1)}
+	if o.Durable {
+		f.flags |= protocol.DurableFlag
+	}
+	for _, c := range clients {
+		d := &fanOutDest{c: c, log: c.log.With("path", remotePath), start: time.Now()}
+		d.ctx, d.cancel = context.WithCancel(ctx)
+		defer d.cancel()
+		f.dests = append(f.dests, d)
+	}
+	if f.size < o.ChunkSize {
+		f.singleCopy()
+	} else {
+		f.multiPartCopy(ctx)
+	}
+	results := make([]DestinationResult, len(f.dests))
+	for i, d := range f.dests {
+		if d.err == nil && d.res == nil {
+			d.err = ctx.Err()
+		}
+		results[i] = DestinationResult{Result: d.res, Err: d.err}
+	}
+	f.abortFailed()
+	return results, nil
+}
+
+type fanOut struct {
+	dests      []*fanOutDest
+	src        io.ReaderAt
+	size       uint64
+	remotePath string
+	flags      uint8
+	o          Options
+	progress   *progress
+	pool       chan []byte
+	lock       sync.Mutex
+	inUse      []*fanOutBlock // in the order they were read
+	released   chan struct{}
+}
+
+// fanOutDest is one of the servers uploaded to. Its ctx is cancelled once
+// it fails.
+type fanOutDest struct {
+	c       *Client
+	ctx     context.Context
+	cancel  context.CancelFunc
+	log     *logger.Logger
+	copyId  uuid.UUID
+	queue   chan *fanOutBlock
+	workers int
+	digests [][]byte
+	start   time.Time
+	res     *Result
+	err     error
+}
+
+// fanOutBlock is a chunk read, held until every server it was handed to
+// sent it or failed.
+type fanOutBlock struct {
+	partNum uint64
+	buf     []byte
+	data    []byte
+	digest  []byte
+	waiting map[*fanOutDest]bool
+}
+
+func (d *fanOutDest) live() bool {
+	return d.ctx.Err() == nil
+}
+
+// fail ends the upload to d with err, unless it failed already.
+func (f *fanOut) fail(d *fanOutDest, err error) {
+	f.lock.Lock()
+	if d.err == nil {
+		d.err = err
+	}
+	f.lock.Unlock()
+	d.cancel()
+}
+
+func (f *fanOut) failAll(err error) {
+	for _, d := range f.dests {
+		f.fail(d, err)
+	}
+}
+
+// each runs fn for every server still uploaded to, at once.
+func (f *fanOut) each(fn func(d *fanOutDest)) {
+	var wg sync.WaitGroup
+	for _, d := range f.dests {
+		if !d.live() {
+			continue
+		}
+		wg.Add(1)
+		go func(d *fanOutDest) {
+			defer wg.Done()
+			fn(d)
+		}(d)
+	}
+	wg.Wait()
+}
+
+// singleCopy sends the file in one go to every server. A file that fits in
+// the memory limit is read and hashed once for all of them, while a larger
+// one is streamed to each server from src, through a buffer of its share
+// of the limit.
+func (f *fanOut) singleCopy() {
+	var data []byte
+	var csum string
+	if f.size <= f.o.MemoryLimit {
+		data = make([]byte, f.size)
+		if n, err := f.src.ReadAt(data, 0); n < len(data) {
+			f.failAll(err)
+			return
+		}
+		sum := md5.Sum(data)
+		csum = hex.EncodeToString(sum[:])
+	}
+	bufferSize := multipart.BufferSize(f.o.MemoryLimit, len(f.dests))
+	f.each(func(d *fanOutDest) {
+		log := d.log.With("op", protocol.SingleCopyOpType, "bytes", f.size)
+		rp := &multipart.RetryProgress{Progress: f.progress.add}
+		send := func(conn net.Conn) (string, error) {
+			if data == nil {
+				pr := &multipart.ProgressReaderAt{ReaderAt: f.src, Progress: rp.Add}
+				return sendFileStreamed(conn, pr, f.size, bufferSize)
+			}
+			if err := writeData(conn, data, rp.Add); err != nil {
+				return "", err
+			}
+			return csum, nil
+		}
+		err := common.Retry(d.ctx, f.o.Retries, log, func() error {
+			var err error
+			rp.Restart()
+			d.res, err = d.c.singleCopy(d.ctx, f.size, f.remotePath, f.flags, send, log)
+			return err
+		})
+		if err != nil {
+			f.fail(d, err)
+		}
+	})
+}
+
+func (f *fanOut) multiPartCopy(ctx context.Context) {
+	f.each(f.init)
+	count := int(f.o.MemoryLimit / f.o.ChunkSize)
+	if count < 1 {
+		count = 1
+	}
+	f.pool = make(chan []byte, count)
+	for i := 0; i < count; i++ {
+		f.pool <- nil
+	}
+	parts := (f.size + f.o.ChunkSize - 1) / f.o.ChunkSize
+	var workers sync.WaitGroup
+	for _, d := range f.dests {
+		if !d.live() {
+			continue
+		}
+		// no more chunks than count are ever held, so sends never block
+		d.queue = make(chan *fanOutBlock, count)
+		d.digests = make([][]byte, parts)
+		d.workers = f.o.Workers
+		if d.workers > count {
+			d.workers = count
+		}
+		for w := 0; w < d.workers; w++ {
+			workers.Add(1)
+			go f.worker(d, &workers)
+		}
+	}
+	f.read(ctx, parts)
+	for _, d := range f.dests {
+		if d.queue != nil {
+			close(d.queue)
+		}
+	}
+	workers.Wait()
+	f.each(f.complete)
+}
+
+// abortFailed asks the servers that initiated a copy and did not complete
+// it to drop it, whether they failed or were stopped before completing.
+// Servers that only computed another checksum did complete it.
+func (f *fanOut) abortFailed() {
+	var wg sync.WaitGroup
+	for _, d := range f.dests {
+		if d.res != nil || d.copyId == (uuid.UUID{}) || d.err == ErrChecksumMismatch {
+			continue
+		}
+		wg.Add(1)
+		go func(d *fanOutDest) {
+			defer wg.Done()
+			d.c.abortMultiPartCopy(d.copyId, d.log)
+		}(d)
+	}
+	wg.Wait()
+}
+
+func (f *fanOut) init(d *fanOutDest) {
+	var mir *protocol.MultiPartCopyInitSuccessResponseOp
+	initLog := d.log.With("op", protocol.MultiPartCopyInitOpType)
+	err := common.Retry(d.ctx, f.o.Retries, initLog, func() error {
+		var err error
+		mir, err = d.c.initMultiPartCopy(d.ctx, f.remotePath, f.size, initLog)
+		return err
+	})
+	if err != nil {
+		f.fail(d, err)
+		return
+	}
+	d.copyId = mir.GetCopyId()
+	d.log = d.log.With("copy_id", d.copyId)
+	d.log.Info("copyId received from server")
+}
+
+// read reads the parts and hands each to the servers still uploaded to.
+func (f *fanOut) read(ctx context.Context, parts uint64) {
+	for i := uint64(0); i < parts; i++ {
+		buf, err := f.buffer(ctx)
+		if err != nil {
+			return
+		}
+		offset := i * f.o.ChunkSize
+		size := f.o.ChunkSize
+		if f.size-offset < size {
+			size = f.size - offset
+		}
+		data := buf[:size]
+		if n, err := f.src.ReadAt(data, int64(offset)); n < len(data) {
+			f.failAll(err)
+			f.pool <- buf
+			return
+		}
+		sum := md5.Sum(data)
+		blk := &fanOutBlock{partNum: i + 1, buf: buf, data: data, digest: sum[:], waiting: make(map[*fanOutDest]bool)}
+		var to []*fanOutDest
+		f.lock.Lock()
+		for _, d := range f.dests {
+			if d.queue != nil && d.live() {
+				blk.waiting[d] = true
+				to = append(to, d)
+			}
+		}
+		if len(to) > 0 {
+			f.inUse = append(f.inUse, blk)
+		}
+		f.lock.Unlock()
+		if len(to) == 0 {
+			f.pool <- buf
+			return
+		}
+		for _, d := range to {
+			d.queue <- blk
+		}
+	}
+}
+
+// buffer takes a buffer for the next chunk, waiting for the servers to
+// send one held, or with FanOutDrop dropping those that hold up the others.
+func (f *fanOut) buffer(ctx context.Context) ([]byte, error) {
+	for {
+		select {
+		case buf := <-f.pool:
+			return f.alloc(buf), nil
+		default:
+		}
+		if f.o.FanOutPolicy == FanOutDrop {
+			f.dropSlow()
+		}
+		select {
+		case buf := <-f.pool:
+			return f.alloc(buf), nil
+		case <-f.released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// alloc makes buffers as they are first needed, as small files need fewer.
+func (f *fanOut) alloc(buf []byte) []byte {
+	if buf == nil {
+		buf = make([]byte, f.o.ChunkSize)
+	}
+	return buf
+}
+
+// dropSlow drops the servers that have yet to send the oldest chunk held,
+// if another server sent every chunk read and so waits for them.
+func (f *fanOut) dropSlow() {
+	var slow []*fanOutDest
+	f.lock.Lock()
+	if len(f.inUse) > 0 && f.anyIdle() {
+		for d := range f.inUse[0].waiting {
+			if d.live() {
+				slow = append(slow, d)
+			}
+		}
+	}
+	f.lock.Unlock()
+	for _, d := range slow {
+		d.log.Warn("dropping destination", "error", ErrFellBehind)
+		f.fail(d, ErrFellBehind)
+	}
+}
+
+// anyIdle tells whether a server still uploaded to holds no chunk. f.lock
+// must be held.
+func (f *fanOut) anyIdle() bool {
+	for _, d := range f.dests {
+		if d.queue == nil || !d.live() {
+			continue
+		}
+		idle := true
+		for _, blk := range f.inUse {
+			if blk.waiting[d] {
+				idle = false
+				break
+			}
+		}
+		if idle {
+			return true
+		}
+	}
+	return false
+}
+
+// release is called once d is done with blk, returning its buffer once
+// every server is.
+func (f *fanOut) release(d *fanOutDest, blk *fanOutBlock) {
+	f.lock.Lock()
+	delete(blk.waiting, d)
+	done := len(blk.waiting) == 0
+	if done {
+		for i, held := range f.inUse {
+			if held == blk {
+				f.inUse = append(f.inUse[:i], f.inUse[i+1:]...)
+				break
+			}
+		}
+	}
+	f.lock.Unlock()
+	if done {
+		f.pool <- blk.buf
+	}
+	select {
+	case f.released <- struct{}{}:
+	default:
+	}
+}
+
+func (f *fanOut) worker(d *fanOutDest, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for blk := range d.queue {
+		if d.live() {
+			if err := f.sendPart(d, blk); err != nil {
+				f.fail(d, err)
+			} else {
+				d.digests[blk.partNum-1] = blk.digest
+			}
+		}
+		f.release(d, blk)
+	}
+}
+
+// sendPart uploads blk to d, sending it again as long as the server fails
+// it with retryable errors.
+func (f *fanOut) sendPart(d *fanOutDest, blk *fanOutBlock) error {
+	rp := &multipart.RetryProgress{Progress: f.progress.add}
+	log := d.log.With("op", protocol.MultiPartCopyPartRequestOpType, "part", blk.partNum, "bytes", len(blk.data))
+	return common.Retry(d.ctx, f.o.Retries, log, func() error {
+		rp.Restart()
+		start := time.Now()
+		conn, err := d.c.dial(d.ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		defer common.WatchContext(d.ctx, conn)()
+		_, err = multipart.SendPart(conn, d.copyId, blk.partNum, uint64(len(blk.data)), func(conn net.Conn) ([]byte, error) {
+			if err := writeData(conn, blk.data, rp.Add); err != nil {
+				return nil, err
+			}
+			return blk.digest, nil
+		}, log)
+		if err != nil {
+			return ctxErrOr(d.ctx, err)
+		}
+		log.Info("successfully uploaded chunk", "duration", time.Since(start))
+		return nil
+	})
+}
+
+func (f *fanOut) complete(d *fanOutDest) {
+	csum := common.CombinePartDigests(d.digests)
+	parts := len(d.digests)
+	b := protocol.PrepareMultiPartCompleteRequestOpHeader(d.copyId, f.size, f.flags, uint64(parts), csum)
+	log := d.log.With("op", protocol.MultiPartCopyCompleteOpType)
+	var res *Result
+	err := common.Retry(d.ctx, f.o.Retries, log, func() error {
+		var err error
+		res, err = d.c.completeMultiPartCopy(d.ctx, b, csum, log)
+		return err
+	})
+	if err != nil {
+		f.fail(d, err)
+		return
+	}
+	res.Bytes = f.size
+	res.Parts = parts
+	res.ChunkSize = f.o.ChunkSize
+	res.Workers = d.workers
+	res.Duration = time.Since(d.start)
+	log.Info("successfully copied", "csum", res.Checksum, "bytes", f.size, "parts", res.Parts,
+		"chunk_size", res.ChunkSize, "workers", res.Workers, "durable", res.Durable, "duration", res.Duration)
+	d.res = res
+}
+
+// writeData writes data to conn in pieces, reporting each to progress.
+func writeData(conn net.Conn, data []byte, progress func(n uint64)) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > multipart.MaxBufferSize {
+			n = multipart.MaxBufferSize
+		}
+		if _, err := conn.Write(data[:n]); err != nil {
+			return err
+		}
+		progress(uint64(n))
+		data = data[n:]
+	}
+	return nil
+}
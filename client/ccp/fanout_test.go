@@ -0,0 +1,218 @@
+package ccp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/common/protocol"
+	"github.com/google/uuid"
+)
+
+// newTestFanOut returns a fan-out to servers named by names, whose queues
+// are set as they are once the copy was initiated, except for those in
+// notInitiated.
+func newTestFanOut(names []string, notInitiated []string) (*fanOut, map[string]*fanOutDest) {
+	f := &fanOut{o: Options{FanOutPolicy: FanOutDrop}, pool: make(chan []byte, 10), released: make(chan struct{}, 1)}
+	byName := make(map[string]*fanOutDest)
+	for _, name := range names {
+		d := &fanOutDest{log: logger.With("dest", name), queue: make(chan *fanOutBlock, 10)}
+		d.ctx, d.cancel = context.WithCancel(context.Background())
+		for _, n := range notInitiated {
+			if n == name {
+				d.queue = nil
+			}
+		}
+		f.dests = append(f.dests, d)
+		byName[name] = d
+	}
+	return f, byName
+}
+
+// hold holds a chunk that the servers named by waiting have yet to send.
+func hold(f *fanOut, dests map[string]*fanOutDest, waiting []string) *fanOutBlock {
+	blk := &fanOutBlock{partNum: uint64(len(f.inUse) + 1), buf: []byte{byte(len(f.inUse))},
+		waiting: make(map[*fanOutDest]bool)}
+	for _, name := range waiting {
+		blk.waiting[dests[name]] = true
+	}
+	f.inUse = append(f.inUse, blk)
+	return blk
+}
+
+func failed(dests map[string]*fanOutDest) []string {
+	var names []string
+	for name, d := range dests {
+		if d.err != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDropSlow(t *testing.T) {
+	tests := []struct {
+		name string
+		// held are the servers each chunk held waits for, oldest first.
+		held         [][]string
+		failed       []string
+		notInitiated []string
+		wantDropped  []string
+	}{
+		{"nothing held", nil, nil, nil, nil},
+		{"all behind alike", [][]string{{"a", "b", "c"}, {"a", "b", "c"}}, nil, nil, nil},
+		{"one ahead", [][]string{{"b", "c"}, {"a", "b", "c"}}, nil, nil, nil},
+		{"one sent all", [][]string{{"b"}, {"b", "c"}}, nil, nil, []string{"b"}},
+		{"only those behind on the oldest", [][]string{{"b", "c"}, {"b", "c"}}, nil, nil, []string{"b", "c"}},
+		{"newer chunks do not count", [][]string{{"c"}, {"b"}}, nil, nil, []string{"c"}},
+		{"failed servers are not idle", [][]string{{"b", "c"}}, []string{"a"}, nil, nil},
+		{"failed servers are not dropped", [][]string{{"b", "c"}}, []string{"b"}, nil, []string{"c"}},
+		{"servers not initiated are not idle", [][]string{{"b", "c"}}, nil, []string{"a"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, dests := newTestFanOut([]string{"a", "b", "c"}, tt.notInitiated)
+			for _, waiting := range tt.held {
+				hold(f, dests, waiting)
+			}
+			for _, name := range tt.failed {
+				dests[name].cancel()
+			}
+			f.dropSlow()
+			var dropped []string
+			for _, name := range failed(dests) {
+				if dests[name].err != ErrFellBehind {
+					t.Errorf("%s failed with %v, want %v", name, dests[name].err, ErrFellBehind)
+				}
+				if dests[name].live() {
+					t.Errorf("%s was dropped but is still uploaded to", name)
+				}
+				dropped = append(dropped, name)
+			}
+			if !reflect.DeepEqual(dropped, tt.wantDropped) {
+				t.Errorf("dropSlow() dropped %v, want %v", dropped, tt.wantDropped)
+			}
+		})
+	}
+}
+
+// TestRelease releases the chunks held, each step by a server, and checks
+// which chunks are still held after each.
+func TestRelease(t *testing.T) {
+	type step struct {
+		dest     string
+		chunk    int
+		wantHeld []uint64
+	}
+	tests := []struct {
+		name  string
+		held  [][]string
+		steps []step
+	}{
+		{"one server", [][]string{{"a"}, {"a"}}, []step{{"a", 0, []uint64{2}}, {"a", 1, nil}}},
+		{"held until all sent", [][]string{{"a", "b"}},
+			[]step{{"a", 0, []uint64{1}}, {"b", 0, nil}}},
+		{"newer chunk first", [][]string{{"a", "b"}, {"a", "b"}, {"a"}},
+			[]step{{"a", 1, []uint64{1, 2, 3}}, {"b", 1, []uint64{1, 3}}, {"a", 2, []uint64{1}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, dests := newTestFanOut([]string{"a", "b"}, nil)
+			var blks []*fanOutBlock
+			for _, waiting := range tt.held {
+				blks = append(blks, hold(f, dests, waiting))
+			}
+			for i, s := range tt.steps {
+				f.release(dests[s.dest], blks[s.chunk])
+				var held []uint64
+				for _, blk := range f.inUse {
+					held = append(held, blk.partNum)
+				}
+				if !reflect.DeepEqual(held, s.wantHeld) {
+					t.Fatalf("step %d, chunks held = %v, want %v", i, held, s.wantHeld)
+				}
+				if want := len(tt.held) - len(s.wantHeld); len(f.pool) != want {
+					t.Fatalf("step %d, %d buffers returned, want %d", i, len(f.pool), want)
+				}
+				select {
+				case <-f.released:
+				default:
+					t.Fatalf("step %d, release was not signalled", i)
+				}
+			}
+		})
+	}
+}
+
+// abortServer answers abort requests, sending the copy id of each on
+// aborted.
+func abortServer(t *testing.T) (address string, aborted chan string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aborted = make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_, headerBytes, err := common.GetOpTypeAndHeaderFromConn(conn)
+			if err == nil {
+				copyId, _ := protocol.ParseCopyId(headerBytes)
+				aborted <- copyId
+				common.SendBytesToConn(conn, protocol.PrepareMultiPartAbortSuccessResponseOpHeader())
+			}
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String(), aborted, func() { ln.Close() }
+}
+
+func TestAbortFailed(t *testing.T) {
+	address, aborted, stop := abortServer(t)
+	defer stop()
+	tests := []struct {
+		name        string
+		initiated   bool
+		res         *Result
+		err         error
+		wantAborted bool
+	}{
+		{"completed", true, &Result{}, nil, false},
+		{"failed", true, nil, errors.New("part failed"), true},
+		{"stopped before completing", true, nil, context.Canceled, true},
+		{"never failed nor completed", true, nil, nil, true},
+		{"checksum mismatch", true, nil, ErrChecksumMismatch, false},
+		{"not initiated", false, nil, errors.New("init failed"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, dests := newTestFanOut([]string{"a"}, nil)
+			d := dests["a"]
+			d.c = NewClient(address)
+			d.res, d.err = tt.res, tt.err
+			if tt.initiated {
+				d.copyId = uuid.New()
+			}
+			f.abortFailed()
+			select {
+			case got := <-aborted:
+				if !tt.wantAborted || got != d.copyId.String() {
+					t.Errorf("aborted %s, want aborted %v", got, tt.wantAborted)
+				}
+			default:
+				if tt.wantAborted {
+					t.Errorf("copy not aborted")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package ccp
+
+import (
+	"context"
+	"time"
+
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/protocol"
+)
+
+// Delete removes remotePath at the server.
+func (c *Client) Delete(ctx context.Context, remotePath string) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return ctxErrOr(ctx, err)
+	}
+	defer conn.Close()
+	defer common.WatchContext(ctx, conn)()
+	if err := common.SendBytesToConn(conn, protocol.PrepareDeleteRequestOpHeader(remotePath)); err != nil {
+		return ctxErrOr(ctx, err)
+	}
+	opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(conn)
+	if err != nil {
+		return ctxErrOr(ctx, err)
+	}
+	switch opType {
+	case protocol.DeleteSuccessResponseOpType:
+		return nil
+	case protocol.ErrorResponseOpType:
+		return protocol.NewServerError(headerBytes)
+	default:
+		return ErrUnexpectedResponse
+	}
+}
+
+// List returns the files directly in remoteDir, in the order the server
+// sends them.
+func (c *Client) List(ctx context.Context, remoteDir string) ([]FileInfo, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, ctxErrOr(ctx, err)
+	}
+	defer conn.Close()
+	defer common.WatchContext(ctx, conn)()
+	if err := common.SendBytesToConn(conn, protocol.PrepareListRequestOpHeader(remoteDir)); err != nil {
+		return nil, ctxErrOr(ctx, err)
+	}
+	var files []FileInfo
+	for {
+		opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(conn)
+		if err != nil {
+			return nil, ctxErrOr(ctx, err)
+		}
+		switch opType {
+		case protocol.ListEntryOpType:
+			le := protocol.NewListEntryOp(headerBytes)
+			files = append(files, FileInfo{Name: le.GetName(), Size: le.GetFileSize(),
+				ModTime: time.Unix(0, le.GetModTime())})
+		case protocol.ListEndOpType:
+			if int(protocol.ParseListEndCount(headerBytes)) != len(files) {
+				return nil, ErrUnexpectedResponse
+			}
+			return files, nil
+		case protocol.ErrorResponseOpType:
+			return nil, protocol.NewServerError(headerBytes)
+		default:
+			return nil, ErrUnexpectedResponse
+		}
+	}
+}
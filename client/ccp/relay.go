@@ -0,0 +1,81 @@
+package ccp
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/protocol"
+)
+
+// ErrRelayTooLong is returned by Relay for paths and peer names too long
+// to send together.
+var ErrRelayTooLong = errors.New("paths and peer name too long for a relay request")
+
+// Relay has the server copy remotePath to peerPath on peer, one of the
+// servers it is configured to relay to, the way Upload would. opts.Progress
+// is called with the bytes the peer confirmed getting, about every second,
+// and opts.Durable asks the peer to fsync the file. The other options are
+// those the server has for the peer.
+func (c *Client) Relay(ctx context.Context, remotePath string, peer string, peerPath string, opts *Options) (*Result, error) {
+	if !protocol.RelayRequestFits(remotePath, peer, peerPath) {
+		return nil, ErrRelayTooLong
+	}
+	o := opts.withDefaults()
+	flags := uint8(0)
+	if o.Durable {
+		flags |= protocol.DurableFlag
+	}
+	log := c.log.With("path", remotePath, "op", protocol.RelayRequestOpType, "peer", peer, "peer_path", peerPath)
+	var res *Result
+	err := common.Retry(ctx, o.Retries, log, func() error {
+		var err error
+		res, err = c.relay(ctx, protocol.PrepareRelayRequestOpHeader(remotePath, peer, peerPath, flags), o.Progress)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Info("successfully relayed", "csum", res.Checksum, "bytes", res.Bytes, "durable", res.Durable,
+		"duration", res.Duration)
+	return res, nil
+}
+
+// relay sends the relay request header b and reads the progress the server
+// reports until it responds.
+func (c *Client) relay(ctx context.Context, b []byte, fn ProgressFunc) (*Result, error) {
+	start := time.Now()
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer common.WatchContext(ctx, conn)()
+	if err := common.SendBytesToConn(conn, b); err != nil {
+		return nil, ctxErrOr(ctx, serverErrorOr(conn, err))
+	}
+	var bytes uint64
+	for {
+		opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(conn)
+		if err != nil {
+			return nil, ctxErrOr(ctx, err)
+		}
+		switch opType {
+		case protocol.RelayProgressOpType:
+			rp := protocol.NewRelayProgressOp(headerBytes)
+			bytes = rp.GetTotal()
+			if fn != nil {
+				fn(rp.GetDone(), rp.GetTotal())
+			}
+		case protocol.RelaySuccessResponseOpType:
+			rsr := protocol.NewSingleCopySuccessResponseOp(headerBytes)
+			return &Result{Checksum: rsr.GetCsum(), Bytes: bytes, Durable: rsr.IsDurable(),
+				Duration: time.Since(start)}, nil
+		case protocol.ErrorResponseOpType:
+			return nil, protocol.NewServerError(headerBytes)
+		default:
+			return nil, ErrUnexpectedResponse
+		}
+	}
+}
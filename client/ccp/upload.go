@@ -0,0 +1,298 @@
+package ccp
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/chili-copy/client/multipart"
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/common/protocol"
+	"github.com/chili-copy/common/zerocopy"
+	"github.com/google/uuid"
+)
+
+// abortTimeout bounds asking the server to drop a multipart copy that
+// failed, which is done even once the context of the upload is done.
+const abortTimeout = 10 * time.Second
+
+// Upload copies size bytes of src to remotePath on the server, in parts if
+// size is at least opts.ChunkSize.
+func (c *Client) Upload(ctx context.Context, src io.ReaderAt, size int64, remotePath string, opts *Options) (*Result, error) {
+	o := opts.withDefaults()
+	flags := uint8(0)
+	if o.Durable {
+		flags |= protocol.DurableFlag
+	}
+	log := c.log.With("path", remotePath)
+	p := newProgress(uint64(size), o.Progress)
+	if uint64(size) < o.ChunkSize {
+		log = log.With("op", protocol.SingleCopyOpType, "bytes", size)
+		// Only bytes sent again by a retry that go past what earlier
+		// attempts sent count as progress.
+		rp := &multipart.RetryProgress{Progress: p.add}
+		if o.ConfirmedProgress {
+			rp.Progress = func(uint64) {}
+		}
+		send := func(conn net.Conn) (string, error) {
+			if f, ok := src.(*os.File); ok && o.ZeroCopy {
+				csum, err := sendFileZeroCopy(conn, f, uint64(size), log)
+				rp.Add(uint64(size))
+				return csum, err
+			}
+			pr := &multipart.ProgressReaderAt{ReaderAt: src, Progress: rp.Add}
+			return sendFileStreamed(conn, pr, uint64(size), multipart.BufferSize(o.MemoryLimit, 1))
+		}
+		var res *Result
+		err := common.Retry(ctx, o.Retries, log, func() error {
+			var err error
+			rp.Restart()
+			res, err = c.singleCopy(ctx, uint64(size), remotePath, flags, send, log)
+			return err
+		})
+		if err == nil && o.ConfirmedProgress {
+			p.add(uint64(size))
+		}
+		return res, err
+	}
+	return c.multiPartCopy(ctx, src, uint64(size), remotePath, flags, o, p, log)
+}
+
+// singleCopy copies a file of fileSize bytes to remotePath, whose data
+// send sends, returning its checksum.
+func (c *Client) singleCopy(ctx context.Context, fileSize uint64, remotePath string, flags uint8, send func(conn net.Conn) (string, error), log *logger.Logger) (*Result, error) {
+	start := time.Now()
+	log.Info("requesting single copy")
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, ctxErrOr(ctx, err)
+	}
+	defer conn.Close()
+	defer common.WatchContext(ctx, conn)()
+	err = common.SendBytesToConn(conn, protocol.PrepareSingleCopyRequestOpHeader(remotePath, fileSize, flags))
+	if err != nil {
+		return nil, ctxErrOr(ctx, serverErrorOr(conn, err))
+	}
+	returnMD5String, err := send(conn)
+	if err != nil {
+		return nil, ctxErrOr(ctx, serverErrorOr(conn, err))
+	}
+	opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(conn)
+	if err != nil {
+		return nil, ctxErrOr(ctx, err)
+	}
+	switch opType {
+	case protocol.SingleCopySuccessResponseOpType:
+		nsr := protocol.NewSingleCopySuccessResponseOp(headerBytes)
+		if nsr.GetCsum() != returnMD5String {
+			log.Error("checksum mismatch from server", "csum", returnMD5String, "server_csum", nsr.GetCsum())
+			return nil, ErrChecksumMismatch
+		}
+		res := &Result{Checksum: returnMD5String, Bytes: fileSize, Parts: 1, Durable: nsr.IsDurable(),
+			Duration: time.Since(start)}
+		log.Info("successfully copied", "csum", res.Checksum, "durable", res.Durable, "duration", res.Duration)
+		return res, nil
+	case protocol.ErrorResponseOpType:
+		return nil, protocol.NewServerError(headerBytes)
+	default:
+		return nil, ErrUnexpectedResponse
+	}
+}
+
+// sendFileStreamed sends the file and returns its checksum, computed in the
+// same pass.
+func sendFileStreamed(conn net.Conn, src io.ReaderAt, fileSize uint64, bufferSize uint64) (string, error) {
+	hash := md5.New()
+	err := common.StreamToConn(conn, src, 0, int64(fileSize), make([]byte, bufferSize), hash)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// sendFileZeroCopy sends the file with sendfile, which never brings the
+// bytes into userspace, so the checksum takes a separate read of the file.
+func sendFileZeroCopy(conn net.Conn, f *os.File, fileSize uint64, log *logger.Logger) (string, error) {
+	hash := md5.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(f, 0, int64(fileSize))); err != nil {
+		log.Error("failed to generate checksum", "error", err)
+		return "", err
+	}
+	_, err := zerocopy.SendFile(conn, f, 0, int64(fileSize))
+	if err != nil {
+		log.Error("failed to send file to server", "error", err)
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (c *Client) multiPartCopy(ctx context.Context, src io.ReaderAt, fileSize uint64, remotePath string, flags uint8, o Options, p *progress, log *logger.Logger) (*Result, error) {
+	start := time.Now()
+	var mir *protocol.MultiPartCopyInitSuccessResponseOp
+	initLog := log.With("op", protocol.MultiPartCopyInitOpType)
+	err := common.Retry(ctx, o.Retries, initLog, func() error {
+		var err error
+		mir, err = c.initMultiPartCopy(ctx, remotePath, fileSize, initLog)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	log = log.With("copy_id", mir.GetCopyId())
+	log.Info("copyId received from server")
+	// A copy failing from here on is dropped at the server, unless the
+	// server completed it.
+	completed := false
+	defer func(log *logger.Logger) {
+		if !completed {
+			c.abortMultiPartCopy(mir.GetCopyId(), log)
+		}
+	}(log)
+	muh, err := multipart.NewMultiPartCopyHandler(mir.GetCopyId(), src, int64(fileSize), o.ChunkSize, o.Workers,
+		c.network, c.address, o.ZeroCopy, o.MemoryLimit, log)
+	if err != nil {
+		return nil, err
+	}
+	if o.ConfirmedProgress {
+		muh.SetPartProgressFunc(p.add)
+	} else {
+		muh.SetProgressFunc(p.add)
+	}
+	muh.SetRetries(o.Retries)
+	muh.SetDialFunc(c.dial)
+	if o.Auto {
+		muh.SetAuto(mir.GetPartLimits())
+	}
+	err = muh.Handle(ctx)
+	if err != nil {
+		return nil, err
+	}
+	csum := muh.CombinedChecksum()
+	b := protocol.PrepareMultiPartCompleteRequestOpHeader(mir.GetCopyId(), fileSize, flags, uint64(muh.GetNumParts()), csum)
+	log = log.With("op", protocol.MultiPartCopyCompleteOpType)
+	var res *Result
+	err = common.Retry(ctx, o.Retries, log, func() error {
+		var err error
+		res, err = c.completeMultiPartCopy(ctx, b, csum, log)
+		return err
+	})
+	// Checksums are only compared once the server completed the copy.
+	completed = err == nil || err == ErrChecksumMismatch
+	if err != nil {
+		return nil, err
+	}
+	res.Bytes = fileSize
+	res.Parts = muh.GetNumParts()
+	res.ChunkSize = muh.ChunkSize()
+	res.Workers = muh.Workers()
+	res.Duration = time.Since(start)
+	log.Info("successfully copied", "csum", res.Checksum, "bytes", fileSize, "parts", res.Parts,
+		"chunk_size", res.ChunkSize, "workers", res.Workers, "durable", res.Durable, "duration", res.Duration)
+	return res, nil
+}
+
+func (c *Client) initMultiPartCopy(ctx context.Context, remotePath string, fileSize uint64, log *logger.Logger) (*protocol.MultiPartCopyInitSuccessResponseOp, error) {
+	log.Info("requesting multipart copy", "bytes", fileSize)
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, ctxErrOr(ctx, err)
+	}
+	defer conn.Close()
+	defer common.WatchContext(ctx, conn)()
+	err = common.SendBytesToConn(conn, protocol.PrepareMultiPartInitRequestOpHeader(remotePath, fileSize))
+	if err != nil {
+		return nil, ctxErrOr(ctx, serverErrorOr(conn, err))
+	}
+	opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(conn)
+	if err != nil {
+		return nil, ctxErrOr(ctx, err)
+	}
+	switch opType {
+	case protocol.MultiPartCopyInitSuccessResponseOpType:
+		return protocol.NewMultiPartCopyInitSuccessResponseOp(headerBytes)
+	case protocol.ErrorResponseOpType:
+		return nil, protocol.NewServerError(headerBytes)
+	default:
+		return nil, ErrUnexpectedResponse
+	}
+}
+
+// completeMultiPartCopy sends the multipart complete header b and checks
+// the checksum the server answers with against csum.
+func (c *Client) completeMultiPartCopy(ctx context.Context, b []byte, csum []byte, log *logger.Logger) (*Result, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, ctxErrOr(ctx, err)
+	}
+	defer conn.Close()
+	defer common.WatchContext(ctx, conn)()
+	returnMD5String := hex.EncodeToString(csum)
+	err = common.SendBytesToConn(conn, b)
+	if err != nil {
+		return nil, ctxErrOr(ctx, serverErrorOr(conn, err))
+	}
+	opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(conn)
+	if err != nil {
+		return nil, ctxErrOr(ctx, err)
+	}
+	switch opType {
+	case protocol.MultiPartCopySuccessResponseOpType:
+		nsr := protocol.NewSingleCopySuccessResponseOp(headerBytes)
+		if nsr.GetCsum() != returnMD5String {
+			log.Error("checksum mismatch from server", "csum", returnMD5String, "server_csum", nsr.GetCsum())
+			return nil, ErrChecksumMismatch
+		}
+		return &Result{Checksum: returnMD5String, Durable: nsr.IsDurable()}, nil
+	case protocol.ErrorResponseOpType:
+		return nil, protocol.NewServerError(headerBytes)
+	default:
+		return nil, ErrUnexpectedResponse
+	}
+}
+
+// abortMultiPartCopy asks the server to drop the multipart copy copyId, so
+// that its parts do not hold the path and space at the server until they
+// expire. Failing to is only logged, as the copy failed already.
+func (c *Client) abortMultiPartCopy(copyId uuid.UUID, log *logger.Logger) {
+	log = log.With("op", protocol.MultiPartCopyAbortOpType)
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+	conn, err := c.dial(ctx)
+	if err != nil {
+		log.Warn("unable to abort multipart copy", "error", ctxErrOr(ctx, err))
+		return
+	}
+	defer conn.Close()
+	defer common.WatchContext(ctx, conn)()
+	if err := common.SendBytesToConn(conn, protocol.PrepareMultiPartAbortRequestOpHeader(copyId)); err != nil {
+		log.Warn("unable to abort multipart copy", "error", serverErrorOr(conn, err))
+		return
+	}
+	opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(conn)
+	switch {
+	case err != nil:
+		log.Warn("unable to abort multipart copy", "error", ctxErrOr(ctx, err))
+	case opType == protocol.MultiPartCopyAbortSuccessResponseOpType:
+		log.Info("aborted multipart copy")
+	case opType == protocol.ErrorResponseOpType:
+		log.Warn("unable to abort multipart copy", "error", protocol.NewServerError(headerBytes))
+	default:
+		log.Warn("unable to abort multipart copy", "error", ErrUnexpectedResponse)
+	}
+}
+
+// serverErrorOr returns the error the server sent before dropping the
+// connection, such as when it rejects a copy without reading its data, or
+// err if there is none.
+func serverErrorOr(conn net.Conn, err error) error {
+	opType, headerBytes, rerr := common.GetOpTypeAndHeaderFromConn(conn)
+	if rerr == nil && opType == protocol.ErrorResponseOpType {
+		return protocol.NewServerError(headerBytes)
+	}
+	return err
+}
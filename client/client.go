@@ -1,179 +1,247 @@
 package main
 
 import (
-	"crypto/md5"
-	"encoding/hex"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"os"
 	"runtime"
+	"strings"
+	"time"
 
-	"github.com/chili-copy/client/multipart"
-	"github.com/chili-copy/common"
-	"github.com/chili-copy/common/protocol"
+	"github.com/chili-copy/client/ccp"
+	"github.com/chili-copy/common/logger"
 )
 
-const (
-	network = "tcp"
-)
+type cmdArgs struct {
+	servers       addressList
+	chunkSize     uint64
+	workerThreads int
+	localPath     string
+	remotePath    string
+	download      bool
+	delete        bool
+	list          bool
+	auto          bool
+	multiplex     bool
+	durable       bool
+	zeroCopy      bool
+	memoryLimit   uint64
+	retries       int
+	dialTimeout   time.Duration
+	ioTimeout     time.Duration
+	logLevel      string
+	logFormat     string
+	fanOutPolicy  string
+	relayPeer     string
+	peerPath      string
+}
 
 func main() {
-	server, chunkSize, workerThreads, localPath, remotePath := getCmdArgs()
-	if localPath == "" || remotePath == "" || server == "" {
-		fmt.Println("One or more argument missing")
+	args := getCmdArgs()
+	if err := logger.Configure(args.logLevel, args.logFormat); err != nil {
+		fmt.Printf("Invalid logging flags. Error : %s\n", err.Error())
+		os.Exit(1)
+	}
+	noLocal := args.relayPeer != "" || args.delete || args.list
+	if (args.localPath == "" && !noLocal) || args.remotePath == "" || len(args.servers) == 0 {
+		logger.Error("one or more argument missing")
 		os.Exit(1)
 	}
-	fmt.Println("Initiating copy ...")
-	err := initiateCopy(server, chunkSize, workerThreads, localPath, remotePath)
+	logger.Info("initiating copy")
+	err := initiateCopy(args)
+	if serr, ok := err.(*ccp.ServerError); ok {
+		logger.Error("failed to copy", "error", err, "err_type", serr.Type, "retryable", serr.Retryable)
+		os.Exit(2)
+	}
 	if err != nil {
-		fmt.Printf("Failed to copy. Error : %s\n", err.Error())
+		logger.Error("failed to copy", "error", err)
 		os.Exit(2)
 	}
 }
 
-func getCmdArgs() (string, uint64, int, string, string) {
-	var server string
-	var localPath string
-	var remotePath string
-
-	flag.StringVar(&server, "destination-address", "", "destination server host and port (eg. localhost:5678)")
-	flag.StringVar(&localPath, "local-file", "", "local file to copy")
-	flag.StringVar(&remotePath, "remote-file", "", "remote file at destination")
-	chunkSize := flag.Uint64("chunk-size", 16*1024*1024, "multipart chunk size (bytes)")
-	workerThreads := flag.Int("worker-count", runtime.NumCPU(), "count of worker threads")
+func getCmdArgs() *cmdArgs {
+	args := &cmdArgs{}
+	flag.Var(&args.servers, "destination-address", "destination server host and port (eg. localhost:5678), or unix socket (eg. unix:///run/ccp.sock), several to upload to all at once, comma separated or repeated")
+	flag.StringVar(&args.localPath, "local-file", "", "local file to copy")
+	flag.StringVar(&args.remotePath, "remote-file", "", "remote file at destination")
+	flag.BoolVar(&args.download, "download", false, "copy remote-file from the server to local-file instead")
+	flag.BoolVar(&args.delete, "delete", false, "delete remote-file at the server instead, no local-file needed")
+	flag.BoolVar(&args.list, "list", false, "list the files in the remote-file directory instead, no local-file needed")
+	flag.Uint64Var(&args.chunkSize, "chunk-size", ccp.DefaultChunkSize, "multipart chunk size (bytes)")
+	flag.IntVar(&args.workerThreads, "worker-count", runtime.NumCPU(), "count of worker threads")
+	flag.BoolVar(&args.auto, "auto", false, "tune chunk size and worker count of uploads to the link")
+	flag.BoolVar(&args.durable, "durable", false, "ask the server to fsync the file before acknowledging")
+	flag.BoolVar(&args.zeroCopy, "zero-copy", false, "send file data with sendfile (linux)")
+	flag.StringVar(&args.fanOutPolicy, "fan-out-policy", string(ccp.FanOutWait), "with several destinations, wait for slow ones or drop those holding up the rest (wait, drop)")
+	flag.StringVar(&args.relayPeer, "relay-peer", "", "have the server copy remote-file to this peer of it instead, no local-file needed")
+	flag.StringVar(&args.peerPath, "peer-file", "", "file at the relay peer (default remote-file)")
+	flag.BoolVar(&args.multiplex, "multiplex", false, "send all requests of the copy over one connection")
+	flag.Uint64Var(&args.memoryLimit, "memory-limit", ccp.DefaultMemoryLimit, "upper bound on memory used for send buffers (bytes)")
+	flag.IntVar(&args.retries, "retries", ccp.DefaultRetries, "times to resend a request the server failed with a retryable error")
+	flag.DurationVar(&args.dialTimeout, "dial-timeout", ccp.DefaultDialTimeout, "how long connecting to the server may take, no limit if 0")
+	flag.DurationVar(&args.ioTimeout, "io-timeout", ccp.DefaultIOTimeout, "how long a request may wait for the server to move any data, no limit if 0")
+	flag.StringVar(&args.logLevel, "log-level", "info", "log level (debug, info, warn, error)")
+	flag.StringVar(&args.logFormat, "log-format", "text", "log format (text, json)")
 
 	flag.Parse()
 
-	return server, *chunkSize, *workerThreads, localPath, remotePath
+	return args
 }
 
-func initiateCopy(server string, chunkSize uint64, workers int, localFile string, remoteFile string) error {
-	fd, err := os.Open(localFile)
-	defer fd.Close()
-	if err != nil {
-		fmt.Printf("Unable to open local file %s. Error %s\n", localFile, err.Error())
-		return err
-	}
-	hash := md5.New()
-	if _, err := io.Copy(hash, fd); err != nil {
-		fmt.Printf("Failed to generate checksum. Error : %s\n", err.Error())
-	}
-	hashInBytes := hash.Sum(nil)[:16]
-	returnMD5String := hex.EncodeToString(hashInBytes)
-	fileSize := common.FileSize(fd)
-	if fileSize < int64(chunkSize) {
-		return singleCopy(localFile, remoteFile, uint64(fileSize), returnMD5String, server)
-	} else {
-		return multiPartCopy(localFile, remoteFile, uint64(fileSize), returnMD5String, server, workers, chunkSize)
+// addressList is a flag taking comma separated addresses, which may also be
+// given several times.
+type addressList []string
+
+func (l *addressList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *addressList) Set(value string) error {
+	for _, address := range strings.Split(value, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			*l = append(*l, address)
+		}
 	}
 	return nil
 }
 
-func singleCopy(localFile string, remoteFile string, fileSize uint64, returnMD5String string, server string) error {
-	fmt.Printf("Request : single copy : %s to %s:%s : size=%d, csum@client =%s\n", localFile, server, remoteFile, fileSize, returnMD5String)
-	conn, err := common.GetConnection(network, server)
-	if err != nil {
-		return err
+func newClient(args *cmdArgs, address string) *ccp.Client {
+	c := ccp.NewClient(address)
+	c.SetLogger(logger.With("remote", address, "local_path", args.localPath))
+	c.SetTimeouts(args.dialTimeout, args.ioTimeout)
+	c.SetMultiplex(args.multiplex)
+	return c
+}
+
+func initiateCopy(args *cmdArgs) error {
+	opts := &ccp.Options{
+		ChunkSize:    args.chunkSize,
+		Workers:      args.workerThreads,
+		Auto:         args.auto,
+		Durable:      args.durable,
+		ZeroCopy:     args.zeroCopy,
+		MemoryLimit:  args.memoryLimit,
+		FanOutPolicy: ccp.FanOutPolicy(args.fanOutPolicy),
+		Retries:      args.retries,
 	}
-	err = common.SendBytesToConn(conn, protocol.PrepareSingleCopyRequestOpHeader(remoteFile, fileSize))
-	if err != nil {
-		return nil
+	if args.retries == 0 {
+		opts.Retries = -1
 	}
-	b, err := ioutil.ReadFile(localFile)
-	if err != nil {
-		fmt.Println("Unable to read local file. Error : %s", err.Error())
+	if args.delete || args.list {
+		if args.download || args.relayPeer != "" || args.delete && args.list || len(args.servers) > 1 {
+			return errors.New("can only delete or list alone, at one destination")
+		}
+		return manage(args)
+	}
+	if args.relayPeer != "" {
+		if args.download || len(args.servers) > 1 {
+			return errors.New("can only relay from one destination")
+		}
+		return relay(args, opts)
+	}
+	if len(args.servers) > 1 {
+		if args.download {
+			return errors.New("cannot download from several destinations")
+		}
+		return copyToAll(args, opts)
+	}
+	c := newClient(args, args.servers[0])
+	defer c.Close()
+	if args.download {
+		_, err := c.DownloadFile(context.Background(), args.remotePath, args.localPath, opts)
 		return err
 	}
-	err = common.SendBytesToConn(conn, b)
+	res, err := c.UploadFile(context.Background(), args.localPath, args.remotePath, opts)
 	if err != nil {
+		return err
+	}
+	if args.durable && !res.Durable {
+		logger.Warn("server did not confirm a durable write, data may be lost on power failure")
+	}
+	return nil
+}
+
+// manage deletes remote-file, or lists the files in it, printing one per
+// line with its size and modification time.
+func manage(args *cmdArgs) error {
+	c := newClient(args, args.servers[0])
+	defer c.Close()
+	if args.delete {
+		if err := c.Delete(context.Background(), args.remotePath); err != nil {
+			return err
+		}
+		logger.Info("deleted remote file", "path", args.remotePath)
 		return nil
 	}
-	opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(conn)
+	files, err := c.List(context.Background(), args.remotePath)
 	if err != nil {
 		return err
 	}
-	switch opType {
-	case protocol.SingleCopySuccessResponseOpType:
-		nsr := protocol.NewSingleCopySuccessResponseOp(headerBytes)
-		if nsr.GetCsum() == returnMD5String {
-			fmt.Printf("Response : successfully copied : %s to %s:%s : size=%d, csum@server=%s\n", localFile, server, remoteFile, fileSize, returnMD5String)
-		} else {
-			fmt.Println("Response : checksum mismatch from server")
-			return errors.New("checksum mismatch from server")
-		}
-	case protocol.ErrorResponseOpType:
-		return errors.New(protocol.ErrorsMap[protocol.ParseErrorType(headerBytes)])
-	default:
-		return errors.New("unknown opType received")
+	for _, fi := range files {
+		fmt.Printf("%12d  %s  %s\n", fi.Size, fi.ModTime.Format(time.RFC3339), fi.Name)
 	}
 	return nil
 }
 
-func multiPartCopy(localFile string, remoteFile string, fileSize uint64, returnMD5String string, server string, workers int, chunkSize uint64) error {
-	fmt.Printf("Request : multipart copy : %s to %s:%s : size=%d, csum@client=%s\n", localFile, server, remoteFile, fileSize, returnMD5String)
-	conn, err := common.GetConnection(network, server)
+// relay has the destination copy remote-file to the relay peer, logging
+// how far it got.
+func relay(args *cmdArgs, opts *ccp.Options) error {
+	peerPath := args.peerPath
+	if peerPath == "" {
+		peerPath = args.remotePath
+	}
+	opts.Progress = func(done uint64, total uint64) {
+		logger.Info("relaying", "peer", args.relayPeer, "done", done, "total", total)
+	}
+	c := newClient(args, args.servers[0])
+	defer c.Close()
+	res, err := c.Relay(context.Background(), args.remotePath, args.relayPeer, peerPath, opts)
 	if err != nil {
 		return err
 	}
-	b := protocol.PrepareMultiPartInitRequestOpHeader(remoteFile)
-	err = common.SendBytesToConn(conn, b)
-	if err != nil {
-		return nil
+	logger.Info("relayed to peer", "peer", args.relayPeer, "csum", res.Checksum, "bytes", res.Bytes,
+		"duration", res.Duration)
+	if args.durable && !res.Durable {
+		logger.Warn("peer did not confirm a durable write, data may be lost on power failure")
 	}
-	opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(conn)
+	return nil
+}
+
+// copyToAll uploads to every destination at once and reports how each went.
+func copyToAll(args *cmdArgs, opts *ccp.Options) error {
+	var clients []*ccp.Client
+	for _, address := range args.servers {
+		c := newClient(args, address)
+		defer c.Close()
+		clients = append(clients, c)
+	}
+	results, err := ccp.UploadFileToAll(context.Background(), clients, args.localPath, args.remotePath, opts)
 	if err != nil {
 		return err
 	}
-	switch opType {
-	case protocol.MultiPartCopyInitSuccessResponseOpType:
-		mir, err := protocol.NewMultiPartCopyInitSuccessResponseOp(headerBytes)
-		if err != nil {
-			return err
-		}
-		fmt.Printf("CopyId received from server : %s\n", mir.GetCopyId().String())
-		muh, err := multipart.NewMultiPartCopyHandler(mir.GetCopyId(), localFile, chunkSize, workers, network, server)
-		if err != nil {
-			return err
-		}
-		defer muh.Close()
-		err = muh.Handle()
-		if err != nil {
-			return err
-		}
-		nConn, err := common.GetConnection(network, server)
-		if err != nil {
-			return err
-		}
-		b := protocol.PrepareMultiPartCompleteRequestOpHeader(mir.GetCopyId(), fileSize)
-		err = common.SendBytesToConn(nConn, b)
-		if err != nil {
-			return nil
-		}
-		opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(nConn)
-		if err != nil {
-			return err
-		}
-		switch opType {
-		case protocol.MultiPartCopySuccessResponseOpType:
-			nsr := protocol.NewSingleCopySuccessResponseOp(headerBytes)
-			if nsr.GetCsum() == returnMD5String {
-				fmt.Printf("Response : successfully copied : %s to %s:%s : size=%d, csum@server=%s\n", localFile, server, remoteFile, fileSize, returnMD5String)
+	failed := 0
+	for i, res := range results {
+		log := logger.With("remote", args.servers[i])
+		if res.Err != nil {
+			failed++
+			if serr, ok := res.Err.(*ccp.ServerError); ok {
+				log.Error("failed to copy to destination", "error", serr, "err_type", serr.Type, "retryable", serr.Retryable)
 			} else {
-				fmt.Println("Response : Checksum mismatch from server")
-				return errors.New("checksum mismatch from server")
+				log.Error("failed to copy to destination", "error", res.Err)
 			}
-		case protocol.ErrorResponseOpType:
-			return errors.New(protocol.ErrorsMap[protocol.ParseErrorType(headerBytes)])
-		default:
-			return errors.New("unknown opType received")
+			continue
+		}
+		log.Info("copied to destination", "csum", res.Result.Checksum, "durable", res.Result.Durable,
+			"duration", res.Result.Duration)
+		if args.durable && !res.Result.Durable {
+			log.Warn("server did not confirm a durable write, data may be lost on power failure")
 		}
-	case protocol.ErrorResponseOpType:
-		return errors.New(protocol.ErrorsMap[protocol.ParseErrorType(headerBytes)])
-	default:
-		return errors.New("unknown opType received")
+	}
+	logger.Info("copied to destinations", "successful", len(results)-failed, "failed", failed)
+	if failed > 0 {
+		return fmt.Errorf("failed to copy to %d of %d destinations", failed, len(results))
 	}
 	return nil
 }
@@ -0,0 +1,221 @@
+package multipart
+
+import (
+	"context"
+	"time"
+
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/common/protocol"
+)
+
+const (
+	autoStartWorkers   = 2
+	autoStartChunkSize = 4 << 20
+	autoMinChunkSize   = 1 << 20
+	autoMaxChunkSize   = 256 << 20
+	autoMaxWorkers     = 64
+	// autoPartTime is how long a part should take to send, so connecting
+	// and waiting for the reply stay small next to it.
+	autoPartTime = time.Second
+	// autoPartRTTs is how many round trips a part should take at least, for
+	// the same reason on slow links.
+	autoPartRTTs = 20
+	// autoGain is how much more workers must move for the tuner to keep
+	// adding more.
+	autoGain = 1.1
+	// autoDrop is how much less workers may move once the tuner settled
+	// before it starts over.
+	autoDrop = 0.5
+)
+
+// SetAuto makes Handle pick the chunk size and the number of workers as it
+// sends parts, instead of using those given to NewMultiPartCopyHandler,
+// keeping to limits, usually those the server advertised.
+func (muh *MultiPartCopyHandler) SetAuto(limits protocol.PartLimits) {
+	muh.auto = true
+	muh.limits = limits
+}
+
+// handleAuto is Handle in auto mode. Parts are cut as they are sent, with
+// the chunk size the tuner settled on by then.
+func (muh *MultiPartCopyHandler) handleAuto(ctx context.Context) error {
+	t := newTuner(muh.limits, muh.log)
+	muh.bufferPool = newBufferPool(muh.memoryLimit, t.maxWorkers)
+	muh.chunkList = nil
+	results := make(chan *chunkUploadResult)
+	rounds := make(map[uint64]int)
+	inFlight := 0
+	offset := int64(0)
+	successful := uint64(0)
+	failed := uint64(0)
+	var firstErr error
+	for {
+		for firstErr == nil && offset < muh.size && inFlight < t.workers {
+			size := t.nextChunk(uint64(muh.size-offset), uint64(len(muh.chunkList)))
+			chunk := &chunkMeta{uint64(len(muh.chunkList)) + 1, offset, size, nil}
+			muh.chunkList = append(muh.chunkList, chunk)
+			rounds[chunk.partNum] = t.round
+			offset += int64(size)
+			inFlight++
+			go func() { results <- muh.sendPart(ctx, chunk) }()
+		}
+		if inFlight == 0 {
+			break
+		}
+		res := <-results
+		inFlight--
+		if res.err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+		successful++
+		chunk := muh.chunkList[res.partNum-1]
+		chunk.md5 = res.md5
+		t.observe(chunk.chunkSize, res, rounds[res.partNum])
+	}
+	muh.chunkSize, muh.workers = t.chunkSize, t.workers
+	muh.log.Info("copied chunks", "successful", successful, "failed", failed, "chunk_size", muh.chunkSize, "workers", muh.workers)
+	return partsError(ctx, successful, failed, firstErr)
+}
+
+// tuner looks for the number of workers and the chunk size that move the
+// most bytes per second. Rounds last until as many parts cut in them are
+// sent as there are workers. While climbing, it doubles the workers after
+// every round that moved enough more than the best one, and settles on the
+// best once one did not. Chunks are sized to take autoPartTime at the rate
+// a single part was sent with.
+type tuner struct {
+	limits      protocol.PartLimits
+	maxWorkers  int
+	workers     int
+	chunkSize   uint64
+	climbing    bool
+	best        float64
+	bestWorkers int
+	rtt         time.Duration
+	round       int
+	roundStart  time.Time
+	roundBytes  uint64
+	roundParts  int
+	roundBusy   time.Duration
+	log         *logger.Logger
+}
+
+func newTuner(limits protocol.PartLimits, log *logger.Logger) *tuner {
+	t := &tuner{limits: limits, maxWorkers: autoMaxWorkers, workers: autoStartWorkers, climbing: true,
+		roundStart: time.Now(), log: log}
+	if limits.MaxParallel > 0 && int(limits.MaxParallel) < t.maxWorkers {
+		t.maxWorkers = int(limits.MaxParallel)
+	}
+	if t.workers > t.maxWorkers {
+		t.workers = t.maxWorkers
+	}
+	t.bestWorkers = t.workers
+	t.chunkSize = t.clamp(autoStartChunkSize)
+	return t
+}
+
+// observe takes in a part sent, cut in round.
+func (t *tuner) observe(size uint64, res *chunkUploadResult, round int) {
+	if t.rtt == 0 || res.connectTime < t.rtt {
+		t.rtt = res.connectTime
+	}
+	if round != t.round {
+		return
+	}
+	t.roundBytes += size
+	t.roundBusy += res.duration
+	t.roundParts++
+	if t.roundParts < t.workers {
+		return
+	}
+	rate := float64(t.roundBytes) / time.Since(t.roundStart).Seconds()
+	t.step(rate)
+	partRate := float64(t.roundBytes) / t.roundBusy.Seconds()
+	partTime := autoPartTime
+	if rtts := autoPartRTTs * t.rtt; rtts > partTime {
+		partTime = rtts
+	}
+	t.chunkSize = t.clamp(uint64(partRate * partTime.Seconds()))
+	t.log.Debug("tuned parts", "rate", uint64(rate), "part_rate", uint64(partRate), "rtt", t.rtt,
+		"workers", t.workers, "chunk_size", t.chunkSize)
+	t.round++
+	t.roundStart, t.roundBytes, t.roundParts, t.roundBusy = time.Now(), 0, 0, 0
+}
+
+// step picks the workers of the next round after one that moved rate bytes
+// per second.
+func (t *tuner) step(rate float64) {
+	switch {
+	case t.climbing && rate > t.best*autoGain:
+		t.best, t.bestWorkers = rate, t.workers
+		if t.workers == t.maxWorkers {
+			t.climbing = false
+			break
+		}
+		t.workers *= 2
+		if t.workers > t.maxWorkers {
+			t.workers = t.maxWorkers
+		}
+	case t.climbing:
+		t.climbing = false
+		t.workers = t.bestWorkers
+	case rate > t.best:
+		t.best = rate
+	case rate < t.best*autoDrop:
+		// the link got slower, so what was best may no longer be
+		t.climbing = true
+		t.best = 0
+		if t.workers > 1 {
+			t.workers /= 2
+		}
+	}
+}
+
+func (t *tuner) clamp(size uint64) uint64 {
+	if size < autoMinChunkSize {
+		size = autoMinChunkSize
+	}
+	if size > autoMaxChunkSize {
+		size = autoMaxChunkSize
+	}
+	if size < t.limits.MinSize {
+		size = t.limits.MinSize
+	}
+	if t.limits.MaxSize > 0 && size > t.limits.MaxSize {
+		size = t.limits.MaxSize
+	}
+	return size
+}
+
+// nextChunk is the size of the next part, when remaining bytes are left
+// and sent parts were cut.
+func (t *tuner) nextChunk(remaining uint64, sent uint64) uint64 {
+	size := t.chunkSize
+	// spread the last bytes over all workers, not to wait for one of them
+	if spread := remaining / uint64(t.workers); spread < size {
+		size = t.clamp(spread)
+	}
+	if t.limits.MaxParts > sent {
+		left := t.limits.MaxParts - sent
+		if least := (remaining + left - 1) / left; size < least {
+			size = least
+		}
+	}
+	if t.limits.MaxSize > 0 && size > t.limits.MaxSize {
+		size = t.limits.MaxSize
+	}
+	if size >= remaining {
+		return remaining
+	}
+	if remaining-size < t.limits.MinSize {
+		if t.limits.MaxSize == 0 || remaining <= t.limits.MaxSize {
+			return remaining
+		}
+		return remaining - t.limits.MinSize
+	}
+	return size
+}
@@ -0,0 +1,161 @@
+package multipart
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/common/protocol"
+)
+
+const mb = 1 << 20
+
+func TestNewTuner(t *testing.T) {
+	tests := []struct {
+		name           string
+		limits         protocol.PartLimits
+		wantWorkers    int
+		wantMaxWorkers int
+		wantChunkSize  uint64
+	}{
+		{"no limits", protocol.PartLimits{}, autoStartWorkers, autoMaxWorkers, autoStartChunkSize},
+		{"server serves few parts at once", protocol.PartLimits{MaxParallel: 8}, autoStartWorkers, 8, autoStartChunkSize},
+		{"server serves one part at once", protocol.PartLimits{MaxParallel: 1}, 1, 1, autoStartChunkSize},
+		{"large parts", protocol.PartLimits{MinSize: 5 * mb}, autoStartWorkers, autoMaxWorkers, 5 * mb},
+		{"small parts", protocol.PartLimits{MaxSize: 2 * mb}, autoStartWorkers, autoMaxWorkers, 2 * mb},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tu := newTuner(tt.limits, logger.With())
+			if tu.workers != tt.wantWorkers || tu.maxWorkers != tt.wantMaxWorkers || tu.chunkSize != tt.wantChunkSize {
+				t.Errorf("newTuner() has %d of %d workers and %d byte chunks, want %d of %d and %d", tu.workers,
+					tu.maxWorkers, tu.chunkSize, tt.wantWorkers, tt.wantMaxWorkers, tt.wantChunkSize)
+			}
+		})
+	}
+}
+
+func TestTunerStep(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxWorkers int
+		// rates are those of the rounds in turn, and workers the workers
+		// wanted after each.
+		rates        []float64
+		workers      []int
+		wantClimbing bool
+	}{
+		{"climbs while it gains", 64, []float64{100, 200, 400}, []int{4, 8, 16}, true},
+		{"settles on the best", 64, []float64{100, 200, 210}, []int{4, 8, 4}, false},
+		{"settles at the start", 64, []float64{100, 105}, []int{4, 2}, false},
+		{"stops at the most workers", 8, []float64{100, 200, 400, 800}, []int{4, 8, 8, 8}, false},
+		{"most workers capped", 6, []float64{100, 200}, []int{4, 6}, true},
+		{"keeps the best once settled", 64, []float64{100, 105, 150, 90}, []int{4, 2, 2, 2}, false},
+		{"starts over once the link slows", 64, []float64{100, 105, 40}, []int{4, 2, 1}, true},
+		{"climbs again after starting over", 64, []float64{100, 105, 40, 50}, []int{4, 2, 1, 2}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tu := newTuner(protocol.PartLimits{MaxParallel: uint32(tt.maxWorkers)}, logger.With())
+			for i, rate := range tt.rates {
+				tu.step(rate)
+				if tu.workers != tt.workers[i] {
+					t.Fatalf("after a round at %.0f, %d workers, want %d", rate, tu.workers, tt.workers[i])
+				}
+			}
+			if tu.climbing != tt.wantClimbing {
+				t.Errorf("climbing = %v, want %v", tu.climbing, tt.wantClimbing)
+			}
+		})
+	}
+}
+
+func TestTunerClamp(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits protocol.PartLimits
+		size   uint64
+		want   uint64
+	}{
+		{"within bounds", protocol.PartLimits{}, 8 * mb, 8 * mb},
+		{"too small", protocol.PartLimits{}, 1000, autoMinChunkSize},
+		{"too large", protocol.PartLimits{}, 1 << 40, autoMaxChunkSize},
+		{"server minimum", protocol.PartLimits{MinSize: 5 * mb}, 2 * mb, 5 * mb},
+		{"server maximum", protocol.PartLimits{MaxSize: 3 * mb}, 8 * mb, 3 * mb},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (&tuner{limits: tt.limits}).clamp(tt.size); got != tt.want {
+				t.Errorf("clamp(%d) = %d, want %d", tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTunerNextChunk(t *testing.T) {
+	tests := []struct {
+		name      string
+		limits    protocol.PartLimits
+		workers   int
+		remaining uint64
+		sent      uint64
+		want      uint64
+	}{
+		{"chunk size", protocol.PartLimits{}, 2, 100 * mb, 0, 4 * mb},
+		{"last bytes spread over workers", protocol.PartLimits{}, 2, 6 * mb, 10, 3 * mb},
+		{"spread no smaller than the minimum", protocol.PartLimits{}, 4, 2 * mb, 10, autoMinChunkSize},
+		{"rest in one part", protocol.PartLimits{}, 1, 3 * mb, 10, 3 * mb},
+		{"few parts left", protocol.PartLimits{MaxParts: 10}, 2, 100 * mb, 8, 50 * mb},
+		{"few parts left no larger than the maximum", protocol.PartLimits{MaxParts: 10, MaxSize: 20 * mb}, 2,
+			100 * mb, 8, 20 * mb},
+		{"no rest below the minimum", protocol.PartLimits{MinSize: 5 * mb}, 2, 8 * mb, 10, 8 * mb},
+		{"rest above the maximum", protocol.PartLimits{MinSize: 5 * mb, MaxSize: 6 * mb}, 2, 8 * mb, 10, 3 * mb},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tu := newTuner(tt.limits, logger.With())
+			tu.workers = tt.workers
+			if got := tu.nextChunk(tt.remaining, tt.sent); got != tt.want {
+				t.Errorf("nextChunk(%d, %d) = %d, want %d", tt.remaining, tt.sent, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTunerObserve(t *testing.T) {
+	tests := []struct {
+		name string
+		// parts are sent by the 2 workers of the first round, each taking
+		// duration to send after connecting in connectTime.
+		parts         int
+		duration      time.Duration
+		connectTime   time.Duration
+		wantRound     int
+		wantChunkSize uint64
+	}{
+		{"round not over", 1, time.Second, time.Millisecond, 0, autoStartChunkSize},
+		{"parts take a second at the part rate", 2, time.Second, time.Millisecond, 1, 8 * mb},
+		{"parts take longer on slow links", 2, time.Second, 100 * time.Millisecond, 1, 16 * mb},
+		{"fast parts grow", 2, 100 * time.Millisecond, time.Millisecond, 1, 80 * mb},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tu := newTuner(protocol.PartLimits{}, logger.With())
+			for i := 0; i < tt.parts; i++ {
+				tu.observe(8*mb, &chunkUploadResult{duration: tt.duration, connectTime: tt.connectTime}, 0)
+			}
+			if tu.round != tt.wantRound || tu.chunkSize != tt.wantChunkSize {
+				t.Errorf("observe() left round %d with %d byte chunks, want %d with %d", tu.round, tu.chunkSize,
+					tt.wantRound, tt.wantChunkSize)
+			}
+			if tu.rtt != tt.connectTime {
+				t.Errorf("rtt = %s, want %s", tu.rtt, tt.connectTime)
+			}
+			// parts cut in earlier rounds do not count
+			tu.observe(8*mb, &chunkUploadResult{duration: tt.duration, connectTime: time.Hour}, tt.wantRound-1)
+			if tu.round != tt.wantRound {
+				t.Errorf("part of an earlier round ended round %d", tu.round)
+			}
+		})
+	}
+}
@@ -1,62 +1,90 @@
 package multipart
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"hash"
+	"io"
 	"math"
+	"net"
 	"os"
+	"time"
 
 	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/logger"
 	"github.com/chili-copy/common/protocol"
+	"github.com/chili-copy/common/zerocopy"
 	"github.com/google/uuid"
 )
 
-type chunkUploadStatus int
-
 const (
-	SUCCESSFUL chunkUploadStatus = iota
-	FAILED
+	// MaxBufferSize is the largest buffer a worker streams a chunk through.
+	MaxBufferSize = 1024 * 1024
+	// MinBufferSize is the smallest buffer a worker streams a chunk through.
+	// When the memory limit cannot give every worker a buffer of this size,
+	// fewer buffers are made and workers wait for one another.
+	MinBufferSize = 64 * 1024
 )
 
 type MultiPartCopyHandler struct {
-	copyId           uuid.UUID
-	fd               *os.File
+	copyId uuid.UUID
+	src    io.ReaderAt
+	// file is src when it is a file and zero copy is on, so chunks can be
+	// sent with sendfile.
+	file             *os.File
+	size             int64
+	chunkSize        uint64
+	memoryLimit      uint64
 	workers          int
+	auto             bool
+	limits           protocol.PartLimits
 	chunkCopyJobQ    chan *chunkMeta
 	chunkCopyResultQ chan *chunkUploadResult
 	network          string
 	address          string
 	chunkList        []*chunkMeta
+	bufferPool       chan []byte
+	progress         func(n uint64)
+	partProgress     bool // progress is only called once a part succeeded
+	retries          int
+	dialTimeout      time.Duration
+	ioTimeout        time.Duration
+	dial             func(ctx context.Context) (net.Conn, error)
+	log              *logger.Logger
 }
 
 type chunkMeta struct {
 	partNum   uint64
 	offset    int64
 	chunkSize uint64
-	md5       hash.Hash
+	md5       []byte
 }
 
 type chunkUploadResult struct {
 	partNum uint64
-	status  chunkUploadStatus
+	md5     []byte
+	err     error
+	// duration is how long the part took to send, and connectTime how
+	// long connecting for it took, about a round trip.
+	duration    time.Duration
+	connectTime time.Duration
 }
 
 func (muh *MultiPartCopyHandler) GetNumParts() int {
 	return len(muh.chunkList)
 }
 
-func NewMultiPartCopyHandler(copyId uuid.UUID, localFile string, chunkSize uint64, nProcs int, network string, address string) (*MultiPartCopyHandler, error) {
-	fd, err := os.Open(localFile)
-	if err != nil {
-		fmt.Printf("Error in opening local file. Error : %s", err.Error())
-		return nil, err
+// NewMultiPartCopyHandler splits the size bytes of src into parts of
+// chunkSize to be sent to address by nProcs workers. Zero copy is only used
+// if src is an *os.File.
+func NewMultiPartCopyHandler(copyId uuid.UUID, src io.ReaderAt, size int64, chunkSize uint64, nProcs int, network string, address string, zeroCopy bool, memoryLimit uint64, log *logger.Logger) (*MultiPartCopyHandler, error) {
+	if chunkSize == 0 || nProcs < 1 {
+		return nil, errors.New("chunk size and worker count must be positive")
 	}
-	fileSize := common.FileSize(fd)
-	totalPartsNum := uint64(math.Ceil(float64(fileSize) / float64(chunkSize)))
-	fmt.Println("Total fileSize : ", fileSize)
-	fmt.Println("Total # of parts : ", totalPartsNum)
+	totalPartsNum := uint64(math.Ceil(float64(size) / float64(chunkSize)))
+	log.Info("split file into parts", "parts", totalPartsNum, "chunk_size", chunkSize)
 	offset := int64(0)
 	partSize := uint64(0)
 	chunkUploadQ := make(chan *chunkMeta, totalPartsNum)
@@ -66,91 +94,302 @@ func NewMultiPartCopyHandler(copyId uuid.UUID, localFile string, chunkSize uint6
 
 	for i := uint64(0); i < totalPartsNum; i++ {
 		offset = offset + int64(partSize)
-		partSize = uint64(math.Min(float64(chunkSize), float64(int64(fileSize)-int64(i*uint64(chunkSize)))))
+		partSize = uint64(math.Min(float64(chunkSize), float64(size-int64(i*chunkSize))))
 		cm := &chunkMeta{i + 1, offset, partSize, nil}
 		chunks = append(chunks, cm)
 	}
-	return &MultiPartCopyHandler{copyId: copyId, fd: fd, workers: nProcs,
+	muh := &MultiPartCopyHandler{copyId: copyId, src: src, size: size, chunkSize: chunkSize, memoryLimit: memoryLimit, workers: nProcs,
 		chunkCopyJobQ: chunkUploadQ, chunkCopyResultQ: chunkUploadResultQ,
-		network: network, address: address, chunkList: chunks}, nil
+		network: network, address: address, chunkList: chunks,
+		bufferPool: newBufferPool(memoryLimit, nProcs), progress: func(uint64) {}, log: log}
+	muh.dial = func(ctx context.Context) (net.Conn, error) {
+		return common.GetConnectionContext(ctx, muh.network, muh.address, muh.dialTimeout, muh.ioTimeout)
+	}
+	if f, ok := src.(*os.File); ok && zeroCopy {
+		muh.file = f
+	}
+	return muh, nil
+}
+
+// SetProgressFunc sets a func called, from any worker, with the number of
+// bytes sent each time some are.
+func (muh *MultiPartCopyHandler) SetProgressFunc(progress func(n uint64)) {
+	muh.progress = progress
+}
+
+// SetPartProgressFunc sets a func called, from any worker, with the size of
+// each part the server confirmed getting, in place of the bytes sent.
+func (muh *MultiPartCopyHandler) SetPartProgressFunc(progress func(n uint64)) {
+	muh.progress = progress
+	muh.partProgress = true
+}
+
+// SetRetries sets how many times a part is sent again when the server fails
+// it with a retryable error.
+func (muh *MultiPartCopyHandler) SetRetries(retries int) {
+	muh.retries = retries
+}
+
+// SetTimeouts sets how long connecting may take and how long a part may
+// move no data. 0 never times out.
+func (muh *MultiPartCopyHandler) SetTimeouts(dialTimeout time.Duration, ioTimeout time.Duration) {
+	muh.dialTimeout = dialTimeout
+	muh.ioTimeout = ioTimeout
+}
+
+// SetDialFunc sets how parts get a connection to the server, in place of
+// connecting to address with the timeouts of SetTimeouts.
+func (muh *MultiPartCopyHandler) SetDialFunc(dial func(ctx context.Context) (net.Conn, error)) {
+	muh.dial = dial
+}
+
+// BufferSize returns the size of the buffer a single stream gets when
+// memoryLimit is shared by workers concurrent streams.
+func BufferSize(memoryLimit uint64, workers int) uint64 {
+	size := memoryLimit / uint64(workers)
+	if size > MaxBufferSize {
+		size = MaxBufferSize
+	}
+	if size < MinBufferSize {
+		size = MinBufferSize
+	}
+	return size
+}
+
+// newBufferPool makes as many buffers as fit in memoryLimit, but no more than
+// one per worker. The pool always holds at least one buffer.
+func newBufferPool(memoryLimit uint64, workers int) chan []byte {
+	size := BufferSize(memoryLimit, workers)
+	count := int(memoryLimit / size)
+	if count > workers {
+		count = workers
+	}
+	if count < 1 {
+		count = 1
+	}
+	pool := make(chan []byte, count)
+	for i := 0; i < count; i++ {
+		pool <- make([]byte, size)
+	}
+	return pool
 }
 
-func (muh *MultiPartCopyHandler) Handle() error {
+// Handle sends all parts. If some fail, it returns ctx's error if ctx is
+// done, otherwise the error of the first part that failed.
+func (muh *MultiPartCopyHandler) Handle(ctx context.Context) error {
+	if muh.auto {
+		return muh.handleAuto(ctx)
+	}
 	totalChunksSuccessful := uint64(0)
 	totalChunksFailed := uint64(0)
+	var firstErr error
 	for w := 1; w <= muh.workers; w++ {
-		go muh.worker(w)
+		go muh.worker(ctx, w)
 	}
 	for _, chunkJob := range muh.chunkList {
 		muh.chunkCopyJobQ <- chunkJob
 	}
 	for chunkResult := range muh.chunkCopyResultQ {
-		if chunkResult.status == SUCCESSFUL {
+		if chunkResult.err == nil {
 			totalChunksSuccessful = totalChunksSuccessful + 1
+			muh.chunkList[chunkResult.partNum-1].md5 = chunkResult.md5
 		} else {
 			totalChunksFailed = totalChunksFailed + 1
+			if firstErr == nil {
+				firstErr = chunkResult.err
+			}
 		}
 		if totalChunksSuccessful+totalChunksFailed >= uint64(len(muh.chunkList)) {
 			break
 		}
 	}
-	fmt.Printf("Successfully copied %d chunks out of %d \n", totalChunksSuccessful, totalChunksSuccessful+totalChunksFailed)
+	muh.log.Info("copied chunks", "successful", totalChunksSuccessful, "failed", totalChunksFailed)
 	close(muh.chunkCopyJobQ)
 	close(muh.chunkCopyResultQ)
-	return nil
+	return partsError(ctx, totalChunksSuccessful, totalChunksFailed, firstErr)
+}
+
+func partsError(ctx context.Context, successful uint64, failed uint64, firstErr error) error {
+	if failed == 0 {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if _, ok := firstErr.(*protocol.ServerError); ok {
+		return firstErr
+	}
+	return fmt.Errorf("failed to copy %d chunks out of %d: %s", failed, successful+failed, firstErr.Error())
+}
+
+// ChunkSize is the size parts were cut to, the last one picked in auto
+// mode.
+func (muh *MultiPartCopyHandler) ChunkSize() uint64 {
+	return muh.chunkSize
 }
 
-func (muh *MultiPartCopyHandler) worker(workerId int) {
+// Workers is how many parts were sent at once, the last number picked in
+// auto mode.
+func (muh *MultiPartCopyHandler) Workers() int {
+	return muh.workers
+}
+
+// CombinedChecksum returns the multipart checksum built from the digests
+// of all chunks, as computed while they were sent.
+func (muh *MultiPartCopyHandler) CombinedChecksum() []byte {
+	digests := make([][]byte, 0, len(muh.chunkList))
+	for _, chunk := range muh.chunkList {
+		digests = append(digests, chunk.md5)
+	}
+	return common.CombinePartDigests(digests)
+}
+
+func (muh *MultiPartCopyHandler) worker(ctx context.Context, workerId int) {
 	for chunk := range muh.chunkCopyJobQ {
-		conn, err := common.GetConnection(muh.network, muh.address)
-		if err != nil {
-			muh.chunkCopyResultQ <- &chunkUploadResult{chunk.partNum, FAILED}
-		}
-		defer conn.Close()
-		buffer := make([]byte, chunk.chunkSize)
-		_, err = muh.fd.ReadAt(buffer, chunk.offset)
-		if err != nil {
-			muh.chunkCopyResultQ <- &chunkUploadResult{chunk.partNum, FAILED}
-		}
-		digest := md5.New()
-		digest.Write(buffer)
-		hash := digest.Sum(nil)
-		returnMD5String := hex.EncodeToString(hash)
-		if err != nil {
-			muh.chunkCopyResultQ <- &chunkUploadResult{chunk.partNum, FAILED}
-		}
-		b := protocol.PrepareMultiPartCopyPartRequestOpHeader(chunk.partNum, muh.copyId, chunk.chunkSize)
-		err = common.SendBytesToConn(conn, b)
-		if err != nil {
-			muh.chunkCopyResultQ <- &chunkUploadResult{chunk.partNum, FAILED}
-		}
-		err = common.SendBytesToConn(conn, buffer)
-		if err != nil {
-			muh.chunkCopyResultQ <- &chunkUploadResult{chunk.partNum, FAILED}
-		}
-		opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(conn)
-		if err != nil {
-			muh.chunkCopyResultQ <- &chunkUploadResult{chunk.partNum, FAILED}
+		muh.chunkCopyResultQ <- muh.sendPart(ctx, chunk)
+	}
+}
+
+// sendPart uploads chunk, sending it again as long as the server fails it
+// with retryable errors.
+func (muh *MultiPartCopyHandler) sendPart(ctx context.Context, chunk *chunkMeta) *chunkUploadResult {
+	res := &chunkUploadResult{partNum: chunk.partNum}
+	if res.err = ctx.Err(); res.err != nil {
+		return res
+	}
+	rp := &RetryProgress{Progress: muh.progress}
+	if muh.partProgress {
+		rp.Progress = func(uint64) {}
+	}
+	log := muh.log.With("op", protocol.MultiPartCopyPartRequestOpType, "part", chunk.partNum, "bytes", chunk.chunkSize)
+	res.err = common.Retry(ctx, muh.retries, log, func() error {
+		var err error
+		rp.Restart()
+		start := time.Now()
+		res.md5, res.connectTime, err = muh.uploadChunk(ctx, chunk, rp.Add, log)
+		res.duration = time.Since(start)
+		return err
+	})
+	if res.err == nil && muh.partProgress {
+		muh.progress(chunk.chunkSize)
+	}
+	return res
+}
+
+// uploadChunk sends chunk and returns its digest and how long connecting
+// took.
+func (muh *MultiPartCopyHandler) uploadChunk(ctx context.Context, chunk *chunkMeta, progress func(n uint64), log *logger.Logger) ([]byte, time.Duration, error) {
+	start := time.Now()
+	conn, err := muh.dial(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	connectTime := time.Since(start)
+	defer conn.Close()
+	defer common.WatchContext(ctx, conn)()
+	digest, err := SendPart(conn, muh.copyId, chunk.partNum, chunk.chunkSize, func(conn net.Conn) ([]byte, error) {
+		if muh.file != nil {
+			return muh.sendChunkZeroCopy(conn, chunk, progress)
 		}
-		switch opType {
-		case protocol.SingleCopySuccessResponseOpType:
-			nsr := protocol.NewSingleCopySuccessResponseOp(headerBytes)
-			if nsr.GetCsum() == returnMD5String {
-				fmt.Printf("Response : successfully uploaded chunk # %d\n", chunk.partNum)
-				muh.chunkCopyResultQ <- &chunkUploadResult{chunk.partNum, SUCCESSFUL}
-			} else {
-				fmt.Printf("Response : failed to upload chunk # %d\n", chunk.partNum)
-				muh.chunkCopyResultQ <- &chunkUploadResult{chunk.partNum, FAILED}
-			}
-		case protocol.ErrorResponseOpType:
-			fmt.Printf("failed copying chunk %d with error %s", chunk.partNum, protocol.ErrorsMap[protocol.ParseErrorType(headerBytes)])
-			muh.chunkCopyResultQ <- &chunkUploadResult{chunk.partNum, FAILED}
-		default:
-			fmt.Println("unknown opType received")
-			muh.chunkCopyResultQ <- &chunkUploadResult{chunk.partNum, FAILED}
+		return muh.sendChunkStreamed(conn, chunk, progress)
+	}, log)
+	if err != nil {
+		return nil, connectTime, err
+	}
+	log.Info("successfully uploaded chunk", "duration", time.Since(start))
+	return digest, connectTime, nil
+}
+
+// SendPart sends part partNum of copyId, of size bytes, on conn. send sends
+// the data of the part and returns its digest, which is checked against the
+// one the server answers with.
+func SendPart(conn net.Conn, copyId uuid.UUID, partNum uint64, size uint64, send func(conn net.Conn) ([]byte, error), log *logger.Logger) ([]byte, error) {
+	err := common.SendBytesToConn(conn, protocol.PrepareMultiPartCopyPartRequestOpHeader(partNum, copyId, size))
+	if err != nil {
+		return nil, err
+	}
+	digest, err := send(conn)
+	if err != nil {
+		return nil, err
+	}
+	opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(conn)
+	if err != nil {
+		return nil, err
+	}
+	switch opType {
+	case protocol.SingleCopySuccessResponseOpType:
+		nsr := protocol.NewSingleCopySuccessResponseOp(headerBytes)
+		if nsr.GetCsum() == hex.EncodeToString(digest) {
+			return digest, nil
 		}
+		log.Warn("checksum mismatch for chunk", "csum", hex.EncodeToString(digest), "server_csum", nsr.GetCsum())
+		return nil, fmt.Errorf("checksum mismatch for part %d", partNum)
+	case protocol.ErrorResponseOpType:
+		serr := protocol.NewServerError(headerBytes)
+		log.Warn("failed to upload chunk", "error", serr)
+		return nil, serr
+	default:
+		log.Warn("unknown opType received", "op_received", opType)
+		return nil, errors.New("unknown opType received")
+	}
+}
+
+// sendChunkStreamed sends the chunk through a buffer taken from the pool,
+// hashing it on the way, so memory use does not depend on the chunk size.
+func (muh *MultiPartCopyHandler) sendChunkStreamed(conn net.Conn, chunk *chunkMeta, progress func(n uint64)) ([]byte, error) {
+	buffer := <-muh.bufferPool
+	defer func() { muh.bufferPool <- buffer }()
+	digest := md5.New()
+	src := &ProgressReaderAt{ReaderAt: muh.src, Progress: progress}
+	err := common.StreamToConn(conn, src, chunk.offset, int64(chunk.chunkSize), buffer, digest)
+	if err != nil {
+		return nil, err
+	}
+	return digest.Sum(nil), nil
+}
+
+// sendChunkZeroCopy hashes the chunk with a separate read, as sendfile never
+// brings the bytes into userspace, and then sends it with sendfile.
+func (muh *MultiPartCopyHandler) sendChunkZeroCopy(conn net.Conn, chunk *chunkMeta, progress func(n uint64)) ([]byte, error) {
+	digest := md5.New()
+	_, err := io.Copy(digest, io.NewSectionReader(muh.file, chunk.offset, int64(chunk.chunkSize)))
+	if err != nil {
+		return nil, err
 	}
+	n, err := zerocopy.SendFile(conn, muh.file, chunk.offset, int64(chunk.chunkSize))
+	progress(uint64(n))
+	return digest.Sum(nil), err
 }
-func (muh *MultiPartCopyHandler) Close() {
-	muh.fd.Close()
+
+// ProgressReaderAt reports the bytes read through it to Progress.
+type ProgressReaderAt struct {
+	io.ReaderAt
+	Progress func(n uint64)
+}
+
+func (pr *ProgressReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	n, err := pr.ReaderAt.ReadAt(b, off)
+	pr.Progress(uint64(n))
+	return n, err
+}
+
+// RetryProgress passes on the bytes of a range reported to Add, except those
+// a retry sends again, so each byte of the range is counted once.
+type RetryProgress struct {
+	Progress func(n uint64)
+	sent     uint64
+	reported uint64
+}
+
+func (rp *RetryProgress) Add(n uint64) {
+	rp.sent += n
+	if rp.sent > rp.reported {
+		rp.Progress(rp.sent - rp.reported)
+		rp.reported = rp.sent
+	}
+}
+
+// Restart is called before each attempt to send the range.
+func (rp *RetryProgress) Restart() {
+	rp.sent = 0
 }
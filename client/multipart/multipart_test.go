@@ -0,0 +1,84 @@
+package multipart
+
+import (
+	"testing"
+)
+
+func TestBufferSize(t *testing.T) {
+	tests := []struct {
+		name        string
+		memoryLimit uint64
+		workers     int
+		want        uint64
+	}{
+		{"shared", 4 * 1024 * 1024, 8, 512 * 1024},
+		{"capped", 64 * 1024 * 1024, 2, MaxBufferSize},
+		{"at least the minimum", 128 * 1024, 8, MinBufferSize},
+		{"one worker", 256 * 1024, 1, 256 * 1024},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := BufferSize(tt.memoryLimit, tt.workers); got != tt.want {
+				t.Errorf("BufferSize(%d, %d) = %d, want %d", tt.memoryLimit, tt.workers, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewBufferPool(t *testing.T) {
+	tests := []struct {
+		name        string
+		memoryLimit uint64
+		workers     int
+		wantCount   int
+		wantSize    int
+	}{
+		{"one per worker", 4 * 1024 * 1024, 8, 8, 512 * 1024},
+		{"no more than workers", 64 * 1024 * 1024, 2, 2, MaxBufferSize},
+		{"as many as fit", 128 * 1024, 8, 2, MinBufferSize},
+		{"at least one", 1024, 4, 1, MinBufferSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newBufferPool(tt.memoryLimit, tt.workers)
+			if cap(pool) != tt.wantCount || len(pool) != tt.wantCount {
+				t.Fatalf("pool holds %d of %d buffers, want %d", len(pool), cap(pool), tt.wantCount)
+			}
+			for i := 0; i < tt.wantCount; i++ {
+				if buf := <-pool; len(buf) != tt.wantSize {
+					t.Errorf("buffer %d is %d bytes, want %d", i, len(buf), tt.wantSize)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryProgress(t *testing.T) {
+	tests := []struct {
+		name string
+		// adds are the bytes sent, and a 0 restarts the range.
+		adds []uint64
+		want uint64
+	}{
+		{"no retries", []uint64{10, 20, 30}, 60},
+		{"retry sends less", []uint64{10, 20, 0, 10}, 30},
+		{"retry sends more", []uint64{10, 20, 0, 10, 20, 30}, 60},
+		{"retry from scratch", []uint64{10, 0, 0, 10}, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reported uint64
+			rp := &RetryProgress{Progress: func(n uint64) { reported += n }}
+			for _, n := range tt.adds {
+				if n == 0 {
+					rp.Restart()
+					continue
+				}
+				rp.Add(n)
+			}
+			if reported != tt.want {
+				t.Errorf("reported %d bytes, want %d", reported, tt.want)
+			}
+		})
+	}
+}
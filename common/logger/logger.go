@@ -0,0 +1,248 @@
+// Package logger writes levelled, structured log lines as text or JSON.
+// Each line carries a timestamp, a level, a message and key/value fields,
+// so the lines of a single transfer can be picked out of interleaved output.
+//
+//	log := logger.With("remote", conn.RemoteAddr(), "op", opType)
+//	log.Info("copy finished", "bytes", n, "duration", time.Since(start))
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Level int32
+
+const (
+	DEBUG Level = iota
+	INFO
+	WARN
+	ERROR
+)
+
+var levelNames = map[Level]string{
+	DEBUG: "debug",
+	INFO:  "info",
+	WARN:  "warn",
+	ERROR: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func ParseLevel(level string) (Level, error) {
+	for l, name := range levelNames {
+		if name == strings.ToLower(level) {
+			return l, nil
+		}
+	}
+	return INFO, errors.New("unknown log level " + level)
+}
+
+type Format int32
+
+const (
+	TEXT Format = iota
+	JSON
+)
+
+func ParseFormat(format string) (Format, error) {
+	switch strings.ToLower(format) {
+	case "text":
+		return TEXT, nil
+	case "json":
+		return JSON, nil
+	default:
+		return TEXT, errors.New("unknown log format " + format)
+	}
+}
+
+var (
+	outLock sync.Mutex
+	out     io.Writer = os.Stdout
+	level             = int32(INFO)
+	format            = int32(TEXT)
+)
+
+// Configure sets the level and format from their names, as given on the
+// command line.
+func Configure(levelName string, formatName string) error {
+	l, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+	f, err := ParseFormat(formatName)
+	if err != nil {
+		return err
+	}
+	SetLevel(l)
+	SetFormat(f)
+	return nil
+}
+
+// SetOutput sets where log lines are written. The default is stdout.
+func SetOutput(w io.Writer) {
+	outLock.Lock()
+	defer outLock.Unlock()
+	out = w
+}
+
+// SetLevel drops lines below l from then on. It is safe to call while
+// logging from other goroutines.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+func SetFormat(f Format) {
+	atomic.StoreInt32(&format, int32(f))
+}
+
+func Enabled(l Level) bool {
+	return int32(l) >= atomic.LoadInt32(&level)
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// Logger adds its fields to every line it writes. The zero value, and a nil
+// *Logger, have none.
+type Logger struct {
+	fields []field
+}
+
+var root = &Logger{}
+
+// With returns a logger adding the key/value pairs kv to every line.
+func With(kv ...interface{}) *Logger {
+	return root.With(kv...)
+}
+
+func (l *Logger) With(kv ...interface{}) *Logger {
+	if l == nil {
+		l = root
+	}
+	fields := make([]field, len(l.fields), len(l.fields)+len(kv)/2)
+	copy(fields, l.fields)
+	return &Logger{append(fields, toFields(kv)...)}
+}
+
+func Debug(msg string, kv ...interface{}) { root.log(DEBUG, msg, kv) }
+func Info(msg string, kv ...interface{})  { root.log(INFO, msg, kv) }
+func Warn(msg string, kv ...interface{})  { root.log(WARN, msg, kv) }
+func Error(msg string, kv ...interface{}) { root.log(ERROR, msg, kv) }
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(DEBUG, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(INFO, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(WARN, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(ERROR, msg, kv) }
+
+func toFields(kv []interface{}) []field {
+	fields := make([]field, 0, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		if i+1 == len(kv) {
+			fields = append(fields, field{"!BADKEY", key})
+			break
+		}
+		fields = append(fields, field{key, kv[i+1]})
+	}
+	return fields
+}
+
+func (l *Logger) log(lvl Level, msg string, kv []interface{}) {
+	if !Enabled(lvl) {
+		return
+	}
+	if l == nil {
+		l = root
+	}
+	fields := append(l.fields[:len(l.fields):len(l.fields)], toFields(kv)...)
+	now := time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	buf := new(bytes.Buffer)
+	if Format(atomic.LoadInt32(&format)) == JSON {
+		writeJSON(buf, now, lvl, msg, fields)
+	} else {
+		writeText(buf, now, lvl, msg, fields)
+	}
+	outLock.Lock()
+	defer outLock.Unlock()
+	out.Write(buf.Bytes())
+}
+
+func writeText(buf *bytes.Buffer, now string, lvl Level, msg string, fields []field) {
+	fmt.Fprintf(buf, "%s %-5s %s", now, strings.ToUpper(lvl.String()), msg)
+	for _, f := range fields {
+		buf.WriteByte(' ')
+		buf.WriteString(f.key)
+		buf.WriteByte('=')
+		buf.WriteString(quoteIfNeeded(stringValue(f.value)))
+	}
+	buf.WriteByte('\n')
+}
+
+func writeJSON(buf *bytes.Buffer, now string, lvl Level, msg string, fields []field) {
+	buf.WriteString(`{"time":`)
+	writeJSONValue(buf, now)
+	buf.WriteString(`,"level":`)
+	writeJSONValue(buf, lvl.String())
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(buf, msg)
+	for _, f := range fields {
+		buf.WriteByte(',')
+		writeJSONValue(buf, f.key)
+		buf.WriteByte(':')
+		writeJSONValue(buf, jsonValue(f.value))
+	}
+	buf.WriteString("}\n")
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// jsonValue keeps numbers and booleans as they are and turns everything
+// else, such as errors, durations and addresses, into its string form.
+func jsonValue(v interface{}) interface{} {
+	switch v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, bool, string:
+		return v
+	default:
+		return stringValue(v)
+	}
+}
+
+func stringValue(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "<nil>"
+	case error:
+		return t.Error()
+	case fmt.Stringer:
+		return t.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func quoteIfNeeded(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
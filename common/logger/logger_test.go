@@ -0,0 +1,141 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// capture runs fn with lines written to a buffer at level l in format f,
+// and returns the lines without their timestamps.
+func capture(l Level, f Format, fn func()) []string {
+	buf := new(bytes.Buffer)
+	SetOutput(buf)
+	SetLevel(l)
+	SetFormat(f)
+	defer func() {
+		SetOutput(os.Stdout)
+		SetLevel(INFO)
+		SetFormat(TEXT)
+	}()
+	fn()
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		if f == TEXT {
+			line = line[strings.Index(line, " ")+1:]
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Level
+		wantErr bool
+	}{
+		{"debug", DEBUG, false},
+		{"info", INFO, false},
+		{"WARN", WARN, false},
+		{"Error", ERROR, false},
+		{"verbose", INFO, true},
+		{"", INFO, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLevel(tt.name)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseLevel(%q) = %s, %v, want %s, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		level   string
+		format  string
+		wantErr bool
+	}{
+		{"debug", "text", false},
+		{"error", "JSON", false},
+		{"loud", "text", true},
+		{"info", "xml", true},
+	}
+	defer SetLevel(INFO)
+	defer SetFormat(TEXT)
+	for _, tt := range tests {
+		if err := Configure(tt.level, tt.format); (err != nil) != tt.wantErr {
+			t.Errorf("Configure(%q, %q) error = %v, want error %v", tt.level, tt.format, err, tt.wantErr)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	tests := []struct {
+		name string
+		log  func()
+		want []string
+	}{
+		{"message only", func() { Info("started") }, []string{"INFO  started"}},
+		{"fields", func() { Warn("slow", "bytes", 10, "duration", 2*time.Second) },
+			[]string{"WARN  slow bytes=10 duration=2s"}},
+		{"quoted", func() { Error("failed", "error", errors.New("no space"), "path", "") },
+			[]string{`ERROR failed error="no space" path=""`}},
+		{"odd fields", func() { Info("odd", "bytes") }, []string{"INFO  odd !BADKEY=bytes"}},
+		{"below level", func() { Debug("hidden") }, nil},
+		{"with", func() {
+			log := With("remote", "10.0.0.1:5000").With("op", "copy")
+			log.Info("done", "bytes", 3)
+		}, []string{"INFO  done remote=10.0.0.1:5000 op=copy bytes=3"}},
+		{"with leaves its parent alone", func() {
+			log := With("remote", "a", "op", "copy")
+			log.With("part", 1).Info("one")
+			log.With("part", 2).Info("two")
+			log.Info("parent")
+		}, []string{"INFO  one remote=a op=copy part=1", "INFO  two remote=a op=copy part=2",
+			"INFO  parent remote=a op=copy"}},
+		{"nil logger", func() {
+			var log *Logger
+			log.Info("nil", "bytes", 1)
+		}, []string{"INFO  nil bytes=1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := capture(INFO, TEXT, tt.log)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("logged %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSON(t *testing.T) {
+	lines := capture(DEBUG, JSON, func() {
+		With("remote", "a").Debug("done", "bytes", 3, "durable", true, "error", errors.New("eof"), "took", time.Second)
+	})
+	if len(lines) != 1 {
+		t.Fatalf("logged %d lines, want 1", len(lines))
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatalf("logged %s, which is not JSON: %v", lines[0], err)
+	}
+	want := map[string]interface{}{
+		"level": "debug", "msg": "done", "remote": "a", "bytes": 3.0, "durable": true, "error": "eof", "took": "1s",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339, got["time"].(string)); err != nil {
+		t.Errorf("time %v does not parse: %v", got["time"], err)
+	}
+}
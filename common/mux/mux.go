@@ -0,0 +1,313 @@
+// Package mux carries many streams over a single connection, for clients
+// that cannot open a connection per op, eg. behind firewalls limiting the
+// connections of a source. Streams are net.Conns, so ops run over them as
+// they do over connections of their own.
+//
+// Every frame starts with a 9 byte header: the stream id (4 bytes), the
+// frame type (1 byte) and the length of the payload (4 bytes), little
+// endian. Data frames carry bytes of the stream, window frames 4 bytes
+// telling how many more bytes of it the receiver took in, and close frames
+// nothing, as the stream is done at the end that sent them. A stream opens
+// with an empty data frame. Clients pick odd ids and servers even ones,
+// each larger than the last. No end sends more bytes of a stream than the
+// window the other advertised, plus the window frames it received since.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	frameHeaderSize = 9
+	// maxFrameSize is the most data a frame carries, so that streams take
+	// turns on the connection.
+	maxFrameSize = 32 * 1024
+	// DefaultWindow is how many bytes of a stream are buffered before it
+	// reads them.
+	DefaultWindow = 256 * 1024
+	// MaxStreams is how many streams of a session may be open at once.
+	// Streams the peer opens past that are closed straight away.
+	MaxStreams = 1024
+)
+
+const (
+	frameData uint8 = iota
+	frameWindow
+	frameClose
+)
+
+var (
+	// ErrClosed is returned once the session is closed.
+	ErrClosed = errors.New("mux session closed")
+	// ErrStreamClosed is returned by writes to a stream the peer closed.
+	ErrStreamClosed = errors.New("mux stream closed by peer")
+	// ErrTooManyStreams is returned by Open when MaxStreams are open.
+	ErrTooManyStreams = errors.New("too many mux streams")
+	errProtocol       = errors.New("mux protocol violation")
+)
+
+// Session is one end of a connection carrying streams.
+type Session struct {
+	conn       net.Conn
+	window     uint32
+	peerWindow uint32
+	idle       time.Duration
+	writeLock  sync.Mutex
+	openLock   sync.Mutex
+	lock       sync.Mutex
+	streams    map[uint32]*Stream
+	nextId     uint32
+	lastPeerId uint32
+	accepted   chan *Stream
+	refusing   chan struct{}
+	refuseOnce sync.Once
+	done       chan struct{}
+	closeOnce  sync.Once
+	err        error
+}
+
+// NewSession runs a session over conn, once both ends agreed to. window is
+// the window this end advertised and peerWindow the one the peer did. The
+// session is closed when conn fails, a frame cannot be written within idle
+// or no stream was open for idle. 0 never times out.
+func NewSession(conn net.Conn, client bool, window uint32, peerWindow uint32, idle time.Duration) *Session {
+	s := &Session{conn: conn, window: window, peerWindow: peerWindow, idle: idle,
+		streams: make(map[uint32]*Stream), nextId: 2, accepted: make(chan *Stream, MaxStreams),
+		refusing: make(chan struct{}), done: make(chan struct{})}
+	if client {
+		s.nextId = 1
+	}
+	go s.readLoop()
+	return s
+}
+
+// Open opens a stream to the peer. It sends an empty frame right away, as
+// the peer takes streams with ids below the last it saw for closed ones,
+// and streams opened at once would otherwise send their first frames in
+// any order.
+func (s *Session) Open() (*Stream, error) {
+	s.openLock.Lock()
+	defer s.openLock.Unlock()
+	s.lock.Lock()
+	if s.IsClosed() {
+		s.lock.Unlock()
+		return nil, s.err
+	}
+	if len(s.streams) >= MaxStreams {
+		s.lock.Unlock()
+		return nil, ErrTooManyStreams
+	}
+	st := newStream(s, s.nextId)
+	s.nextId += 2
+	s.streams[st.id] = st
+	s.lock.Unlock()
+	if err := s.writeFrame(st.id, frameData, nil); err != nil {
+		s.forget(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept returns the next stream the peer opened, or an error once the
+// session is closed or refuses streams.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accepted:
+		return st, nil
+	case <-s.refusing:
+		return nil, ErrClosed
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+// Refuse closes streams the peer opens from now on, while those open carry
+// on, eg. to shut down gracefully.
+func (s *Session) Refuse() {
+	s.refuseOnce.Do(func() { close(s.refusing) })
+}
+
+// Close closes the session and with it all its streams.
+func (s *Session) Close() error {
+	s.closeWith(ErrClosed)
+	return nil
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done is closed once the session is.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Session) closeWith(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+func (s *Session) numStreams() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) forget(id uint32) {
+	s.lock.Lock()
+	delete(s.streams, id)
+	s.lock.Unlock()
+}
+
+func (s *Session) writeFrame(id uint32, frameType uint8, payload []byte) error {
+	header := make([]byte, frameHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], id)
+	header[4] = frameType
+	binary.LittleEndian.PutUint32(header[5:9], uint32(len(payload)))
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.IsClosed() {
+		return s.err
+	}
+	if s.idle > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.idle))
+	}
+	bufs := net.Buffers{header, payload}
+	if _, err := bufs.WriteTo(s.conn); err != nil {
+		s.closeWith(err)
+		return err
+	}
+	return nil
+}
+
+// readFull reads b off the connection. Running into the idle timeout only
+// fails it if no stream is open, as streams may be waiting for long ops.
+func (s *Session) readFull(b []byte) error {
+	for n := 0; n < len(b); {
+		if s.idle > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(s.idle))
+		}
+		m, err := s.conn.Read(b[n:])
+		n += m
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && s.numStreams() > 0 {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Session) readLoop() {
+	header := make([]byte, frameHeaderSize)
+	payload := make([]byte, maxFrameSize)
+	for {
+		if err := s.readFull(header); err != nil {
+			s.closeWith(err)
+			return
+		}
+		id := binary.LittleEndian.Uint32(header[0:4])
+		length := binary.LittleEndian.Uint32(header[5:9])
+		if length > maxFrameSize {
+			s.closeWith(errProtocol)
+			return
+		}
+		if err := s.readFull(payload[:length]); err != nil {
+			s.closeWith(err)
+			return
+		}
+		var err error
+		switch header[4] {
+		case frameData:
+			err = s.receive(id, payload[:length])
+		case frameWindow:
+			err = s.credit(id, payload[:length])
+		case frameClose:
+			if st := s.lookup(id); st != nil {
+				st.remoteClose()
+			}
+		default:
+			err = errProtocol
+		}
+		if err != nil {
+			s.closeWith(err)
+			return
+		}
+	}
+}
+
+func (s *Session) lookup(id uint32) *Stream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streams[id]
+}
+
+// stream returns the open stream id, opening it if the peer just did.
+func (s *Session) stream(id uint32) *Stream {
+	s.lock.Lock()
+	if st, ok := s.streams[id]; ok {
+		s.lock.Unlock()
+		return st
+	}
+	// ours, or the peer's that are closed
+	if id%2 == s.nextId%2 || id <= s.lastPeerId {
+		s.lock.Unlock()
+		return nil
+	}
+	s.lastPeerId = id
+	refused := len(s.streams) >= MaxStreams
+	select {
+	case <-s.refusing:
+		refused = true
+	default:
+	}
+	if refused {
+		s.lock.Unlock()
+		s.writeFrame(id, frameClose, nil)
+		return nil
+	}
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.accepted <- st
+	s.lock.Unlock()
+	return st
+}
+
+func (s *Session) receive(id uint32, data []byte) error {
+	st := s.stream(id)
+	if st == nil {
+		return nil
+	}
+	return st.push(data)
+}
+
+func (s *Session) credit(id uint32, payload []byte) error {
+	if len(payload) != 4 {
+		return errProtocol
+	}
+	if st := s.lookup(id); st != nil {
+		st.credit(binary.LittleEndian.Uint32(payload))
+	}
+	return nil
+}
+
+// timeoutError is returned by reads and writes past the deadline of a
+// stream.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
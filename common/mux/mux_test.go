@@ -0,0 +1,317 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sessionPair returns a client and a server session talking over a pipe,
+// each advertising window.
+func sessionPair(window uint32, idle time.Duration) (*Session, *Session) {
+	c, s := net.Pipe()
+	return NewSession(c, true, window, window, idle), NewSession(s, false, window, window, idle)
+}
+
+func testData(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 31)
+	}
+	return b
+}
+
+func TestStreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		streams int
+		size    int
+		window  uint32
+	}{
+		{"one stream", 1, 1000, DefaultWindow},
+		{"larger than a frame", 1, 3*maxFrameSize + 7, DefaultWindow},
+		{"larger than the window", 1, 100000, 4096},
+		{"many streams", 20, 50000, 8192},
+		{"empty", 3, 0, DefaultWindow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := sessionPair(tt.window, 0)
+			defer client.Close()
+			defer server.Close()
+			// The server echoes every stream back, so data flows both ways
+			// at once.
+			go func() {
+				for {
+					st, err := server.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						io.Copy(st, st)
+						st.Close()
+					}()
+				}
+			}()
+			var wg sync.WaitGroup
+			for i := 0; i < tt.streams; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					st, err := client.Open()
+					if err != nil {
+						t.Errorf("Open() error = %v", err)
+						return
+					}
+					defer st.Close()
+					data := testData(tt.size + i)
+					go st.Write(data)
+					got := make([]byte, len(data))
+					if _, err := io.ReadFull(st, got); err != nil {
+						t.Errorf("stream %d: reading the echo: %v", i, err)
+						return
+					}
+					if !bytes.Equal(got, data) {
+						t.Errorf("stream %d: echoed bytes differ", i)
+					}
+				}(i)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// TestFlowControl writes more than the window to a stream the peer does
+// not read, which must stop at the window until the peer reads.
+func TestFlowControl(t *testing.T) {
+	const window = 1000
+	tests := []struct {
+		name string
+		// read is how much the peer reads before the second write.
+		read      int
+		wantWrite int
+	}{
+		{"nothing read", 0, 0},
+		{"less than half the window read", window/2 - 1, 0},
+		{"half the window read", window / 2, window / 2},
+		{"all read", window, window},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := sessionPair(window, 0)
+			defer client.Close()
+			defer server.Close()
+			st, err := client.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			st.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+			n, err := st.Write(testData(3 * window))
+			if n != window {
+				t.Fatalf("Write() wrote %d bytes, want the %d byte window", n, window)
+			}
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				t.Fatalf("Write() past the window error = %v, want a timeout", err)
+			}
+			peer, err := server.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(peer, make([]byte, tt.read)); err != nil {
+				t.Fatal(err)
+			}
+			st.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+			if n, _ := st.Write(testData(window)); n != tt.wantWrite {
+				t.Errorf("Write() after the peer read %d bytes wrote %d, want %d", tt.read, n, tt.wantWrite)
+			}
+		})
+	}
+}
+
+func frame(id uint32, frameType uint8, payload []byte) []byte {
+	header := make([]byte, frameHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], id)
+	header[4] = frameType
+	binary.LittleEndian.PutUint32(header[5:9], uint32(len(payload)))
+	return append(header, payload...)
+}
+
+// TestPeerFrames sends raw frames to a server session with a 100 byte
+// window.
+func TestPeerFrames(t *testing.T) {
+	tests := []struct {
+		name       string
+		frames     [][]byte
+		wantClosed bool
+		// wantRead is what the stream the frames opened holds, if any.
+		wantRead string
+	}{
+		{"data", [][]byte{frame(1, frameData, []byte("hello")), frame(1, frameData, []byte(" there"))}, false,
+			"hello there"},
+		{"up to the window", [][]byte{frame(1, frameData, make([]byte, 100))}, false, string(make([]byte, 100))},
+		{"past the window", [][]byte{frame(1, frameData, make([]byte, 60)), frame(1, frameData, make([]byte, 60))},
+			true, ""},
+		{"frame too large", [][]byte{frame(1, frameData, make([]byte, maxFrameSize+1))}, true, ""},
+		{"unknown frame type", [][]byte{frame(1, 7, nil)}, true, ""},
+		{"bad window frame", [][]byte{frame(1, frameData, []byte("x")), frame(1, frameWindow, []byte{1, 2})}, true,
+			""},
+		{"stream of the server's ids", [][]byte{frame(2, frameData, []byte("x"))}, false, ""},
+		{"window for no stream", [][]byte{frame(5, frameWindow, []byte{1, 0, 0, 0})}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s := net.Pipe()
+			defer c.Close()
+			server := NewSession(s, false, 100, 100, 0)
+			defer server.Close()
+			go io.Copy(ioutil.Discard, c)
+			for _, f := range tt.frames {
+				if _, err := c.Write(f); err != nil {
+					break
+				}
+			}
+			// a frame after, to know the ones before were handled
+			c.Write(frame(99, frameWindow, []byte{0, 0, 0, 0}))
+			select {
+			case <-server.Done():
+			case <-time.After(50 * time.Millisecond):
+			}
+			if server.IsClosed() != tt.wantClosed {
+				t.Fatalf("session closed = %v, want %v", server.IsClosed(), tt.wantClosed)
+			}
+			if tt.wantRead == "" {
+				return
+			}
+			st, err := server.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(tt.wantRead))
+			if _, err := io.ReadFull(st, got); err != nil || string(got) != tt.wantRead {
+				t.Errorf("stream holds %q, %v, want %q", got, err, tt.wantRead)
+			}
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	tests := []struct {
+		name string
+		// close closes the stream from the peer or the session.
+		close         func(client *Session, server *Session, peer *Stream)
+		wantReadErr   error
+		wantWriteErr  error
+		wantAcceptErr error
+	}{
+		{"peer closes stream", func(c *Session, s *Session, peer *Stream) { peer.Close() }, io.EOF, ErrStreamClosed,
+			nil},
+		{"session closed", func(c *Session, s *Session, peer *Stream) { c.Close() }, ErrClosed, ErrClosed, ErrClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := sessionPair(DefaultWindow, 0)
+			defer client.Close()
+			defer server.Close()
+			st, err := client.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			st.Write([]byte("x"))
+			peer, err := server.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.close(client, server, peer)
+			time.Sleep(20 * time.Millisecond)
+			if _, err := st.Read(make([]byte, 1)); err != tt.wantReadErr {
+				t.Errorf("Read() error = %v, want %v", err, tt.wantReadErr)
+			}
+			if _, err := st.Write([]byte("y")); err != tt.wantWriteErr {
+				t.Errorf("Write() error = %v, want %v", err, tt.wantWriteErr)
+			}
+			if tt.wantAcceptErr != nil {
+				if _, err := client.Accept(); err != tt.wantAcceptErr {
+					t.Errorf("Accept() error = %v, want %v", err, tt.wantAcceptErr)
+				}
+			}
+			st.Close()
+			if _, err := st.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+				t.Errorf("Read() after Close() error = %v, want %v", err, io.ErrClosedPipe)
+			}
+		})
+	}
+}
+
+func TestRefuse(t *testing.T) {
+	client, server := sessionPair(DefaultWindow, 0)
+	defer client.Close()
+	defer server.Close()
+	server.Refuse()
+	if _, err := server.Accept(); err != ErrClosed {
+		t.Errorf("Accept() once refusing error = %v, want %v", err, ErrClosed)
+	}
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Write([]byte("x"))
+	st.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := st.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() of a refused stream error = %v, want %v", err, io.EOF)
+	}
+	if server.IsClosed() {
+		t.Error("refusing streams closed the session")
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	client, server := sessionPair(DefaultWindow, 0)
+	defer client.Close()
+	defer server.Close()
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err = st.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Read() past the deadline error = %v, want a timeout", err)
+	}
+}
+
+func TestIdle(t *testing.T) {
+	tests := []struct {
+		name       string
+		openStream bool
+		wantClosed bool
+	}{
+		{"no streams", false, true},
+		{"stream open", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := sessionPair(DefaultWindow, 50*time.Millisecond)
+			defer client.Close()
+			defer server.Close()
+			if tt.openStream {
+				st, err := client.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				st.Write([]byte("x"))
+				if _, err := server.Accept(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			time.Sleep(200 * time.Millisecond)
+			if client.IsClosed() != tt.wantClosed || server.IsClosed() != tt.wantClosed {
+				t.Errorf("sessions closed = %v and %v, want %v", client.IsClosed(), server.IsClosed(), tt.wantClosed)
+			}
+		})
+	}
+}
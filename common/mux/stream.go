@@ -0,0 +1,216 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream is a connection carried by a session.
+type Stream struct {
+	session       *Session
+	id            uint32
+	lock          sync.Mutex
+	buf           bytes.Buffer
+	unacked       uint32 // bytes read but not yet credited to the peer
+	sendWindow    uint32
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closed        bool
+	remoteClosed  bool
+	readable      chan struct{}
+	writable      chan struct{}
+}
+
+var _ net.Conn = (*Stream)(nil)
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{session: s, id: id, sendWindow: s.peerWindow,
+		readable: make(chan struct{}, 1), writable: make(chan struct{}, 1)}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push buffers data received for the stream.
+func (st *Stream) push(data []byte) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.closed {
+		return nil
+	}
+	if uint64(st.buf.Len())+uint64(len(data)) > uint64(st.session.window) {
+		return errProtocol
+	}
+	st.buf.Write(data)
+	notify(st.readable)
+	return nil
+}
+
+func (st *Stream) credit(n uint32) {
+	st.lock.Lock()
+	st.sendWindow += n
+	st.lock.Unlock()
+	notify(st.writable)
+}
+
+func (st *Stream) remoteClose() {
+	st.lock.Lock()
+	st.remoteClosed = true
+	st.lock.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+}
+
+// wait waits for ch to be notified until deadline.
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return timeoutError{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return timeoutError{}
+	case <-st.session.done:
+		return st.session.err
+	}
+}
+
+// Read reads what the peer sent, and io.EOF once the peer closed the
+// stream and all of it was read. The peer is credited with what was read
+// once that is half the window.
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.lock.Lock()
+		if st.closed {
+			st.lock.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(b)
+			st.unacked += uint32(n)
+			credit := uint32(0)
+			if st.unacked >= st.session.window/2 {
+				credit, st.unacked = st.unacked, 0
+			}
+			st.lock.Unlock()
+			if credit > 0 {
+				payload := make([]byte, 4)
+				binary.LittleEndian.PutUint32(payload, credit)
+				st.session.writeFrame(st.id, frameWindow, payload)
+			}
+			return n, nil
+		}
+		if st.remoteClosed {
+			st.lock.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.lock.Unlock()
+		if err := st.wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends b in frames, as the window of the peer allows.
+func (st *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		st.lock.Lock()
+		if st.closed {
+			st.lock.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if st.remoteClosed {
+			st.lock.Unlock()
+			return written, ErrStreamClosed
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.lock.Unlock()
+			if err := st.wait(st.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := len(b)
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		if uint32(n) > st.sendWindow {
+			n = int(st.sendWindow)
+		}
+		st.sendWindow -= uint32(n)
+		st.lock.Unlock()
+		if err := st.session.writeFrame(st.id, frameData, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close closes the stream at both ends.
+func (st *Stream) Close() error {
+	st.lock.Lock()
+	if st.closed {
+		st.lock.Unlock()
+		return nil
+	}
+	st.closed = true
+	remoteClosed := st.remoteClosed
+	st.lock.Unlock()
+	st.session.forget(st.id)
+	notify(st.readable)
+	notify(st.writable)
+	if remoteClosed {
+		return nil
+	}
+	return st.session.writeFrame(st.id, frameClose, nil)
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.readDeadline = t
+	st.lock.Unlock()
+	notify(st.readable)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.writeDeadline = t
+	st.lock.Unlock()
+	notify(st.writable)
+	return nil
+}
@@ -4,13 +4,21 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
-	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 const NumHeaderBytes = 512
 
+// MaxErrorMessageLen is the longest message an error response carries.
+const MaxErrorMessageLen = 255
+
+// errorFlagsOffset is where the flags byte of an error response sits, past
+// the longest message, so messages of any length can come before it.
+const errorFlagsOffset = 4 + MaxErrorMessageLen
+
 type OpType int
 
 const (
@@ -21,18 +29,86 @@ const (
 	MultiPartCopyPartRequestOpType
 	MultiPartCopyCompleteOpType
 	MultiPartCopySuccessResponseOpType
+	MultiPartCopyAbortOpType
+	MultiPartCopyAbortSuccessResponseOpType
 	ErrorResponseOpType
+	StatRequestOpType
+	StatResponseOpType
+	ReadRequestOpType
+	ReadResponseOpType
+	MuxOpType
+	MuxAcceptOpType
+	RelayRequestOpType
+	RelayProgressOpType
+	RelaySuccessResponseOpType
+	DeleteRequestOpType
+	DeleteSuccessResponseOpType
+	ListRequestOpType
+	ListEntryOpType
+	ListEndOpType
 	Unknown
 )
+
+var opTypeNames = map[OpType]string{
+	SingleCopyOpType:                        "single-copy",
+	SingleCopySuccessResponseOpType:         "single-copy-success",
+	MultiPartCopyInitOpType:                 "multipart-init",
+	MultiPartCopyInitSuccessResponseOpType:  "multipart-init-success",
+	MultiPartCopyPartRequestOpType:          "multipart-part",
+	MultiPartCopyCompleteOpType:             "multipart-complete",
+	MultiPartCopySuccessResponseOpType:      "multipart-success",
+	MultiPartCopyAbortOpType:                "multipart-abort",
+	MultiPartCopyAbortSuccessResponseOpType: "multipart-abort-success",
+	ErrorResponseOpType:                     "error",
+	StatRequestOpType:                       "stat",
+	StatResponseOpType:                      "stat-response",
+	ReadRequestOpType:                       "read",
+	ReadResponseOpType:                      "read-response",
+	MuxOpType:                               "mux",
+	MuxAcceptOpType:                         "mux-accept",
+	RelayRequestOpType:                      "relay",
+	RelayProgressOpType:                     "relay-progress",
+	RelaySuccessResponseOpType:              "relay-success",
+	DeleteRequestOpType:                     "delete",
+	DeleteSuccessResponseOpType:             "delete-success",
+	ListRequestOpType:                       "list",
+	ListEntryOpType:                         "list-entry",
+	ListEndOpType:                           "list-end",
+	Unknown:                                 "unknown",
+}
+
+func (o OpType) String() string {
+	if name, ok := opTypeNames[o]; ok {
+		return name
+	}
+	return "unknown"
+}
+
 const (
-	singleCopyRequestOpCode            = "SC"
-	singleCopySuccessResponseOpCode    = "SS"
-	multiPartInitRequestOpCode         = "MI"
-	multiPartInitSuccessResponseOpCode = "MS"
-	multiPartCopyPartRequestOpCode     = "MC"
-	multiPartCompleteRequestOpCode     = "MT"
-	multiPartCopySuccessResponseOpCode = "MM"
-	errorResponseOpCode                = "ER"
+	singleCopyRequestOpCode             = "SC"
+	singleCopySuccessResponseOpCode     = "SS"
+	multiPartInitRequestOpCode          = "MI"
+	multiPartInitSuccessResponseOpCode  = "MS"
+	multiPartCopyPartRequestOpCode      = "MC"
+	multiPartCompleteRequestOpCode      = "MT"
+	multiPartCopySuccessResponseOpCode  = "MM"
+	multiPartAbortRequestOpCode         = "AB"
+	multiPartAbortSuccessResponseOpCode = "AS"
+	errorResponseOpCode                 = "ER"
+	statRequestOpCode                   = "ST"
+	statResponseOpCode                  = "SR"
+	readRequestOpCode                   = "RD"
+	readResponseOpCode                  = "RR"
+	muxRequestOpCode                    = "MX"
+	muxAcceptOpCode                     = "MA"
+	relayRequestOpCode                  = "RL"
+	relayProgressOpCode                 = "RP"
+	relaySuccessResponseOpCode          = "RS"
+	deleteRequestOpCode                 = "DL"
+	deleteSuccessResponseOpCode         = "DS"
+	listRequestOpCode                   = "LS"
+	listEntryOpCode                     = "LE"
+	listEndOpCode                       = "LD"
 )
 
 type ErrType int8
@@ -44,8 +120,35 @@ const (
 	ErrorWritingPart
 	ErrorCopyIdNotFound
 	ErrorUnknownOp
+	ErrorChecksumMismatch
+	ErrorMissingParts
+	ErrorInsufficientSpace
+	ErrorFileTooLarge
+	ErrorFileNotFound
+	ErrorReadingFile
+	ErrorInvalidRange
+	ErrorRejected
+	ErrorAccessDenied
+	ErrorQuotaExceeded
+	ErrorServerBusy
+	ErrorTimeout
+	ErrorUnknownPeer
+	ErrorRelayFailed
+	ErrorDeletingFile
+)
+
+// Flags carried in the single flags byte of request and response headers.
+const (
+	// DurableFlag in a request asks the server to fsync the file and its
+	// parent directory before acknowledging. In a success response it tells
+	// the client that the server actually did so.
+	DurableFlag uint8 = 1 << iota
 )
 
+// RetryableFlag in an error response tells the client that the same request
+// may succeed if sent again later, eg. once another copy to the path ends.
+const RetryableFlag uint8 = 1 << 0
+
 var ErrorsMap = map[ErrType]string{
 	ErrorParsingHeader:     "error parsing headers",
 	ErrorCopyOpInProgress:  "copy operation already in progress",
@@ -53,6 +156,88 @@ var ErrorsMap = map[ErrType]string{
 	ErrorWritingPart:       "error writing part at server",
 	ErrorCopyIdNotFound:    "copyId supplied by the client is not known",
 	ErrorUnknownOp:         "Unknown operation",
+	ErrorChecksumMismatch:  "checksum computed at server does not match the client's",
+	ErrorMissingParts:      "server did not receive all parts of the multipart copy",
+	ErrorInsufficientSpace: "insufficient space at server",
+	ErrorFileTooLarge:      "file is larger than the server allows",
+	ErrorFileNotFound:      "file not found at server",
+	ErrorReadingFile:       "error reading file at server",
+	ErrorInvalidRange:      "requested range is outside the file",
+	ErrorRejected:          "copy rejected by server",
+	ErrorAccessDenied:      "access denied by server",
+	ErrorQuotaExceeded:     "quota exceeded at server",
+	ErrorServerBusy:        "server busy",
+	ErrorTimeout:           "timed out at server",
+	ErrorUnknownPeer:       "peer is not known to server",
+	ErrorRelayFailed:       "relay to peer failed",
+	ErrorDeletingFile:      "error deleting file at server",
+}
+
+var errTypeNames = map[ErrType]string{
+	ErrorParsingHeader:     "parsing-header",
+	ErrorCopyOpInProgress:  "copy-in-progress",
+	ErrorWritingSingleCopy: "writing-single-copy",
+	ErrorWritingPart:       "writing-part",
+	ErrorCopyIdNotFound:    "copy-id-not-found",
+	ErrorUnknownOp:         "unknown-op",
+	ErrorChecksumMismatch:  "checksum-mismatch",
+	ErrorMissingParts:      "missing-parts",
+	ErrorInsufficientSpace: "insufficient-space",
+	ErrorFileTooLarge:      "file-too-large",
+	ErrorFileNotFound:      "file-not-found",
+	ErrorReadingFile:       "reading-file",
+	ErrorInvalidRange:      "invalid-range",
+	ErrorRejected:          "rejected",
+	ErrorAccessDenied:      "access-denied",
+	ErrorQuotaExceeded:     "quota-exceeded",
+	ErrorServerBusy:        "server-busy",
+	ErrorTimeout:           "timeout",
+	ErrorUnknownPeer:       "unknown-peer",
+	ErrorRelayFailed:       "relay-failed",
+	ErrorDeletingFile:      "deleting-file",
+}
+
+// ServerError is an error response received from the server.
+type ServerError struct {
+	Type ErrType
+	// Message is the cause the server gives for the error, eg. "permission
+	// denied", or why a hook rejected a copy. It may be empty.
+	Message string
+	// Retryable is set by the server when sending the request again later
+	// may succeed.
+	Retryable bool
+	// RetryAfter is how long the server asks the client to wait before
+	// retrying, 0 if it does not say.
+	RetryAfter time.Duration
+}
+
+func (e *ServerError) Error() string {
+	msg, ok := ErrorsMap[e.Type]
+	if !ok {
+		msg = "unknown error " + e.Type.String()
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.RetryAfter > 0 {
+		msg += ", retry after " + e.RetryAfter.String()
+	}
+	return msg
+}
+
+// NewServerError returns the error carried by an ErrorResponseOpType header.
+func NewServerError(b []byte) *ServerError {
+	retryAfter := binary.LittleEndian.Uint32(b[errorFlagsOffset+1 : errorFlagsOffset+5])
+	return &ServerError{ParseErrorType(b), ParseErrorMessage(b), b[errorFlagsOffset]&RetryableFlag != 0,
+		time.Duration(retryAfter) * time.Millisecond}
+}
+
+// String returns a short name for the error type, for logs and metric labels.
+func (e ErrType) String() string {
+	if name, ok := errTypeNames[e]; ok {
+		return name
+	}
+	return "unknown"
 }
 
 func GetOp(b []byte) OpType {
@@ -71,8 +256,40 @@ func GetOp(b []byte) OpType {
 		return MultiPartCopyCompleteOpType
 	case multiPartCopySuccessResponseOpCode:
 		return MultiPartCopySuccessResponseOpType
+	case multiPartAbortRequestOpCode:
+		return MultiPartCopyAbortOpType
+	case multiPartAbortSuccessResponseOpCode:
+		return MultiPartCopyAbortSuccessResponseOpType
 	case errorResponseOpCode:
 		return ErrorResponseOpType
+	case statRequestOpCode:
+		return StatRequestOpType
+	case statResponseOpCode:
+		return StatResponseOpType
+	case readRequestOpCode:
+		return ReadRequestOpType
+	case readResponseOpCode:
+		return ReadResponseOpType
+	case muxRequestOpCode:
+		return MuxOpType
+	case muxAcceptOpCode:
+		return MuxAcceptOpType
+	case relayRequestOpCode:
+		return RelayRequestOpType
+	case relayProgressOpCode:
+		return RelayProgressOpType
+	case relaySuccessResponseOpCode:
+		return RelaySuccessResponseOpType
+	case deleteRequestOpCode:
+		return DeleteRequestOpType
+	case deleteSuccessResponseOpCode:
+		return DeleteSuccessResponseOpType
+	case listRequestOpCode:
+		return ListRequestOpType
+	case listEntryOpCode:
+		return ListEntryOpType
+	case listEndOpCode:
+		return ListEndOpType
 	default:
 		return Unknown
 	}
@@ -83,13 +300,19 @@ func GetOp(b []byte) OpType {
 type SingleCopyOp struct {
 	filePath      string
 	contentLength uint64
+	flags         uint8
 }
 
 func NewSingleCopyOp(b []byte) *SingleCopyOp {
 	//TODO : fix endian, taking little for my machine
 	contentLength := binary.LittleEndian.Uint64(b[2:10])
 	pathLen := uint8(b[10])
-	return &SingleCopyOp{string(b[11 : 11+pathLen]), contentLength}
+	flags := b[11+int(pathLen)]
+	return &SingleCopyOp{string(b[11 : 11+pathLen]), contentLength, flags}
+}
+
+func (sco *SingleCopyOp) IsDurable() bool {
+	return sco.flags&DurableFlag != 0
 }
 
 func (sco *SingleCopyOp) GetContentLength() uint64 {
@@ -100,44 +323,80 @@ func (sco *SingleCopyOp) GetFilePath() string {
 	return sco.filePath
 }
 
+// SetFilePath replaces the path sent by the client, eg. with where it is
+// stored at the server.
+func (sco *SingleCopyOp) SetFilePath(path string) {
+	sco.filePath = path
+}
+
 ///////////////////////////////////////////////////////////
 
 type SingleCopySuccessResponseOp struct {
-	Md5 string
+	Md5   string
+	flags uint8
 }
 
 func NewSingleCopySuccessResponseOp(b []byte) *SingleCopySuccessResponseOp {
 	buf := bytes.NewReader(b[2 : 2+16])
 	md5 := make([]byte, 16)
 	binary.Read(buf, binary.LittleEndian, &md5)
-	return &SingleCopySuccessResponseOp{hex.EncodeToString(md5)}
+	return &SingleCopySuccessResponseOp{hex.EncodeToString(md5), b[2+16]}
 }
 
 func (nsr *SingleCopySuccessResponseOp) GetCsum() string {
 	return nsr.Md5
 }
 
+func (nsr *SingleCopySuccessResponseOp) IsDurable() bool {
+	return nsr.flags&DurableFlag != 0
+}
+
 ///////////////////////////////////////////////////////////
 
 type MultiPartCopyOp struct {
 	filePath string
 	state    MultiPartOpState
 	copyId   uuid.UUID
+	fileSize uint64
 }
 
-type MultiPartOpState int
+type MultiPartOpState int32
 
 const (
 	INITIALIZING MultiPartOpState = iota
 	INITIATED
 	INPROGRESS
 	COMPLETED
+	// STITCHING and ABORTED are appended so the earlier values stay put.
+	STITCHING
+	ABORTED
 )
 
+var multiPartOpStateNames = map[MultiPartOpState]string{
+	INITIALIZING: "initializing",
+	INITIATED:    "initiated",
+	INPROGRESS:   "in-progress",
+	COMPLETED:    "completed",
+	STITCHING:    "stitching",
+	ABORTED:      "aborted",
+}
+
+func (s MultiPartOpState) String() string {
+	if name, ok := multiPartOpStateNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
 func NewMultiPartCopyOp(b []byte) *MultiPartCopyOp {
 	pathLen := uint8(b[2])
 	id, _ := uuid.NewUUID()
-	return &MultiPartCopyOp{string(b[3 : 3+pathLen]), INITIALIZING, id}
+	fileSize := binary.LittleEndian.Uint64(b[3+int(pathLen) : 3+int(pathLen)+8])
+	return &MultiPartCopyOp{string(b[3 : 3+pathLen]), INITIALIZING, id, fileSize}
+}
+
+func (mco *MultiPartCopyOp) GetFileSize() uint64 {
+	return mco.fileSize
 }
 
 func (mco *MultiPartCopyOp) GetCopyId() uuid.UUID {
@@ -148,18 +407,41 @@ func (mco *MultiPartCopyOp) GetFilePath() string {
 	return mco.filePath
 }
 
+func (mco *MultiPartCopyOp) SetFilePath(path string) {
+	mco.filePath = path
+}
+
 func (mco *MultiPartCopyOp) SetState(state MultiPartOpState) {
-	mco.state = state
+	atomic.StoreInt32((*int32)(&mco.state), int32(state))
 }
 
 func (mco *MultiPartCopyOp) GetState() MultiPartOpState {
-	return mco.state
+	return MultiPartOpState(atomic.LoadInt32((*int32)(&mco.state)))
+}
+
+// CompareAndSwapState moves the copy to state new only if it is in state
+// old, so that two requests cannot both move it on from the same state.
+func (mco *MultiPartCopyOp) CompareAndSwapState(old MultiPartOpState, new MultiPartOpState) bool {
+	return atomic.CompareAndSwapInt32((*int32)(&mco.state), int32(old), int32(new))
 }
 
 ///////////////////////////////////////////////////////////
 
+// PartLimits are what a server takes for the parts of a multipart copy,
+// sent along with the copy id. Zero values are not limited, so servers
+// that do not send them look unlimited.
+type PartLimits struct {
+	// MaxParallel is how many parts the server serves at once.
+	MaxParallel uint32
+	// MinSize applies to every part but the last.
+	MinSize  uint64
+	MaxSize  uint64
+	MaxParts uint64
+}
+
 type MultiPartCopyInitSuccessResponseOp struct {
 	copyId uuid.UUID
+	limits PartLimits
 }
 
 func NewMultiPartCopyInitSuccessResponseOp(b []byte) (*MultiPartCopyInitSuccessResponseOp, error) {
@@ -167,80 +449,423 @@ func NewMultiPartCopyInitSuccessResponseOp(b []byte) (*MultiPartCopyInitSuccessR
 	if err != nil {
 		return nil, err
 	}
-	return &MultiPartCopyInitSuccessResponseOp{uuid}, nil
+	limits := PartLimits{
+		MaxParallel: binary.LittleEndian.Uint32(b[18:22]),
+		MinSize:     binary.LittleEndian.Uint64(b[22:30]),
+		MaxSize:     binary.LittleEndian.Uint64(b[30:38]),
+		MaxParts:    binary.LittleEndian.Uint64(b[38:46]),
+	}
+	return &MultiPartCopyInitSuccessResponseOp{uuid, limits}, nil
 }
 
 func (nmir *MultiPartCopyInitSuccessResponseOp) GetCopyId() uuid.UUID {
 	return nmir.copyId
 }
 
+func (nmir *MultiPartCopyInitSuccessResponseOp) GetPartLimits() PartLimits {
+	return nmir.limits
+}
+
 ///////////////////////////////////////////////////////////
 
-func NewMultiPartCopyPartOp(b []byte, copyId string, scratchDir string) *SingleCopyOp {
+// NewMultiPartCopyPartOp reads a part as a single copy with no path, as
+// parts are stored by the multipart copy they belong to.
+func NewMultiPartCopyPartOp(b []byte) *SingleCopyOp {
 	//TODO : fix endian, taking little for my machine
-	partNum := binary.LittleEndian.Uint64(b[2+16 : 2+16+8])
-	partNumStr := strconv.FormatUint(partNum, 10)
 	contentLength := binary.LittleEndian.Uint64(b[2+16+8 : 2+16+8+8])
-	return &SingleCopyOp{scratchDir + copyId + "/" + partNumStr, contentLength}
+	return &SingleCopyOp{"", contentLength, 0}
+}
+
+///////////////////////////////////////////////////////////
+
+type MultiPartCopyCompleteOp struct {
+	copyId   string
+	fileSize uint64
+	flags    uint8
+	numParts uint64
+	csum     []byte
+}
+
+func NewMultiPartCopyCompleteOp(b []byte) (*MultiPartCopyCompleteOp, error) {
+	copyId, err := ParseCopyId(b)
+	if err != nil {
+		return nil, err
+	}
+	fileSize := binary.LittleEndian.Uint64(b[2+16 : 2+16+8])
+	flags := b[2+16+8]
+	numParts := binary.LittleEndian.Uint64(b[2+16+8+1 : 2+16+8+1+8])
+	csum := make([]byte, 16)
+	copy(csum, b[2+16+8+1+8:2+16+8+1+8+16])
+	return &MultiPartCopyCompleteOp{copyId, fileSize, flags, numParts, csum}, nil
+}
+
+func (mcc *MultiPartCopyCompleteOp) GetNumParts() uint64 {
+	return mcc.numParts
+}
+
+func (mcc *MultiPartCopyCompleteOp) GetCsum() []byte {
+	return mcc.csum
+}
+
+func (mcc *MultiPartCopyCompleteOp) GetCopyId() string {
+	return mcc.copyId
+}
+
+func (mcc *MultiPartCopyCompleteOp) GetFileSize() uint64 {
+	return mcc.fileSize
+}
+
+func (mcc *MultiPartCopyCompleteOp) IsDurable() bool {
+	return mcc.flags&DurableFlag != 0
+}
+
+///////////////////////////////////////////////////////////
+
+type StatOp struct {
+	filePath string
+}
+
+func NewStatOp(b []byte) *StatOp {
+	pathLen := uint8(b[2])
+	return &StatOp{string(b[3 : 3+pathLen])}
+}
+
+func (so *StatOp) GetFilePath() string {
+	return so.filePath
+}
+
+func (so *StatOp) SetFilePath(path string) {
+	so.filePath = path
+}
+
+///////////////////////////////////////////////////////////
+
+type StatResponseOp struct {
+	fileSize uint64
+	modTime  int64
+}
+
+func NewStatResponseOp(b []byte) *StatResponseOp {
+	fileSize := binary.LittleEndian.Uint64(b[2:10])
+	modTime := int64(binary.LittleEndian.Uint64(b[10:18]))
+	return &StatResponseOp{fileSize, modTime}
+}
+
+func (sr *StatResponseOp) GetFileSize() uint64 {
+	return sr.fileSize
+}
+
+// GetModTime returns the modification time in nanoseconds since the epoch.
+func (sr *StatResponseOp) GetModTime() int64 {
+	return sr.modTime
+}
+
+///////////////////////////////////////////////////////////
+
+type ReadOp struct {
+	filePath string
+	offset   uint64
+	length   uint64
+}
+
+func NewReadOp(b []byte) *ReadOp {
+	offset := binary.LittleEndian.Uint64(b[2:10])
+	length := binary.LittleEndian.Uint64(b[10:18])
+	pathLen := uint8(b[18])
+	return &ReadOp{string(b[19 : 19+pathLen]), offset, length}
+}
+
+func (ro *ReadOp) GetFilePath() string {
+	return ro.filePath
+}
+
+func (ro *ReadOp) SetFilePath(path string) {
+	ro.filePath = path
+}
+
+func (ro *ReadOp) GetOffset() uint64 {
+	return ro.offset
+}
+
+func (ro *ReadOp) GetLength() uint64 {
+	return ro.length
+}
+
+///////////////////////////////////////////////////////////
+
+func ParseReadResponseLength(b []byte) uint64 {
+	return binary.LittleEndian.Uint64(b[2:10])
+}
+
+///////////////////////////////////////////////////////////
+
+// MuxOp asks to carry many streams over the connection instead of a single
+// op, and a MuxAcceptOpType response agrees to. Window is how many bytes of
+// a stream the sender buffers for it before it reads them.
+type MuxOp struct {
+	window uint32
+}
+
+func NewMuxOp(b []byte) *MuxOp {
+	return &MuxOp{binary.LittleEndian.Uint32(b[2:6])}
+}
+
+func (mo *MuxOp) GetWindow() uint32 {
+	return mo.window
+}
+
+///////////////////////////////////////////////////////////
+
+// RelayOp asks the server to copy a file it has to a peer, a server named
+// in its configuration. The server answers with RelayProgressOpType headers
+// as the copy goes, and then a RelaySuccessResponseOpType header carrying
+// the checksum the peer computed, or an error.
+type RelayOp struct {
+	filePath string
+	peer     string
+	peerPath string
+	flags    uint8
+}
+
+func NewRelayOp(b []byte) *RelayOp {
+	flags := b[2]
+	filePath, off := relayString(b, 3)
+	peer, off := relayString(b, off)
+	peerPath, _ := relayString(b, off)
+	return &RelayOp{filePath, peer, peerPath, flags}
+}
+
+// relayString reads the string of a relay request whose length is at off,
+// cut at the end of the header for lengths that do not fit it, and returns
+// the offset past it.
+func relayString(b []byte, off int) (string, int) {
+	if off >= len(b) {
+		return "", off
+	}
+	end := off + 1 + int(b[off])
+	if end > len(b) {
+		end = len(b)
+	}
+	return string(b[off+1 : end]), end
+}
+
+// RelayRequestFits tells whether the paths and peer name fit a relay
+// request header together.
+func RelayRequestFits(remoteFile string, peer string, peerFile string) bool {
+	for _, s := range []string{remoteFile, peer, peerFile} {
+		if len(s) > 255 {
+			return false
+		}
+	}
+	return 6+len(remoteFile)+len(peer)+len(peerFile) <= NumHeaderBytes
+}
+
+// GetFilePath is the path of the file at the server.
+func (ro *RelayOp) GetFilePath() string {
+	return ro.filePath
+}
+
+func (ro *RelayOp) SetFilePath(path string) {
+	ro.filePath = path
+}
+
+func (ro *RelayOp) GetPeer() string {
+	return ro.peer
+}
+
+// GetPeerPath is the path to copy the file to at the peer.
+func (ro *RelayOp) GetPeerPath() string {
+	return ro.peerPath
+}
+
+func (ro *RelayOp) IsDurable() bool {
+	return ro.flags&DurableFlag != 0
+}
+
+///////////////////////////////////////////////////////////
+
+// RelayProgressOp tells how many bytes of a relay the peer confirmed
+// getting so far.
+type RelayProgressOp struct {
+	done  uint64
+	total uint64
+}
+
+func NewRelayProgressOp(b []byte) *RelayProgressOp {
+	return &RelayProgressOp{binary.LittleEndian.Uint64(b[2:10]), binary.LittleEndian.Uint64(b[10:18])}
+}
+
+func (rp *RelayProgressOp) GetDone() uint64 {
+	return rp.done
+}
+
+func (rp *RelayProgressOp) GetTotal() uint64 {
+	return rp.total
+}
+
+///////////////////////////////////////////////////////////
+
+// DeleteOp asks the server to remove a file. It answers with a
+// DeleteSuccessResponseOpType header, or an error.
+type DeleteOp struct {
+	filePath string
+}
+
+func NewDeleteOp(b []byte) *DeleteOp {
+	pathLen := uint8(b[2])
+	return &DeleteOp{string(b[3 : 3+pathLen])}
+}
+
+func (do *DeleteOp) GetFilePath() string {
+	return do.filePath
+}
+
+func (do *DeleteOp) SetFilePath(path string) {
+	do.filePath = path
+}
+
+///////////////////////////////////////////////////////////
+
+// ListOp asks the server for the files directly in a directory. It answers
+// with a ListEntryOpType header for each of them and then a ListEndOpType
+// header carrying their count, or an error.
+type ListOp struct {
+	dirPath string
+}
+
+func NewListOp(b []byte) *ListOp {
+	pathLen := uint8(b[2])
+	return &ListOp{string(b[3 : 3+pathLen])}
+}
+
+// GetFilePath returns the directory listed.
+func (lo *ListOp) GetFilePath() string {
+	return lo.dirPath
+}
+
+func (lo *ListOp) SetFilePath(path string) {
+	lo.dirPath = path
 }
 
 ///////////////////////////////////////////////////////////
 
-func PrepareErrorResponseOpHeader(errType ErrType) []byte {
+// ListEntryOp is a file of a listed directory, named without the directory.
+type ListEntryOp struct {
+	name     string
+	fileSize uint64
+	modTime  int64
+}
+
+func NewListEntryOp(b []byte) *ListEntryOp {
+	fileSize := binary.LittleEndian.Uint64(b[2:10])
+	modTime := int64(binary.LittleEndian.Uint64(b[10:18]))
+	nameLen := int(b[18])
+	return &ListEntryOp{string(b[19 : 19+nameLen]), fileSize, modTime}
+}
+
+func (le *ListEntryOp) GetName() string {
+	return le.name
+}
+
+func (le *ListEntryOp) GetFileSize() uint64 {
+	return le.fileSize
+}
+
+// GetModTime returns the modification time in nanoseconds since the epoch.
+func (le *ListEntryOp) GetModTime() int64 {
+	return le.modTime
+}
+
+// ParseListEndCount returns how many entries the server sent before a
+// ListEndOpType header.
+func ParseListEndCount(b []byte) uint32 {
+	return binary.LittleEndian.Uint32(b[2:6])
+}
+
+///////////////////////////////////////////////////////////
+
+// PrepareErrorResponseOpHeader carries e.Message cut to MaxErrorMessageLen
+// bytes.
+func PrepareErrorResponseOpHeader(e *ServerError) []byte {
+	message := e.Message
+	if len(message) > MaxErrorMessageLen {
+		message = message[:MaxErrorMessageLen]
+	}
+	flags := uint8(0)
+	if e.Retryable {
+		flags |= RetryableFlag
+	}
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.LittleEndian, []byte(errorResponseOpCode))
-	binary.Write(buf, binary.LittleEndian, errType)
+	binary.Write(buf, binary.LittleEndian, e.Type)
+	binary.Write(buf, binary.LittleEndian, uint8(len(message)))
+	binary.Write(buf, binary.LittleEndian, []byte(message))
+	binary.Write(buf, binary.LittleEndian, make([]byte, errorFlagsOffset-len(buf.Bytes())))
+	binary.Write(buf, binary.LittleEndian, flags)
+	binary.Write(buf, binary.LittleEndian, uint32(e.RetryAfter/time.Millisecond))
 	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
 	return buf.Bytes()
 }
 
-func PrepareCopySuccessResponseOpHeader(csum []byte, opType OpType) []byte {
+func PrepareCopySuccessResponseOpHeader(csum []byte, opType OpType, flags uint8) []byte {
 	buf := new(bytes.Buffer)
 	switch opType {
 	case SingleCopySuccessResponseOpType:
 		binary.Write(buf, binary.LittleEndian, []byte(singleCopySuccessResponseOpCode))
 	case MultiPartCopySuccessResponseOpType:
 		binary.Write(buf, binary.LittleEndian, []byte(multiPartCopySuccessResponseOpCode))
+	case RelaySuccessResponseOpType:
+		binary.Write(buf, binary.LittleEndian, []byte(relaySuccessResponseOpCode))
 	}
 	binary.Write(buf, binary.LittleEndian, csum)
+	binary.Write(buf, binary.LittleEndian, flags)
 	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
 	return buf.Bytes()
 }
 
-func PrepareMultiPartCopyInitSuccessResponseOpHeader(copyId uuid.UUID) []byte {
+func PrepareMultiPartCopyInitSuccessResponseOpHeader(copyId uuid.UUID, limits PartLimits) []byte {
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.LittleEndian, []byte(multiPartInitSuccessResponseOpCode))
 	binaryUuid, _ := copyId.MarshalBinary()
 	binary.Write(buf, binary.LittleEndian, binaryUuid)
+	binary.Write(buf, binary.LittleEndian, limits.MaxParallel)
+	binary.Write(buf, binary.LittleEndian, limits.MinSize)
+	binary.Write(buf, binary.LittleEndian, limits.MaxSize)
+	binary.Write(buf, binary.LittleEndian, limits.MaxParts)
 	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
 	return buf.Bytes()
 }
 
-func PrepareSingleCopyRequestOpHeader(remoteFile string, fileSize uint64) []byte {
+func PrepareSingleCopyRequestOpHeader(remoteFile string, fileSize uint64, flags uint8) []byte {
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.LittleEndian, []byte(singleCopyRequestOpCode))
 	binary.Write(buf, binary.LittleEndian, fileSize)
 	binary.Write(buf, binary.LittleEndian, uint8(len(remoteFile)))
 	binary.Write(buf, binary.LittleEndian, []byte(remoteFile))
+	binary.Write(buf, binary.LittleEndian, flags)
 	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
 	return buf.Bytes()
 }
 
-func PrepareMultiPartInitRequestOpHeader(remoteFile string) []byte {
+func PrepareMultiPartInitRequestOpHeader(remoteFile string, fileSize uint64) []byte {
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.LittleEndian, []byte(multiPartInitRequestOpCode))
 	binary.Write(buf, binary.LittleEndian, uint8(len(remoteFile)))
 	binary.Write(buf, binary.LittleEndian, []byte(remoteFile))
+	binary.Write(buf, binary.LittleEndian, fileSize)
 	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
 	return buf.Bytes()
 }
 
-func PrepareMultiPartCompleteRequestOpHeader(copyId uuid.UUID, fileSize uint64) []byte {
+func PrepareMultiPartCompleteRequestOpHeader(copyId uuid.UUID, fileSize uint64, flags uint8, numParts uint64, csum []byte) []byte {
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.LittleEndian, []byte(multiPartCompleteRequestOpCode))
 	cId, _ := copyId.MarshalBinary()
 	binary.Write(buf, binary.LittleEndian, cId)
 	binary.Write(buf, binary.LittleEndian, fileSize)
+	binary.Write(buf, binary.LittleEndian, flags)
+	binary.Write(buf, binary.LittleEndian, numParts)
+	binary.Write(buf, binary.LittleEndian, csum)
 	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
 	return buf.Bytes()
 }
@@ -256,6 +881,24 @@ func PrepareMultiPartCopyPartRequestOpHeader(partNum uint64, copyId uuid.UUID, p
 	return buf.Bytes()
 }
 
+// PrepareMultiPartAbortRequestOpHeader asks the server to drop a multipart
+// copy the client gave up on, with the parts it received.
+func PrepareMultiPartAbortRequestOpHeader(copyId uuid.UUID) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, []byte(multiPartAbortRequestOpCode))
+	cId, _ := copyId.MarshalBinary()
+	binary.Write(buf, binary.LittleEndian, cId)
+	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
+	return buf.Bytes()
+}
+
+func PrepareMultiPartAbortSuccessResponseOpHeader() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, []byte(multiPartAbortSuccessResponseOpCode))
+	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
+	return buf.Bytes()
+}
+
 func ParseCopyId(b []byte) (string, error) {
 	uuid, err := uuid.FromBytes(b[2 : 2+16])
 	if err != nil {
@@ -264,7 +907,146 @@ func ParseCopyId(b []byte) (string, error) {
 	return uuid.String(), nil
 }
 
+func ParsePartNum(b []byte) uint64 {
+	return binary.LittleEndian.Uint64(b[2+16 : 2+16+8])
+}
+
 func ParseErrorType(b []byte) ErrType {
 	errType := ErrType(b[2])
 	return errType
 }
+
+// ParseErrorMessage returns the message of an error response, empty from
+// servers that send none.
+func ParseErrorMessage(b []byte) string {
+	msgLen := uint8(b[3])
+	return string(b[4 : 4+int(msgLen)])
+}
+
+func PrepareStatRequestOpHeader(remoteFile string) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, []byte(statRequestOpCode))
+	binary.Write(buf, binary.LittleEndian, uint8(len(remoteFile)))
+	binary.Write(buf, binary.LittleEndian, []byte(remoteFile))
+	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
+	return buf.Bytes()
+}
+
+func PrepareStatResponseOpHeader(fileSize uint64, modTime int64) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, []byte(statResponseOpCode))
+	binary.Write(buf, binary.LittleEndian, fileSize)
+	binary.Write(buf, binary.LittleEndian, modTime)
+	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
+	return buf.Bytes()
+}
+
+func PrepareReadRequestOpHeader(remoteFile string, offset uint64, length uint64) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, []byte(readRequestOpCode))
+	binary.Write(buf, binary.LittleEndian, offset)
+	binary.Write(buf, binary.LittleEndian, length)
+	binary.Write(buf, binary.LittleEndian, uint8(len(remoteFile)))
+	binary.Write(buf, binary.LittleEndian, []byte(remoteFile))
+	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
+	return buf.Bytes()
+}
+
+// PrepareReadResponseOpHeader precedes the length bytes of a read. They are
+// followed by a SingleCopySuccessResponseOpType header carrying their
+// checksum, which the server computes as it sends them.
+func PrepareReadResponseOpHeader(length uint64) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, []byte(readResponseOpCode))
+	binary.Write(buf, binary.LittleEndian, length)
+	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
+	return buf.Bytes()
+}
+
+func PrepareMuxRequestOpHeader(window uint32) []byte {
+	return prepareMuxOpHeader(muxRequestOpCode, window)
+}
+
+func PrepareMuxAcceptOpHeader(window uint32) []byte {
+	return prepareMuxOpHeader(muxAcceptOpCode, window)
+}
+
+func prepareMuxOpHeader(opCode string, window uint32) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, []byte(opCode))
+	binary.Write(buf, binary.LittleEndian, window)
+	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
+	return buf.Bytes()
+}
+
+func PrepareRelayRequestOpHeader(remoteFile string, peer string, peerFile string, flags uint8) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, []byte(relayRequestOpCode))
+	binary.Write(buf, binary.LittleEndian, flags)
+	binary.Write(buf, binary.LittleEndian, uint8(len(remoteFile)))
+	binary.Write(buf, binary.LittleEndian, []byte(remoteFile))
+	binary.Write(buf, binary.LittleEndian, uint8(len(peer)))
+	binary.Write(buf, binary.LittleEndian, []byte(peer))
+	binary.Write(buf, binary.LittleEndian, uint8(len(peerFile)))
+	binary.Write(buf, binary.LittleEndian, []byte(peerFile))
+	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
+	return buf.Bytes()
+}
+
+func PrepareRelayProgressOpHeader(done uint64, total uint64) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, []byte(relayProgressOpCode))
+	binary.Write(buf, binary.LittleEndian, done)
+	binary.Write(buf, binary.LittleEndian, total)
+	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
+	return buf.Bytes()
+}
+
+func PrepareDeleteRequestOpHeader(remoteFile string) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, []byte(deleteRequestOpCode))
+	binary.Write(buf, binary.LittleEndian, uint8(len(remoteFile)))
+	binary.Write(buf, binary.LittleEndian, []byte(remoteFile))
+	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
+	return buf.Bytes()
+}
+
+func PrepareDeleteSuccessResponseOpHeader() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, []byte(deleteSuccessResponseOpCode))
+	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
+	return buf.Bytes()
+}
+
+func PrepareListRequestOpHeader(remoteDir string) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, []byte(listRequestOpCode))
+	binary.Write(buf, binary.LittleEndian, uint8(len(remoteDir)))
+	binary.Write(buf, binary.LittleEndian, []byte(remoteDir))
+	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
+	return buf.Bytes()
+}
+
+// PrepareListEntryOpHeader carries name cut to 255 bytes, the most file
+// systems allow for a name.
+func PrepareListEntryOpHeader(name string, fileSize uint64, modTime int64) []byte {
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, []byte(listEntryOpCode))
+	binary.Write(buf, binary.LittleEndian, fileSize)
+	binary.Write(buf, binary.LittleEndian, modTime)
+	binary.Write(buf, binary.LittleEndian, uint8(len(name)))
+	binary.Write(buf, binary.LittleEndian, []byte(name))
+	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
+	return buf.Bytes()
+}
+
+func PrepareListEndOpHeader(count uint32) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, []byte(listEndOpCode))
+	binary.Write(buf, binary.LittleEndian, count)
+	binary.Write(buf, binary.LittleEndian, make([]byte, NumHeaderBytes-len(buf.Bytes())))
+	return buf.Bytes()
+}
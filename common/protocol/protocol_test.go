@@ -0,0 +1,189 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDurableFlag(t *testing.T) {
+	csum := bytes.Repeat([]byte{0xab}, 16)
+	copyId, _ := uuid.NewUUID()
+	tests := []struct {
+		name    string
+		header  func(flags uint8) []byte
+		durable func(b []byte) bool
+	}{
+		{"single copy", func(flags uint8) []byte {
+			return PrepareSingleCopyRequestOpHeader("/data/file", 100, flags)
+		}, func(b []byte) bool {
+			return NewSingleCopyOp(b).IsDurable()
+		}},
+		{"multipart complete", func(flags uint8) []byte {
+			return PrepareMultiPartCompleteRequestOpHeader(copyId, 100, flags, 3, csum)
+		}, func(b []byte) bool {
+			mcc, err := NewMultiPartCopyCompleteOp(b)
+			return err == nil && mcc.IsDurable()
+		}},
+		{"success response", func(flags uint8) []byte {
+			return PrepareCopySuccessResponseOpHeader(csum, SingleCopySuccessResponseOpType, flags)
+		}, func(b []byte) bool {
+			return NewSingleCopySuccessResponseOp(b).IsDurable()
+		}},
+		{"relay", func(flags uint8) []byte {
+			return PrepareRelayRequestOpHeader("/data/file", "peer", "/copy", flags)
+		}, func(b []byte) bool {
+			return NewRelayOp(b).IsDurable()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, flags := range []uint8{0, DurableFlag} {
+				b := tt.header(flags)
+				if len(b) != NumHeaderBytes {
+					t.Fatalf("header is %d bytes, want %d", len(b), NumHeaderBytes)
+				}
+				if got := tt.durable(b); got != (flags == DurableFlag) {
+					t.Errorf("IsDurable() with flags %d = %v", flags, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSingleCopyHeader(t *testing.T) {
+	tests := []struct {
+		path string
+		size uint64
+	}{
+		{"/data/file", 0},
+		{"/data/file", 1 << 40},
+		{"/" + string(bytes.Repeat([]byte{'a'}, 200)), 7},
+	}
+	for _, tt := range tests {
+		b := PrepareSingleCopyRequestOpHeader(tt.path, tt.size, 0)
+		if got := GetOp(b); got != SingleCopyOpType {
+			t.Errorf("GetOp() = %d, want %d", got, SingleCopyOpType)
+		}
+		sco := NewSingleCopyOp(b)
+		if sco.GetFilePath() != tt.path || sco.GetContentLength() != tt.size {
+			t.Errorf("NewSingleCopyOp() = %s of %d bytes, want %s of %d", sco.GetFilePath(), sco.GetContentLength(),
+				tt.path, tt.size)
+		}
+	}
+}
+
+func TestMultiPartAbortHeader(t *testing.T) {
+	copyId := uuid.New()
+	b := PrepareMultiPartAbortRequestOpHeader(copyId)
+	if got := GetOp(b); got != MultiPartCopyAbortOpType {
+		t.Errorf("GetOp() = %s, want %s", got, MultiPartCopyAbortOpType)
+	}
+	if got, err := ParseCopyId(b); err != nil || got != copyId.String() {
+		t.Errorf("ParseCopyId() = %s, %v, want %s", got, err, copyId)
+	}
+	if got := GetOp(PrepareMultiPartAbortSuccessResponseOpHeader()); got != MultiPartCopyAbortSuccessResponseOpType {
+		t.Errorf("GetOp() = %s, want %s", got, MultiPartCopyAbortSuccessResponseOpType)
+	}
+}
+
+func TestListEntryHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileName string
+		want     string
+	}{
+		{"short name", "file", "file"},
+		{"longest name", string(bytes.Repeat([]byte{'a'}, 255)), string(bytes.Repeat([]byte{'a'}, 255))},
+		{"name cut", string(bytes.Repeat([]byte{'a'}, 300)), string(bytes.Repeat([]byte{'a'}, 255))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := PrepareListEntryOpHeader(tt.fileName, 1<<40, -5)
+			if got := GetOp(b); got != ListEntryOpType {
+				t.Errorf("GetOp() = %s, want %s", got, ListEntryOpType)
+			}
+			le := NewListEntryOp(b)
+			if le.GetName() != tt.want || le.GetFileSize() != 1<<40 || le.GetModTime() != -5 {
+				t.Errorf("NewListEntryOp() = %s of %d bytes at %d, want %s of %d at %d", le.GetName(),
+					le.GetFileSize(), le.GetModTime(), tt.want, uint64(1<<40), -5)
+			}
+		})
+	}
+}
+
+func TestPathRequestHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   OpType
+		path   func(b []byte) string
+	}{
+		{"delete", PrepareDeleteRequestOpHeader("/data/file"), DeleteRequestOpType, func(b []byte) string {
+			return NewDeleteOp(b).GetFilePath()
+		}},
+		{"list", PrepareListRequestOpHeader("/data/file"), ListRequestOpType, func(b []byte) string {
+			return NewListOp(b).GetFilePath()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GetOp(tt.header); got != tt.want {
+				t.Errorf("GetOp() = %s, want %s", got, tt.want)
+			}
+			if got := tt.path(tt.header); got != "/data/file" {
+				t.Errorf("path = %s, want /data/file", got)
+			}
+		})
+	}
+	if got := ParseListEndCount(PrepareListEndOpHeader(7)); got != 7 {
+		t.Errorf("ParseListEndCount() = %d, want 7", got)
+	}
+}
+
+func TestServerError(t *testing.T) {
+	long := string(bytes.Repeat([]byte{'x'}, MaxErrorMessageLen+10))
+	tests := []struct {
+		name       string
+		err        ServerError
+		want       ServerError
+		wantString string
+	}{
+		{"type only", ServerError{Type: ErrorFileNotFound}, ServerError{Type: ErrorFileNotFound},
+			"file not found at server"},
+		{"message", ServerError{Type: ErrorWritingPart, Message: "no space left on device"},
+			ServerError{Type: ErrorWritingPart, Message: "no space left on device"},
+			"error writing part at server: no space left on device"},
+		{"retryable", ServerError{Type: ErrorCopyOpInProgress, Retryable: true},
+			ServerError{Type: ErrorCopyOpInProgress, Retryable: true}, "copy operation already in progress"},
+		{"retry after", ServerError{Type: ErrorServerBusy, Retryable: true, RetryAfter: 1500 * time.Millisecond},
+			ServerError{Type: ErrorServerBusy, Retryable: true, RetryAfter: 1500 * time.Millisecond},
+			"server busy, retry after 1.5s"},
+		{"retry after in whole milliseconds", ServerError{Type: ErrorServerBusy, RetryAfter: 2500 * time.Microsecond},
+			ServerError{Type: ErrorServerBusy, RetryAfter: 2 * time.Millisecond}, "server busy, retry after 2ms"},
+		{"long message is cut", ServerError{Type: ErrorRejected, Message: long},
+			ServerError{Type: ErrorRejected, Message: long[:MaxErrorMessageLen]},
+			"copy rejected by server: " + long[:MaxErrorMessageLen]},
+		{"unknown type", ServerError{Type: ErrType(100)}, ServerError{Type: ErrType(100)}, "unknown error unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := PrepareErrorResponseOpHeader(&tt.err)
+			if len(b) != NumHeaderBytes {
+				t.Fatalf("header is %d bytes, want %d", len(b), NumHeaderBytes)
+			}
+			if op := GetOp(b); op != ErrorResponseOpType {
+				t.Fatalf("GetOp() = %s, want %s", op, ErrorResponseOpType)
+			}
+			got := NewServerError(b)
+			if *got != tt.want {
+				t.Errorf("NewServerError() = %+v, want %+v", *got, tt.want)
+			}
+			if got.Error() != tt.wantString {
+				t.Errorf("Error() = %q, want %q", got.Error(), tt.wantString)
+			}
+		})
+	}
+}
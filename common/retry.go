@@ -0,0 +1,46 @@
+package common
+
+import (
+	"context"
+	"time"
+
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/common/protocol"
+)
+
+// RetryDelay is how long Retry waits before the first retry. The wait
+// doubles before every retry after that, unless the server asks for
+// another wait.
+const RetryDelay = 500 * time.Millisecond
+
+// IsRetryable tells whether err is an error response the server marked as
+// worth sending the request again for.
+func IsRetryable(err error) bool {
+	serr, ok := err.(*protocol.ServerError)
+	return ok && serr.Retryable
+}
+
+// Retry calls attempt until it succeeds, fails with an error that is not
+// retryable, or has been retried retries times, and returns its last error.
+func Retry(ctx context.Context, retries int, log *logger.Logger, attempt func() error) error {
+	delay := RetryDelay
+	for retry := 1; ; retry++ {
+		err := attempt()
+		if err == nil || retry > retries || !IsRetryable(err) {
+			return err
+		}
+		wait := delay
+		if retryAfter := err.(*protocol.ServerError).RetryAfter; retryAfter > 0 {
+			wait = retryAfter
+		}
+		log.Warn("retrying", "error", err, "retry", retry, "delay", wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,85 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/common/protocol"
+)
+
+func TestRetry(t *testing.T) {
+	busy := &protocol.ServerError{Type: protocol.ErrorServerBusy, Retryable: true, RetryAfter: time.Millisecond}
+	final := &protocol.ServerError{Type: protocol.ErrorFileNotFound}
+	other := errors.New("connection reset")
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		retries int
+		// errs are returned by the attempts in turn, the last one by any
+		// attempts after.
+		errs         []error
+		wantErr      error
+		wantAttempts int
+	}{
+		{"succeeds", context.Background(), 3, []error{nil}, nil, 1},
+		{"succeeds on retry", context.Background(), 3, []error{busy, busy, nil}, nil, 3},
+		{"not retryable", context.Background(), 3, []error{final}, final, 1},
+		{"not a server error", context.Background(), 3, []error{other}, other, 1},
+		{"retryable then not", context.Background(), 3, []error{busy, final}, final, 2},
+		{"out of retries", context.Background(), 2, []error{busy}, busy, 3},
+		{"no retries", context.Background(), 0, []error{busy}, busy, 1},
+		{"cancelled while waiting", cancelled, 3, []error{busy}, context.Canceled, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := Retry(tt.ctx, tt.retries, logger.With(), func() error {
+				err := tt.errs[len(tt.errs)-1]
+				if attempts < len(tt.errs) {
+					err = tt.errs[attempts]
+				}
+				attempts++
+				return err
+			})
+			if err != tt.wantErr {
+				t.Errorf("Retry() error = %v, want %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("Retry() made %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryWaitsAsAsked(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter time.Duration
+		want       time.Duration
+	}{
+		{"server asks", 50 * time.Millisecond, 50 * time.Millisecond},
+		{"server does not say", 0, RetryDelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := &protocol.ServerError{Type: protocol.ErrorCopyOpInProgress, Retryable: true,
+				RetryAfter: tt.retryAfter}
+			attempts := 0
+			start := time.Now()
+			Retry(context.Background(), 1, logger.With(), func() error {
+				if attempts++; attempts == 1 {
+					return err
+				}
+				return nil
+			})
+			if waited := time.Since(start); waited < tt.want || waited > tt.want+time.Second {
+				t.Errorf("Retry() waited %s, want %s", waited, tt.want)
+			}
+		})
+	}
+}
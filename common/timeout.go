@@ -0,0 +1,178 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/chili-copy/common/protocol"
+)
+
+// TimeoutKind tells which of the timeouts of a connection passed.
+type TimeoutKind uint8
+
+const (
+	// TimeoutDial is the time allowed to connect.
+	TimeoutDial TimeoutKind = iota
+	// TimeoutHeader is the time allowed for the header of an op to arrive.
+	TimeoutHeader
+	// TimeoutIdle is the time allowed for a read or write to move any data.
+	TimeoutIdle
+	// TimeoutOp is the time allowed for a whole op.
+	TimeoutOp
+)
+
+// TimeoutError is returned when the peer took longer than Limit.
+type TimeoutError struct {
+	Kind  TimeoutKind
+	Limit time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	switch e.Kind {
+	case TimeoutDial:
+		return fmt.Sprintf("not connected within %s", e.Limit)
+	case TimeoutHeader:
+		return fmt.Sprintf("no header within %s", e.Limit)
+	case TimeoutIdle:
+		return fmt.Sprintf("no data moved for %s", e.Limit)
+	default:
+		return fmt.Sprintf("operation not done within %s", e.Limit)
+	}
+}
+
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary is true, as a slow peer or network may have sped up on a retry.
+func (e *TimeoutError) Temporary() bool {
+	return true
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// TimeoutConn fails reads and writes that move no data for idle, and any
+// once the op it carries has taken opTimeout, with a *TimeoutError. Zero
+// values do not time out. It keeps zero copy working by handing out the
+// raw connection of conn with the same timeouts.
+type TimeoutConn struct {
+	net.Conn
+	idle      time.Duration
+	opTimeout time.Duration
+	lock      sync.Mutex
+	deadline  time.Time
+}
+
+func NewTimeoutConn(conn net.Conn, idle time.Duration, opTimeout time.Duration) *TimeoutConn {
+	c := &TimeoutConn{Conn: conn, idle: idle, opTimeout: opTimeout}
+	if opTimeout > 0 {
+		c.deadline = time.Now().Add(opTimeout)
+	}
+	return c
+}
+
+// SetDeadline moves the end of the op to t, eg. to now to cancel it.
+func (c *TimeoutConn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.deadline = t
+	c.lock.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+// next is the deadline of the next read or write.
+func (c *TimeoutConn) next() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.idle == 0 {
+		return c.deadline
+	}
+	next := time.Now().Add(c.idle)
+	if !c.deadline.IsZero() && c.deadline.Before(next) {
+		return c.deadline
+	}
+	return next
+}
+
+func (c *TimeoutConn) timeoutError(err error) error {
+	if !isTimeout(err) {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.deadline.IsZero() && !time.Now().Before(c.deadline) {
+		return &TimeoutError{Kind: TimeoutOp, Limit: c.opTimeout}
+	}
+	return &TimeoutError{Kind: TimeoutIdle, Limit: c.idle}
+}
+
+func (c *TimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(c.next())
+	n, err := c.Conn.Read(b)
+	return n, c.timeoutError(err)
+}
+
+func (c *TimeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(c.next())
+	n, err := c.Conn.Write(b)
+	return n, c.timeoutError(err)
+}
+
+func (c *TimeoutConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return nil, syscall.EINVAL
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	return &timeoutRawConn{RawConn: rc, conn: c}, nil
+}
+
+// timeoutRawConn moves the deadline every time the connection is ready,
+// as the kernel moves data between those without the connection knowing.
+type timeoutRawConn struct {
+	syscall.RawConn
+	conn *TimeoutConn
+}
+
+func (rc *timeoutRawConn) Read(f func(fd uintptr) bool) error {
+	c := rc.conn
+	c.Conn.SetReadDeadline(c.next())
+	err := rc.RawConn.Read(func(fd uintptr) bool {
+		c.Conn.SetReadDeadline(c.next())
+		return f(fd)
+	})
+	return c.timeoutError(err)
+}
+
+func (rc *timeoutRawConn) Write(f func(fd uintptr) bool) error {
+	c := rc.conn
+	c.Conn.SetWriteDeadline(c.next())
+	err := rc.RawConn.Write(func(fd uintptr) bool {
+		c.Conn.SetWriteDeadline(c.next())
+		return f(fd)
+	})
+	return c.timeoutError(err)
+}
+
+// GetOpTypeAndHeaderWithin reads a header as GetOpTypeAndHeaderFromConn
+// does, failing with a *TimeoutError if it does not arrive within timeout.
+func GetOpTypeAndHeaderWithin(conn net.Conn, timeout time.Duration) (protocol.OpType, []byte, error) {
+	if timeout == 0 {
+		return GetOpTypeAndHeaderFromConn(conn)
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	opType, b, err := GetOpTypeAndHeaderFromConn(conn)
+	if isTimeout(err) {
+		return opType, b, &TimeoutError{Kind: TimeoutHeader, Limit: timeout}
+	}
+	conn.SetReadDeadline(time.Time{})
+	return opType, b, err
+}
@@ -0,0 +1,149 @@
+package common
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chili-copy/common/protocol"
+)
+
+// trickle writes a byte to conn every interval, n times, then stops.
+func trickle(conn net.Conn, interval time.Duration, n int) {
+	for i := 0; i < n; i++ {
+		time.Sleep(interval)
+		if _, err := conn.Write([]byte{byte(i)}); err != nil {
+			return
+		}
+	}
+}
+
+func TestTimeoutConn(t *testing.T) {
+	tests := []struct {
+		name      string
+		idle      time.Duration
+		opTimeout time.Duration
+		// peer runs on the other end of the connection.
+		peer func(conn net.Conn)
+		// write writes to the peer instead of reading from it.
+		write bool
+		// want is how many bytes move before the connection times out, or
+		// that are moved without it timing out, -1 for any.
+		want     int
+		wantErr  bool
+		wantKind TimeoutKind
+	}{
+		{"data keeps coming", 100 * time.Millisecond, 0, func(c net.Conn) { trickle(c, 20*time.Millisecond, 10) },
+			false, 10, false, 0},
+		{"no timeouts", 0, 0, func(c net.Conn) { trickle(c, 50*time.Millisecond, 2) }, false, 2, false, 0},
+		{"idle read", 50 * time.Millisecond, 0, func(c net.Conn) { trickle(c, 10*time.Millisecond, 2) }, false, 2,
+			true, TimeoutIdle},
+		{"op runs out", 100 * time.Millisecond, 150 * time.Millisecond,
+			func(c net.Conn) { trickle(c, 20*time.Millisecond, 100) }, false, -1, true, TimeoutOp},
+		{"idle write", 50 * time.Millisecond, 0, func(c net.Conn) {}, true, 0, true, TimeoutIdle},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go tt.peer(server)
+			conn := NewTimeoutConn(client, tt.idle, tt.opTimeout)
+			got := 0
+			var err error
+			b := make([]byte, 1)
+			for err == nil && (tt.wantErr || got < tt.want) {
+				var n int
+				if tt.write {
+					n, err = conn.Write(b)
+				} else {
+					n, err = conn.Read(b)
+				}
+				got += n
+			}
+			if tt.want >= 0 && got != tt.want {
+				t.Errorf("moved %d bytes, want %d", got, tt.want)
+			}
+			if !tt.wantErr {
+				if err != nil {
+					t.Errorf("error = %v, want none", err)
+				}
+				return
+			}
+			if te, ok := err.(*TimeoutError); !ok || te.Kind != tt.wantKind {
+				t.Fatalf("error = %v, want a timeout of kind %d", err, tt.wantKind)
+			}
+			if !isTimeout(err) {
+				t.Error("timeout error is not a net.Error timing out")
+			}
+		})
+	}
+}
+
+func TestTimeoutConnSetDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := NewTimeoutConn(client, time.Minute, time.Hour)
+	conn.SetDeadline(time.Now())
+	_, err := conn.Read(make([]byte, 1))
+	if te, ok := err.(*TimeoutError); !ok || te.Kind != TimeoutOp {
+		t.Errorf("Read() after the deadline error = %v, want the op to time out", err)
+	}
+}
+
+func TestGetOpTypeAndHeaderWithin(t *testing.T) {
+	header := protocol.PrepareStatRequestOpHeader("/file")
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		send    [][]byte
+		wantErr bool
+	}{
+		{"header", time.Second, [][]byte{header}, false},
+		{"header in pieces", time.Second, [][]byte{header[:10], header[10:]}, false},
+		{"no timeout", 0, [][]byte{header}, false},
+		{"nothing", 50 * time.Millisecond, nil, true},
+		{"half a header", 50 * time.Millisecond, [][]byte{header[:10]}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go func() {
+				for _, b := range tt.send {
+					client.Write(b)
+					time.Sleep(10 * time.Millisecond)
+				}
+			}()
+			opType, _, err := GetOpTypeAndHeaderWithin(server, tt.timeout)
+			if !tt.wantErr {
+				if err != nil || opType != protocol.StatRequestOpType {
+					t.Errorf("GetOpTypeAndHeaderWithin() = %s, %v, want %s", opType, err, protocol.StatRequestOpType)
+				}
+				return
+			}
+			if te, ok := err.(*TimeoutError); !ok || te.Kind != TimeoutHeader || te.Limit != tt.timeout {
+				t.Errorf("GetOpTypeAndHeaderWithin() error = %v, want no header within %s", err, tt.timeout)
+			}
+		})
+	}
+}
+
+func TestTimeoutErrorString(t *testing.T) {
+	tests := []struct {
+		kind TimeoutKind
+		want string
+	}{
+		{TimeoutDial, "not connected within 1s"},
+		{TimeoutHeader, "no header within 1s"},
+		{TimeoutIdle, "no data moved for 1s"},
+		{TimeoutOp, "operation not done within 1s"},
+	}
+	for _, tt := range tests {
+		if got := (&TimeoutError{Kind: tt.kind, Limit: time.Second}).Error(); got != tt.want {
+			t.Errorf("Error() = %q, want %q", got, tt.want)
+		}
+	}
+}
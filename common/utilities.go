@@ -1,29 +1,46 @@
 package common
 
 import (
+	"context"
+	"crypto/md5"
 	"encoding/binary"
-	"fmt"
+	"hash"
+	"io"
 	"net"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/chili-copy/common/logger"
 	"github.com/chili-copy/common/protocol"
 )
 
 func FileSize(fd *os.File) int64 {
 	fileinfo, err := fd.Stat()
 	if err != nil {
-		fmt.Println(err)
+		logger.Error("unable to stat file", "path", fd.Name(), "error", err)
 		os.Exit(1)
 	}
 	filesize := fileinfo.Size()
 	return filesize
 }
 
+// CombinePartDigests returns the checksum of a multipart copy: the MD5 of the
+// MD5 digests of its parts concatenated in part number order. Both sides
+// can build it from digests computed while the parts are moved.
+func CombinePartDigests(digests [][]byte) []byte {
+	hash := md5.New()
+	for _, digest := range digests {
+		hash.Write(digest)
+	}
+	return hash.Sum(nil)
+}
+
 func GetOpTypeAndHeaderFromConn(conn net.Conn) (protocol.OpType, []byte, error) {
 	b := make([]byte, protocol.NumHeaderBytes)
 	err := binary.Read(conn, binary.LittleEndian, b)
 	if err != nil {
-		fmt.Printf("Unable to read from connection. Error : %s\n", err.Error())
+		logger.Debug("unable to read header from connection", "remote", conn.RemoteAddr(), "error", err)
 		return protocol.Unknown, b, err
 	}
 	return protocol.GetOp(b), b, nil
@@ -34,7 +51,7 @@ func SendBytesToConn(conn net.Conn, b []byte) error {
 	for toBeWritten > 0 {
 		len, err := conn.Write(b[toBeWritten-len(b) : len(b)])
 		if err != nil {
-			fmt.Println("Error in sending bytes to server. Error : %s", err.Error())
+			logger.Debug("unable to send bytes to connection", "remote", conn.RemoteAddr(), "error", err)
 			return err
 		}
 		toBeWritten = toBeWritten - len
@@ -42,11 +59,70 @@ func SendBytesToConn(conn net.Conn, b []byte) error {
 	return nil
 }
 
+// StreamToConn sends size bytes of r starting at offset to conn, staging
+// them through buf and feeding them to digest, if not nil, on the way.
+func StreamToConn(conn net.Conn, r io.ReaderAt, offset int64, size int64, buf []byte, digest hash.Hash) error {
+	var w io.Writer = conn
+	if digest != nil {
+		w = io.MultiWriter(conn, digest)
+	}
+	_, err := io.CopyBuffer(w, io.NewSectionReader(r, offset, size), buf)
+	if err != nil {
+		logger.Debug("unable to stream bytes to connection", "remote", conn.RemoteAddr(), "error", err)
+	}
+	return err
+}
+
 func GetConnection(network string, address string) (net.Conn, error) {
 	conn, err := net.Dial(network, address)
 	if err != nil {
-		fmt.Printf("Failed to open connection to server. Error : %s\n", err.Error())
+		logger.Debug("unable to open connection", "remote", address, "error", err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// GetConnectionContext connects to address, failing with a *TimeoutError
+// if that takes longer than dialTimeout. Reads and writes on the connection
+// fail the same way once they move no data for ioTimeout. Zero values do
+// not time out.
+func GetConnectionContext(ctx context.Context, network string, address string, dialTimeout time.Duration, ioTimeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		logger.Debug("unable to open connection", "remote", address, "error", err)
+		if isTimeout(err) && ctx.Err() == nil {
+			return nil, &TimeoutError{Kind: TimeoutDial, Limit: dialTimeout}
+		}
 		return nil, err
 	}
+	if ioTimeout > 0 {
+		return NewTimeoutConn(conn, ioTimeout, 0), nil
+	}
 	return conn, nil
 }
+
+// WatchContext makes reads and writes on conn fail once ctx is done, by
+// moving its deadline to now. The returned func stops watching.
+func WatchContext(ctx context.Context, conn net.Conn) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// SplitAddress splits addresses such as "unix:///run/ccp.sock" or
+// "tcp6://[::1]:5678" into the network and address to dial or listen on.
+// Addresses without a scheme are TCP, eg. "localhost:5678". On Linux,
+// unix socket paths starting with @ are in the abstract namespace.
+func SplitAddress(address string) (string, string) {
+	if i := strings.Index(address, "://"); i >= 0 {
+		return address[:i], address[i+3:]
+	}
+	return "tcp", address
+}
@@ -0,0 +1,129 @@
+package common
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// boundedReaderAt fails reads larger than max, and records the largest.
+type boundedReaderAt struct {
+	data    []byte
+	max     int
+	largest int
+}
+
+func (r *boundedReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if len(b) > r.largest {
+		r.largest = len(b)
+	}
+	if len(b) > r.max {
+		return 0, io.ErrShortBuffer
+	}
+	if off >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, r.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestStreamToConn(t *testing.T) {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	tests := []struct {
+		name    string
+		offset  int64
+		size    int64
+		bufSize int
+	}{
+		{"whole through a small buffer", 0, 10000, 333},
+		{"range", 1234, 5000, 1000},
+		{"buffer larger than the range", 9000, 1000, 4096},
+		{"empty", 500, 0, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &boundedReaderAt{data: data, max: tt.bufSize}
+			client, server := net.Pipe()
+			got := make(chan []byte, 1)
+			go func() {
+				b, _ := ioutil.ReadAll(server)
+				got <- b
+			}()
+			digest := md5.New()
+			err := StreamToConn(client, src, tt.offset, tt.size, make([]byte, tt.bufSize), digest)
+			client.Close()
+			if err != nil {
+				t.Fatalf("StreamToConn() error = %v", err)
+			}
+			want := data[tt.offset : tt.offset+tt.size]
+			if b := <-got; !bytes.Equal(b, want) {
+				t.Errorf("sent %d bytes that differ from the %d of the range", len(b), len(want))
+			}
+			if sum := md5.Sum(want); !bytes.Equal(digest.Sum(nil), sum[:]) {
+				t.Error("digest is not that of the range")
+			}
+			if src.largest > tt.bufSize {
+				t.Errorf("read %d bytes at once, more than the %d byte buffer", src.largest, tt.bufSize)
+			}
+		})
+	}
+}
+
+func TestCombinePartDigests(t *testing.T) {
+	digest := func(s string) []byte {
+		sum := md5.Sum([]byte(s))
+		return sum[:]
+	}
+	tests := []struct {
+		name    string
+		digests [][]byte
+		want    string
+	}{
+		{"two parts", [][]byte{digest("a"), digest("b")}, "96e024ba2074fe77e8e965ba43a704be"},
+		{"order matters", [][]byte{digest("b"), digest("a")}, "f2cb06b385316e99d9d9fb3a0c017f22"},
+		{"one part", [][]byte{digest("part one")}, "a675974b8fb9bfea1d5007ce26896811"},
+		{"no parts", nil, "d41d8cd98f00b204e9800998ecf8427e"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hex.EncodeToString(CombinePartDigests(tt.digests)); got != tt.want {
+				t.Errorf("CombinePartDigests() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitAddress(t *testing.T) {
+	tests := []struct {
+		address     string
+		wantNetwork string
+		wantAddr    string
+	}{
+		{"localhost:5678", "tcp", "localhost:5678"},
+		{":5678", "tcp", ":5678"},
+		{"tcp://10.0.0.1:5678", "tcp", "10.0.0.1:5678"},
+		{"tcp6://[::1]:5678", "tcp6", "[::1]:5678"},
+		{"unix:///run/ccp.sock", "unix", "/run/ccp.sock"},
+		{"unix://@ccp", "unix", "@ccp"},
+		{"unix://", "unix", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			network, addr := SplitAddress(tt.address)
+			if network != tt.wantNetwork || addr != tt.wantAddr {
+				t.Errorf("SplitAddress(%q) = %q, %q, want %q, %q", tt.address, network, addr, tt.wantNetwork,
+					tt.wantAddr)
+			}
+		})
+	}
+}
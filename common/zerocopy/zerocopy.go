@@ -0,0 +1,31 @@
+// Package zerocopy moves file data to and from sockets without copying it
+// through userspace buffers where the platform allows it. On Linux this is
+// sendfile(2) for file to socket and splice(2) for socket to file. Elsewhere,
+// or when the connection does not expose a file descriptor, it falls back to
+// a regular buffered copy.
+package zerocopy
+
+import (
+	"io"
+	"net"
+	"os"
+)
+
+// SendFile writes count bytes of f starting at offset to conn.
+func SendFile(conn net.Conn, f *os.File, offset int64, count int64) (int64, error) {
+	return sendFile(conn, f, offset, count)
+}
+
+// SpliceToFile reads count bytes from conn and writes them to f at its
+// current offset. f must not be opened with O_APPEND.
+func SpliceToFile(f *os.File, conn net.Conn, count int64) (int64, error) {
+	return spliceToFile(f, conn, count)
+}
+
+func copyToConn(conn net.Conn, f *os.File, offset int64, count int64) (int64, error) {
+	return io.Copy(conn, io.NewSectionReader(f, offset, count))
+}
+
+func copyToFile(f *os.File, conn net.Conn, count int64) (int64, error) {
+	return io.CopyN(f, conn, count)
+}
@@ -0,0 +1,139 @@
+//go:build linux
+// +build linux
+
+package zerocopy
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+const (
+	spliceMove     = 0x1
+	spliceNonBlock = 0x2
+
+	// maxSendfileSize is the largest count passed to a single sendfile(2)
+	// call, matching what the kernel transfers at most in one go.
+	maxSendfileSize = 0x7ffff000
+	// pipeSize is the default capacity of a Linux pipe.
+	pipeSize = 64 * 1024
+)
+
+func sendFile(conn net.Conn, f *os.File, offset int64, count int64) (int64, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return copyToConn(conn, f, offset, count)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return copyToConn(conn, f, offset, count)
+	}
+	infd := int(f.Fd())
+	written := int64(0)
+	var serr error
+	err = rc.Write(func(fd uintptr) bool {
+		for written < count {
+			n, e := syscall.Sendfile(int(fd), infd, &offset, int(minInt64(count-written, maxSendfileSize)))
+			if n > 0 {
+				written += int64(n)
+			}
+			switch {
+			case e == syscall.EINTR:
+				continue
+			case e == syscall.EAGAIN:
+				return false
+			case e != nil:
+				serr = os.NewSyscallError("sendfile", e)
+				return true
+			case n == 0:
+				serr = io.ErrUnexpectedEOF
+				return true
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = serr
+	}
+	if written == 0 && isUnsupported(err) {
+		return copyToConn(conn, f, offset, count)
+	}
+	return written, err
+}
+
+func spliceToFile(f *os.File, conn net.Conn, count int64) (int64, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return copyToFile(f, conn, count)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return copyToFile(f, conn, count)
+	}
+	p := make([]int, 2)
+	if err := syscall.Pipe2(p, syscall.O_CLOEXEC); err != nil {
+		return copyToFile(f, conn, count)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+	outfd := int(f.Fd())
+	// consumed counts bytes taken off the socket, written those that reached
+	// the file. Falling back is only safe while nothing was consumed.
+	consumed := int64(0)
+	written := int64(0)
+	var serr error
+	err = rc.Read(func(fd uintptr) bool {
+		for written < count {
+			n, e := syscall.Splice(int(fd), nil, p[1], nil, int(minInt64(count-written, pipeSize)), spliceMove|spliceNonBlock)
+			switch {
+			case e == syscall.EINTR:
+				continue
+			case e == syscall.EAGAIN:
+				return false
+			case e != nil:
+				serr = os.NewSyscallError("splice", e)
+				return true
+			case n == 0:
+				serr = io.ErrUnexpectedEOF
+				return true
+			}
+			consumed += n
+			for n > 0 {
+				m, e := syscall.Splice(p[0], nil, outfd, nil, int(n), spliceMove)
+				if e == syscall.EINTR {
+					continue
+				}
+				if e != nil {
+					serr = os.NewSyscallError("splice", e)
+					return true
+				}
+				n -= m
+				written += m
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = serr
+	}
+	if consumed == 0 && isUnsupported(err) {
+		return copyToFile(f, conn, count)
+	}
+	return written, err
+}
+
+func isUnsupported(err error) bool {
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return err == syscall.EINVAL || err == syscall.ENOSYS || err == syscall.EOPNOTSUPP
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
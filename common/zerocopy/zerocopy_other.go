@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package zerocopy
+
+import (
+	"net"
+	"os"
+)
+
+func sendFile(conn net.Conn, f *os.File, offset int64, count int64) (int64, error) {
+	return copyToConn(conn, f, offset, count)
+}
+
+func spliceToFile(f *os.File, conn net.Conn, count int64) (int64, error) {
+	return copyToFile(f, conn, count)
+}
@@ -0,0 +1,49 @@
+#!/bin/sh
+# Compares the buffered and zero-copy data paths by copying the same file
+# over loopback with each combination of client and server modes.
+#
+# usage: scripts/bench.sh [size-in-MB] [chunk-size-bytes]
+
+set -e
+
+BIN_DIR=$(cd "$(dirname "$0")/../bin" && pwd)
+SIZE_MB=${1:-1024}
+CHUNK_SIZE=${2:-16777216}
+PORT=5699
+WORK_DIR=$(mktemp -d)
+SRC="$WORK_DIR/src"
+DST="$WORK_DIR/dst"
+
+cleanup() {
+	[ -n "$SERVER_PID" ] && kill "$SERVER_PID" 2>/dev/null || true
+	rm -rf "$WORK_DIR"
+}
+trap cleanup EXIT
+
+dd if=/dev/urandom of="$SRC" bs=1048576 count="$SIZE_MB" 2>/dev/null
+
+run() {
+	server_flags=$1
+	client_flags=$2
+	"$BIN_DIR/ccp_server" -port $PORT $server_flags >/dev/null 2>&1 &
+	SERVER_PID=$!
+	sleep 1
+	start=$(date +%s.%N)
+	"$BIN_DIR/ccp_client" -destination-address localhost:$PORT -local-file "$SRC" \
+		-remote-file "$DST" -chunk-size "$CHUNK_SIZE" $client_flags >/dev/null
+	end=$(date +%s.%N)
+	kill "$SERVER_PID"
+	wait "$SERVER_PID" 2>/dev/null || true
+	SERVER_PID=
+	cmp -s "$SRC" "$DST"
+	rm -f "$DST"
+	printf "%-12s %-12s %8.2fs\n" "${server_flags:-buffered}" "${client_flags:-buffered}" \
+		"$(awk "BEGIN { print $end - $start }")"
+}
+
+echo "file size: ${SIZE_MB}MB, chunk size: ${CHUNK_SIZE}"
+printf "%-12s %-12s %9s\n" server client time
+run "" ""
+run "-zero-copy" ""
+run "" "-zero-copy"
+run "-zero-copy" "-zero-copy"
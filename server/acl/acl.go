@@ -0,0 +1,185 @@
+// Package acl decides which clients may do what to which paths.
+//
+// Clients are not authenticated, so they are only told apart by the address
+// they connect from: their source IP, matched by address or CIDR, or being on
+// a unix socket. There are no tokens or certificates to match rules against.
+package acl
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+type Permission uint8
+
+const (
+	Read Permission = 1 << iota
+	Write
+	Delete
+	List
+)
+
+var permissionNames = []struct {
+	perm Permission
+	name string
+}{
+	{Read, "read"},
+	{Write, "write"},
+	{Delete, "delete"},
+	{List, "list"},
+}
+
+func ParsePermission(name string) (Permission, error) {
+	for _, pn := range permissionNames {
+		if pn.name == name {
+			return pn.perm, nil
+		}
+	}
+	return 0, errors.New("unknown permission " + name)
+}
+
+func (p Permission) String() string {
+	var names []string
+	for _, pn := range permissionNames {
+		if p&pn.perm != 0 {
+			names = append(names, pn.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// Clients matches client addresses.
+type Clients []*net.IPNet
+
+// unixClients stands in Clients for the clients on unix sockets, which
+// have no address.
+var unixClients = &net.IPNet{}
+
+// ParseClients parses CIDRs and IP addresses, "unix" for clients on unix
+// sockets and "*" for any client.
+func ParseClients(clients []string) (Clients, error) {
+	var c Clients
+	for _, client := range clients {
+		if client == "*" {
+			c = append(c, &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+				&net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}, unixClients)
+			continue
+		}
+		if client == "unix" {
+			c = append(c, unixClients)
+			continue
+		}
+		if !strings.Contains(client, "/") {
+			ip := net.ParseIP(client)
+			if ip == nil {
+				return nil, errors.New("invalid client " + client)
+			}
+			c = append(c, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(client)
+		if err != nil {
+			return nil, errors.New("invalid client " + client)
+		}
+		c = append(c, ipNet)
+	}
+	return c, nil
+}
+
+// Contains tells whether c matches the client at ip, nil for clients on
+// unix sockets.
+func (c Clients) Contains(ip net.IP) bool {
+	for _, ipNet := range c {
+		if ip == nil && ipNet == unixClients || ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rule grants Allow to the clients it matches on the paths it matches, and
+// no other permission.
+type Rule struct {
+	clients Clients
+	paths   []string
+	Allow   Permission
+}
+
+// NewRule makes a rule for clients, as taken by ParseClients, and paths. A
+// path ending in "/" matches everything under it, one with glob characters
+// is matched with filepath.Match, and any other matches itself and
+// everything under it. allow names permissions.
+func NewRule(clients []string, paths []string, allow []string) (*Rule, error) {
+	if len(clients) == 0 || len(paths) == 0 {
+		return nil, errors.New("acl rule needs clients and paths")
+	}
+	parsed, err := ParseClients(clients)
+	if err != nil {
+		return nil, err
+	}
+	r := &Rule{clients: parsed}
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "/") {
+			return nil, errors.New("acl path " + path + " is not absolute")
+		}
+		if _, err := filepath.Match(path, ""); err != nil {
+			return nil, errors.New("invalid acl path " + path)
+		}
+		r.paths = append(r.paths, path)
+	}
+	for _, name := range allow {
+		perm, err := ParsePermission(name)
+		if err != nil {
+			return nil, err
+		}
+		r.Allow |= perm
+	}
+	return r, nil
+}
+
+func (r *Rule) matches(ip net.IP, path string) bool {
+	if !r.clients.Contains(ip) {
+		return false
+	}
+	for _, pattern := range r.paths {
+		if matchPath(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPath(pattern string, path string) bool {
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(path, pattern)
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, _ := filepath.Match(pattern, path)
+		return ok
+	}
+	return path == pattern || strings.HasPrefix(path, pattern+"/")
+}
+
+// Rules are checked in order, and the first rule matching the client and
+// path decides. No rules allow everything, while a client and path that no
+// rule matches are denied.
+type Rules []*Rule
+
+// Allows tells whether the client at ip may use perm on path, and the index
+// of the rule that decided it, -1 if none did.
+func (l Rules) Allows(ip net.IP, path string, perm Permission) (bool, int) {
+	if len(l) == 0 {
+		return true, -1
+	}
+	for i, r := range l {
+		if r.matches(ip, path) {
+			return r.Allow&perm == perm, i
+		}
+	}
+	return false, -1
+}
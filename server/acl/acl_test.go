@@ -0,0 +1,182 @@
+package acl
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParsePermission(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Permission
+		wantErr bool
+	}{
+		{"read", Read, false},
+		{"write", Write, false},
+		{"delete", Delete, false},
+		{"list", List, false},
+		{"Read", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePermission(tt.name)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("ParsePermission(%q) = %v, %v, want %v, error %v", tt.name, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPermissionString(t *testing.T) {
+	tests := []struct {
+		perm Permission
+		want string
+	}{
+		{0, "none"},
+		{Read, "read"},
+		{Read | Write, "read,write"},
+		{Write | List, "write,list"},
+	}
+	for _, tt := range tests {
+		if got := tt.perm.String(); got != tt.want {
+			t.Errorf("Permission(%d).String() = %s, want %s", tt.perm, got, tt.want)
+		}
+	}
+}
+
+func TestClientsContains(t *testing.T) {
+	tests := []struct {
+		name    string
+		clients []string
+		ip      net.IP
+		want    bool
+	}{
+		{"address", []string{"10.1.2.3"}, net.ParseIP("10.1.2.3"), true},
+		{"other address", []string{"10.1.2.3"}, net.ParseIP("10.1.2.4"), false},
+		{"cidr", []string{"10.1.0.0/16"}, net.ParseIP("10.1.200.7"), true},
+		{"outside cidr", []string{"10.1.0.0/16"}, net.ParseIP("10.2.0.1"), false},
+		{"ipv6", []string{"::1"}, net.ParseIP("::1"), true},
+		{"ipv6 cidr", []string{"fd00::/8"}, net.ParseIP("fd12::1"), true},
+		{"unix", []string{"unix"}, nil, true},
+		{"unix is not an address", []string{"unix"}, net.ParseIP("10.1.2.3"), false},
+		{"address is not unix", []string{"10.1.0.0/16"}, nil, false},
+		{"any ipv4", []string{"*"}, net.ParseIP("192.168.1.1"), true},
+		{"any ipv6", []string{"*"}, net.ParseIP("2001:db8::1"), true},
+		{"any unix", []string{"*"}, nil, true},
+		{"second client", []string{"10.1.2.3", "10.9.0.0/16"}, net.ParseIP("10.9.1.1"), true},
+		{"none", nil, net.ParseIP("10.1.2.3"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseClients(tt.clients)
+			if err != nil {
+				t.Fatalf("ParseClients(%q) error = %v", tt.clients, err)
+			}
+			if got := c.Contains(tt.ip); got != tt.want {
+				t.Errorf("Contains(%v) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseClientsInvalid(t *testing.T) {
+	for _, client := range []string{"", "host.example", "10.1.2", "10.1.0.0/33", "10.1.0.0/"} {
+		if _, err := ParseClients([]string{client}); err == nil {
+			t.Errorf("ParseClients(%q) succeeded", client)
+		}
+	}
+}
+
+func TestNewRuleInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		clients []string
+		paths   []string
+		allow   []string
+	}{
+		{"no clients", nil, []string{"/srv/"}, []string{"read"}},
+		{"no paths", []string{"*"}, nil, []string{"read"}},
+		{"relative path", []string{"*"}, []string{"srv/"}, []string{"read"}},
+		{"bad glob", []string{"*"}, []string{"/srv/[a"}, []string{"read"}},
+		{"bad client", []string{"nope"}, []string{"/srv/"}, []string{"read"}},
+		{"bad permission", []string{"*"}, []string{"/srv/"}, []string{"admin"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRule(tt.clients, tt.paths, tt.allow); err == nil {
+				t.Error("NewRule() succeeded")
+			}
+		})
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"/srv/", "/srv/a", true},
+		{"/srv/", "/srv/a/b", true},
+		{"/srv/", "/srv", false},
+		{"/srv/", "/srvx/a", false},
+		{"/srv", "/srv", true},
+		{"/srv", "/srv/a/b", true},
+		{"/srv", "/srvx", false},
+		{"/srv/*.log", "/srv/a.log", true},
+		{"/srv/*.log", "/srv/a/b.log", false},
+		{"/srv/?.bin", "/srv/a.bin", true},
+		{"/srv/[ab].bin", "/srv/c.bin", false},
+	}
+	for _, tt := range tests {
+		if got := matchPath(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("matchPath(%s, %s) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRulesAllows(t *testing.T) {
+	rule := func(clients []string, paths []string, allow []string) *Rule {
+		r, err := NewRule(clients, paths, allow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	rules := Rules{
+		rule([]string{"*"}, []string{"/srv/archive/"}, []string{"read"}),
+		rule([]string{"10.1.0.0/16", "unix"}, []string{"/srv/"}, []string{"read", "write"}),
+		rule([]string{"10.1.9.9"}, []string{"/tmp"}, nil),
+	}
+	local := net.ParseIP("10.1.2.3")
+	remote := net.ParseIP("192.168.1.1")
+	tests := []struct {
+		name      string
+		rules     Rules
+		ip        net.IP
+		path      string
+		perm      Permission
+		want      bool
+		wantIndex int
+	}{
+		{"no rules", nil, remote, "/anything", Write, true, -1},
+		{"first rule reads", rules, remote, "/srv/archive/a", Read, true, 0},
+		{"first rule decides", rules, local, "/srv/archive/a", Write, false, 0},
+		{"second rule writes", rules, local, "/srv/data/a", Write, true, 1},
+		{"not granted", rules, local, "/srv/data/a", Delete, false, 1},
+		{"unix writes", rules, nil, "/srv/data/a", Write, true, 1},
+		{"both needed", rules, local, "/srv/data/a", Read | Write, true, 1},
+		{"client not matched", rules, remote, "/srv/data/a", Read, false, -1},
+		{"empty allow denies", rules, net.ParseIP("10.1.9.9"), "/tmp/a", Read, false, 2},
+		{"path not matched", rules, local, "/etc/passwd", Read, false, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, index := tt.rules.Allows(tt.ip, tt.path, tt.perm)
+			if got != tt.want || index != tt.wantIndex {
+				t.Errorf("Allows() = %v, %d, want %v, %d", got, index, tt.want, tt.wantIndex)
+			}
+		})
+	}
+}
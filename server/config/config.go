@@ -0,0 +1,443 @@
+// Package config loads the server's configuration from a TOML file.
+//
+//	[server]
+//	port = "5678"
+//	worker_count = 8
+//
+//	[log]
+//	level = "debug"
+//
+// Keys left out keep their defaults, and unknown keys are rejected so that
+// typos do not go unnoticed.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/server/acl"
+	"github.com/chili-copy/server/quota"
+	"github.com/chili-copy/server/storage"
+)
+
+type Config struct {
+	Server  ServerConfig  `toml:"server"`
+	Storage StorageConfig `toml:"storage"`
+	Log     LogConfig     `toml:"log"`
+	Limits  LimitsConfig  `toml:"limits"`
+	Hooks   HooksConfig   `toml:"hooks"`
+	ACL     []ACLRule     `toml:"acl"`
+	Quota   QuotaConfig   `toml:"quota"`
+	Peers   []PeerConfig  `toml:"peer"`
+}
+
+type ServerConfig struct {
+	Port           string `toml:"port"`
+	WorkerCount    int    `toml:"worker_count"`
+	ConnQueueSize  int    `toml:"conn_queue_size"`
+	MetricsAddress string `toml:"metrics_address"`
+	AdminAddress   string `toml:"admin_address"`
+	// ConnMode is pool to queue connections for worker_count workers, or
+	// goroutine to serve each on its own, with at most max_data_ops ops
+	// moving file data and max_control_ops others at once.
+	ConnMode      string `toml:"conn_mode"`
+	MaxDataOps    int    `toml:"max_data_ops"`
+	MaxControlOps int    `toml:"max_control_ops"`
+	// Listen are the addresses to listen on, as taken by ListenAddresses,
+	// instead of port on all interfaces.
+	Listen []string `toml:"listen"`
+}
+
+type StorageConfig struct {
+	// Backend is where files are stored: local, s3 or memory.
+	Backend string `toml:"backend"`
+	// Root is the directory client paths are relative to. Clients may copy
+	// to any path if it is empty.
+	Root              string   `toml:"root"`
+	ScratchDir        string   `toml:"scratch_dir"`
+	ScratchOnTargetFS bool     `toml:"scratch_on_target_fs"`
+	Durability        string   `toml:"durability"`
+	ZeroCopy          bool     `toml:"zero_copy"`
+	Preallocate       bool     `toml:"preallocate"`
+	S3                S3Config `toml:"s3"`
+}
+
+// S3Config is used by the s3 backend. The keys default to the
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.
+type S3Config struct {
+	Endpoint  string `toml:"endpoint"`
+	Region    string `toml:"region"`
+	Bucket    string `toml:"bucket"`
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+	PathStyle bool   `toml:"path_style"`
+}
+
+type LogConfig struct {
+	Level  string `toml:"level"`
+	Format string `toml:"format"`
+}
+
+// HooksConfig names executables run before a copy is accepted and after
+// it is committed. See controller.CommandHooks.
+type HooksConfig struct {
+	PreAccept  string `toml:"pre_accept"`
+	PostCommit string `toml:"post_commit"`
+	// Timeout is how long a hook may run, eg. "30s".
+	Timeout string `toml:"timeout"`
+}
+
+// ACLRule grants the clients it matches permissions on the paths it
+// matches. See acl.NewRule.
+type ACLRule struct {
+	Clients []string `toml:"clients"`
+	Paths   []string `toml:"paths"`
+	Allow   []string `toml:"allow"`
+}
+
+// QuotaConfig limits what each client may copy. Zero values are not
+// limited. Clients matched by a rule get the rule's limits instead.
+type QuotaConfig struct {
+	MaxSessions     int    `toml:"max_sessions"`
+	MaxSessionBytes uint64 `toml:"max_session_bytes"`
+	MaxBytes        uint64 `toml:"max_bytes"`
+	// Window is the period max_bytes applies to, eg. "1h".
+	Window      string        `toml:"window"`
+	MaxFileSize uint64        `toml:"max_file_size"`
+	Clients     []ClientQuota `toml:"client"`
+}
+
+// ClientQuota gives the clients it matches their own limits. Limits left
+// out are not limited, and the window defaults to the one of [quota].
+type ClientQuota struct {
+	Clients         []string `toml:"clients"`
+	MaxSessions     int      `toml:"max_sessions"`
+	MaxSessionBytes uint64   `toml:"max_session_bytes"`
+	MaxBytes        uint64   `toml:"max_bytes"`
+	Window          string   `toml:"window"`
+	MaxFileSize     uint64   `toml:"max_file_size"`
+}
+
+// PeerConfig names a server that clients may have files relayed to. See
+// controller.Peer.
+type PeerConfig struct {
+	Name    string `toml:"name"`
+	Address string `toml:"address"`
+	// Clients may relay to the peer, all of them if it is left out.
+	Clients   []string `toml:"clients"`
+	Multiplex bool     `toml:"multiplex"`
+	ChunkSize uint64   `toml:"chunk_size"`
+	Workers   int      `toml:"workers"`
+}
+
+// AllowedClients are the parsed clients of the peer.
+func (p PeerConfig) AllowedClients() (acl.Clients, error) {
+	if len(p.Clients) == 0 {
+		return acl.ParseClients([]string{"*"})
+	}
+	return acl.ParseClients(p.Clients)
+}
+
+type LimitsConfig struct {
+	// MaxFileSize is the largest file, in bytes, a client may copy. 0 means
+	// no limit.
+	MaxFileSize uint64 `toml:"max_file_size"`
+	// QueueTimeout is how long an accepted connection may wait for a free
+	// slot in a full queue before it is told the server is busy, eg.
+	// "500ms". "0s" turns it away at once.
+	QueueTimeout string `toml:"queue_timeout"`
+	// BusyRetryAfter is how long clients told the server is busy are asked
+	// to wait before retrying, eg. "1s".
+	BusyRetryAfter string `toml:"busy_retry_after"`
+	// HeaderTimeout, IdleTimeout and OpTimeout bound waiting for the header
+	// of a connection, an op moving no data and a whole op, eg. "10s". "0s"
+	// never times out.
+	HeaderTimeout string `toml:"header_timeout"`
+	IdleTimeout   string `toml:"idle_timeout"`
+	OpTimeout     string `toml:"op_timeout"`
+	// SessionTimeout is how long a multipart copy may go without receiving
+	// a part before it is dropped with its parts, eg. "1h". "0s" keeps it
+	// until it is completed or aborted.
+	SessionTimeout string `toml:"session_timeout"`
+}
+
+// Timeouts are the parsed timeouts of [limits].
+type Timeouts struct {
+	Header  time.Duration
+	Idle    time.Duration
+	Op      time.Duration
+	Session time.Duration
+}
+
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:          "5678",
+			WorkerCount:   runtime.NumCPU(),
+			ConnQueueSize: runtime.NumCPU() * 10,
+			ConnMode:      "pool",
+			MaxDataOps:    64,
+			MaxControlOps: 256,
+		},
+		Storage: StorageConfig{
+			Backend:    "local",
+			ScratchDir: storage.DefaultScratchDir,
+			Durability: "request",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Limits: LimitsConfig{
+			QueueTimeout:   "500ms",
+			BusyRetryAfter: "1s",
+			HeaderTimeout:  "10s",
+			IdleTimeout:    "1m",
+			OpTimeout:      "0s",
+			SessionTimeout: "1h",
+		},
+		Hooks: HooksConfig{
+			Timeout: "30s",
+		},
+		Quota: QuotaConfig{
+			Window: "1h",
+		},
+	}
+}
+
+// Load reads the file at path over the defaults and validates the result.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	md, err := toml.DecodeFile(path, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return nil, fmt.Errorf("unknown keys in %s: %s", path, strings.Join(keys, ", "))
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", path, err.Error())
+	}
+	return cfg, nil
+}
+
+// Validate checks the settings that can be checked without the rest of the
+// server. The durability mode and scratch dir are checked as they are
+// applied.
+func (c *Config) Validate() error {
+	if c.Server.Port == "" && len(c.Server.Listen) == 0 {
+		return errors.New("server.port is empty")
+	}
+	for _, address := range c.Server.Listen {
+		network, addr := common.SplitAddress(address)
+		switch network {
+		case "tcp", "tcp4", "tcp6", "unix":
+		default:
+			return fmt.Errorf("unknown network of server.listen address %s", address)
+		}
+		if addr == "" {
+			return fmt.Errorf("server.listen address %s is empty", address)
+		}
+	}
+	if c.Server.WorkerCount < 1 {
+		return errors.New("server.worker_count must be at least 1")
+	}
+	if c.Server.ConnQueueSize < 0 {
+		return errors.New("server.conn_queue_size must not be negative")
+	}
+	switch c.Server.ConnMode {
+	case "pool":
+	case "goroutine":
+		if c.Server.MaxDataOps < 1 || c.Server.MaxControlOps < 1 {
+			return errors.New("server.max_data_ops and server.max_control_ops must be at least 1")
+		}
+	default:
+		return fmt.Errorf("unknown server.conn_mode %s", c.Server.ConnMode)
+	}
+	switch c.Storage.Backend {
+	case "local", "memory":
+	case "s3":
+		if c.Storage.S3.Bucket == "" {
+			return errors.New("storage.s3.bucket is empty")
+		}
+	default:
+		return fmt.Errorf("unknown storage.backend %s", c.Storage.Backend)
+	}
+	if timeout, err := time.ParseDuration(c.Hooks.Timeout); err != nil || timeout <= 0 {
+		return fmt.Errorf("hooks.timeout %q is not a positive duration", c.Hooks.Timeout)
+	}
+	if _, err := c.QueueTimeout(); err != nil {
+		return err
+	}
+	if _, err := c.BusyRetryAfter(); err != nil {
+		return err
+	}
+	if _, err := c.Timeouts(); err != nil {
+		return err
+	}
+	if _, err := c.ACLRules(); err != nil {
+		return err
+	}
+	if _, err := c.QuotaPolicy(); err != nil {
+		return err
+	}
+	if err := c.validatePeers(); err != nil {
+		return err
+	}
+	if _, err := logger.ParseLevel(c.Log.Level); err != nil {
+		return err
+	}
+	if _, err := logger.ParseFormat(c.Log.Format); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *Config) validatePeers() error {
+	names := make(map[string]bool, len(c.Peers))
+	for i, p := range c.Peers {
+		if p.Name == "" {
+			return fmt.Errorf("peer %d: name is empty", i+1)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("peer %s is configured twice", p.Name)
+		}
+		names[p.Name] = true
+		network, addr := common.SplitAddress(p.Address)
+		switch network {
+		case "tcp", "tcp4", "tcp6", "unix":
+		default:
+			return fmt.Errorf("peer %s: unknown network of address %s", p.Name, p.Address)
+		}
+		if addr == "" {
+			return fmt.Errorf("peer %s: address is empty", p.Name)
+		}
+		if p.Workers < 0 {
+			return fmt.Errorf("peer %s: workers must not be negative", p.Name)
+		}
+		if _, err := p.AllowedClients(); err != nil {
+			return fmt.Errorf("peer %s: %s", p.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// ListenAddresses are the addresses of server.listen, eg. "tcp://:5678",
+// "tcp6://[::1]:5678", "10.0.0.1:5678" or "unix:///run/ccp.sock", or if
+// it is empty, server.port on all interfaces.
+func (c *Config) ListenAddresses() []string {
+	if len(c.Server.Listen) > 0 {
+		return c.Server.Listen
+	}
+	return []string{":" + c.Server.Port}
+}
+
+func (c *Config) QueueTimeout() (time.Duration, error) {
+	return limitDuration("queue_timeout", c.Limits.QueueTimeout)
+}
+
+// BusyRetryAfter is sent to clients in whole milliseconds, so it is
+// rounded down to them.
+func (c *Config) BusyRetryAfter() (time.Duration, error) {
+	d, err := limitDuration("busy_retry_after", c.Limits.BusyRetryAfter)
+	if err != nil {
+		return 0, err
+	}
+	if d > math.MaxUint32*time.Millisecond {
+		return 0, fmt.Errorf("limits.busy_retry_after %q is too long", c.Limits.BusyRetryAfter)
+	}
+	return d.Truncate(time.Millisecond), nil
+}
+
+func (c *Config) Timeouts() (Timeouts, error) {
+	var t Timeouts
+	var err error
+	if t.Header, err = limitDuration("header_timeout", c.Limits.HeaderTimeout); err != nil {
+		return Timeouts{}, err
+	}
+	if t.Idle, err = limitDuration("idle_timeout", c.Limits.IdleTimeout); err != nil {
+		return Timeouts{}, err
+	}
+	if t.Op, err = limitDuration("op_timeout", c.Limits.OpTimeout); err != nil {
+		return Timeouts{}, err
+	}
+	if t.Session, err = limitDuration("session_timeout", c.Limits.SessionTimeout); err != nil {
+		return Timeouts{}, err
+	}
+	return t, nil
+}
+
+func limitDuration(key string, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("limits.%s %q is not a duration of 0 or more", key, value)
+	}
+	return d, nil
+}
+
+// ACLRules returns the [[acl]] rules in the order they are checked.
+func (c *Config) ACLRules() (acl.Rules, error) {
+	var rules acl.Rules
+	for i, rc := range c.ACL {
+		rule, err := acl.NewRule(rc.Clients, rc.Paths, rc.Allow)
+		if err != nil {
+			return nil, fmt.Errorf("acl rule %d: %s", i+1, err.Error())
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// QuotaPolicy returns the [quota] limits and the rules of its
+// [[quota.client]] tables.
+func (c *Config) QuotaPolicy() (quota.Policy, error) {
+	q := c.Quota
+	defaults, err := quotaLimits(q.MaxSessions, q.MaxSessionBytes, q.MaxBytes, q.Window, q.MaxFileSize)
+	if err != nil {
+		return quota.Policy{}, fmt.Errorf("quota: %s", err.Error())
+	}
+	policy := quota.Policy{Default: defaults}
+	for i, cq := range q.Clients {
+		window := cq.Window
+		if window == "" {
+			window = q.Window
+		}
+		limits, err := quotaLimits(cq.MaxSessions, cq.MaxSessionBytes, cq.MaxBytes, window, cq.MaxFileSize)
+		if err != nil {
+			return quota.Policy{}, fmt.Errorf("quota client %d: %s", i+1, err.Error())
+		}
+		clients, err := acl.ParseClients(cq.Clients)
+		if err != nil {
+			return quota.Policy{}, fmt.Errorf("quota client %d: %s", i+1, err.Error())
+		}
+		policy.Rules = append(policy.Rules, quota.Rule{Clients: clients, Limits: limits})
+	}
+	return policy, nil
+}
+
+func quotaLimits(maxSessions int, maxSessionBytes uint64, maxBytes uint64, window string, maxFileSize uint64) (quota.Limits, error) {
+	if maxSessions < 0 {
+		return quota.Limits{}, errors.New("max_sessions must not be negative")
+	}
+	limits := quota.Limits{MaxSessions: maxSessions, MaxSessionBytes: maxSessionBytes, MaxBytes: maxBytes,
+		MaxFileSize: maxFileSize}
+	if maxBytes > 0 {
+		d, err := time.ParseDuration(window)
+		if err != nil || d <= 0 {
+			return quota.Limits{}, fmt.Errorf("window %q is not a positive duration", window)
+		}
+		limits.Window = d
+	}
+	return limits, nil
+}
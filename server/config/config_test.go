@@ -0,0 +1,175 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chili-copy/server/quota"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		toml    string
+		wantErr bool
+		check   func(c *Config) bool
+	}{
+		{"empty keeps defaults", "", false, func(c *Config) bool { return reflect.DeepEqual(c, Default()) }},
+		{"overrides", "[server]\nport = \"9000\"\nworker_count = 3\n[log]\nlevel = \"debug\"\n", false,
+			func(c *Config) bool {
+				return c.Server.Port == "9000" && c.Server.WorkerCount == 3 && c.Log.Level == "debug" &&
+					c.Log.Format == "text"
+			}},
+		{"storage and limits", "[storage]\ndurability = \"always\"\nzero_copy = true\n[limits]\nmax_file_size = 10\n",
+			false, func(c *Config) bool {
+				return c.Storage.Durability == "always" && c.Storage.ZeroCopy && c.Limits.MaxFileSize == 10
+			}},
+		{"acl and peers", `
+[[acl]]
+clients = ["10.0.0.0/8"]
+paths = ["/data/"]
+allow = ["read", "write"]
+
+[[peer]]
+name = "backup"
+address = "10.0.0.2:5678"
+`, false, func(c *Config) bool { return len(c.ACL) == 1 && len(c.Peers) == 1 }},
+		{"unknown key", "[server]\nprot = \"9000\"\n", true, nil},
+		{"wrong type", "[server]\nport = 9000\n", true, nil},
+		{"no port", "[server]\nport = \"\"\n", true, nil},
+		{"no workers", "[server]\nworker_count = 0\n", true, nil},
+		{"negative queue", "[server]\nconn_queue_size = -1\n", true, nil},
+		{"unknown conn mode", "[server]\nconn_mode = \"threads\"\n", true, nil},
+		{"goroutine mode without data ops", "[server]\nconn_mode = \"goroutine\"\nmax_data_ops = 0\n", true, nil},
+		{"listen", "[server]\nport = \"\"\nlisten = [\"tcp://:5678\", \"unix:///run/ccp.sock\"]\n", false, nil},
+		{"listen on unknown network", "[server]\nlisten = [\"udp://:5678\"]\n", true, nil},
+		{"listen on empty address", "[server]\nlisten = [\"unix://\"]\n", true, nil},
+		{"unknown backend", "[storage]\nbackend = \"tape\"\n", true, nil},
+		{"s3 without bucket", "[storage]\nbackend = \"s3\"\n", true, nil},
+		{"s3", "[storage]\nbackend = \"s3\"\n[storage.s3]\nbucket = \"b\"\n", false, nil},
+		{"bad hooks timeout", "[hooks]\ntimeout = \"0s\"\n", true, nil},
+		{"bad queue timeout", "[limits]\nqueue_timeout = \"soon\"\n", true, nil},
+		{"negative idle timeout", "[limits]\nidle_timeout = \"-1s\"\n", true, nil},
+		{"bad session timeout", "[limits]\nsession_timeout = \"forever\"\n", true, nil},
+		{"busy retry after too long", "[limits]\nbusy_retry_after = \"2000h\"\n", true, nil},
+		{"bad acl rule", "[[acl]]\nclients = [\"*\"]\npaths = [\"/\"]\nallow = [\"admin\"]\n", true, nil},
+		{"bad quota window", "[quota]\nmax_bytes = 10\nwindow = \"0s\"\n", true, nil},
+		{"negative quota sessions", "[quota]\nmax_sessions = -1\n", true, nil},
+		{"peer without name", "[[peer]]\naddress = \"10.0.0.2:5678\"\n", true, nil},
+		{"peer twice", "[[peer]]\nname = \"p\"\naddress = \"a:1\"\n[[peer]]\nname = \"p\"\naddress = \"b:1\"\n", true, nil},
+		{"peer with bad clients", "[[peer]]\nname = \"p\"\naddress = \"a:1\"\nclients = [\"10.0.0.0/99\"]\n", true, nil},
+		{"bad log level", "[log]\nlevel = \"loud\"\n", true, nil},
+		{"bad log format", "[log]\nformat = \"xml\"\n", true, nil},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, string(rune('a'+i))+".toml")
+			if err := ioutil.WriteFile(path, []byte(tt.toml), 0644); err != nil {
+				t.Fatal(err)
+			}
+			c, err := Load(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && tt.check != nil && !tt.check(c) {
+				t.Errorf("Load() = %+v", c)
+			}
+		})
+	}
+}
+
+func TestBusyRetryAfter(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"1s", time.Second, false},
+		{"1500us", time.Millisecond, false},
+		{"0s", 0, false},
+		{"-1s", 0, true},
+		{"2000h", 0, true},
+	}
+	for _, tt := range tests {
+		c := Default()
+		c.Limits.BusyRetryAfter = tt.value
+		got, err := c.BusyRetryAfter()
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("BusyRetryAfter() of %s = %s, %v, want %s, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestListenAddresses(t *testing.T) {
+	tests := []struct {
+		port   string
+		listen []string
+		want   []string
+	}{
+		{"5678", nil, []string{":5678"}},
+		{"5678", []string{"unix:///run/ccp.sock"}, []string{"unix:///run/ccp.sock"}},
+	}
+	for _, tt := range tests {
+		c := Default()
+		c.Server.Port, c.Server.Listen = tt.port, tt.listen
+		if got := c.ListenAddresses(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ListenAddresses() = %v, want %v", got, tt.want)
+		}
+	}
+}
+
+func TestQuotaPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		quota       QuotaConfig
+		wantDefault quota.Limits
+		wantRules   []quota.Limits
+		wantErr     bool
+	}{
+		{"none", QuotaConfig{Window: "1h"}, quota.Limits{}, nil, false},
+		{"window only with max bytes", QuotaConfig{MaxSessions: 2, Window: "1h"}, quota.Limits{MaxSessions: 2}, nil,
+			false},
+		{"default", QuotaConfig{MaxBytes: 10, Window: "1h", MaxFileSize: 5},
+			quota.Limits{MaxBytes: 10, Window: time.Hour, MaxFileSize: 5}, nil, false},
+		{"client inherits window", QuotaConfig{Window: "1h", Clients: []ClientQuota{{Clients: []string{"*"}, MaxBytes: 7}}},
+			quota.Limits{}, []quota.Limits{{MaxBytes: 7, Window: time.Hour}}, false},
+		{"client window", QuotaConfig{Window: "1h",
+			Clients: []ClientQuota{{Clients: []string{"*"}, MaxBytes: 7, Window: "10m"}}},
+			quota.Limits{}, []quota.Limits{{MaxBytes: 7, Window: 10 * time.Minute}}, false},
+		{"client with bad clients", QuotaConfig{Window: "1h", Clients: []ClientQuota{{Clients: []string{"nope/8"}}}},
+			quota.Limits{}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			c.Quota = tt.quota
+			policy, err := c.QuotaPolicy()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("QuotaPolicy() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if policy.Default != tt.wantDefault {
+				t.Errorf("default limits = %+v, want %+v", policy.Default, tt.wantDefault)
+			}
+			if len(policy.Rules) != len(tt.wantRules) {
+				t.Fatalf("%d rules, want %d", len(policy.Rules), len(tt.wantRules))
+			}
+			for i, rule := range policy.Rules {
+				if rule.Limits != tt.wantRules[i] {
+					t.Errorf("rule %d limits = %+v, want %+v", i, rule.Limits, tt.wantRules[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"net"
+	"strings"
+
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/common/protocol"
+	"github.com/chili-copy/server/acl"
+	"github.com/chili-copy/server/writer"
+)
+
+// allowed checks the op in headerBytes against the ACL, and sends an access
+// denied error if the client may not perform it. Ops whose path cannot be
+// told, such as parts of an unknown copy, are left for their handlers to
+// fail.
+func (cc *ChiliController) allowed(opType protocol.OpType, headerBytes []byte, conn net.Conn, log *logger.Logger) bool {
+	rules := cc.Settings().ACL
+	if len(rules) == 0 {
+		return true
+	}
+	perm, path, ok := cc.opAccess(opType, headerBytes)
+	if !ok {
+		return true
+	}
+	allowed, rule := rules.Allows(remoteIP(conn), path, perm)
+	if allowed {
+		return true
+	}
+	log = log.With("path", path, "permission", perm)
+	if rule >= 0 {
+		log = log.With("acl_rule", rule+1)
+	}
+	cc.errorResponseWithMessage(protocol.ErrorAccessDenied, perm.String()+" not allowed", conn, log)
+	return false
+}
+
+// opAccess returns the permission an op needs and the path it needs it on.
+// Parts, completes and aborts of multipart copies need to write to the path
+// the copy was initiated for.
+func (cc *ChiliController) opAccess(opType protocol.OpType, headerBytes []byte) (acl.Permission, string, bool) {
+	var op pathOp
+	perm := acl.Write
+	switch opType {
+	case protocol.SingleCopyOpType:
+		op = protocol.NewSingleCopyOp(headerBytes)
+	case protocol.MultiPartCopyInitOpType:
+		op = protocol.NewMultiPartCopyOp(headerBytes)
+	case protocol.MultiPartCopyPartRequestOpType:
+		copyId, err := protocol.ParseCopyId(headerBytes)
+		if err != nil {
+			return 0, "", false
+		}
+		return cc.multiPartCopyAccess(copyId)
+	case protocol.MultiPartCopyCompleteOpType:
+		mcc, err := protocol.NewMultiPartCopyCompleteOp(headerBytes)
+		if err != nil {
+			return 0, "", false
+		}
+		return cc.multiPartCopyAccess(mcc.GetCopyId())
+	case protocol.MultiPartCopyAbortOpType:
+		copyId, err := protocol.ParseCopyId(headerBytes)
+		if err != nil {
+			return 0, "", false
+		}
+		return cc.multiPartCopyAccess(copyId)
+	case protocol.StatRequestOpType:
+		op, perm = protocol.NewStatOp(headerBytes), acl.Read
+	case protocol.ReadRequestOpType:
+		op, perm = protocol.NewReadOp(headerBytes), acl.Read
+	case protocol.RelayRequestOpType:
+		op, perm = protocol.NewRelayOp(headerBytes), acl.Read
+	case protocol.DeleteRequestOpType:
+		op, perm = protocol.NewDeleteOp(headerBytes), acl.Delete
+	case protocol.ListRequestOpType:
+		// A directory is matched as the files in it, so that a rule for
+		// "/srv/" covers listing /srv.
+		lo := protocol.NewListOp(headerBytes)
+		cc.rootPath(lo)
+		return acl.List, strings.TrimSuffix(lo.GetFilePath(), "/") + "/", true
+	default:
+		return 0, "", false
+	}
+	cc.rootPath(op)
+	return perm, op.GetFilePath(), true
+}
+
+func (cc *ChiliController) multiPartCopyAccess(copyId string) (acl.Permission, string, bool) {
+	mcop, ok := cc.onGoingMultiCopiesByIds.Load(copyId)
+	if !ok {
+		return 0, "", false
+	}
+	return acl.Write, mcop.(*writer.MultiPartCopyHandler).CopyOp.GetFilePath(), true
+}
+
+// remoteIP returns the address of the client of conn, nil for clients on
+// unix sockets.
+func remoteIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// clientName is what the quotas of the client at ip are kept under. Clients
+// on unix sockets share theirs.
+func clientName(ip net.IP) string {
+	if ip == nil {
+		return "unix"
+	}
+	return ip.String()
+}
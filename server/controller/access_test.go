@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		network  string
+		address  string
+		wantIP   net.IP
+		wantName string
+	}{
+		{"tcp", "127.0.0.1:0", net.ParseIP("127.0.0.1"), "127.0.0.1"},
+		{"unix", filepath.Join(dir, "ccp.sock"), nil, "unix"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			ln, err := net.Listen(tt.network, tt.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				conn, err := net.Dial(tt.network, ln.Addr().String())
+				if err == nil {
+					defer conn.Close()
+					conn.Read(make([]byte, 1))
+				}
+			}()
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			ip := remoteIP(conn)
+			if (ip == nil) != (tt.wantIP == nil) || !ip.Equal(tt.wantIP) {
+				t.Errorf("remoteIP() = %v, want %v", ip, tt.wantIP)
+			}
+			if name := clientName(ip); name != tt.wantName {
+				t.Errorf("clientName(%v) = %s, want %s", ip, name, tt.wantName)
+			}
+		})
+	}
+}
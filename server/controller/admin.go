@@ -0,0 +1,172 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/common/protocol"
+	"github.com/chili-copy/server/writer"
+)
+
+var (
+	ErrCopyNotFound = errors.New("no ongoing copy matches")
+	ErrCopyBusy     = errors.New("copy is being stitched or aborted")
+)
+
+const (
+	singleCopyType    = "single"
+	multiPartCopyType = "multipart"
+)
+
+// CopyStatus describes an ongoing copy for the admin API.
+type CopyStatus struct {
+	Type          string    `json:"type"`
+	Path          string    `json:"path"`
+	CopyId        string    `json:"copy_id,omitempty"`
+	State         string    `json:"state"`
+	PartsReceived uint64    `json:"parts_received"`
+	BytesReceived uint64    `json:"bytes_received"`
+	BytesTotal    uint64    `json:"bytes_total"`
+	Client        string    `json:"client"`
+	Started       time.Time `json:"started"`
+	AgeSeconds    float64   `json:"age_seconds"`
+	// PathLocked is false for a multipart copy whose path an operator has
+	// released.
+	PathLocked bool `json:"path_locked"`
+}
+
+// OngoingCopies lists single copies being received and multipart copies
+// that have been initiated but not completed, oldest first.
+func (cc *ChiliController) OngoingCopies() []CopyStatus {
+	now := time.Now()
+	copies := []CopyStatus{}
+	cc.onGoingCopyOpsByPath.Range(func(key, value interface{}) bool {
+		if sc, ok := value.(*writer.SingleCopyHandler); ok {
+			copies = append(copies, CopyStatus{
+				Type:          singleCopyType,
+				Path:          sc.CopyOp.GetFilePath(),
+				State:         protocol.INPROGRESS.String(),
+				BytesReceived: sc.ReceivedBytes(),
+				BytesTotal:    sc.CopyOp.GetContentLength(),
+				Client:        sc.Conn.RemoteAddr().String(),
+				Started:       sc.Started,
+				AgeSeconds:    now.Sub(sc.Started).Seconds(),
+				PathLocked:    true,
+			})
+		}
+		return true
+	})
+	cc.onGoingMultiCopiesByIds.Range(func(key, value interface{}) bool {
+		mph := value.(*writer.MultiPartCopyHandler)
+		held, _ := cc.onGoingCopyOpsByPath.Load(mph.CopyOp.GetFilePath())
+		copies = append(copies, CopyStatus{
+			Type:          multiPartCopyType,
+			Path:          mph.CopyOp.GetFilePath(),
+			CopyId:        mph.CopyOp.GetCopyId().String(),
+			State:         mph.CopyOp.GetState().String(),
+			PartsReceived: atomic.LoadUint64(&mph.TotalPartsCopied),
+			BytesReceived: mph.ReceivedBytes(),
+			BytesTotal:    mph.CopyOp.GetFileSize(),
+			Client:        mph.Remote,
+			Started:       mph.Started,
+			AgeSeconds:    now.Sub(mph.Started).Seconds(),
+			PathLocked:    held == mph,
+		})
+		return true
+	})
+	sort.Slice(copies, func(i, j int) bool {
+		return copies[i].Started.Before(copies[j].Started)
+	})
+	return copies
+}
+
+// AbortCopy drops a multipart copy and its parts. The client's later parts
+// and its complete request fail as the copyId is no longer known.
+func (cc *ChiliController) AbortCopy(copyId string) error {
+	mph, err := cc.abortCopy(copyId)
+	if err != nil {
+		return err
+	}
+	logger.Warn("aborted multipart copy by admin request", "copy_id", copyId, "path", mph.CopyOp.GetFilePath())
+	return nil
+}
+
+// abortCopy drops the multipart copy copyId unless it is being stitched or
+// was aborted already.
+func (cc *ChiliController) abortCopy(copyId string) (*writer.MultiPartCopyHandler, error) {
+	value, ok := cc.onGoingMultiCopiesByIds.Load(copyId)
+	if !ok {
+		return nil, ErrCopyNotFound
+	}
+	mph := value.(*writer.MultiPartCopyHandler)
+	if !mph.BeginAbort() {
+		return nil, ErrCopyBusy
+	}
+	cc.dropMultiPartCopy(mph)
+	return mph, nil
+}
+
+// ReleasePath lets new copies to path start. A single copy still writing
+// to it has its connection closed. A multipart copy keeps its parts and can
+// still be completed or aborted by copyId.
+func (cc *ChiliController) ReleasePath(path string) error {
+	value, ok := cc.onGoingCopyOpsByPath.Load(path)
+	if !ok {
+		return ErrCopyNotFound
+	}
+	cc.releasePathOf(path, value)
+	if sc, ok := value.(*writer.SingleCopyHandler); ok {
+		sc.Conn.Close()
+	}
+	logger.Warn("released path by admin request", "path", path)
+	return nil
+}
+
+// AdminHandler serves the admin API:
+//
+//	GET  /copies                      list ongoing copies as JSON
+//	POST /copies/abort?copy_id=<id>   abort a multipart copy
+//	POST /paths/release?path=<path>   release the lock on a path
+func (cc *ChiliController) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/copies", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cc.OngoingCopies())
+	})
+	mux.HandleFunc("/copies/abort", adminAction("copy_id", cc.AbortCopy))
+	mux.HandleFunc("/paths/release", adminAction("path", cc.ReleasePath))
+	return mux
+}
+
+func adminAction(param string, action func(string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		value := r.URL.Query().Get(param)
+		if value == "" {
+			http.Error(w, "missing "+param, http.StatusBadRequest)
+			return
+		}
+		switch err := action(value); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case ErrCopyNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case ErrCopyBusy:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/common/protocol"
+	"github.com/chili-copy/server/writer"
+)
+
+// adminFixture is a controller with a multipart copy to /a in progress, one
+// to /b being stitched, and a single copy to /c being received, started in
+// that order.
+type adminFixture struct {
+	cc     *ChiliController
+	a, b   *writer.MultiPartCopyHandler
+	client net.Conn
+}
+
+func newAdminFixture(t *testing.T) *adminFixture {
+	cc := NewChiliController()
+	now := time.Now()
+	multiPart := func(path string, state protocol.MultiPartOpState, started time.Time) *writer.MultiPartCopyHandler {
+		mpo := protocol.NewMultiPartCopyOp(protocol.PrepareMultiPartInitRequestOpHeader(path, 100))
+		mpo.SetState(state)
+		mph := &writer.MultiPartCopyHandler{CopyOp: mpo, Log: logger.With(), Remote: "10.0.0.1:1", Started: started}
+		mph.RecordPart(1, make([]byte, 16), 40)
+		cc.onGoingCopyOpsByPath.Store(path, mph)
+		cc.onGoingMultiCopiesByIds.Store(mpo.GetCopyId().String(), mph)
+		cc.metrics.activeMultiPartCopies.Inc()
+		return mph
+	}
+	f := &adminFixture{cc: cc}
+	f.a = multiPart("/a", protocol.INPROGRESS, now.Add(-3*time.Hour))
+	f.b = multiPart("/b", protocol.STITCHING, now.Add(-2*time.Hour))
+	var server net.Conn
+	f.client, server = net.Pipe()
+	cc.onGoingCopyOpsByPath.Store("/c", &writer.SingleCopyHandler{
+		Conn:    server,
+		CopyOp:  protocol.NewSingleCopyOp(protocol.PrepareSingleCopyRequestOpHeader("/c", 50, 0)),
+		Started: now.Add(-time.Hour),
+	})
+	return f
+}
+
+func TestAdminHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		url      func(f *adminFixture) string
+		wantCode int
+		// wantCopies are the paths of the copies listed after, and whether
+		// each still holds its path.
+		wantCopies map[string]bool
+	}{
+		{"list", "GET", func(f *adminFixture) string { return "/copies" }, http.StatusOK,
+			map[string]bool{"/a": true, "/b": true, "/c": true}},
+		{"list by post", "POST", func(f *adminFixture) string { return "/copies" }, http.StatusMethodNotAllowed,
+			map[string]bool{"/a": true, "/b": true, "/c": true}},
+		{"abort", "POST", func(f *adminFixture) string { return "/copies/abort?copy_id=" + f.a.CopyOp.GetCopyId().String() },
+			http.StatusNoContent, map[string]bool{"/b": true, "/c": true}},
+		{"abort by get", "GET", func(f *adminFixture) string {
+			return "/copies/abort?copy_id=" + f.a.CopyOp.GetCopyId().String()
+		}, http.StatusMethodNotAllowed, map[string]bool{"/a": true, "/b": true, "/c": true}},
+		{"abort without copy id", "POST", func(f *adminFixture) string { return "/copies/abort" },
+			http.StatusBadRequest, map[string]bool{"/a": true, "/b": true, "/c": true}},
+		{"abort unknown copy", "POST", func(f *adminFixture) string { return "/copies/abort?copy_id=nope" },
+			http.StatusNotFound, map[string]bool{"/a": true, "/b": true, "/c": true}},
+		{"abort while stitching", "POST", func(f *adminFixture) string {
+			return "/copies/abort?copy_id=" + f.b.CopyOp.GetCopyId().String()
+		}, http.StatusConflict, map[string]bool{"/a": true, "/b": true, "/c": true}},
+		{"release multipart path", "POST", func(f *adminFixture) string { return "/paths/release?path=/a" },
+			http.StatusNoContent, map[string]bool{"/a": false, "/b": true, "/c": true}},
+		{"release single copy path", "POST", func(f *adminFixture) string { return "/paths/release?path=/c" },
+			http.StatusNoContent, map[string]bool{"/a": true, "/b": true}},
+		{"release unknown path", "POST", func(f *adminFixture) string { return "/paths/release?path=/d" },
+			http.StatusNotFound, map[string]bool{"/a": true, "/b": true, "/c": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newAdminFixture(t)
+			defer f.client.Close()
+			handler := f.cc.AdminHandler()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.url(f), nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("%s %s = %d, want %d", tt.method, tt.url(f), rec.Code, tt.wantCode)
+			}
+			rec = httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", "/copies", nil))
+			var copies []CopyStatus
+			if err := json.NewDecoder(rec.Body).Decode(&copies); err != nil {
+				t.Fatalf("listing copies: %v", err)
+			}
+			got := make(map[string]bool)
+			for _, c := range copies {
+				got[c.Path] = c.PathLocked
+			}
+			if !reflect.DeepEqual(got, tt.wantCopies) {
+				t.Errorf("copies listed = %v, want %v", got, tt.wantCopies)
+			}
+		})
+	}
+}
+
+func TestOngoingCopies(t *testing.T) {
+	f := newAdminFixture(t)
+	defer f.client.Close()
+	copies := f.cc.OngoingCopies()
+	if len(copies) != 3 {
+		t.Fatalf("OngoingCopies() lists %d copies, want 3", len(copies))
+	}
+	tests := []CopyStatus{
+		{Type: multiPartCopyType, Path: "/a", CopyId: f.a.CopyOp.GetCopyId().String(), State: "in-progress",
+			PartsReceived: 1, BytesReceived: 40, BytesTotal: 100, Client: "10.0.0.1:1", PathLocked: true},
+		{Type: multiPartCopyType, Path: "/b", CopyId: f.b.CopyOp.GetCopyId().String(), State: "stitching",
+			PartsReceived: 1, BytesReceived: 40, BytesTotal: 100, Client: "10.0.0.1:1", PathLocked: true},
+		{Type: singleCopyType, Path: "/c", State: "in-progress", BytesTotal: 50, Client: "pipe", PathLocked: true},
+	}
+	for i, want := range tests {
+		got := copies[i]
+		if got.AgeSeconds < float64(3-i)*3600 {
+			t.Errorf("copy %s is %.0fs old, want %ds", got.Path, got.AgeSeconds, (3-i)*3600)
+		}
+		got.Started, got.AgeSeconds = time.Time{}, 0
+		if got != want {
+			t.Errorf("copy %d = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestReleasePathClosesSingleCopy(t *testing.T) {
+	f := newAdminFixture(t)
+	defer f.client.Close()
+	if err := f.cc.ReleasePath("/c"); err != nil {
+		t.Fatalf("ReleasePath() error = %v", err)
+	}
+	f.client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := f.client.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("single copy connection still open after its path was released: %v", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -1,150 +1,1037 @@
 package controller
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/logger"
 	"github.com/chili-copy/common/protocol"
+	"github.com/chili-copy/server/acl"
+	"github.com/chili-copy/server/quota"
+	"github.com/chili-copy/server/reader"
+	"github.com/chili-copy/server/space"
+	"github.com/chili-copy/server/storage"
 	"github.com/chili-copy/server/writer"
 	"github.com/google/uuid"
 )
 
-const scratchDir = "/tmp/"
+const (
+	// defaultConnQueueSize is the size of the accepted connection queue
+	// when Serve is called before MakeAcceptedConnQ.
+	defaultConnQueueSize = 100
+
+	defaultQueueTimeout   = 500 * time.Millisecond
+	defaultBusyRetryAfter = time.Second
+	// busyReplyTimeout bounds reading the header of a connection turned
+	// away and sending it the busy error.
+	busyReplyTimeout = 2 * time.Second
+
+	defaultHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout   = time.Minute
+	// defaultSessionTimeout is how long a multipart copy may receive no
+	// parts, and sessionCheckInterval how often copies are checked for it.
+	defaultSessionTimeout = time.Hour
+	sessionCheckInterval  = 10 * time.Second
+)
+
+type DurabilityMode int
+
+const (
+	// DurabilityOff never fsyncs, even if the client asks for it.
+	DurabilityOff DurabilityMode = iota
+	// DurabilityOnRequest fsyncs only when the client sets DurableFlag.
+	DurabilityOnRequest
+	// DurabilityAlways fsyncs every completed copy.
+	DurabilityAlways
+)
+
+var durabilityModes = map[string]DurabilityMode{
+	"off":     DurabilityOff,
+	"request": DurabilityOnRequest,
+	"always":  DurabilityAlways,
+}
+
+func ParseDurabilityMode(mode string) (DurabilityMode, error) {
+	dm, ok := durabilityModes[mode]
+	if !ok {
+		return DurabilityOff, errors.New("unknown durability mode " + mode)
+	}
+	return dm, nil
+}
+
+// Settings are the parts of the controller's configuration that can be
+// changed while copies are in flight. Each operation uses the settings that
+// were current when it started.
+type Settings struct {
+	Durability  DurabilityMode
+	ZeroCopy    bool
+	Preallocate bool
+	// MaxFileSize is the largest file a client may copy, 0 for no limit.
+	MaxFileSize uint64
+	// ACL decides which clients may use which paths. Empty allows all.
+	ACL acl.Rules
+	// Quota limits what each client may copy.
+	Quota quota.Policy
+	// QueueTimeout is how long an accepted connection may wait for room in
+	// a full queue before it is turned away with ErrorServerBusy.
+	QueueTimeout time.Duration
+	// BusyRetryAfter is how long clients turned away are asked to wait
+	// before retrying.
+	BusyRetryAfter time.Duration
+	// HeaderTimeout is how long a worker waits for the header of a
+	// connection, IdleTimeout how long an op may move no data and
+	// OpTimeout how long an op may take in all. 0 never times out.
+	HeaderTimeout time.Duration
+	IdleTimeout   time.Duration
+	OpTimeout     time.Duration
+	// SessionTimeout is how long a multipart copy may receive no parts
+	// before it is dropped, freeing its path, parts, space and quota for a
+	// client that went away without completing or aborting it. 0 keeps it.
+	SessionTimeout time.Duration
+	// Peers are the servers clients may have files relayed to, by name.
+	Peers map[string]Peer
+}
+
+func (s Settings) isDurable(requested bool) bool {
+	switch s.Durability {
+	case DurabilityAlways:
+		return true
+	case DurabilityOnRequest:
+		return requested
+	default:
+		return false
+	}
+}
+
+func (s Settings) allowsFileSize(size uint64) bool {
+	return s.MaxFileSize == 0 || size <= s.MaxFileSize
+}
+
+// acceptedConn is a connection waiting for a worker. done, if set, is
+// called once it has been served.
+type acceptedConn struct {
+	ctx    context.Context
+	conn   net.Conn
+	done   func()
+	queued time.Time
+}
+
+func (ac acceptedConn) finish() {
+	if ac.done != nil {
+		ac.done()
+	}
+}
 
 type ChiliController struct {
-	acceptedConns           chan net.Conn
+	connCount               uint64
+	acceptedConns           chan acceptedConn
+	opLimits                *opLimits // set if every connection gets a goroutine
+	startWorkers            sync.Once
+	startExpiry             sync.Once
 	onGoingCopyOpsByPath    sync.Map
 	onGoingMultiCopiesByIds sync.Map
+	readClaimsLock          sync.Mutex // held while a readClaim is taken or let go
+	settingsLock            sync.Mutex
+	settings                atomic.Value
+	space                   *space.Tracker
+	quota                   *quota.Tracker
+	storage                 storage.Backend
+	local                   *storage.Local // storage if on local disk, whose free space is checked
+	root                    string
+	hooks                   Hooks
+	metrics                 *serverMetrics
+	// queueWaiters and turningAway count the connections waiting for room
+	// in a full queue and being told the server is busy, each bounded by
+	// the size of the queue.
+	queueWaiters int32
+	turningAway  int32
 }
 
 func NewChiliController() *ChiliController {
-	return &ChiliController{}
+	local := storage.NewLocal()
+	cc := &ChiliController{space: space.NewTracker(), quota: quota.NewTracker(), storage: local, local: local}
+	cc.settings.Store(Settings{Durability: DurabilityOnRequest, QueueTimeout: defaultQueueTimeout,
+		BusyRetryAfter: defaultBusyRetryAfter, HeaderTimeout: defaultHeaderTimeout, IdleTimeout: defaultIdleTimeout,
+		SessionTimeout: defaultSessionTimeout})
+	cc.metrics = newServerMetrics(cc)
+	return cc
+}
+
+// SetStorage sets where copied files are stored, local disk by default. It
+// must be called before the controller serves connections.
+func (cc *ChiliController) SetStorage(backend storage.Backend) {
+	cc.storage = backend
+	cc.local, _ = backend.(*storage.Local)
+}
+
+// SetScratchDir sets the directory parts of multipart copies are written to
+// before being stitched together, if files are stored on local disk.
+func (cc *ChiliController) SetScratchDir(dir string) {
+	if cc.local != nil {
+		cc.local.SetScratchDir(dir)
+	}
+}
+
+// SetScratchOnTargetFS makes multipart copies to local disk keep their
+// parts next to the target. See storage.Local.SetScratchOnTargetFS.
+func (cc *ChiliController) SetScratchOnTargetFS(onTargetFS bool) {
+	if cc.local != nil {
+		cc.local.SetScratchOnTargetFS(onTargetFS)
+	}
+}
+
+// SetRoot confines the paths clients copy to and from to dir, which they
+// are then relative to. Clients can still follow symlinks placed under dir.
+func (cc *ChiliController) SetRoot(dir string) {
+	cc.root = filepath.Clean(dir)
+}
+
+// SetHooks sets the hooks called around operations. It must be called
+// before the controller serves connections.
+func (cc *ChiliController) SetHooks(hooks Hooks) {
+	cc.hooks = hooks
+}
+
+type pathOp interface {
+	GetFilePath() string
+	SetFilePath(path string)
+}
+
+// rootPath cleans the path of op as an absolute one and moves it under the
+// root, if one is set. Cleaning drops any ".." that would leave the root, or
+// take the path out of the ACL rules it looks to fall under.
+func (cc *ChiliController) rootPath(op pathOp) {
+	path := filepath.Clean("/" + op.GetFilePath())
+	if cc.root != "" {
+		path = filepath.Join(cc.root, path)
+	}
+	op.SetFilePath(path)
+}
+
+func (cc *ChiliController) Settings() Settings {
+	return cc.settings.Load().(Settings)
+}
+
+// ApplySettings replaces the settings for operations that start from now
+// on. Operations in flight keep the settings they started with.
+func (cc *ChiliController) ApplySettings(settings Settings) {
+	cc.settingsLock.Lock()
+	defer cc.settingsLock.Unlock()
+	cc.settings.Store(settings)
+}
+
+func (cc *ChiliController) updateSettings(update func(*Settings)) {
+	cc.settingsLock.Lock()
+	defer cc.settingsLock.Unlock()
+	settings := cc.settings.Load().(Settings)
+	update(&settings)
+	cc.settings.Store(settings)
+}
+
+func (cc *ChiliController) SetDurabilityMode(mode DurabilityMode) {
+	cc.updateSettings(func(s *Settings) { s.Durability = mode })
+}
+
+func (cc *ChiliController) SetZeroCopy(zeroCopy bool) {
+	cc.updateSettings(func(s *Settings) { s.ZeroCopy = zeroCopy })
+}
+
+func (cc *ChiliController) SetPreallocate(preallocate bool) {
+	cc.updateSettings(func(s *Settings) { s.Preallocate = preallocate })
+}
+
+func (cc *ChiliController) SetMaxFileSize(size uint64) {
+	cc.updateSettings(func(s *Settings) { s.MaxFileSize = size })
 }
 
 func (cc *ChiliController) MakeAcceptedConnQ(size int) {
-	cc.acceptedConns = make(chan net.Conn, size)
+	cc.acceptedConns = make(chan acceptedConn, size)
 }
 
+// AddConnToQ serves conn as Serve does with the connections it accepts.
 func (cc *ChiliController) AddConnToQ(conn net.Conn) {
-	cc.acceptedConns <- conn
+	cc.dispatch(context.Background(), acceptedConn{conn: conn})
 }
 
-func (cc *ChiliController) CreateAcceptedConnHandlers(size int) {
-	for i := 0; i < size; i++ {
-		go cc.handleConnection()
+func (cc *ChiliController) dispatch(ctx context.Context, ac acceptedConn) {
+	ac.ctx = ctx
+	if cc.opLimits != nil {
+		go cc.serveOwnConn(ac)
+		return
+	}
+	cc.enqueue(ctx, ac)
+}
+
+// enqueue queues ac for a worker without blocking the caller. If the queue
+// is full, ac waits for room in the background for up to QueueTimeout and
+// is then turned away, rather than holding up Accept for everyone else. As
+// many connections may wait as the queue holds, and those past that are
+// turned away at once.
+func (cc *ChiliController) enqueue(ctx context.Context, ac acceptedConn) {
+	ac.queued = time.Now()
+	select {
+	case cc.acceptedConns <- ac:
+		return
+	default:
+	}
+	settings := cc.Settings()
+	if atomic.AddInt32(&cc.queueWaiters, 1) > int32(cap(cc.acceptedConns)) {
+		atomic.AddInt32(&cc.queueWaiters, -1)
+		cc.turnAway(ac, settings.BusyRetryAfter)
+		return
+	}
+	go func() {
+		defer atomic.AddInt32(&cc.queueWaiters, -1)
+		timer := time.NewTimer(settings.QueueTimeout)
+		defer timer.Stop()
+		select {
+		case cc.acceptedConns <- ac:
+		case <-timer.C:
+			cc.rejectBusy(ac.conn, settings.BusyRetryAfter)
+			ac.finish()
+		case <-ctx.Done():
+			ac.conn.Close()
+			ac.finish()
+		}
+	}()
+}
+
+// turnAway has rejectBusy reply to ac in the background. Past as many
+// replies as the queue holds, ac is closed without one, as reading its
+// header could take up to busyReplyTimeout each.
+func (cc *ChiliController) turnAway(ac acceptedConn, retryAfter time.Duration) {
+	if atomic.AddInt32(&cc.turningAway, 1) > int32(cap(cc.acceptedConns)) {
+		atomic.AddInt32(&cc.turningAway, -1)
+		logger.With("conn", atomic.AddUint64(&cc.connCount, 1), "remote", ac.conn.RemoteAddr()).Warn(
+			"closed connection, too many already turned away")
+		ac.conn.Close()
+		ac.finish()
+		return
 	}
+	go func() {
+		defer atomic.AddInt32(&cc.turningAway, -1)
+		cc.rejectBusy(ac.conn, retryAfter)
+		ac.finish()
+	}()
+}
+
+// rejectBusy tells the client of conn to retry after retryAfter and closes
+// conn. The header is read first, as closing a connection with unread data
+// resets it, which could lose the error on its way to the client.
+func (cc *ChiliController) rejectBusy(conn net.Conn, retryAfter time.Duration) {
+	defer conn.Close()
+	log := cc.connLogger(conn)
+	conn.SetDeadline(time.Now().Add(busyReplyTimeout))
+	opType, _, err := common.GetOpTypeAndHeaderFromConn(conn)
+	if err != nil {
+		log.Debug("unable to read header of connection turned away", "error", err)
+		return
+	}
+	cc.replyBusy(conn, opType, retryAfter, log)
+}
+
+func (cc *ChiliController) replyBusy(conn net.Conn, opType protocol.OpType, retryAfter time.Duration, log *logger.Logger) {
+	log = log.With("op", opType, "retry_after", retryAfter)
+	cc.sendError(&protocol.ServerError{Type: protocol.ErrorServerBusy, Retryable: true, RetryAfter: retryAfter}, conn, log)
+	cc.metrics.observeOp(opType, false)
+}
+
+// CreateAcceptedConnHandlers starts size workers to serve queued
+// connections. Only the first call starts any.
+func (cc *ChiliController) CreateAcceptedConnHandlers(size int) {
+	cc.startWorkers.Do(func() {
+		for i := 0; i < size; i++ {
+			cc.metrics.workers.Inc()
+			go cc.handleConnection()
+		}
+	})
 }
 
 func (cc *ChiliController) handleConnection() {
-	for conn := range cc.acceptedConns {
-		opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(conn)
+	for ac := range cc.acceptedConns {
+		if !ac.queued.IsZero() {
+			cc.metrics.queueWait.Observe(time.Since(ac.queued).Seconds())
+		}
+		cc.metrics.busyWorkers.Inc()
+		cc.serveConn(ac)
+		cc.metrics.busyWorkers.Dec()
+	}
+}
+
+// Serve accepts connections on ln and serves them until ctx is done, which
+// closes ln. It then waits for the connections it accepted to be served and
+// returns nil. Otherwise it returns the error that stopped it accepting.
+//
+// Unless SetGoroutinePerConn was called, the queue and workers are made
+// with defaults if MakeAcceptedConnQ and CreateAcceptedConnHandlers were
+// not called before. Serve may be called for several listeners at once.
+func (cc *ChiliController) Serve(ctx context.Context, ln net.Listener) error {
+	if cc.opLimits == nil {
+		if cc.acceptedConns == nil {
+			cc.MakeAcceptedConnQ(defaultConnQueueSize)
+		}
+		cc.CreateAcceptedConnHandlers(runtime.NumCPU())
+	}
+	cc.startExpiry.Do(func() { go cc.expireIdleCopies() })
+	var served sync.WaitGroup
+	defer served.Wait()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.Close()
+		case <-stop:
+		}
+	}()
+	var backoff time.Duration
+	for {
+		conn, err := ln.Accept()
 		if err != nil {
-			errorResponse(protocol.ErrorParsingHeader, conn)
-		}
-		switch opType {
-		case protocol.SingleCopyOpType:
-			sco := protocol.NewSingleCopyOp(headerBytes)
-			fmt.Printf("Received single copy request for file %s\n", sco.GetFilePath())
-			_, ok := cc.onGoingCopyOpsByPath.Load(sco.GetFilePath())
-			if ok {
-				errorResponse(protocol.ErrorWritingSingleCopy, conn)
-				conn.Close()
-				break
-			} else {
-				opHandle := &writer.SingleCopyHandler{Conn: conn, Md5: md5.New(), CopyOp: sco}
-				cc.onGoingCopyOpsByPath.Store(sco.GetFilePath(), opHandle)
-				csum, err := opHandle.Handle()
-				if err != nil {
-					errorResponse(protocol.ErrorCopyOpInProgress, conn)
-					cc.onGoingCopyOpsByPath.Delete(sco.GetFilePath())
-					conn.Close()
-					break
-				}
-				fmt.Printf("Sending success for single copy request for file %s\n", sco.GetFilePath())
-				sendCopySuccessResponse(csum, conn, protocol.SingleCopySuccessResponseOpType)
-				cc.onGoingCopyOpsByPath.Delete(sco.GetFilePath())
-				conn.Close()
-			}
-		case protocol.MultiPartCopyInitOpType:
-			mpo := protocol.NewMultiPartCopyOp(headerBytes)
-			_, ok := cc.onGoingCopyOpsByPath.Load(mpo.GetFilePath())
-			if ok {
-				errorResponse(protocol.ErrorCopyOpInProgress, conn)
-				conn.Close()
-				break
-			} else {
-				opHandle := &writer.MultiPartCopyHandler{mpo, uint64(0), scratchDir}
-				//TODO: surround with a lock
-				cc.onGoingCopyOpsByPath.Store(mpo.GetFilePath(), opHandle)
-				cc.onGoingMultiCopiesByIds.Store(mpo.GetCopyId().String(), opHandle)
-				//TODO: surround with a lock
-				mpo.SetState(protocol.INITIATED)
-				fmt.Println("Initiated multipart copy with copyId ", mpo.GetCopyId().String())
-				multiPartCopyInitSuccessResponse(mpo.GetCopyId(), conn)
-			}
-		case protocol.MultiPartCopyPartRequestOpType:
-			copyId, _ := protocol.ParseCopyId(headerBytes)
-			fmt.Println("Received multipart copy part req with copyId ", copyId)
-			_, ok := cc.onGoingMultiCopiesByIds.Load(copyId)
-			if ok {
-				mcp := protocol.NewMultiPartCopyPartOp(headerBytes, copyId, scratchDir)
-				opHandle := writer.SingleCopyHandler{Conn: conn, Md5: md5.New(), CopyOp: mcp}
-				opHandle.CreateDir(scratchDir + copyId)
-				csum, err := opHandle.Handle()
-				if err != nil {
-					errorResponse(protocol.ErrorWritingPart, conn)
-					cc.onGoingCopyOpsByPath.Delete(mcp.GetFilePath())
-					conn.Close()
-					break
-				}
-				mcop, _ := cc.onGoingMultiCopiesByIds.Load(copyId)
-				mcop.(*writer.MultiPartCopyHandler).IncreaseTotalPartsCopiedByOne()
-				sendCopySuccessResponse(csum, conn, protocol.SingleCopySuccessResponseOpType)
-				conn.Close()
-			} else {
-				errorResponse(protocol.ErrorCopyIdNotFound, conn)
-				conn.Close()
+			if ctx.Err() != nil {
+				return nil
 			}
-		case protocol.MultiPartCopyCompleteOpType:
-			copyId, _ := protocol.ParseCopyId(headerBytes)
-			fmt.Println("Received multipart copy complete req with copyId ", copyId)
-			opHandle, ok := cc.onGoingMultiCopiesByIds.Load(copyId)
-			if ok {
-				hash, err := opHandle.(*writer.MultiPartCopyHandler).StitchChunks()
-				if err != nil {
-
-				}
-				fmt.Printf("Sending success for multipart copy for file %s with csum %s\n",
-					opHandle.(*writer.MultiPartCopyHandler).CopyOp.GetFilePath(), hex.EncodeToString(hash))
-				cc.onGoingMultiCopiesByIds.Delete(copyId)
-				cc.onGoingCopyOpsByPath.Delete(opHandle.(*writer.MultiPartCopyHandler).CopyOp.GetFilePath())
-				sendCopySuccessResponse(hash, conn, protocol.MultiPartCopySuccessResponseOpType)
-				conn.Close()
-			} else {
-				errorResponse(protocol.ErrorCopyIdNotFound, conn)
-				conn.Close()
+			// Running out of file descriptors and the like passes, so
+			// retry those as net/http does.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				backoff = nextBackoff(backoff)
+				logger.Warn("unable to accept connection, retrying", "error", err, "retry_in", backoff)
+				time.Sleep(backoff)
+				continue
 			}
-		default:
-			errorResponse(protocol.ErrorUnknownOp, conn)
+			return err
+		}
+		backoff = 0
+		served.Add(1)
+		cc.dispatch(ctx, acceptedConn{conn: conn, done: served.Done})
+	}
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return 5 * time.Millisecond
+	}
+	if backoff *= 2; backoff > time.Second {
+		return time.Second
+	}
+	return backoff
+}
+
+// serveConn reads the header of the single operation carried by ac,
+// performs it, closes the connection and calls ac.finish. Clients that
+// stall, by not sending a header, not moving data or taking too long, are
+// timed out so they cannot hold a worker forever. Connections carrying
+// many streams are handed over to serveMux instead.
+func (cc *ChiliController) serveConn(ac acceptedConn) {
+	log := cc.connLogger(ac.conn)
+	opType, headerBytes, ok := cc.readHeader(ac.conn, log)
+	if ok && opType == protocol.MuxOpType {
+		go cc.serveMux(ac, headerBytes, log)
+		return
+	}
+	defer ac.finish()
+	defer ac.conn.Close()
+	if ok {
+		cc.serveOp(ac.conn, opType, headerBytes, log)
+	}
+}
+
+func (cc *ChiliController) connLogger(conn net.Conn) *logger.Logger {
+	return logger.With("conn", atomic.AddUint64(&cc.connCount, 1), "remote", conn.RemoteAddr())
+}
+
+// readHeader reads the header of the op carried by conn, and tells the
+// client if it could not.
+func (cc *ChiliController) readHeader(conn net.Conn, log *logger.Logger) (protocol.OpType, []byte, bool) {
+	opType, headerBytes, err := common.GetOpTypeAndHeaderWithin(conn, cc.Settings().HeaderTimeout)
+	if err != nil {
+		cc.errorResponseFor(protocol.ErrorParsingHeader, err, conn, log)
+		cc.metrics.observeOp(protocol.Unknown, false)
+		return opType, headerBytes, false
+	}
+	return opType, headerBytes, true
+}
+
+// serveOp performs the op of headerBytes, whose header was read off conn.
+func (cc *ChiliController) serveOp(conn net.Conn, opType protocol.OpType, headerBytes []byte, log *logger.Logger) {
+	settings := cc.Settings()
+	conn = common.NewTimeoutConn(conn, settings.IdleTimeout, settings.OpTimeout)
+	log = log.With("op", opType)
+	if !cc.allowed(opType, headerBytes, conn, log) {
+		cc.metrics.observeOp(opType, false)
+		return
+	}
+	var ok bool
+	switch opType {
+	case protocol.SingleCopyOpType:
+		ok = cc.handleSingleCopy(conn, headerBytes, log)
+	case protocol.MultiPartCopyInitOpType:
+		ok = cc.handleMultiPartCopyInit(conn, headerBytes, log)
+	case protocol.MultiPartCopyPartRequestOpType:
+		ok = cc.handleMultiPartCopyPart(conn, headerBytes, log)
+	case protocol.MultiPartCopyCompleteOpType:
+		ok = cc.handleMultiPartCopyComplete(conn, headerBytes, log)
+	case protocol.MultiPartCopyAbortOpType:
+		ok = cc.handleMultiPartCopyAbort(conn, headerBytes, log)
+	case protocol.StatRequestOpType:
+		ok = cc.handleStat(conn, headerBytes, log)
+	case protocol.ReadRequestOpType:
+		ok = cc.handleRead(conn, headerBytes, log)
+	case protocol.RelayRequestOpType:
+		ok = cc.handleRelay(conn, headerBytes, log)
+	case protocol.DeleteRequestOpType:
+		ok = cc.handleDelete(conn, headerBytes, log)
+	case protocol.ListRequestOpType:
+		ok = cc.handleList(conn, headerBytes, log)
+	default:
+		cc.errorResponse(protocol.ErrorUnknownOp, conn, log)
+	}
+	cc.metrics.observeOp(opType, ok)
+}
+
+// The handlers below return true if they sent a success response.
+
+func (cc *ChiliController) handleSingleCopy(conn net.Conn, headerBytes []byte, log *logger.Logger) bool {
+	start := time.Now()
+	sco := protocol.NewSingleCopyOp(headerBytes)
+	cc.rootPath(sco)
+	log = log.With("path", sco.GetFilePath(), "bytes", sco.GetContentLength())
+	log.Info("received single copy request")
+	settings := cc.Settings()
+	if !settings.allowsFileSize(sco.GetContentLength()) {
+		cc.errorResponseWithMessage(protocol.ErrorFileTooLarge, fmt.Sprintf("largest allowed is %d bytes", settings.MaxFileSize), conn, log)
+		return false
+	}
+	durable := settings.isDurable(sco.IsDurable())
+	opHandle := &writer.SingleCopyHandler{Conn: conn, Md5: md5.New(), CopyOp: sco, Durable: durable,
+		ZeroCopy: settings.ZeroCopy, Preallocate: settings.Preallocate, Log: log, Started: start}
+	// Checking for the path and taking it is one step, so of two copies to
+	// the same path only one gets it.
+	if _, loaded := cc.onGoingCopyOpsByPath.LoadOrStore(sco.GetFilePath(), opHandle); loaded {
+		cc.errorResponse(protocol.ErrorCopyOpInProgress, conn, log)
+		return false
+	}
+	err := cc.preAccept(CopyInfo{Op: protocol.SingleCopyOpType, Path: sco.GetFilePath(), Size: sco.GetContentLength(),
+		Remote: conn.RemoteAddr().String()})
+	if err != nil {
+		cc.releasePathOf(sco.GetFilePath(), opHandle)
+		cc.errorResponseWithMessage(protocol.ErrorRejected, err.Error(), conn, log)
+		return false
+	}
+	ip := remoteIP(conn)
+	charge, err := cc.quota.AddFile(clientName(ip), settings.Quota.For(ip), sco.GetContentLength())
+	if err != nil {
+		cc.releasePathOf(sco.GetFilePath(), opHandle)
+		cc.errorResponseFor(protocol.ErrorQuotaExceeded, err, conn, log)
+		return false
+	}
+	// Copies that fail do not count against the client.
+	defer charge.Refund()
+	var reservation *space.Reservation
+	if cc.local != nil {
+		reservation, err = cc.space.Reserve(space.Request{Dir: filepath.Dir(sco.GetFilePath()), Bytes: sco.GetContentLength()})
+		if err != nil {
+			cc.releasePathOf(sco.GetFilePath(), opHandle)
+			cc.errorResponse(protocol.ErrorInsufficientSpace, conn, log)
+			return false
+		}
+	}
+	defer reservation.Release()
+	defer cc.releasePathOf(sco.GetFilePath(), opHandle)
+	temp, err := cc.storage.CreateTemp(sco.GetFilePath(), sco.GetContentLength())
+	if err != nil {
+		cc.errorResponseFor(protocol.ErrorWritingSingleCopy, err, conn, log)
+		return false
+	}
+	opHandle.Temp = temp
+	csum, err := opHandle.Handle()
+	if err != nil {
+		cc.errorResponseFor(protocol.ErrorWritingSingleCopy, err, conn, log)
+		return false
+	}
+	log.Info("sending success for single copy", "csum", hex.EncodeToString(csum), "durable", durable,
+		"duration", time.Since(start))
+	charge.Keep()
+	cc.metrics.receivedBytes.Add(sco.GetContentLength())
+	sendCopySuccessResponse(csum, conn, protocol.SingleCopySuccessResponseOpType, durable)
+	cc.postCommit(CommitInfo{CopyInfo: CopyInfo{Op: protocol.SingleCopyOpType, Path: sco.GetFilePath(),
+		Size: sco.GetContentLength(), Remote: conn.RemoteAddr().String()}, Checksum: csum, Durable: durable})
+	return true
+}
+
+func (cc *ChiliController) handleMultiPartCopyInit(conn net.Conn, headerBytes []byte, log *logger.Logger) bool {
+	start := time.Now()
+	mpo := protocol.NewMultiPartCopyOp(headerBytes)
+	cc.rootPath(mpo)
+	log = log.With("path", mpo.GetFilePath(), "bytes", mpo.GetFileSize(), "copy_id", mpo.GetCopyId())
+	settings := cc.Settings()
+	if !settings.allowsFileSize(mpo.GetFileSize()) {
+		cc.errorResponseWithMessage(protocol.ErrorFileTooLarge, fmt.Sprintf("largest allowed is %d bytes", settings.MaxFileSize), conn, log)
+		return false
+	}
+	opHandle := &writer.MultiPartCopyHandler{CopyOp: mpo, TotalPartsCopied: uint64(0), Log: log,
+		Remote: conn.RemoteAddr().String(), Started: start}
+	if _, loaded := cc.onGoingCopyOpsByPath.LoadOrStore(mpo.GetFilePath(), opHandle); loaded {
+		cc.errorResponse(protocol.ErrorCopyOpInProgress, conn, log)
+		return false
+	}
+	err := cc.preAccept(CopyInfo{Op: protocol.MultiPartCopyInitOpType, Path: mpo.GetFilePath(), Size: mpo.GetFileSize(),
+		CopyId: mpo.GetCopyId().String(), Remote: conn.RemoteAddr().String()})
+	if err != nil {
+		cc.releasePathOf(mpo.GetFilePath(), opHandle)
+		cc.errorResponseWithMessage(protocol.ErrorRejected, err.Error(), conn, log)
+		return false
+	}
+	ip := remoteIP(conn)
+	session, err := cc.quota.StartSession(clientName(ip), settings.Quota.For(ip), mpo.GetFileSize())
+	if err != nil {
+		cc.releasePathOf(mpo.GetFilePath(), opHandle)
+		cc.errorResponseFor(protocol.ErrorQuotaExceeded, err, conn, log)
+		return false
+	}
+	opHandle.Quota = session
+	if cc.local != nil {
+		scratchDir, onTargetFS := cc.local.ScratchDirFor(mpo.GetFilePath())
+		targetDir := filepath.Dir(mpo.GetFilePath())
+		// The parts need room in scratch and stitching them needs as
+		// much again at the target, unless scratch is on the target's
+		// filesystem, where they are stitched in place.
+		inPlace := onTargetFS || space.SameFilesystem(scratchDir, targetDir)
+		requests := []space.Request{{Dir: targetDir, Bytes: mpo.GetFileSize()}}
+		if !inPlace {
+			requests = append(requests, space.Request{Dir: scratchDir, Bytes: mpo.GetFileSize()})
+		}
+		reservations, err := cc.space.ReserveAll(requests...)
+		if err != nil {
+			session.End()
+			cc.releasePathOf(mpo.GetFilePath(), opHandle)
+			cc.errorResponse(protocol.ErrorInsufficientSpace, conn, log)
+			return false
+		}
+		opHandle.InPlace = inPlace
+		opHandle.TargetReservation = reservations[0]
+		if !inPlace {
+			opHandle.ScratchReservation = reservations[1]
+		}
+		log = log.With("scratch_dir", scratchDir)
+	}
+	upload, err := cc.storage.CreateMultipart(mpo.GetCopyId().String(), mpo.GetFilePath(), mpo.GetFileSize())
+	if err != nil {
+		opHandle.Abort()
+		cc.releasePathOf(mpo.GetFilePath(), opHandle)
+		cc.errorResponseFor(protocol.ErrorWritingPart, err, conn, log)
+		return false
+	}
+	opHandle.Upload = upload
+	// Parts stitched in place replace the target, so space preallocated
+	// for it would only be taken twice until then.
+	if settings.Preallocate && !opHandle.InPlace {
+		// Other failures, such as fallocate being unsupported, leave the
+		// copy to its space reservation as for single copies.
+		if err := opHandle.PreallocateTarget(); err == space.ErrInsufficientSpace {
+			opHandle.Abort()
+			cc.releasePathOf(mpo.GetFilePath(), opHandle)
+			cc.errorResponse(protocol.ErrorInsufficientSpace, conn, log)
+			return false
 		}
 	}
+	// The copy is initiated before its copyId is known, so that its first
+	// parts find it ready for them.
+	mpo.SetState(protocol.INITIATED)
+	cc.onGoingMultiCopiesByIds.Store(mpo.GetCopyId().String(), opHandle)
+	cc.metrics.activeMultiPartCopies.Inc()
+	log.Info("initiated multipart copy")
+	cc.multiPartCopyInitSuccessResponse(mpo.GetCopyId(), conn)
+	return true
 }
 
-func errorResponse(errType protocol.ErrType, conn net.Conn) {
-	payload := protocol.PrepareErrorResponseOpHeader(errType)
+func (cc *ChiliController) handleMultiPartCopyPart(conn net.Conn, headerBytes []byte, log *logger.Logger) bool {
+	start := time.Now()
+	copyId, _ := protocol.ParseCopyId(headerBytes)
+	partNum := protocol.ParsePartNum(headerBytes)
+	log = log.With("copy_id", copyId, "part", partNum)
+	mcop, ok := cc.onGoingMultiCopiesByIds.Load(copyId)
+	if !ok {
+		cc.errorResponse(protocol.ErrorCopyIdNotFound, conn, log)
+		return false
+	}
+	mph := mcop.(*writer.MultiPartCopyHandler)
+	mcp := protocol.NewMultiPartCopyPartOp(headerBytes)
+	log = log.With("bytes", mcp.GetContentLength())
+	log.Debug("received multipart copy part")
+	// Parts are not written once the copy is being stitched or aborted.
+	if state, ok := mph.BeginPart(); !ok {
+		errType := protocol.ErrorCopyIdNotFound
+		if state == protocol.STITCHING {
+			errType = protocol.ErrorCopyOpInProgress
+		}
+		cc.errorResponse(errType, conn, log.With("state", state))
+		return false
+	}
+	ended := false
+	defer func() {
+		if !ended {
+			mph.EndPart()
+		}
+	}()
+	mph.Touch()
+	defer mph.Touch()
+	charge, err := mph.Quota.Add(mcp.GetContentLength())
+	if err != nil {
+		cc.errorResponseFor(protocol.ErrorQuotaExceeded, err, conn, log)
+		return false
+	}
+	// Parts that fail do not count against the copy or the client.
+	defer charge.Refund()
+	part, err := mph.Upload.CreatePart(partNum, mcp.GetContentLength())
+	if err != nil {
+		cc.errorResponseFor(protocol.ErrorWritingPart, err, conn, log)
+		return false
+	}
+	opHandle := writer.SingleCopyHandler{Conn: conn, Temp: part, Md5: md5.New(), CopyOp: mcp, ZeroCopy: cc.Settings().ZeroCopy, Log: log}
+	csum, err := opHandle.Handle()
+	if err != nil {
+		cc.errorResponseFor(protocol.ErrorWritingPart, err, conn, log)
+		return false
+	}
+	mph.RecordPart(partNum, csum, mcp.GetContentLength())
+	charge.Keep()
+	mph.CopyOp.CompareAndSwapState(protocol.INITIATED, protocol.INPROGRESS)
+	mph.ConsumeReservation(mcp.GetContentLength())
+	cc.metrics.receivedBytes.Add(mcp.GetContentLength())
+	cc.metrics.partWriteDuration.Observe(time.Since(start).Seconds())
+	log.Info("received part", "duration", time.Since(start))
+	// The part ends before the client hears it succeeded, so a complete
+	// sent right after does not find it still being written.
+	mph.EndPart()
+	ended = true
+	sendCopySuccessResponse(csum, conn, protocol.SingleCopySuccessResponseOpType, false)
+	return true
+}
+
+func (cc *ChiliController) handleMultiPartCopyComplete(conn net.Conn, headerBytes []byte, log *logger.Logger) bool {
+	start := time.Now()
+	mcc, err := protocol.NewMultiPartCopyCompleteOp(headerBytes)
+	if err != nil {
+		cc.errorResponseFor(protocol.ErrorParsingHeader, err, conn, log)
+		return false
+	}
+	copyId := mcc.GetCopyId()
+	log = log.With("copy_id", copyId, "parts", mcc.GetNumParts(), "bytes", mcc.GetFileSize())
+	log.Info("received multipart copy complete request")
+	opHandle, ok := cc.onGoingMultiCopiesByIds.Load(copyId)
+	if !ok {
+		cc.errorResponse(protocol.ErrorCopyIdNotFound, conn, log)
+		return false
+	}
+	mph := opHandle.(*writer.MultiPartCopyHandler)
+	// Only one request may stitch the parts, and not while they are being
+	// written or aborted.
+	if !mph.BeginStitch() {
+		cc.errorResponse(protocol.ErrorCopyOpInProgress, conn, log.With("state", mph.CopyOp.GetState()))
+		return false
+	}
+	hash, err := mph.CombinedChecksum(mcc.GetNumParts())
+	if err != nil {
+		cc.abortMultiPartCopy(mph, protocol.ErrorMissingParts, err, conn, log)
+		return false
+	}
+	if !bytes.Equal(hash, mcc.GetCsum()) {
+		cc.abortMultiPartCopy(mph, protocol.ErrorChecksumMismatch, nil, conn, log.With("csum", hex.EncodeToString(hash),
+			"client_csum", hex.EncodeToString(mcc.GetCsum())))
+		return false
+	}
+	durable := cc.Settings().isDurable(mcc.IsDurable())
+	stitchStart := time.Now()
+	err = mph.StitchChunks(mcc.GetNumParts(), durable)
+	cc.metrics.stitchDuration.Observe(time.Since(stitchStart).Seconds())
+	if err != nil {
+		cc.abortMultiPartCopy(mph, protocol.ErrorWritingPart, err, conn, log)
+		return false
+	}
+	log.Info("sending success for multipart copy", "path", mph.CopyOp.GetFilePath(), "csum", hex.EncodeToString(hash),
+		"durable", durable, "duration", time.Since(start))
+	mph.ReleaseSpace()
+	mph.Quota.End()
+	mph.CopyOp.SetState(protocol.COMPLETED)
+	cc.onGoingMultiCopiesByIds.Delete(copyId)
+	cc.releasePathOf(mph.CopyOp.GetFilePath(), mph)
+	cc.metrics.activeMultiPartCopies.Dec()
+	sendCopySuccessResponse(hash, conn, protocol.MultiPartCopySuccessResponseOpType, durable)
+	cc.postCommit(CommitInfo{CopyInfo: CopyInfo{Op: protocol.MultiPartCopyCompleteOpType, Path: mph.CopyOp.GetFilePath(),
+		Size: mph.CopyOp.GetFileSize(), CopyId: copyId, Remote: conn.RemoteAddr().String()}, Checksum: hash, Durable: durable})
+	return true
+}
+
+// handleMultiPartCopyAbort drops a multipart copy the client gave up on, so
+// its path, parts and space are freed at once.
+func (cc *ChiliController) handleMultiPartCopyAbort(conn net.Conn, headerBytes []byte, log *logger.Logger) bool {
+	copyId, err := protocol.ParseCopyId(headerBytes)
+	if err != nil {
+		cc.errorResponseFor(protocol.ErrorParsingHeader, err, conn, log)
+		return false
+	}
+	log = log.With("copy_id", copyId)
+	log.Info("received multipart copy abort request")
+	mph, err := cc.abortCopy(copyId)
+	switch err {
+	case nil:
+	case ErrCopyNotFound:
+		cc.errorResponse(protocol.ErrorCopyIdNotFound, conn, log)
+		return false
+	default:
+		cc.errorResponseWithMessage(protocol.ErrorCopyOpInProgress, err.Error(), conn, log)
+		return false
+	}
+	log.Info("aborted multipart copy", "path", mph.CopyOp.GetFilePath())
+	common.SendBytesToConn(conn, protocol.PrepareMultiPartAbortSuccessResponseOpHeader())
+	return true
+}
+
+func (cc *ChiliController) handleStat(conn net.Conn, headerBytes []byte, log *logger.Logger) bool {
+	so := protocol.NewStatOp(headerBytes)
+	cc.rootPath(so)
+	log = log.With("path", so.GetFilePath())
+	log.Debug("received stat request")
+	if cc.beingWritten(so.GetFilePath()) {
+		cc.errorResponse(protocol.ErrorCopyOpInProgress, conn, log)
+		return false
+	}
+	fi, err := cc.storage.Stat(so.GetFilePath())
+	if err != nil {
+		cc.errorResponseFor(statErrType(err), err, conn, log)
+		return false
+	}
+	payload := protocol.PrepareStatResponseOpHeader(fi.Size, fi.ModTime.UnixNano())
 	common.SendBytesToConn(conn, payload)
+	return true
 }
 
-func multiPartCopyInitSuccessResponse(copyId uuid.UUID, conn net.Conn) {
-	payload := protocol.PrepareMultiPartCopyInitSuccessResponseOpHeader(copyId)
+func (cc *ChiliController) handleRead(conn net.Conn, headerBytes []byte, log *logger.Logger) bool {
+	start := time.Now()
+	ro := protocol.NewReadOp(headerBytes)
+	cc.rootPath(ro)
+	log = log.With("path", ro.GetFilePath(), "offset", ro.GetOffset(), "bytes", ro.GetLength())
+	log.Info("received read request")
+	if cc.beingWritten(ro.GetFilePath()) {
+		cc.errorResponse(protocol.ErrorCopyOpInProgress, conn, log)
+		return false
+	}
+	f, err := cc.storage.Open(ro.GetFilePath())
+	if err != nil {
+		cc.errorResponseFor(statErrType(err), err, conn, log)
+		return false
+	}
+	defer f.Close()
+	size := f.Size()
+	if ro.GetOffset() > size || ro.GetLength() > size-ro.GetOffset() {
+		cc.errorResponseWithMessage(protocol.ErrorInvalidRange, fmt.Sprintf("file is %d bytes", size), conn, log)
+		return false
+	}
+	opHandle := &reader.FileReadHandler{Conn: conn, File: f, ReadOp: ro, ZeroCopy: cc.Settings().ZeroCopy, Log: log}
+	csum, err := opHandle.Handle()
+	if err != nil {
+		// The client is already reading data, so it learns of the failure
+		// from the connection closing early.
+		log.Warn("failed to send file range", "error", err)
+		return false
+	}
+	cc.metrics.sentBytes.Add(ro.GetLength())
+	log.Info("sent file range", "csum", hex.EncodeToString(csum), "duration", time.Since(start))
+	sendCopySuccessResponse(csum, conn, protocol.SingleCopySuccessResponseOpType, false)
+	return true
+}
+
+func (cc *ChiliController) handleDelete(conn net.Conn, headerBytes []byte, log *logger.Logger) bool {
+	do := protocol.NewDeleteOp(headerBytes)
+	cc.rootPath(do)
+	log = log.With("path", do.GetFilePath())
+	log.Info("received delete request")
+	// The path is held while the file is removed, so that no copy, read or
+	// relay of it starts meanwhile.
+	if _, loaded := cc.onGoingCopyOpsByPath.LoadOrStore(do.GetFilePath(), do); loaded {
+		cc.errorResponse(protocol.ErrorCopyOpInProgress, conn, log)
+		return false
+	}
+	defer cc.releasePathOf(do.GetFilePath(), do)
+	if err := cc.storage.Delete(do.GetFilePath()); err != nil {
+		errType := protocol.ErrorDeletingFile
+		if os.IsNotExist(err) {
+			errType = protocol.ErrorFileNotFound
+		}
+		cc.errorResponseFor(errType, err, conn, log)
+		return false
+	}
+	log.Info("deleted file")
+	common.SendBytesToConn(conn, protocol.PrepareDeleteSuccessResponseOpHeader())
+	return true
+}
+
+func (cc *ChiliController) handleList(conn net.Conn, headerBytes []byte, log *logger.Logger) bool {
+	lo := protocol.NewListOp(headerBytes)
+	cc.rootPath(lo)
+	log = log.With("path", lo.GetFilePath())
+	log.Debug("received list request")
+	files, err := cc.storage.List(lo.GetFilePath())
+	if err != nil {
+		cc.errorResponseFor(statErrType(err), err, conn, log)
+		return false
+	}
+	for _, fi := range files {
+		payload := protocol.PrepareListEntryOpHeader(filepath.Base(fi.Path), fi.Size, fi.ModTime.UnixNano())
+		if err := common.SendBytesToConn(conn, payload); err != nil {
+			log.Warn("failed to send list entry", "error", err)
+			return false
+		}
+	}
+	common.SendBytesToConn(conn, protocol.PrepareListEndOpHeader(uint32(len(files))))
+	return true
+}
+
+// statErrType is the error to send for a path that could not be opened.
+func statErrType(err error) protocol.ErrType {
+	if os.IsNotExist(err) {
+		return protocol.ErrorFileNotFound
+	}
+	return protocol.ErrorReadingFile
+}
+
+// abortMultiPartCopy ends a multipart copy that cannot be completed and
+// tells the client why. The error is never retryable, as the copy is gone.
+func (cc *ChiliController) abortMultiPartCopy(mph *writer.MultiPartCopyHandler, errType protocol.ErrType, err error, conn net.Conn, log *logger.Logger) {
+	serr := serverError(errType, err)
+	serr.Retryable = false
+	if err != nil {
+		log = log.With("error", err)
+	}
+	cc.dropMultiPartCopy(mph)
+	cc.sendError(serr, conn, log)
+}
+
+// dropMultiPartCopy frees the copyId and path of a multipart copy and
+// removes its scratch data.
+func (cc *ChiliController) dropMultiPartCopy(mph *writer.MultiPartCopyHandler) {
+	mph.CopyOp.SetState(protocol.ABORTED)
+	mph.Abort()
+	cc.onGoingMultiCopiesByIds.Delete(mph.CopyOp.GetCopyId().String())
+	cc.releasePathOf(mph.CopyOp.GetFilePath(), mph)
+	cc.metrics.activeMultiPartCopies.Dec()
+}
+
+// expireIdleCopies drops the multipart copies that received no parts for
+// SessionTimeout, every sessionCheckInterval, for as long as the server
+// runs.
+func (cc *ChiliController) expireIdleCopies() {
+	ticker := time.NewTicker(sessionCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if timeout := cc.Settings().SessionTimeout; timeout > 0 {
+			cc.expireCopiesIdleFor(timeout)
+		}
+	}
+}
+
+func (cc *ChiliController) expireCopiesIdleFor(timeout time.Duration) {
+	cc.onGoingMultiCopiesByIds.Range(func(key, value interface{}) bool {
+		mph := value.(*writer.MultiPartCopyHandler)
+		idle := mph.Idle()
+		if idle < timeout {
+			return true
+		}
+		if _, err := cc.abortCopy(key.(string)); err == nil {
+			logger.Warn("dropped idle multipart copy", "copy_id", key, "path", mph.CopyOp.GetFilePath(),
+				"idle", idle.Truncate(time.Second))
+		}
+		return true
+	})
+}
+
+// releasePathOf frees path only if it is still held by handler, as an
+// operator may have released it and let another copy take it since.
+func (cc *ChiliController) releasePathOf(path string, handler interface{}) {
+	if held, ok := cc.onGoingCopyOpsByPath.Load(path); ok && held == handler {
+		cc.onGoingCopyOpsByPath.Delete(path)
+	}
+}
+
+// readClaim holds a path for the ops reading it, so that no copy or delete
+// of it starts until the last of them is done. Other reads go on meanwhile.
+type readClaim struct {
+	readers int
+}
+
+// claimRead holds path for reading, unless it is being written.
+func (cc *ChiliController) claimRead(path string) (*readClaim, bool) {
+	cc.readClaimsLock.Lock()
+	defer cc.readClaimsLock.Unlock()
+	held, _ := cc.onGoingCopyOpsByPath.LoadOrStore(path, &readClaim{})
+	rc, ok := held.(*readClaim)
+	if !ok {
+		return nil, false
+	}
+	rc.readers++
+	return rc, true
+}
+
+// releaseRead lets go of a claim taken by claimRead, freeing path once its
+// last reader is done.
+func (cc *ChiliController) releaseRead(path string, rc *readClaim) {
+	cc.readClaimsLock.Lock()
+	defer cc.readClaimsLock.Unlock()
+	if rc.readers--; rc.readers == 0 {
+		cc.releasePathOf(path, rc)
+	}
+}
+
+// beingWritten tells whether path is held by a copy or delete.
+func (cc *ChiliController) beingWritten(path string) bool {
+	held, ok := cc.onGoingCopyOpsByPath.Load(path)
+	if !ok {
+		return false
+	}
+	_, reading := held.(*readClaim)
+	return !reading
+}
+
+func (cc *ChiliController) multiPartCopyInitSuccessResponse(copyId uuid.UUID, conn net.Conn) {
+	payload := protocol.PrepareMultiPartCopyInitSuccessResponseOpHeader(copyId, cc.partLimits())
 	common.SendBytesToConn(conn, payload)
 }
 
-func sendCopySuccessResponse(csum []byte, conn net.Conn, opType protocol.OpType) {
-	payload := protocol.PrepareCopySuccessResponseOpHeader(csum, opType)
+// partLimits tells clients how to split their files: the parts the storage
+// takes, and how many parts are served at once, beyond which they would
+// only wait.
+func (cc *ChiliController) partLimits() protocol.PartLimits {
+	var limits protocol.PartLimits
+	if pl, ok := cc.storage.(storage.PartLimiter); ok {
+		sl := pl.PartLimits()
+		limits.MinSize, limits.MaxSize, limits.MaxParts = sl.MinSize, sl.MaxSize, sl.MaxParts
+	}
+	if cc.opLimits != nil {
+		limits.MaxParallel = uint32(cap(cc.opLimits.data))
+	} else {
+		limits.MaxParallel = uint32(cc.metrics.workers.Value())
+	}
+	return limits
+}
+
+func sendCopySuccessResponse(csum []byte, conn net.Conn, opType protocol.OpType, durable bool) {
+	flags := uint8(0)
+	if durable {
+		flags |= protocol.DurableFlag
+	}
+	payload := protocol.PrepareCopySuccessResponseOpHeader(csum, opType, flags)
 	common.SendBytesToConn(conn, payload)
 }
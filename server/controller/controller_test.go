@@ -0,0 +1,980 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chili-copy/client/ccp"
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/protocol"
+	"github.com/chili-copy/server/acl"
+	"github.com/chili-copy/server/writer"
+	"github.com/google/uuid"
+)
+
+// startServer serves cc on a loopback listener, storing files under a
+// temporary root. stop stops it and removes the root.
+func startServer(t *testing.T, cc *ChiliController) (client *ccp.Client, root string, stop func()) {
+	root, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.SetRoot(root)
+	cc.SetScratchDir(filepath.Join(root, ".scratch"))
+	address, stopServing := serve(t, cc)
+	client = ccp.NewClient(address)
+	return client, root, func() {
+		client.Close()
+		stopServing()
+		os.RemoveAll(root)
+	}
+}
+
+// serve serves cc on a local port, and returns its address.
+func serve(t *testing.T, cc *ChiliController) (address string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		cc.Serve(ctx, ln)
+		close(served)
+	}()
+	return ln.Addr().String(), func() {
+		cancel()
+		<-served
+	}
+}
+
+func testData(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+func TestIsDurable(t *testing.T) {
+	tests := []struct {
+		mode      DurabilityMode
+		requested bool
+		want      bool
+	}{
+		{DurabilityOff, false, false},
+		{DurabilityOff, true, false},
+		{DurabilityOnRequest, false, false},
+		{DurabilityOnRequest, true, true},
+		{DurabilityAlways, false, true},
+		{DurabilityAlways, true, true},
+	}
+	for _, tt := range tests {
+		if got := (Settings{Durability: tt.mode}).isDurable(tt.requested); got != tt.want {
+			t.Errorf("isDurable(%v) in mode %d = %v, want %v", tt.requested, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestParseDurabilityMode(t *testing.T) {
+	for name, want := range map[string]DurabilityMode{"off": DurabilityOff, "request": DurabilityOnRequest,
+		"always": DurabilityAlways} {
+		if got, err := ParseDurabilityMode(name); err != nil || got != want {
+			t.Errorf("ParseDurabilityMode(%s) = %d, %v, want %d", name, got, err, want)
+		}
+	}
+	if _, err := ParseDurabilityMode("sometimes"); err == nil {
+		t.Error("ParseDurabilityMode(sometimes) succeeded")
+	}
+}
+
+// request sends header and data to cc over a connection of its own, and
+// returns the response.
+func request(t *testing.T, cc *ChiliController, header []byte, data []byte) (protocol.OpType, []byte) {
+	client, server := net.Pipe()
+	defer client.Close()
+	cc.AddConnToQ(server)
+	if err := common.SendBytesToConn(client, append(header, data...)); err != nil {
+		t.Fatalf("sending the request: %v", err)
+	}
+	opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(client)
+	if err != nil {
+		t.Fatalf("reading the response: %v", err)
+	}
+	// The server closes the connection once it is done with the request.
+	ioutil.ReadAll(client)
+	return opType, headerBytes
+}
+
+// TestCopyDurable copies a file in one go, or in parts of 1000 bytes, and
+// checks the success response tells whether it was fsynced.
+func TestCopyDurable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name      string
+		mode      DurabilityMode
+		requested bool
+		parts     int
+		want      bool
+	}{
+		{"single on request", DurabilityOnRequest, true, 0, true},
+		{"single not requested", DurabilityOnRequest, false, 0, false},
+		{"single always", DurabilityAlways, false, 0, true},
+		{"single off", DurabilityOff, true, 0, false},
+		{"multipart on request", DurabilityOnRequest, true, 3, true},
+		{"multipart not requested", DurabilityOnRequest, false, 3, false},
+		{"multipart always", DurabilityAlways, false, 3, true},
+		{"multipart off", DurabilityOff, true, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := NewChiliController()
+			cc.SetDurabilityMode(tt.mode)
+			cc.MakeAcceptedConnQ(1)
+			cc.CreateAcceptedConnHandlers(1)
+			defer close(cc.acceptedConns)
+			path := filepath.Join(dir, "file")
+			os.Remove(path)
+			flags := uint8(0)
+			if tt.requested {
+				flags = protocol.DurableFlag
+			}
+			n := tt.parts
+			if n == 0 {
+				n = 1
+			}
+			data := bytes.Repeat([]byte("durable!"), 125*n)
+			var opType protocol.OpType
+			var headerBytes []byte
+			if tt.parts == 0 {
+				opType, headerBytes = request(t, cc,
+					protocol.PrepareSingleCopyRequestOpHeader(path, uint64(len(data)), flags), data)
+			} else {
+				opType, headerBytes = request(t, cc, protocol.PrepareMultiPartInitRequestOpHeader(path, uint64(len(data))), nil)
+				mir, err := protocol.NewMultiPartCopyInitSuccessResponseOp(headerBytes)
+				if opType != protocol.MultiPartCopyInitSuccessResponseOpType || err != nil {
+					t.Fatalf("init responded %d, %v", opType, err)
+				}
+				var digests [][]byte
+				for i := 0; i < tt.parts; i++ {
+					part := data[i*1000 : (i+1)*1000]
+					sum := md5.Sum(part)
+					digests = append(digests, sum[:])
+					opType, _ = request(t, cc, protocol.PrepareMultiPartCopyPartRequestOpHeader(uint64(i+1),
+						mir.GetCopyId(), uint64(len(part))), part)
+					if opType != protocol.SingleCopySuccessResponseOpType {
+						t.Fatalf("part %d responded %d", i+1, opType)
+					}
+				}
+				opType, headerBytes = request(t, cc,
+					protocol.PrepareMultiPartCompleteRequestOpHeader(mir.GetCopyId(), uint64(len(data)), flags,
+						uint64(tt.parts), common.CombinePartDigests(digests)), nil)
+			}
+			if opType != protocol.SingleCopySuccessResponseOpType &&
+				opType != protocol.MultiPartCopySuccessResponseOpType {
+				t.Fatalf("copy responded %d", opType)
+			}
+			if got := protocol.NewSingleCopySuccessResponseOp(headerBytes).IsDurable(); got != tt.want {
+				t.Errorf("response durable = %v, want %v", got, tt.want)
+			}
+			if got, _ := ioutil.ReadFile(path); !bytes.Equal(got, data) {
+				t.Errorf("server holds %d bytes that differ from the %d copied", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestCompleteVerifiesParts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	parts := [][]byte{bytes.Repeat([]byte("a"), 1000), bytes.Repeat([]byte("b"), 1000), []byte("c")}
+	var digests [][]byte
+	for _, part := range parts {
+		sum := md5.Sum(part)
+		digests = append(digests, sum[:])
+	}
+	tests := []struct {
+		name       string
+		onTargetFS bool
+		sent       int
+		numParts   uint64
+		csum       []byte
+		wantErr    bool
+		errType    protocol.ErrType
+	}{
+		{"all parts", false, 3, 3, common.CombinePartDigests(digests), false, 0},
+		{"all parts on target fs", true, 3, 3, common.CombinePartDigests(digests), false, 0},
+		{"checksum mismatch", false, 3, 3, common.CombinePartDigests(digests[:2]), true, protocol.ErrorChecksumMismatch},
+		{"missing part", false, 2, 3, common.CombinePartDigests(digests), true, protocol.ErrorMissingParts},
+		{"missing part on target fs", true, 2, 3, common.CombinePartDigests(digests), true, protocol.ErrorMissingParts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := NewChiliController()
+			cc.SetScratchOnTargetFS(tt.onTargetFS)
+			cc.MakeAcceptedConnQ(1)
+			cc.CreateAcceptedConnHandlers(1)
+			defer close(cc.acceptedConns)
+			path := filepath.Join(dir, "file")
+			os.Remove(path)
+			scratchDir, _ := cc.local.ScratchDirFor(path)
+			opType, headerBytes := request(t, cc, protocol.PrepareMultiPartInitRequestOpHeader(path, 2001), nil)
+			mir, err := protocol.NewMultiPartCopyInitSuccessResponseOp(headerBytes)
+			if opType != protocol.MultiPartCopyInitSuccessResponseOpType || err != nil {
+				t.Fatalf("init responded %d, %v", opType, err)
+			}
+			copyId := mir.GetCopyId()
+			for i, part := range parts[:tt.sent] {
+				opType, _ = request(t, cc, protocol.PrepareMultiPartCopyPartRequestOpHeader(uint64(i+1),
+					copyId, uint64(len(part))), part)
+				if opType != protocol.SingleCopySuccessResponseOpType {
+					t.Fatalf("part %d responded %d", i+1, opType)
+				}
+			}
+			opType, headerBytes = request(t, cc,
+				protocol.PrepareMultiPartCompleteRequestOpHeader(copyId, 2001, 0, tt.numParts, tt.csum), nil)
+			if !tt.wantErr {
+				if opType != protocol.MultiPartCopySuccessResponseOpType {
+					t.Fatalf("complete responded %d", opType)
+				}
+				if got, _ := ioutil.ReadFile(path); !bytes.Equal(got, bytes.Join(parts, nil)) {
+					t.Errorf("server holds %d bytes that differ from the parts sent", len(got))
+				}
+			}
+			if tt.onTargetFS {
+				if _, err := os.Stat(scratchDir); !os.IsNotExist(err) {
+					t.Errorf("scratch dir next to the target was left behind")
+				}
+			}
+			if !tt.wantErr {
+				return
+			}
+			if opType != protocol.ErrorResponseOpType || protocol.ParseErrorType(headerBytes) != tt.errType {
+				t.Fatalf("complete responded %d, want error %d", opType, tt.errType)
+			}
+			if _, err := os.Stat(scratchDir + copyId.String()); !os.IsNotExist(err) {
+				t.Errorf("scratch data of the failed copy was left behind")
+			}
+			if _, ok := cc.onGoingCopyOpsByPath.Load(path); ok {
+				t.Errorf("path still taken by the failed copy")
+			}
+		})
+	}
+}
+
+func TestMultiPartCopyAbort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		copyId  func(copyId uuid.UUID) uuid.UUID
+		stitch  bool
+		twice   bool
+		wantErr bool
+		errType protocol.ErrType
+	}{
+		{"parts received", nil, false, false, false, 0},
+		{"aborted twice", nil, false, true, true, protocol.ErrorCopyIdNotFound},
+		{"unknown copy id", func(uuid.UUID) uuid.UUID { return uuid.New() }, false, false, true,
+			protocol.ErrorCopyIdNotFound},
+		{"being stitched", nil, true, false, true, protocol.ErrorCopyOpInProgress},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := NewChiliController()
+			cc.SetScratchDir(dir)
+			cc.MakeAcceptedConnQ(1)
+			cc.CreateAcceptedConnHandlers(1)
+			defer close(cc.acceptedConns)
+			path := filepath.Join(dir, "file")
+			opType, headerBytes := request(t, cc, protocol.PrepareMultiPartInitRequestOpHeader(path, 2000), nil)
+			mir, err := protocol.NewMultiPartCopyInitSuccessResponseOp(headerBytes)
+			if opType != protocol.MultiPartCopyInitSuccessResponseOpType || err != nil {
+				t.Fatalf("init responded %d, %v", opType, err)
+			}
+			copyId := mir.GetCopyId()
+			part := bytes.Repeat([]byte("a"), 1000)
+			opType, _ = request(t, cc, protocol.PrepareMultiPartCopyPartRequestOpHeader(1, copyId,
+				uint64(len(part))), part)
+			if opType != protocol.SingleCopySuccessResponseOpType {
+				t.Fatalf("part responded %d", opType)
+			}
+			scratchDir, _ := cc.local.ScratchDirFor(path)
+			if _, err := os.Stat(scratchDir + copyId.String()); err != nil {
+				t.Fatalf("parts not in scratch: %v", err)
+			}
+			if tt.stitch {
+				value, _ := cc.onGoingMultiCopiesByIds.Load(copyId.String())
+				value.(*writer.MultiPartCopyHandler).BeginStitch()
+			}
+			abortId := copyId
+			if tt.copyId != nil {
+				abortId = tt.copyId(copyId)
+			}
+			opType, headerBytes = request(t, cc, protocol.PrepareMultiPartAbortRequestOpHeader(abortId), nil)
+			if tt.twice {
+				opType, headerBytes = request(t, cc, protocol.PrepareMultiPartAbortRequestOpHeader(abortId), nil)
+			}
+			if tt.wantErr {
+				if opType != protocol.ErrorResponseOpType || protocol.ParseErrorType(headerBytes) != tt.errType {
+					t.Errorf("abort responded %d, want error %d", opType, tt.errType)
+				}
+				if !tt.twice {
+					cc.AbortCopy(copyId.String())
+				}
+				return
+			}
+			if opType != protocol.MultiPartCopyAbortSuccessResponseOpType {
+				t.Fatalf("abort responded %d", opType)
+			}
+			if _, err := os.Stat(scratchDir + copyId.String()); !os.IsNotExist(err) {
+				t.Errorf("parts of the aborted copy were left behind")
+			}
+			if _, ok := cc.onGoingCopyOpsByPath.Load(path); ok {
+				t.Errorf("path still taken by the aborted copy")
+			}
+		})
+	}
+}
+
+func TestExpireIdleCopies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name string
+		// idle makes the copy look idle for an hour, or not.
+		idle func(mph *writer.MultiPartCopyHandler)
+		want bool
+	}{
+		{"no parts for an hour", func(mph *writer.MultiPartCopyHandler) { mph.Started = mph.Started.Add(-time.Hour) },
+			true},
+		{"just started", func(mph *writer.MultiPartCopyHandler) {}, false},
+		{"part being written", func(mph *writer.MultiPartCopyHandler) {
+			mph.Started = mph.Started.Add(-time.Hour)
+			mph.BeginPart()
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := NewChiliController()
+			cc.SetScratchDir(dir)
+			cc.MakeAcceptedConnQ(1)
+			cc.CreateAcceptedConnHandlers(1)
+			defer close(cc.acceptedConns)
+			path := filepath.Join(dir, "file")
+			_, headerBytes := request(t, cc, protocol.PrepareMultiPartInitRequestOpHeader(path, 2000), nil)
+			mir, err := protocol.NewMultiPartCopyInitSuccessResponseOp(headerBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			copyId := mir.GetCopyId().String()
+			value, _ := cc.onGoingMultiCopiesByIds.Load(copyId)
+			mph := value.(*writer.MultiPartCopyHandler)
+			tt.idle(mph)
+			cc.expireCopiesIdleFor(time.Hour)
+			_, ok := cc.onGoingMultiCopiesByIds.Load(copyId)
+			if expired := !ok; expired != tt.want {
+				t.Errorf("copy expired = %v, want %v", expired, tt.want)
+			}
+			if _, ok := cc.onGoingCopyOpsByPath.Load(path); ok == tt.want {
+				t.Errorf("path held = %v, want %v", ok, !tt.want)
+			}
+			cc.AbortCopy(copyId)
+		})
+	}
+}
+
+func TestInsufficientSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{"single copy", protocol.PrepareSingleCopyRequestOpHeader(path, 1<<62, 0)},
+		{"multipart init", protocol.PrepareMultiPartInitRequestOpHeader(path, 1<<62)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := NewChiliController()
+			cc.MakeAcceptedConnQ(1)
+			cc.CreateAcceptedConnHandlers(1)
+			defer close(cc.acceptedConns)
+			opType, headerBytes := request(t, cc, tt.header, nil)
+			if opType != protocol.ErrorResponseOpType || protocol.ParseErrorType(headerBytes) != protocol.ErrorInsufficientSpace {
+				t.Fatalf("copy responded %d, want insufficient space", opType)
+			}
+			if _, ok := cc.onGoingCopyOpsByPath.Load(path); ok {
+				t.Errorf("path still taken by the refused copy")
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("refused copy left a file behind")
+			}
+		})
+	}
+}
+
+// TestInitInPlace checks that copies whose parts are stitched in place get
+// one space reservation and no preallocated target.
+func TestInitInPlace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name       string
+		onTargetFS bool
+	}{
+		{"scratch dir on the target filesystem", false},
+		{"scratch next to the target", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := NewChiliController()
+			cc.SetScratchDir(dir)
+			cc.SetScratchOnTargetFS(tt.onTargetFS)
+			cc.SetPreallocate(true)
+			cc.MakeAcceptedConnQ(1)
+			cc.CreateAcceptedConnHandlers(1)
+			defer close(cc.acceptedConns)
+			path := filepath.Join(dir, "file")
+			opType, headerBytes := request(t, cc, protocol.PrepareMultiPartInitRequestOpHeader(path, 2000), nil)
+			mir, err := protocol.NewMultiPartCopyInitSuccessResponseOp(headerBytes)
+			if opType != protocol.MultiPartCopyInitSuccessResponseOpType || err != nil {
+				t.Fatalf("init responded %d, %v", opType, err)
+			}
+			mcop, _ := cc.onGoingMultiCopiesByIds.Load(mir.GetCopyId().String())
+			mph := mcop.(*writer.MultiPartCopyHandler)
+			defer cc.dropMultiPartCopy(mph)
+			if !mph.InPlace || mph.ScratchReservation != nil {
+				t.Errorf("in place = %v with scratch reservation %v, want in place with none", mph.InPlace,
+					mph.ScratchReservation)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("target preallocated for a copy stitched in place")
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	data := bytes.Repeat([]byte("metrics!"), 625)
+	type count struct {
+		op      protocol.OpType
+		outcome string
+		want    uint64
+	}
+	tests := []struct {
+		name        string
+		run         func(cc *ChiliController)
+		wantBytes   uint64
+		wantOps     []count
+		wantNoSpace uint64
+	}{
+		{"single copy", func(cc *ChiliController) {
+			request(t, cc, protocol.PrepareSingleCopyRequestOpHeader(path, uint64(len(data)), 0), data)
+		}, 5000, []count{{protocol.SingleCopyOpType, outcomeSuccess, 1}}, 0},
+		{"multipart copy", func(cc *ChiliController) {
+			_, headerBytes := request(t, cc, protocol.PrepareMultiPartInitRequestOpHeader(path, uint64(len(data))), nil)
+			mir, err := protocol.NewMultiPartCopyInitSuccessResponseOp(headerBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var digests [][]byte
+			for i := 0; i*2000 < len(data); i++ {
+				part := data[i*2000:]
+				if len(part) > 2000 {
+					part = part[:2000]
+				}
+				sum := md5.Sum(part)
+				digests = append(digests, sum[:])
+				request(t, cc, protocol.PrepareMultiPartCopyPartRequestOpHeader(uint64(i+1), mir.GetCopyId(),
+					uint64(len(part))), part)
+			}
+			request(t, cc, protocol.PrepareMultiPartCompleteRequestOpHeader(mir.GetCopyId(), uint64(len(data)), 0,
+				uint64(len(digests)), common.CombinePartDigests(digests)), nil)
+		}, 5000, []count{
+			{protocol.MultiPartCopyInitOpType, outcomeSuccess, 1},
+			{protocol.MultiPartCopyPartRequestOpType, outcomeSuccess, 3},
+			{protocol.MultiPartCopyCompleteOpType, outcomeSuccess, 1},
+		}, 0},
+		{"copy refused for space", func(cc *ChiliController) {
+			request(t, cc, protocol.PrepareSingleCopyRequestOpHeader(path, 1<<62, 0), nil)
+		}, 0, []count{{protocol.SingleCopyOpType, outcomeError, 1}}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := NewChiliController()
+			cc.MakeAcceptedConnQ(1)
+			cc.CreateAcceptedConnHandlers(1)
+			defer close(cc.acceptedConns)
+			tt.run(cc)
+			m := cc.metrics
+			if got := m.receivedBytes.Value(); got != tt.wantBytes {
+				t.Errorf("received bytes = %d, want %d", got, tt.wantBytes)
+			}
+			for _, c := range tt.wantOps {
+				if got := m.operations.With(c.op.String(), c.outcome).Value(); got != c.want {
+					t.Errorf("%s ops with outcome %s = %d, want %d", c.op, c.outcome, got, c.want)
+				}
+			}
+			if got := m.errors.With(protocol.ErrorInsufficientSpace.String()).Value(); got != tt.wantNoSpace {
+				t.Errorf("insufficient space errors = %d, want %d", got, tt.wantNoSpace)
+			}
+			if got := m.activeMultiPartCopies.Value(); got != 0 {
+				t.Errorf("%d multipart copies still active", got)
+			}
+		})
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	tests := []struct {
+		name   string
+		max    uint64
+		header []byte
+		data   []byte
+		want   protocol.OpType
+	}{
+		{"single copy over the limit", 10, protocol.PrepareSingleCopyRequestOpHeader(path, 11, 0), nil,
+			protocol.ErrorResponseOpType},
+		{"single copy at the limit", 10, protocol.PrepareSingleCopyRequestOpHeader(path, 10, 0), make([]byte, 10),
+			protocol.SingleCopySuccessResponseOpType},
+		{"single copy without a limit", 0, protocol.PrepareSingleCopyRequestOpHeader(path, 11, 0), make([]byte, 11),
+			protocol.SingleCopySuccessResponseOpType},
+		{"multipart copy over the limit", 10, protocol.PrepareMultiPartInitRequestOpHeader(path, 11), nil,
+			protocol.ErrorResponseOpType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := NewChiliController()
+			cc.SetMaxFileSize(tt.max)
+			cc.MakeAcceptedConnQ(1)
+			cc.CreateAcceptedConnHandlers(1)
+			defer close(cc.acceptedConns)
+			opType, headerBytes := request(t, cc, tt.header, tt.data)
+			if opType != tt.want {
+				t.Fatalf("copy responded %d, want %d", opType, tt.want)
+			}
+			if opType == protocol.ErrorResponseOpType && protocol.ParseErrorType(headerBytes) != protocol.ErrorFileTooLarge {
+				t.Errorf("copy failed with %s, want %s", protocol.ParseErrorType(headerBytes), protocol.ErrorFileTooLarge)
+			}
+		})
+	}
+}
+
+func TestServe(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(cc *ChiliController)
+	}{
+		{"defaults", func(cc *ChiliController) {}},
+		{"pool", func(cc *ChiliController) {
+			cc.MakeAcceptedConnQ(4)
+			cc.CreateAcceptedConnHandlers(2)
+		}},
+		{"goroutine per connection", func(cc *ChiliController) { cc.SetGoroutinePerConn(2, 2) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := NewChiliController()
+			tt.setup(cc)
+			root, err := ioutil.TempDir("", "controller")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			cc.SetRoot(root)
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			served := make(chan error, 1)
+			go func() { served <- cc.Serve(ctx, ln) }()
+			client := ccp.NewClient(ln.Addr().String())
+			if _, err := client.Upload(ctx, bytes.NewReader(testData(100)), 100, "/file", nil); err != nil {
+				t.Fatalf("Upload() error = %v", err)
+			}
+			// A connection still being served keeps Serve from returning.
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+			select {
+			case err := <-served:
+				t.Fatalf("Serve() returned %v while serving a connection", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+			if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+				t.Error("listener still accepts connections once the context is done")
+			}
+			conn.Close()
+			select {
+			case err := <-served:
+				if err != nil {
+					t.Errorf("Serve() = %v, want nil", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Serve() did not return once its connections were served")
+			}
+		})
+	}
+}
+
+func TestServeListenerClosed(t *testing.T) {
+	cc := NewChiliController()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- cc.Serve(context.Background(), ln) }()
+	ln.Close()
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Error("Serve() = nil for a listener closed under it, want its error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve() did not return once its listener was closed")
+	}
+}
+
+func TestRootPath(t *testing.T) {
+	tests := []struct {
+		name string
+		root string
+		path string
+		want string
+	}{
+		{"no root", "", "/data/file", "/data/file"},
+		{"no root dot dot", "", "/data/../etc/passwd", "/etc/passwd"},
+		{"no root relative", "", "data/file", "/data/file"},
+		{"under root", "/srv", "/data/file", "/srv/data/file"},
+		{"relative", "/srv", "data/file", "/srv/data/file"},
+		{"dot dot", "/srv", "/../../etc/passwd", "/srv/etc/passwd"},
+		{"dot dot inside", "/srv", "/data/../file", "/srv/file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := NewChiliController()
+			if tt.root != "" {
+				cc.SetRoot(tt.root)
+			}
+			op := protocol.NewSingleCopyOp(protocol.PrepareSingleCopyRequestOpHeader(tt.path, 0, 0))
+			cc.rootPath(op)
+			if got := op.GetFilePath(); got != tt.want {
+				t.Errorf("rootPath() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostCommit(t *testing.T) {
+	root, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	data := bytes.Repeat([]byte("commit!!"), 250)
+	sum := md5.Sum(data)
+	tests := []struct {
+		name  string
+		parts int
+		want  []byte
+	}{
+		{"single copy", 0, sum[:]},
+		{"multipart copy", 2, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := NewChiliController()
+			cc.SetRoot(root)
+			cc.SetScratchDir(root)
+			var commits []CommitInfo
+			cc.SetHooks(Hooks{PostCommit: func(info CommitInfo) { commits = append(commits, info) }})
+			cc.MakeAcceptedConnQ(1)
+			cc.CreateAcceptedConnHandlers(1)
+			defer close(cc.acceptedConns)
+			want := tt.want
+			if tt.parts == 0 {
+				request(t, cc, protocol.PrepareSingleCopyRequestOpHeader("/file", uint64(len(data)), 0), data)
+			} else {
+				_, headerBytes := request(t, cc, protocol.PrepareMultiPartInitRequestOpHeader("/file",
+					uint64(len(data))), nil)
+				mir, err := protocol.NewMultiPartCopyInitSuccessResponseOp(headerBytes)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var digests [][]byte
+				size := len(data) / tt.parts
+				for i := 0; i < tt.parts; i++ {
+					part := data[i*size : (i+1)*size]
+					sum := md5.Sum(part)
+					digests = append(digests, sum[:])
+					request(t, cc, protocol.PrepareMultiPartCopyPartRequestOpHeader(uint64(i+1), mir.GetCopyId(),
+						uint64(len(part))), part)
+				}
+				want = common.CombinePartDigests(digests)
+				request(t, cc, protocol.PrepareMultiPartCompleteRequestOpHeader(mir.GetCopyId(), uint64(len(data)), 0,
+					uint64(tt.parts), want), nil)
+			}
+			if len(commits) != 1 {
+				t.Fatalf("post commit hook called %d times, want once", len(commits))
+			}
+			c := commits[0]
+			if c.Path != filepath.Join(root, "file") || c.Size != uint64(len(data)) || !bytes.Equal(c.Checksum, want) {
+				t.Errorf("post commit hook got %s of %d bytes with checksum %x, want %s of %d with %x", c.Path, c.Size,
+					c.Checksum, filepath.Join(root, "file"), len(data), want)
+			}
+		})
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	cc := NewChiliController()
+	client, root, stop := startServer(t, cc)
+	defer stop()
+	for _, dir := range []string{"archive", "data", "trash"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{filepath.Join("archive", "file"), filepath.Join("trash", "file")} {
+		if err := ioutil.WriteFile(filepath.Join(root, file), testData(10), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rule := func(clients []string, paths []string, allow []string) *acl.Rule {
+		r, err := acl.NewRule(clients, paths, allow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	cc.updateSettings(func(s *Settings) {
+		s.ACL = acl.Rules{
+			rule([]string{"10.0.0.0/8"}, []string{"/"}, []string{"read", "write"}),
+			rule([]string{"127.0.0.1"}, []string{filepath.Join(root, "archive") + "/"}, []string{"read"}),
+			rule([]string{"127.0.0.1"}, []string{filepath.Join(root, "data") + "/"}, []string{"write"}),
+			rule([]string{"127.0.0.1"}, []string{filepath.Join(root, "trash") + "/"}, []string{"delete", "list"}),
+		}
+	})
+	tests := []struct {
+		name string
+		run  func() error
+		// wantDenied tells whether the op is denied, rather than allowed.
+		wantDenied bool
+	}{
+		{"stat with read", func() error {
+			_, err := client.Stat(context.Background(), "/archive/file")
+			return err
+		}, false},
+		{"stat without read", func() error {
+			_, err := client.Stat(context.Background(), "/data/file")
+			return err
+		}, true},
+		{"copy with write", func() error {
+			_, err := client.Upload(context.Background(), bytes.NewReader(testData(10)), 10, "/data/file", nil)
+			return err
+		}, false},
+		{"copy without write", func() error {
+			_, err := client.Upload(context.Background(), bytes.NewReader(testData(10)), 10, "/archive/file", nil)
+			return err
+		}, true},
+		{"multipart copy without write", func() error {
+			_, err := client.Upload(context.Background(), bytes.NewReader(testData(5000)), 5000, "/archive/file",
+				&ccp.Options{ChunkSize: 1000})
+			return err
+		}, true},
+		{"delete without delete", func() error {
+			return client.Delete(context.Background(), "/archive/file")
+		}, true},
+		{"delete with delete", func() error {
+			return client.Delete(context.Background(), "/trash/file")
+		}, false},
+		{"list without list", func() error {
+			_, err := client.List(context.Background(), "/archive")
+			return err
+		}, true},
+		{"list with list", func() error {
+			_, err := client.List(context.Background(), "/trash")
+			return err
+		}, false},
+		{"dot dot out of a rule", func() error {
+			_, err := client.Stat(context.Background(), "/archive/../data/file")
+			return err
+		}, true},
+		{"dot dot into a rule", func() error {
+			_, err := client.Stat(context.Background(), "/data/../archive/file")
+			return err
+		}, false},
+		{"no rule matches", func() error {
+			_, err := client.Stat(context.Background(), "/elsewhere")
+			return err
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.run()
+			se, denied := err.(*ccp.ServerError)
+			denied = denied && se.Type == protocol.ErrorAccessDenied
+			if denied != tt.wantDenied || !denied && err != nil {
+				t.Errorf("error = %v, want denied %v", err, tt.wantDenied)
+			}
+		})
+	}
+}
+
+func TestEnqueueBoundsWaiters(t *testing.T) {
+	cc := NewChiliController()
+	// No workers, so the first connection fills the queue.
+	cc.MakeAcceptedConnQ(1)
+	cc.updateSettings(func(s *Settings) {
+		s.QueueTimeout = time.Minute
+		s.BusyRetryAfter = 3 * time.Second
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"fits the queue", "queued"},
+		{"waits for room", "waiting"},
+		{"past the waiters", "busy"},
+		{"past the busy replies", "closed"},
+	}
+	clients := make([]net.Conn, len(tests))
+	servers := make([]net.Conn, len(tests))
+	for i := range tests {
+		client, server := net.Pipe()
+		defer client.Close()
+		clients[i], servers[i] = client, server
+		cc.enqueue(ctx, acceptedConn{conn: server})
+	}
+	var queued net.Conn
+	select {
+	case ac := <-cc.acceptedConns:
+		queued = ac.conn
+	default:
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pipeState(clients[i])
+			if got == "unread" && servers[i] == queued {
+				got = "queued"
+			} else if got == "unread" {
+				got = "waiting"
+			}
+			if got != tt.want {
+				t.Errorf("connection is %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// pipeState sends a header on conn and tells how the server dealt with it.
+func pipeState(conn net.Conn) string {
+	conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	defer conn.SetDeadline(time.Time{})
+	if err := common.SendBytesToConn(conn, protocol.PrepareStatRequestOpHeader("/file")); err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			// Nothing reads connections in the queue or waiting for it.
+			return "unread"
+		}
+		return "closed"
+	}
+	opType, b, err := common.GetOpTypeAndHeaderFromConn(conn)
+	if err != nil {
+		return "closed"
+	}
+	if opType != protocol.ErrorResponseOpType {
+		return "replied " + opType.String()
+	}
+	serr := protocol.NewServerError(b)
+	if serr.Type != protocol.ErrorServerBusy || !serr.Retryable || serr.RetryAfter != 3*time.Second {
+		return "replied " + serr.Error()
+	}
+	return "busy"
+}
+
+func TestServerTimeouts(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings func(s *Settings)
+		// send is sent before waiting for the response.
+		send []byte
+	}{
+		{"no header", func(s *Settings) { s.HeaderTimeout = 50 * time.Millisecond }, nil},
+		{"half a header", func(s *Settings) { s.HeaderTimeout = 50 * time.Millisecond },
+			protocol.PrepareStatRequestOpHeader("/file")[:10]},
+		{"no data", func(s *Settings) { s.IdleTimeout = 50 * time.Millisecond },
+			protocol.PrepareSingleCopyRequestOpHeader("/file", 100, 0)},
+		{"op too long", func(s *Settings) { s.OpTimeout = 100 * time.Millisecond },
+			protocol.PrepareSingleCopyRequestOpHeader("/file", 100, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := NewChiliController()
+			cc.updateSettings(tt.settings)
+			address, stop := serve(t, cc)
+			defer stop()
+			conn, err := net.Dial("tcp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write(tt.send)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(conn)
+			if err != nil || opType != protocol.ErrorResponseOpType {
+				t.Fatalf("server responded %s, %v, want an error response", opType, err)
+			}
+			if se := protocol.NewServerError(headerBytes); se.Type != protocol.ErrorTimeout {
+				t.Errorf("server responded %v, want it to time out", se)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/common/protocol"
+	"github.com/chili-copy/server/space"
+)
+
+// errorReplyTimeout bounds sending the error of an op that timed out.
+const errorReplyTimeout = 5 * time.Second
+
+// serverError describes err, which made an op fail with errType, for the
+// client. Running out of space and timeouts are reported as such whatever
+// errType is, and errors that may pass, such as another copy holding the
+// path or the object store being unavailable, are marked retryable.
+func serverError(errType protocol.ErrType, err error) *protocol.ServerError {
+	serr := &protocol.ServerError{Type: errType, Retryable: errType == protocol.ErrorCopyOpInProgress}
+	// A missing file needs no more explaining.
+	if err == nil || errType == protocol.ErrorFileNotFound {
+		return serr
+	}
+	cause := underlyingError(err)
+	if cause == syscall.ENOSPC || cause == space.ErrInsufficientSpace {
+		serr.Type = protocol.ErrorInsufficientSpace
+		return serr
+	}
+	if _, ok := cause.(*common.TimeoutError); ok {
+		serr.Type = protocol.ErrorTimeout
+	}
+	if temp, ok := cause.(interface{ Temporary() bool }); ok && temp.Temporary() {
+		serr.Retryable = true
+	}
+	serr.Message = cause.Error()
+	return serr
+}
+
+// underlyingError strips the op and path off filesystem and network errors,
+// leaving eg. "permission denied", as paths on the server mean nothing to
+// the client and may reveal more than it should know.
+func underlyingError(err error) error {
+	for {
+		switch e := err.(type) {
+		case *os.PathError:
+			err = e.Err
+		case *os.LinkError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		default:
+			return err
+		}
+	}
+}
+
+func (cc *ChiliController) errorResponse(errType protocol.ErrType, conn net.Conn, log *logger.Logger) {
+	cc.sendError(serverError(errType, nil), conn, log)
+}
+
+// errorResponseFor sends errType with err as its cause.
+func (cc *ChiliController) errorResponseFor(errType protocol.ErrType, err error, conn net.Conn, log *logger.Logger) {
+	cc.sendError(serverError(errType, err), conn, log.With("error", err))
+}
+
+func (cc *ChiliController) errorResponseWithMessage(errType protocol.ErrType, message string, conn net.Conn, log *logger.Logger) {
+	serr := serverError(errType, nil)
+	serr.Message = message
+	cc.sendError(serr, conn, log.With("message", message))
+}
+
+func (cc *ChiliController) sendError(serr *protocol.ServerError, conn net.Conn, log *logger.Logger) {
+	log.Warn("sending error response", "err_type", serr.Type, "retryable", serr.Retryable)
+	if tc, ok := conn.(*common.TimeoutConn); ok && serr.Type == protocol.ErrorTimeout {
+		// The op may be out of time, but the client should still learn why.
+		tc.SetDeadline(time.Now().Add(errorReplyTimeout))
+	}
+	cc.metrics.observeError(serr.Type)
+	common.SendBytesToConn(conn, protocol.PrepareErrorResponseOpHeader(serr))
+}
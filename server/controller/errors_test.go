@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/protocol"
+	"github.com/chili-copy/server/space"
+)
+
+func TestServerError(t *testing.T) {
+	tests := []struct {
+		name    string
+		errType protocol.ErrType
+		err     error
+		want    protocol.ServerError
+	}{
+		{"no cause", protocol.ErrorWritingPart, nil, protocol.ServerError{Type: protocol.ErrorWritingPart}},
+		{"path in progress", protocol.ErrorCopyOpInProgress, nil,
+			protocol.ServerError{Type: protocol.ErrorCopyOpInProgress, Retryable: true}},
+		{"path stripped", protocol.ErrorWritingSingleCopy,
+			&os.PathError{Op: "open", Path: "/secret/dir/file", Err: syscall.EACCES},
+			protocol.ServerError{Type: protocol.ErrorWritingSingleCopy, Message: "permission denied"}},
+		{"nested causes", protocol.ErrorReadingFile,
+			&os.PathError{Op: "read", Path: "/f", Err: &os.SyscallError{Syscall: "pread", Err: syscall.EIO}},
+			protocol.ServerError{Type: protocol.ErrorReadingFile, Message: "input/output error"}},
+		{"no space", protocol.ErrorWritingPart, &os.PathError{Op: "write", Path: "/f", Err: syscall.ENOSPC},
+			protocol.ServerError{Type: protocol.ErrorInsufficientSpace}},
+		{"no space reserved", protocol.ErrorWritingSingleCopy, space.ErrInsufficientSpace,
+			protocol.ServerError{Type: protocol.ErrorInsufficientSpace}},
+		{"timeout", protocol.ErrorWritingPart,
+			&net.OpError{Op: "read", Err: &common.TimeoutError{Kind: common.TimeoutIdle, Limit: time.Minute}},
+			protocol.ServerError{Type: protocol.ErrorTimeout, Retryable: true, Message: "no data moved for 1m0s"}},
+		{"missing file", protocol.ErrorFileNotFound, &os.PathError{Op: "stat", Path: "/f", Err: syscall.ENOENT},
+			protocol.ServerError{Type: protocol.ErrorFileNotFound}},
+		{"other error", protocol.ErrorReadingFile, errors.New("object store went away"),
+			protocol.ServerError{Type: protocol.ErrorReadingFile, Message: "object store went away"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serverError(tt.errType, tt.err); *got != tt.want {
+				t.Errorf("serverError() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
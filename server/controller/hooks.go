@@ -0,0 +1,141 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/common/protocol"
+)
+
+// Hooks are called by the controller around operations. Nil hooks are
+// skipped.
+type Hooks struct {
+	// PreAccept is called before a single or multipart copy is accepted.
+	// Returning an error rejects the copy, and the error's text is sent to
+	// the client.
+	PreAccept func(CopyInfo) error
+	// PostCommit is called once a copied file is in place at its path and
+	// the client was told of the success. It runs on the worker that served
+	// the copy, so slow processing should be handed off.
+	PostCommit func(CommitInfo)
+}
+
+// CopyInfo describes a copy asked for by a client.
+type CopyInfo struct {
+	Op   protocol.OpType
+	Path string
+	Size uint64
+	// CopyId is set for multipart copies.
+	CopyId string
+	// Remote is the address of the client, which is all that identifies it
+	// as clients do not authenticate.
+	Remote string
+}
+
+// CommitInfo describes a copy that was committed to its path.
+type CommitInfo struct {
+	CopyInfo
+	// Checksum is the MD5 of the file, or the multipart checksum for
+	// multipart copies.
+	Checksum []byte
+	Durable  bool
+}
+
+func (cc *ChiliController) preAccept(info CopyInfo) error {
+	if cc.hooks.PreAccept == nil {
+		return nil
+	}
+	return cc.hooks.PreAccept(info)
+}
+
+func (cc *ChiliController) postCommit(info CommitInfo) {
+	if cc.hooks.PostCommit != nil {
+		cc.hooks.PostCommit(info)
+	}
+}
+
+// CommandHooks returns hooks that run the executables at preAccept and
+// postCommit, either of which may be empty. The copy is described to them
+// in the environment by CCP_HOOK (pre-accept or post-commit), CCP_OP,
+// CCP_PATH, CCP_SIZE, CCP_COPY_ID and CCP_CLIENT, and after commit also by
+// CCP_CHECKSUM and CCP_DURABLE.
+//
+// The pre-accept command rejects the copy by exiting with a non-zero status,
+// and the first line it prints is sent to the client as the reason. The
+// post-commit command runs in the background, so that processing it starts
+// does not hold up the worker. Commands are killed after timeout.
+func CommandHooks(preAccept string, postCommit string, timeout time.Duration) Hooks {
+	var hooks Hooks
+	if preAccept != "" {
+		hooks.PreAccept = func(info CopyInfo) error {
+			return runPreAcceptCommand(preAccept, timeout, info)
+		}
+	}
+	if postCommit != "" {
+		hooks.PostCommit = func(info CommitInfo) {
+			go runPostCommitCommand(postCommit, timeout, info)
+		}
+	}
+	return hooks
+}
+
+func runPreAcceptCommand(command string, timeout time.Duration, info CopyInfo) error {
+	out, err := runHookCommand(command, timeout, append(copyEnv(info), "CCP_HOOK=pre-accept"))
+	if err == nil {
+		return nil
+	}
+	log := logger.With("hook", command, "path", info.Path, "remote", info.Remote)
+	if _, ok := err.(*exec.ExitError); !ok {
+		// Copies are rejected rather than let in unchecked.
+		log.Error("failed to run pre-accept hook", "error", err)
+		return errors.New("pre-accept hook failed")
+	}
+	reason, _ := bufio.NewReader(bytes.NewReader(out)).ReadString('\n')
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		reason = "rejected by pre-accept hook"
+	}
+	log.Info("pre-accept hook rejected copy", "reason", reason)
+	return errors.New(reason)
+}
+
+func runPostCommitCommand(command string, timeout time.Duration, info CommitInfo) {
+	env := append(copyEnv(info.CopyInfo), "CCP_HOOK=post-commit",
+		fmt.Sprintf("CCP_CHECKSUM=%x", info.Checksum), "CCP_DURABLE="+strconv.FormatBool(info.Durable))
+	_, err := runHookCommand(command, timeout, env)
+	if err != nil {
+		logger.Warn("post-commit hook failed", "hook", command, "path", info.Path, "error", err)
+	}
+}
+
+func copyEnv(info CopyInfo) []string {
+	return []string{
+		"CCP_OP=" + info.Op.String(),
+		"CCP_PATH=" + info.Path,
+		"CCP_SIZE=" + strconv.FormatUint(info.Size, 10),
+		"CCP_COPY_ID=" + info.CopyId,
+		"CCP_CLIENT=" + info.Remote,
+	}
+}
+
+// runHookCommand returns what command prints on its standard output.
+func runHookCommand(command string, timeout time.Duration, env []string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return out, fmt.Errorf("timed out after %s", timeout)
+	}
+	return out, err
+}
@@ -0,0 +1,178 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chili-copy/client/ccp"
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/protocol"
+)
+
+// writeScript writes an executable shell script to dir.
+func writeScript(t *testing.T, dir string, name string, script string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPreAcceptCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		script  string
+		wantErr string
+	}{
+		{"accept", "exit 0\n", ""},
+		{"sees the copy", `[ "$CCP_HOOK" = pre-accept ] && [ "$CCP_OP" = multipart-init ] && [ "$CCP_PATH" = /data/file ] &&
+[ "$CCP_SIZE" = 42 ] && [ "$CCP_COPY_ID" = id ] && [ "$CCP_CLIENT" = 10.0.0.1:1 ]
+`, ""},
+		{"reject with a reason", "echo 'disk is for logs only'\necho more\nexit 1\n", "disk is for logs only"},
+		{"reject without a reason", "exit 3\n", "rejected by pre-accept hook"},
+		{"too slow", "exec sleep 5\n", "pre-accept hook failed"},
+	}
+	info := CopyInfo{Op: protocol.MultiPartCopyInitOpType, Path: "/data/file", Size: 42, CopyId: "id",
+		Remote: "10.0.0.1:1"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command := writeScript(t, dir, strings.Replace(tt.name, " ", "-", -1), tt.script)
+			err := CommandHooks(command, "", 500*time.Millisecond).PreAccept(info)
+			if got := errString(err); got != tt.wantErr {
+				t.Errorf("PreAccept() error = %q, want %q", got, tt.wantErr)
+			}
+		})
+	}
+	err = CommandHooks(filepath.Join(dir, "missing"), "", time.Second).PreAccept(info)
+	if got := errString(err); got != "pre-accept hook failed" {
+		t.Errorf("PreAccept() with a missing command error = %q, want it to fail", got)
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func TestPostCommitCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "env")
+	command := writeScript(t, dir, "post-commit", "env | grep ^CCP_ | sort > "+out+".tmp && mv "+out+".tmp "+out+"\n")
+	hooks := CommandHooks("", command, 5*time.Second)
+	if hooks.PreAccept != nil {
+		t.Error("CommandHooks() made a pre-accept hook with no command")
+	}
+	hooks.PostCommit(CommitInfo{CopyInfo: CopyInfo{Op: protocol.SingleCopyOpType, Path: "/data/file", Size: 3,
+		Remote: "10.0.0.1:1"}, Checksum: []byte{0xab, 0xcd}, Durable: true})
+	var got []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got, err = ioutil.ReadFile(out); err == nil {
+			break
+		}
+	}
+	want := "CCP_CHECKSUM=abcd\nCCP_CLIENT=10.0.0.1:1\nCCP_COPY_ID=\nCCP_DURABLE=true\nCCP_HOOK=post-commit\n" +
+		"CCP_OP=single-copy\nCCP_PATH=/data/file\nCCP_SIZE=3\n"
+	if string(got) != want {
+		t.Errorf("post-commit hook ran with\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		size       int
+		wantOp     protocol.OpType
+		wantReject bool
+	}{
+		{"single copy", "/file", 1000, protocol.SingleCopyOpType, false},
+		{"multipart copy", "/file", 5000, protocol.MultiPartCopyInitOpType, false},
+		{"single copy rejected", "/rejected", 1000, protocol.SingleCopyOpType, true},
+		{"multipart copy rejected", "/rejected", 5000, protocol.MultiPartCopyInitOpType, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var accepted []CopyInfo
+			commits := make(chan CommitInfo, 1)
+			cc := NewChiliController()
+			cc.SetHooks(Hooks{
+				PreAccept: func(info CopyInfo) error {
+					accepted = append(accepted, info)
+					if strings.HasSuffix(info.Path, "/rejected") {
+						return errors.New("no rejects here")
+					}
+					return nil
+				},
+				PostCommit: func(info CommitInfo) { commits <- info },
+			})
+			client, root, stop := startServer(t, cc)
+			defer stop()
+			data := testData(tt.size)
+			_, err := client.Upload(context.Background(), bytes.NewReader(data), int64(len(data)), tt.path,
+				&ccp.Options{ChunkSize: 2000, Workers: 2})
+			if len(accepted) != 1 {
+				t.Fatalf("pre-accept hook called %d times, want 1", len(accepted))
+			}
+			if info := accepted[0]; info.Op != tt.wantOp || info.Path != filepath.Join(root, tt.path) ||
+				info.Size != uint64(tt.size) || info.Remote == "" {
+				t.Errorf("pre-accept hook called with %+v", info)
+			}
+			if tt.wantReject {
+				se, ok := err.(*ccp.ServerError)
+				if !ok || se.Type != protocol.ErrorRejected || se.Message != "no rejects here" {
+					t.Errorf("Upload() error = %v, want it rejected with the hook's reason", err)
+				}
+				if _, err := os.Stat(filepath.Join(root, tt.path)); err == nil {
+					t.Error("rejected copy was written")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Upload() error = %v", err)
+			}
+			var want []byte
+			if tt.size < 2000 {
+				sum := md5.Sum(data)
+				want = sum[:]
+			} else {
+				var digests [][]byte
+				for off := 0; off < len(data); off += 2000 {
+					end := off + 2000
+					if end > len(data) {
+						end = len(data)
+					}
+					sum := md5.Sum(data[off:end])
+					digests = append(digests, sum[:])
+				}
+				want = common.CombinePartDigests(digests)
+			}
+			select {
+			case info := <-commits:
+				if info.Path != filepath.Join(root, tt.path) || !bytes.Equal(info.Checksum, want) {
+					t.Errorf("post-commit hook called with %+v, want checksum %x", info, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("post-commit hook not called")
+			}
+		})
+	}
+}
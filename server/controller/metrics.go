@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/chili-copy/common/protocol"
+	"github.com/chili-copy/server/metrics"
+)
+
+const (
+	outcomeSuccess = "success"
+	outcomeError   = "error"
+)
+
+type serverMetrics struct {
+	registry              *metrics.Registry
+	receivedBytes         *metrics.Counter
+	sentBytes             *metrics.Counter
+	relayedBytes          *metrics.Counter
+	operations            *metrics.CounterVec
+	errors                *metrics.CounterVec
+	partWriteDuration     *metrics.Histogram
+	stitchDuration        *metrics.Histogram
+	activeMultiPartCopies *metrics.Gauge
+	queueWait             *metrics.Histogram
+	busyWorkers           *metrics.Gauge
+	workers               *metrics.Gauge
+	muxSessions           *metrics.Gauge
+}
+
+func newServerMetrics(cc *ChiliController) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: r,
+		receivedBytes: r.NewCounter("ccp_received_bytes_total",
+			"Bytes of file data received and written by copies and parts."),
+		sentBytes: r.NewCounter("ccp_sent_bytes_total",
+			"Bytes of file data sent to clients downloading files."),
+		relayedBytes: r.NewCounter("ccp_relayed_bytes_total",
+			"Bytes of file data relayed to peers."),
+		operations: r.NewCounterVec("ccp_operations_total",
+			"Operations handled, by op type and outcome.", "op", "outcome"),
+		errors: r.NewCounterVec("ccp_errors_total",
+			"Error responses sent to clients, by error type.", "err_type"),
+		partWriteDuration: r.NewHistogram("ccp_part_write_duration_seconds",
+			"Time taken to receive and write one part of a multipart copy.", metrics.DefaultDurationBuckets),
+		stitchDuration: r.NewHistogram("ccp_stitch_duration_seconds",
+			"Time taken to stitch the parts of a multipart copy into the target file.", metrics.DefaultDurationBuckets),
+		activeMultiPartCopies: r.NewGauge("ccp_active_multipart_copies",
+			"Multipart copies initiated and not yet completed or aborted."),
+		queueWait: r.NewHistogram("ccp_queue_wait_seconds",
+			"Time accepted connections waited in the queue for a worker, or for a slot with a goroutine per connection.",
+			metrics.DefaultDurationBuckets),
+	}
+	r.NewGaugeFunc("ccp_accepted_conns_queued", "Accepted connections waiting for a worker.", func() int64 {
+		return int64(len(cc.acceptedConns))
+	})
+	r.NewGaugeFunc("ccp_data_ops_running", "Ops moving file data being served, with a goroutine per connection.", func() int64 {
+		return cc.opLimits.running(true)
+	})
+	r.NewGaugeFunc("ccp_control_ops_running", "Other ops being served, with a goroutine per connection.", func() int64 {
+		return cc.opLimits.running(false)
+	})
+	m.busyWorkers = r.NewGauge("ccp_busy_workers", "Workers currently serving a connection.")
+	m.workers = r.NewGauge("ccp_workers", "Workers started to serve connections.")
+	m.muxSessions = r.NewGauge("ccp_mux_sessions", "Connections carrying many streams, each served as a connection.")
+	return m
+}
+
+// MetricsHandler serves the server's metrics in the Prometheus text format.
+func (cc *ChiliController) MetricsHandler() http.Handler {
+	return cc.metrics.registry.Handler()
+}
+
+func (m *serverMetrics) observeOp(opType protocol.OpType, ok bool) {
+	outcome := outcomeSuccess
+	if !ok {
+		outcome = outcomeError
+	}
+	m.operations.With(opType.String(), outcome).Inc()
+}
+
+func (m *serverMetrics) observeError(errType protocol.ErrType) {
+	m.errors.With(errType.String()).Inc()
+}
@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"sync"
+
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/common/mux"
+	"github.com/chili-copy/common/protocol"
+)
+
+// serveMux serves the streams of a connection that asked to carry many,
+// each as an accepted connection of its own, until the client closes it or
+// it idles out. Once ac's context is done, new streams are refused and
+// those open are served before it returns.
+func (cc *ChiliController) serveMux(ac acceptedConn, headerBytes []byte, log *logger.Logger) {
+	defer ac.finish()
+	log = log.With("op", protocol.MuxOpType)
+	if _, nested := ac.conn.(*mux.Stream); nested {
+		cc.errorResponse(protocol.ErrorUnknownOp, ac.conn, log)
+		cc.metrics.observeOp(protocol.MuxOpType, false)
+		ac.conn.Close()
+		return
+	}
+	err := common.SendBytesToConn(ac.conn, protocol.PrepareMuxAcceptOpHeader(mux.DefaultWindow))
+	cc.metrics.observeOp(protocol.MuxOpType, err == nil)
+	if err != nil {
+		ac.conn.Close()
+		return
+	}
+	session := mux.NewSession(ac.conn, false, mux.DefaultWindow, protocol.NewMuxOp(headerBytes).GetWindow(),
+		cc.Settings().IdleTimeout)
+	defer session.Close()
+	cc.metrics.muxSessions.Inc()
+	defer cc.metrics.muxSessions.Dec()
+	log.Info("serving streams")
+	var streams sync.WaitGroup
+	defer streams.Wait()
+	go func() {
+		select {
+		case <-ac.ctx.Done():
+			session.Refuse()
+		case <-session.Done():
+		}
+	}()
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			log.Info("stopped serving streams", "error", err)
+			return
+		}
+		streams.Add(1)
+		cc.dispatch(ac.ctx, acceptedConn{conn: stream, done: streams.Done})
+	}
+}
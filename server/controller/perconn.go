@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/chili-copy/common/protocol"
+)
+
+// opLimits bound the ops served at once when every connection gets a
+// goroutine of its own. Ops moving file data take a slot of data and the
+// others one of control, so small requests never wait behind large parts.
+type opLimits struct {
+	data    chan struct{}
+	control chan struct{}
+}
+
+// SetGoroutinePerConn makes Serve and AddConnToQ serve every connection on
+// a goroutine of its own, instead of queueing it for the workers. At most
+// dataOps ops moving file data (single copies, parts, reads and relays) and
+// controlOps others (inits, completes, aborts and stats) run at once, and
+// an op that waits QueueTimeout for a slot is turned away as busy. It must
+// be called before the controller serves connections.
+func (cc *ChiliController) SetGoroutinePerConn(dataOps int, controlOps int) {
+	cc.opLimits = &opLimits{data: make(chan struct{}, dataOps), control: make(chan struct{}, controlOps)}
+}
+
+func carriesData(opType protocol.OpType) bool {
+	switch opType {
+	case protocol.SingleCopyOpType, protocol.MultiPartCopyPartRequestOpType, protocol.ReadRequestOpType,
+		protocol.RelayRequestOpType:
+		return true
+	default:
+		return false
+	}
+}
+
+// serveOwnConn is serveConn for connections with a goroutine of their own.
+// The header is read before taking a slot, as the op it names decides
+// which slots to wait for.
+func (cc *ChiliController) serveOwnConn(ac acceptedConn) {
+	conn := ac.conn
+	log := cc.connLogger(conn)
+	opType, headerBytes, ok := cc.readHeader(conn, log)
+	if ok && opType == protocol.MuxOpType {
+		cc.serveMux(ac, headerBytes, log)
+		return
+	}
+	defer ac.finish()
+	defer conn.Close()
+	if !ok {
+		return
+	}
+	slots := cc.opLimits.control
+	if carriesData(opType) {
+		slots = cc.opLimits.data
+	}
+	queued := time.Now()
+	select {
+	case slots <- struct{}{}:
+	default:
+		settings := cc.Settings()
+		timer := time.NewTimer(settings.QueueTimeout)
+		select {
+		case slots <- struct{}{}:
+			timer.Stop()
+		case <-timer.C:
+			cc.replyBusy(conn, opType, settings.BusyRetryAfter, log)
+			return
+		}
+	}
+	defer func() { <-slots }()
+	cc.metrics.queueWait.Observe(time.Since(queued).Seconds())
+	cc.serveOp(conn, opType, headerBytes, log)
+}
+
+func (l *opLimits) running(data bool) int64 {
+	if l == nil {
+		return 0
+	}
+	if data {
+		return int64(len(l.data))
+	}
+	return int64(len(l.control))
+}
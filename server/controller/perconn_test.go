@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/protocol"
+)
+
+func TestCarriesData(t *testing.T) {
+	tests := []struct {
+		opType protocol.OpType
+		want   bool
+	}{
+		{protocol.SingleCopyOpType, true},
+		{protocol.MultiPartCopyPartRequestOpType, true},
+		{protocol.ReadRequestOpType, true},
+		{protocol.RelayRequestOpType, true},
+		{protocol.MultiPartCopyInitOpType, false},
+		{protocol.MultiPartCopyCompleteOpType, false},
+		{protocol.MultiPartCopyAbortOpType, false},
+		{protocol.StatRequestOpType, false},
+	}
+	for _, tt := range tests {
+		if got := carriesData(tt.opType); got != tt.want {
+			t.Errorf("carriesData(%s) = %v, want %v", tt.opType, got, tt.want)
+		}
+	}
+}
+
+// TestOpLimits holds the only slot for ops moving data with a single copy
+// that sends no data, and sends another op.
+func TestOpLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   []byte
+		wantType protocol.ErrType
+	}{
+		{"data op waits and is turned away", protocol.PrepareSingleCopyRequestOpHeader("/other", 10, 0),
+			protocol.ErrorServerBusy},
+		{"read waits and is turned away", protocol.PrepareReadRequestOpHeader("/file", 0, 10),
+			protocol.ErrorServerBusy},
+		{"control op is served", protocol.PrepareStatRequestOpHeader("/missing"), protocol.ErrorFileNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := NewChiliController()
+			cc.SetGoroutinePerConn(1, 1)
+			cc.updateSettings(func(s *Settings) {
+				s.QueueTimeout = 50 * time.Millisecond
+				s.BusyRetryAfter = 2 * time.Second
+			})
+			root, err := ioutil.TempDir("", "controller")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			cc.SetRoot(root)
+			address, stop := serve(t, cc)
+			defer stop()
+			holder, err := net.Dial("tcp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer holder.Close()
+			common.SendBytesToConn(holder, protocol.PrepareSingleCopyRequestOpHeader("/file", 10, 0))
+			for deadline := time.Now().Add(5 * time.Second); cc.opLimits.running(true) == 0; {
+				if time.Now().After(deadline) {
+					t.Fatal("single copy never took the data slot")
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			conn, err := net.Dial("tcp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			common.SendBytesToConn(conn, tt.header)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(conn)
+			if err != nil || opType != protocol.ErrorResponseOpType {
+				t.Fatalf("server responded %s, %v, want an error response", opType, err)
+			}
+			se := protocol.NewServerError(headerBytes)
+			if se.Type != tt.wantType {
+				t.Errorf("server responded %v, want %s", se, tt.wantType)
+			}
+			if se.Type == protocol.ErrorServerBusy && (!se.Retryable || se.RetryAfter != 2*time.Second) {
+				t.Errorf("busy response %+v does not ask to retry after 2s", se)
+			}
+		})
+	}
+}
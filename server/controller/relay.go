@@ -0,0 +1,164 @@
+package controller
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/chili-copy/client/ccp"
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/common/protocol"
+	"github.com/chili-copy/server/acl"
+	"github.com/chili-copy/server/storage"
+)
+
+// relayProgressInterval is how often the client of a relay is told how far
+// it got, which also keeps it from timing out while the peer stitches the
+// file.
+const relayProgressInterval = time.Second
+
+// Peer is a server clients may have this one relay files to, as a client of
+// it. Servers do not authenticate their clients, so the peer tells this one
+// apart by the address it connects from, and its own ACL decides where this
+// one may write.
+type Peer struct {
+	Address string
+	// Clients may relay to the peer. Others are told it is not known.
+	Clients acl.Clients
+	// Multiplex sends the requests of a relay over one connection.
+	Multiplex bool
+	// ChunkSize and Workers are those of multipart copies to the peer, the
+	// defaults of ccp.Options if 0.
+	ChunkSize uint64
+	Workers   int
+}
+
+// SetPeers sets the servers clients may have files relayed to, by name.
+func (cc *ChiliController) SetPeers(peers map[string]Peer) {
+	cc.updateSettings(func(s *Settings) { s.Peers = peers })
+}
+
+// handleRelay uploads a file to a peer with the ccp client library, so a
+// relay retries, tunes and aborts its copy just as a client's upload does,
+// rather than through a second implementation of the client side. ccp only
+// depends on common and client/multipart, never on server packages, which
+// keeps this import free of cycles.
+func (cc *ChiliController) handleRelay(conn net.Conn, headerBytes []byte, log *logger.Logger) bool {
+	start := time.Now()
+	ro := protocol.NewRelayOp(headerBytes)
+	cc.rootPath(ro)
+	log = log.With("path", ro.GetFilePath(), "peer", ro.GetPeer(), "peer_path", ro.GetPeerPath())
+	log.Info("received relay request")
+	settings := cc.Settings()
+	peer, ok := settings.Peers[ro.GetPeer()]
+	// Clients that may not use a peer are not told it exists.
+	if !ok || !peer.Clients.Contains(remoteIP(conn)) {
+		cc.errorResponse(protocol.ErrorUnknownPeer, conn, log)
+		return false
+	}
+	// The file is held for the relay, so that no copy replaces it meanwhile,
+	// while reads and other relays of it go on.
+	rc, ok := cc.claimRead(ro.GetFilePath())
+	if !ok {
+		cc.errorResponse(protocol.ErrorCopyOpInProgress, conn, log)
+		return false
+	}
+	defer cc.releaseRead(ro.GetFilePath(), rc)
+	f, err := cc.storage.Open(ro.GetFilePath())
+	if err != nil {
+		cc.errorResponseFor(statErrType(err), err, conn, log)
+		return false
+	}
+	defer f.Close()
+	var src io.ReaderAt = f
+	if of, ok := f.(storage.OSFile); ok && settings.ZeroCopy {
+		src = of.File()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	progress := &relayProgress{conn: conn, total: f.Size(), interval: relayProgressInterval, cancel: cancel,
+		stopped: make(chan struct{}), finished: make(chan struct{})}
+	go progress.report()
+	c := ccp.NewClient(peer.Address)
+	// The client logs the path and op of its own requests.
+	c.SetLogger(logger.With("relay_path", ro.GetFilePath(), "peer", ro.GetPeer(), "peer_address", peer.Address))
+	c.SetMultiplex(peer.Multiplex)
+	defer c.Close()
+	res, err := c.Upload(ctx, src, int64(f.Size()), ro.GetPeerPath(), &ccp.Options{ChunkSize: peer.ChunkSize,
+		Workers: peer.Workers, Durable: ro.IsDurable(), ZeroCopy: settings.ZeroCopy, Progress: progress.set,
+		ConfirmedProgress: true})
+	progress.stop()
+	if ctx.Err() != nil {
+		log.Warn("client went away, stopped relay", "error", err)
+		return false
+	}
+	if serr, ok := err.(*protocol.ServerError); ok {
+		// The client learns what the peer said, eg. to retry when it was busy.
+		relayed := *serr
+		relayed.Message = "at peer " + ro.GetPeer()
+		if serr.Message != "" {
+			relayed.Message += ": " + serr.Message
+		}
+		cc.sendError(&relayed, conn, log.With("error", err))
+		return false
+	}
+	if err != nil {
+		cc.errorResponseFor(protocol.ErrorRelayFailed, err, conn, log)
+		return false
+	}
+	csum, _ := hex.DecodeString(res.Checksum)
+	cc.metrics.relayedBytes.Add(res.Bytes)
+	log.Info("relayed file", "csum", res.Checksum, "bytes", res.Bytes, "parts", res.Parts, "durable", res.Durable,
+		"duration", time.Since(start))
+	// The client is told the whole file got there, however fast it was.
+	if err := common.SendBytesToConn(conn, protocol.PrepareRelayProgressOpHeader(res.Bytes, res.Bytes)); err != nil {
+		return false
+	}
+	sendCopySuccessResponse(csum, conn, protocol.RelaySuccessResponseOpType, res.Durable)
+	return true
+}
+
+// relayProgress tells the client of a relay how many bytes the peer
+// confirmed getting, every interval, and cancels the relay once the client cannot
+// be told, as it went away or the op ran out of time.
+type relayProgress struct {
+	conn     net.Conn
+	done     uint64
+	total    uint64
+	interval time.Duration
+	cancel   func()
+	stopped  chan struct{}
+	finished chan struct{}
+}
+
+func (rp *relayProgress) set(done uint64, total uint64) {
+	atomic.StoreUint64(&rp.done, done)
+}
+
+func (rp *relayProgress) report() {
+	defer close(rp.finished)
+	ticker := time.NewTicker(rp.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rp.stopped:
+			return
+		case <-ticker.C:
+		}
+		header := protocol.PrepareRelayProgressOpHeader(atomic.LoadUint64(&rp.done), rp.total)
+		if err := common.SendBytesToConn(rp.conn, header); err != nil {
+			rp.cancel()
+			return
+		}
+	}
+}
+
+// stop stops reporting, so that the response can be sent.
+func (rp *relayProgress) stop() {
+	close(rp.stopped)
+	<-rp.finished
+}
@@ -0,0 +1,218 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chili-copy/client/ccp"
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/protocol"
+	"github.com/chili-copy/server/acl"
+	"github.com/chili-copy/server/writer"
+)
+
+func TestRelayProgress(t *testing.T) {
+	tests := []struct {
+		name string
+		// dones are set one after the other, each read back by the client
+		// before the next.
+		dones       []uint64
+		closeClient bool
+		wantCancel  bool
+	}{
+		{"reports as it goes", []uint64{0, 300, 1000}, false, false},
+		{"client not reading", nil, false, false},
+		{"client gone cancels", nil, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			rp := &relayProgress{conn: server, total: 1000, interval: 10 * time.Millisecond, cancel: cancel,
+				stopped: make(chan struct{}), finished: make(chan struct{})}
+			go rp.report()
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for _, done := range tt.dones {
+				rp.set(done, 1000)
+				// reports of what was set before may still be on their way
+				for {
+					opType, headerBytes, err := common.GetOpTypeAndHeaderFromConn(client)
+					if err != nil || opType != protocol.RelayProgressOpType {
+						t.Fatalf("read %s, %v, want progress", opType, err)
+					}
+					p := protocol.NewRelayProgressOp(headerBytes)
+					if p.GetTotal() != 1000 {
+						t.Fatalf("progress total = %d, want 1000", p.GetTotal())
+					}
+					if p.GetDone() == done {
+						break
+					}
+				}
+			}
+			if tt.closeClient {
+				client.Close()
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(200 * time.Millisecond):
+			}
+			if canceled := ctx.Err() != nil; canceled != tt.wantCancel {
+				t.Errorf("relay canceled = %v, want %v", canceled, tt.wantCancel)
+			}
+			// A report blocked on the pipe ends as it is closed.
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				client.Close()
+			}()
+			rp.stop()
+		})
+	}
+}
+
+// relayChecksum is the checksum of data uploaded in parts of chunkSize.
+func relayChecksum(data []byte, chunkSize int) string {
+	if len(data) < chunkSize {
+		sum := md5.Sum(data)
+		return hex.EncodeToString(sum[:])
+	}
+	var digests [][]byte
+	for off := 0; off < len(data); off += chunkSize {
+		end := off + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := md5.Sum(data[off:end])
+		digests = append(digests, sum[:])
+	}
+	return hex.EncodeToString(common.CombinePartDigests(digests))
+}
+
+func TestRelay(t *testing.T) {
+	peerRoot, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(peerRoot)
+	peer := NewChiliController()
+	peer.SetRoot(peerRoot)
+	peer.SetScratchDir(filepath.Join(peerRoot, ".scratch"))
+	peerAddress, stopPeer := serve(t, peer)
+	defer stopPeer()
+	local, _ := acl.ParseClients([]string{"127.0.0.1"})
+	elsewhere, _ := acl.ParseClients([]string{"10.0.0.0/8"})
+	cc := NewChiliController()
+	cc.SetPeers(map[string]Peer{
+		"p":      {Address: peerAddress, Clients: local, ChunkSize: 1000, Workers: 2},
+		"closed": {Address: peerAddress, Clients: elsewhere},
+	})
+	client, root, stop := startServer(t, cc)
+	defer stop()
+	tests := []struct {
+		name     string
+		size     int
+		path     string
+		peer     string
+		peerPath string
+		// held holds the source while relaying, as another op would.
+		held     interface{}
+		wantErr  bool
+		wantType protocol.ErrType
+	}{
+		{"single copy", 999, "/src", "p", "/dst", nil, false, 0},
+		{"parts", 3500, "/src", "p", "/dst", nil, false, 0},
+		{"source relayed by another", 999, "/src", "p", "/dst", &readClaim{readers: 1}, false, 0},
+		{"source being copied", 999, "/src", "p", "/dst", &writer.SingleCopyHandler{}, true, protocol.ErrorCopyOpInProgress},
+		{"unknown peer", 10, "/src", "q", "/dst", nil, true, protocol.ErrorUnknownPeer},
+		{"peer the client may not use", 10, "/src", "closed", "/dst", nil, true, protocol.ErrorUnknownPeer},
+		{"missing file", 10, "/missing", "p", "/dst", nil, true, protocol.ErrorFileNotFound},
+		{"peer fails", 10, "/src", "p", "/no/such/file", nil, true, protocol.ErrorWritingSingleCopy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testData(tt.size)
+			if err := ioutil.WriteFile(filepath.Join(root, "src"), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			os.Remove(filepath.Join(peerRoot, "dst"))
+			if tt.held != nil {
+				src := filepath.Join(root, "src")
+				cc.onGoingCopyOpsByPath.Store(src, tt.held)
+				defer cc.onGoingCopyOpsByPath.Delete(src)
+			}
+			var progressed uint64
+			res, err := client.Relay(context.Background(), tt.path, tt.peer, tt.peerPath, &ccp.Options{Retries: -1,
+				Progress: func(done uint64, total uint64) { progressed = done }})
+			if tt.wantErr {
+				se, ok := err.(*protocol.ServerError)
+				if !ok || se.Type != tt.wantType {
+					t.Fatalf("Relay() error = %v, want a server error of type %s", err, tt.wantType)
+				}
+				if tt.wantType == protocol.ErrorWritingSingleCopy && !strings.HasPrefix(se.Message, "at peer p") {
+					t.Errorf("Relay() error message = %q, want it to name the peer", se.Message)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Relay() error = %v", err)
+			}
+			if want := relayChecksum(data, 1000); res.Checksum != want || res.Bytes != uint64(tt.size) {
+				t.Errorf("Relay() = %s of %d bytes, want %s of %d", res.Checksum, res.Bytes, want, tt.size)
+			}
+			if progressed != uint64(tt.size) {
+				t.Errorf("relay progress ended at %d bytes, want %d", progressed, tt.size)
+			}
+			if got, _ := ioutil.ReadFile(filepath.Join(peerRoot, "dst")); !bytes.Equal(got, data) {
+				t.Errorf("peer holds %d bytes that differ from the %d relayed", len(got), tt.size)
+			}
+		})
+	}
+}
+
+func TestClaimRead(t *testing.T) {
+	tests := []struct {
+		name             string
+		held             interface{} // what holds the path before the claim, if anything
+		wantClaim        bool
+		wantBeingWritten bool
+	}{
+		{"free path", nil, true, false},
+		{"path relayed", &readClaim{readers: 1}, true, false},
+		{"path copied", &writer.SingleCopyHandler{}, false, true},
+		{"path deleted", &protocol.DeleteOp{}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := NewChiliController()
+			if tt.held != nil {
+				cc.onGoingCopyOpsByPath.Store("/f", tt.held)
+			}
+			if got := cc.beingWritten("/f"); got != tt.wantBeingWritten {
+				t.Errorf("beingWritten() = %v, want %v", got, tt.wantBeingWritten)
+			}
+			rc, ok := cc.claimRead("/f")
+			if ok != tt.wantClaim {
+				t.Fatalf("claimRead() = %v, want %v", ok, tt.wantClaim)
+			}
+			if !ok {
+				return
+			}
+			cc.releaseRead("/f", rc)
+			_, stillHeld := cc.onGoingCopyOpsByPath.Load("/f")
+			// the path stays held for the relay that held it before
+			if stillHeld != (tt.held != nil) {
+				t.Errorf("path held = %v after the claim was let go, want %v", stillHeld, tt.held != nil)
+			}
+		})
+	}
+}
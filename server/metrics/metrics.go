@@ -0,0 +1,262 @@
+// Package metrics keeps counters, gauges and histograms and writes them in
+// the Prometheus text exposition format, so that a scraper can read them
+// from the server's metrics listener.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultDurationBuckets are upper bounds, in seconds, for latencies from a
+// millisecond to a couple of minutes.
+var DefaultDurationBuckets = []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120}
+
+type collector interface {
+	kind() string
+	write(w io.Writer, name string)
+}
+
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *Counter) kind() string {
+	return "counter"
+}
+
+func (c *Counter) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %d\n", name, c.Value())
+}
+
+type Gauge struct {
+	v int64
+}
+
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.v, 1)
+}
+
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.v, -1)
+}
+
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.v, v)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+func (g *Gauge) kind() string {
+	return "gauge"
+}
+
+func (g *Gauge) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %d\n", name, g.Value())
+}
+
+// GaugeFunc is a gauge whose value is read when it is scraped, for values
+// such as queue lengths that are already kept elsewhere.
+type GaugeFunc func() int64
+
+func (f GaugeFunc) kind() string {
+	return "gauge"
+}
+
+func (f GaugeFunc) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %d\n", name, f())
+}
+
+type Histogram struct {
+	lock    sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &Histogram{buckets: b, counts: make([]uint64, len(b))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) kind() string {
+	return "histogram"
+}
+
+func (h *Histogram) write(w io.Writer, name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(upper), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// CounterVec is a family of counters told apart by the values of its labels.
+type CounterVec struct {
+	labelNames []string
+	lock       sync.RWMutex
+	counters   map[string]*Counter
+}
+
+func NewCounterVec(labelNames ...string) *CounterVec {
+	return &CounterVec{labelNames: labelNames, counters: make(map[string]*Counter)}
+}
+
+// With returns the counter for the given label values, in the order the
+// label names were given, creating it on first use.
+func (cv *CounterVec) With(labelValues ...string) *Counter {
+	key := formatLabels(cv.labelNames, labelValues)
+	cv.lock.RLock()
+	c, ok := cv.counters[key]
+	cv.lock.RUnlock()
+	if ok {
+		return c
+	}
+	cv.lock.Lock()
+	defer cv.lock.Unlock()
+	if c, ok = cv.counters[key]; !ok {
+		c = &Counter{}
+		cv.counters[key] = c
+	}
+	return c
+}
+
+func (cv *CounterVec) kind() string {
+	return "counter"
+}
+
+func (cv *CounterVec) write(w io.Writer, name string) {
+	cv.lock.RLock()
+	defer cv.lock.RUnlock()
+	keys := make([]string, 0, len(cv.counters))
+	for key := range cv.counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, key, cv.counters[key].Value())
+	}
+}
+
+type metric struct {
+	name      string
+	help      string
+	collector collector
+}
+
+// Registry holds named metrics and writes them in the order they were
+// registered.
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(name string, help string, c collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.metrics = append(r.metrics, metric{name: name, help: help, collector: c})
+}
+
+func (r *Registry) NewCounter(name string, help string) *Counter {
+	c := &Counter{}
+	r.register(name, help, c)
+	return c
+}
+
+func (r *Registry) NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	cv := NewCounterVec(labelNames...)
+	r.register(name, help, cv)
+	return cv
+}
+
+func (r *Registry) NewGauge(name string, help string) *Gauge {
+	g := &Gauge{}
+	r.register(name, help, g)
+	return g
+}
+
+func (r *Registry) NewGaugeFunc(name string, help string, f func() int64) {
+	r.register(name, help, GaugeFunc(f))
+}
+
+func (r *Registry) NewHistogram(name string, help string, buckets []float64) *Histogram {
+	h := NewHistogram(buckets)
+	r.register(name, help, h)
+	return h
+}
+
+func (r *Registry) Write(w io.Writer) {
+	r.lock.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.lock.Unlock()
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.collector.kind())
+		m.collector.write(w, m.name)
+	}
+}
+
+// Handler serves the registry to Prometheus scrapers.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+func formatLabels(names []string, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + "=" + strconv.Quote(value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	tests := []struct {
+		name     string
+		buckets  []float64
+		observed []float64
+		want     string
+	}{
+		{"buckets are cumulative", []float64{1, 5}, []float64{0.5, 1, 3, 10},
+			"h_bucket{le=\"1\"} 2\nh_bucket{le=\"5\"} 3\nh_bucket{le=\"+Inf\"} 4\nh_sum 14.5\nh_count 4\n"},
+		{"buckets are sorted", []float64{5, 0.25}, []float64{0.1},
+			"h_bucket{le=\"0.25\"} 1\nh_bucket{le=\"5\"} 1\nh_bucket{le=\"+Inf\"} 1\nh_sum 0.1\nh_count 1\n"},
+		{"nothing observed", []float64{1}, nil,
+			"h_bucket{le=\"1\"} 0\nh_bucket{le=\"+Inf\"} 0\nh_sum 0\nh_count 0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHistogram(tt.buckets)
+			for _, v := range tt.observed {
+				h.Observe(v)
+			}
+			buf := new(bytes.Buffer)
+			h.write(buf, "h")
+			if buf.String() != tt.want {
+				t.Errorf("wrote\n%s\nwant\n%s", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels []string
+		incs   [][]string
+		want   string
+	}{
+		{"one label", []string{"op"}, [][]string{{"copy"}, {"copy"}, {"part"}},
+			"c{op=\"copy\"} 2\nc{op=\"part\"} 1\n"},
+		{"two labels", []string{"op", "outcome"}, [][]string{{"copy", "ok"}, {"copy", "error"}},
+			"c{op=\"copy\",outcome=\"error\"} 1\nc{op=\"copy\",outcome=\"ok\"} 1\n"},
+		{"missing values are empty", []string{"op", "outcome"}, [][]string{{"copy"}},
+			"c{op=\"copy\",outcome=\"\"} 1\n"},
+		{"values are quoted", []string{"error"}, [][]string{{`say "busy"`}},
+			"c{error=\"say \\\"busy\\\"\"} 1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cv := NewCounterVec(tt.labels...)
+			for _, values := range tt.incs {
+				cv.With(values...).Inc()
+			}
+			buf := new(bytes.Buffer)
+			cv.write(buf, "c")
+			if buf.String() != tt.want {
+				t.Errorf("wrote\n%s\nwant\n%s", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("bytes_total", "Bytes received.").Add(42)
+	g := r.NewGauge("sessions", "Sessions open.")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	r.NewGaugeFunc("queue", "Queue depth.", func() int64 { return 7 })
+	r.NewCounterVec("ops_total", "Ops.", "op").With("copy").Inc()
+	r.NewHistogram("latency", "Latency.", []float64{1}).Observe(2)
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %s", ct)
+	}
+	body, _ := ioutil.ReadAll(rec.Body)
+	want := `# HELP bytes_total Bytes received.
+# TYPE bytes_total counter
+bytes_total 42
+# HELP sessions Sessions open.
+# TYPE sessions gauge
+sessions 1
+# HELP queue Queue depth.
+# TYPE queue gauge
+queue 7
+# HELP ops_total Ops.
+# TYPE ops_total counter
+ops_total{op="copy"} 1
+# HELP latency Latency.
+# TYPE latency histogram
+latency_bucket{le="1"} 0
+latency_bucket{le="+Inf"} 1
+latency_sum 2
+latency_count 1
+`
+	if string(body) != want {
+		t.Errorf("served\n%s\nwant\n%s", body, want)
+	}
+}
@@ -0,0 +1,266 @@
+// Package quota limits how much each client may copy to the server, so one
+// client cannot hold every multipart session or fill the disk. Clients are
+// told apart by their address.
+package quota
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chili-copy/server/acl"
+)
+
+// Limits a client is held to. Zero values are not limited.
+type Limits struct {
+	// MaxSessions is how many multipart copies the client may have in
+	// progress at once.
+	MaxSessions int
+	// MaxSessionBytes is the most a multipart copy may be sent, counting
+	// parts sent again.
+	MaxSessionBytes uint64
+	// MaxBytes is the most the client may send in each Window.
+	MaxBytes uint64
+	// Window must be set if MaxBytes is. Windows are fixed, starting with
+	// the first copy after the last one passed.
+	Window time.Duration
+	// MaxFileSize is the largest file the client may copy.
+	MaxFileSize uint64
+}
+
+// Rule holds the clients it matches to its own limits.
+type Rule struct {
+	Clients acl.Clients
+	Limits  Limits
+}
+
+// Policy gives clients the limits of the first rule that matches them, or
+// Default if none does.
+type Policy struct {
+	Default Limits
+	Rules   []Rule
+}
+
+func (p Policy) For(ip net.IP) Limits {
+	for _, r := range p.Rules {
+		if r.Clients.Contains(ip) {
+			return r.Limits
+		}
+	}
+	return p.Default
+}
+
+// Error is returned when a copy would take a client past one of its limits.
+type Error struct {
+	msg string
+	// temporary is set for limits that free up as the client's other copies
+	// end.
+	temporary bool
+}
+
+func (e *Error) Error() string {
+	return e.msg
+}
+
+func (e *Error) Temporary() bool {
+	return e.temporary
+}
+
+type usage struct {
+	sessions    int
+	windowStart time.Time
+	windowBytes uint64
+}
+
+// Tracker counts the sessions and bytes of every client.
+type Tracker struct {
+	lock      sync.Mutex
+	clients   map[string]*usage
+	lastSweep time.Time
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{clients: make(map[string]*usage), lastSweep: time.Now()}
+}
+
+// Session is a multipart copy counted against its client's sessions until
+// it is ended.
+type Session struct {
+	tracker *Tracker
+	client  string
+	limits  Limits
+	bytes   uint64
+	ended   bool
+}
+
+// StartSession checks that client may start a multipart copy of a file of
+// size bytes.
+func (t *Tracker) StartSession(client string, limits Limits, size uint64) (*Session, error) {
+	if err := checkFileSize(limits, size); err != nil {
+		return nil, err
+	}
+	if limits.MaxSessionBytes > 0 && size > limits.MaxSessionBytes {
+		return nil, &Error{msg: fmt.Sprintf("file is larger than the %d bytes a multipart copy may send", limits.MaxSessionBytes)}
+	}
+	if limits == (Limits{}) {
+		return &Session{}, nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	u := t.usageOf(client, limits, time.Now())
+	if limits.MaxSessions > 0 && u.sessions >= limits.MaxSessions {
+		return nil, &Error{msg: fmt.Sprintf("%d multipart copies already in progress", u.sessions), temporary: true}
+	}
+	if err := checkWindow(u, limits, size); err != nil {
+		return nil, err
+	}
+	u.sessions++
+	return &Session{tracker: t, client: client, limits: limits}, nil
+}
+
+// Add counts n bytes about to be received for the session, unless they
+// would take the session or its client past their limits. The bytes are
+// given back with the Charge if the part is not received.
+func (s *Session) Add(n uint64) (*Charge, error) {
+	if s == nil || s.tracker == nil {
+		return nil, nil
+	}
+	t := s.tracker
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if s.limits.MaxSessionBytes > 0 && s.bytes+n > s.limits.MaxSessionBytes {
+		return nil, &Error{msg: fmt.Sprintf("multipart copy may send at most %d bytes", s.limits.MaxSessionBytes)}
+	}
+	u := t.usageOf(s.client, s.limits, time.Now())
+	if err := checkWindow(u, s.limits, n); err != nil {
+		return nil, err
+	}
+	s.bytes += n
+	u.windowBytes += n
+	return &Charge{tracker: t, client: s.client, windowStart: u.windowStart, bytes: n, session: s}, nil
+}
+
+// End frees the session for another. It may be called more than once.
+func (s *Session) End() {
+	if s == nil || s.tracker == nil {
+		return
+	}
+	t := s.tracker
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if s.ended {
+		return
+	}
+	s.ended = true
+	u, ok := t.clients[s.client]
+	if !ok {
+		return
+	}
+	u.sessions--
+	// Without a window, there is nothing else to remember.
+	if u.sessions == 0 && s.limits.Window == 0 {
+		delete(t.clients, s.client)
+	}
+}
+
+// AddFile counts a single copy of size bytes, unless it would take client
+// past its limits. The bytes are given back with the Charge if the copy
+// fails.
+func (t *Tracker) AddFile(client string, limits Limits, size uint64) (*Charge, error) {
+	if err := checkFileSize(limits, size); err != nil {
+		return nil, err
+	}
+	if limits.MaxBytes == 0 {
+		return nil, nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	u := t.usageOf(client, limits, time.Now())
+	if err := checkWindow(u, limits, size); err != nil {
+		return nil, err
+	}
+	u.windowBytes += size
+	return &Charge{tracker: t, client: client, windowStart: u.windowStart, bytes: size}, nil
+}
+
+// Charge is bytes counted for a copy before it is received, refunded unless
+// the copy gets through.
+type Charge struct {
+	tracker     *Tracker
+	client      string
+	windowStart time.Time
+	bytes       uint64
+	session     *Session
+	done        bool
+}
+
+// Keep counts the bytes for good. Refund does nothing afterwards.
+func (c *Charge) Keep() {
+	if c == nil {
+		return
+	}
+	c.tracker.lock.Lock()
+	defer c.tracker.lock.Unlock()
+	c.done = true
+}
+
+// Refund gives the bytes back to the session and to the client's window,
+// unless the window has passed since. It may be called more than once, as
+// deferred with Keep on success.
+func (c *Charge) Refund() {
+	if c == nil {
+		return
+	}
+	t := c.tracker
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if c.done {
+		return
+	}
+	c.done = true
+	if c.session != nil {
+		c.session.bytes -= c.bytes
+	}
+	if u, ok := t.clients[c.client]; ok && u.windowStart.Equal(c.windowStart) && u.windowBytes >= c.bytes {
+		u.windowBytes -= c.bytes
+	}
+}
+
+func checkFileSize(limits Limits, size uint64) error {
+	if limits.MaxFileSize > 0 && size > limits.MaxFileSize {
+		return &Error{msg: fmt.Sprintf("file is larger than the %d bytes allowed", limits.MaxFileSize)}
+	}
+	return nil
+}
+
+func checkWindow(u *usage, limits Limits, n uint64) error {
+	if limits.MaxBytes > 0 && u.windowBytes+n > limits.MaxBytes {
+		return &Error{msg: fmt.Sprintf("%d of the %d bytes allowed every %s already sent", u.windowBytes, limits.MaxBytes, limits.Window)}
+	}
+	return nil
+}
+
+// usageOf returns the usage of client, starting a new window if the last
+// one has passed. Clients with nothing in progress and no bytes in the
+// current window are forgotten now and then.
+func (t *Tracker) usageOf(client string, limits Limits, now time.Time) *usage {
+	if limits.Window > 0 && now.Sub(t.lastSweep) > limits.Window {
+		for c, u := range t.clients {
+			if u.sessions == 0 && now.Sub(u.windowStart) >= limits.Window {
+				delete(t.clients, c)
+			}
+		}
+		t.lastSweep = now
+	}
+	u, ok := t.clients[client]
+	if !ok {
+		u = &usage{windowStart: now}
+		t.clients[client] = u
+	}
+	if limits.Window > 0 && now.Sub(u.windowStart) >= limits.Window {
+		u.windowStart = now
+		u.windowBytes = 0
+	}
+	return u
+}
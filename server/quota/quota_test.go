@@ -0,0 +1,235 @@
+package quota
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chili-copy/server/acl"
+)
+
+func TestPolicyFor(t *testing.T) {
+	backup, err := acl.ParseClients([]string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := acl.ParseClients([]string{"unix", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Policy{Default: Limits{MaxSessions: 1}, Rules: []Rule{
+		{Clients: backup, Limits: Limits{MaxSessions: 16}},
+		{Clients: local, Limits: Limits{}},
+	}}
+	tests := []struct {
+		name string
+		ip   net.IP
+		want Limits
+	}{
+		{"first rule", net.ParseIP("10.1.2.3"), Limits{MaxSessions: 16}},
+		{"second rule", net.ParseIP("127.0.0.1"), Limits{}},
+		{"unix", nil, Limits{}},
+		{"default", net.ParseIP("192.168.1.1"), Limits{MaxSessions: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.For(tt.ip); got != tt.want {
+				t.Errorf("For(%v) = %+v, want %+v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  Limits
+		sizes   []uint64
+		wantErr []bool
+	}{
+		{"no limits", Limits{}, []uint64{1 << 40, 1 << 40}, []bool{false, false}},
+		{"file size", Limits{MaxFileSize: 100}, []uint64{100, 101}, []bool{false, true}},
+		{"window", Limits{MaxBytes: 100, Window: time.Hour}, []uint64{60, 40, 1}, []bool{false, false, true}},
+		{"too large for the window", Limits{MaxBytes: 100, Window: time.Hour}, []uint64{101, 100}, []bool{true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := NewTracker()
+			for i, size := range tt.sizes {
+				c, err := tr.AddFile("client", tt.limits, size)
+				if (err != nil) != tt.wantErr[i] {
+					t.Fatalf("AddFile(%d) error = %v, want error %v", size, err, tt.wantErr[i])
+				}
+				c.Keep()
+			}
+		})
+	}
+}
+
+func TestAddFileClientsApart(t *testing.T) {
+	tr := NewTracker()
+	limits := Limits{MaxBytes: 100, Window: time.Hour}
+	if _, err := tr.AddFile("a", limits, 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.AddFile("b", limits, 100); err != nil {
+		t.Errorf("AddFile() for another client error = %v", err)
+	}
+	if _, err := tr.AddFile("a", limits, 1); err == nil {
+		t.Error("AddFile() past the window succeeded")
+	}
+}
+
+func TestWindowPasses(t *testing.T) {
+	tr := NewTracker()
+	limits := Limits{MaxBytes: 100, Window: 50 * time.Millisecond}
+	if _, err := tr.AddFile("client", limits, 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.AddFile("client", limits, 1); err == nil {
+		t.Fatal("AddFile() past the window succeeded")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := tr.AddFile("client", limits, 100); err != nil {
+		t.Errorf("AddFile() in the next window error = %v", err)
+	}
+}
+
+func TestChargeRefund(t *testing.T) {
+	limits := Limits{MaxBytes: 100, MaxSessionBytes: 100, Window: time.Hour}
+	tests := []struct {
+		name string
+		add  func(tr *Tracker, n uint64) (*Charge, error)
+	}{
+		{"file", func(tr *Tracker, n uint64) (*Charge, error) {
+			return tr.AddFile("client", limits, n)
+		}},
+		{"part", func() func(tr *Tracker, n uint64) (*Charge, error) {
+			var s *Session
+			return func(tr *Tracker, n uint64) (*Charge, error) {
+				if s == nil {
+					var err error
+					if s, err = tr.StartSession("client", limits, 100); err != nil {
+						return nil, err
+					}
+				}
+				return s.Add(n)
+			}
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := NewTracker()
+			c, err := tt.add(tr, 80)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Refund()
+			c.Refund()
+			kept, err := tt.add(tr, 80)
+			if err != nil {
+				t.Fatalf("Add() after a refund error = %v", err)
+			}
+			kept.Keep()
+			kept.Refund()
+			if _, err := tt.add(tr, 80); err == nil {
+				t.Error("Add() past a kept charge succeeded")
+			}
+		})
+	}
+}
+
+func TestRefundAfterWindowPasses(t *testing.T) {
+	tr := NewTracker()
+	limits := Limits{MaxBytes: 100, Window: 50 * time.Millisecond}
+	old, err := tr.AddFile("client", limits, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := tr.AddFile("client", limits, 60); err != nil {
+		t.Fatal(err)
+	}
+	// The refund is of the previous window, so it leaves this one alone.
+	old.Refund()
+	if _, err := tr.AddFile("client", limits, 60); err == nil {
+		t.Error("AddFile() past the window succeeded")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	tests := []struct {
+		name     string
+		limits   Limits
+		size     uint64
+		parts    []uint64
+		wantErr  bool
+		partErrs []bool
+	}{
+		{"no limits", Limits{}, 1 << 40, []uint64{1 << 40}, false, []bool{false}},
+		{"file size", Limits{MaxFileSize: 10}, 11, nil, true, nil},
+		{"larger than a session", Limits{MaxSessionBytes: 10}, 11, nil, true, nil},
+		{"larger than the window", Limits{MaxBytes: 10, Window: time.Hour}, 11, nil, true, nil},
+		{"parts sent again", Limits{MaxSessionBytes: 100}, 100, []uint64{50, 50, 1}, false, []bool{false, false, true}},
+		{"parts past the window", Limits{MaxBytes: 100, Window: time.Hour}, 100, []uint64{60, 60}, false,
+			[]bool{false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := NewTracker()
+			s, err := tr.StartSession("client", tt.limits, tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("StartSession() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer s.End()
+			for i, n := range tt.parts {
+				c, err := s.Add(n)
+				if (err != nil) != tt.partErrs[i] {
+					t.Fatalf("Add(%d) error = %v, want error %v", n, err, tt.partErrs[i])
+				}
+				c.Keep()
+			}
+		})
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	tr := NewTracker()
+	limits := Limits{MaxSessions: 2}
+	first, err := tr.StartSession("client", limits, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.StartSession("client", limits, 1); err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.StartSession("client", limits, 1)
+	if qerr, ok := err.(*Error); !ok || !qerr.Temporary() {
+		t.Fatalf("StartSession() past the sessions error = %v, want a temporary one", err)
+	}
+	if _, err := tr.StartSession("other", limits, 1); err != nil {
+		t.Errorf("StartSession() for another client error = %v", err)
+	}
+	first.End()
+	first.End()
+	if _, err := tr.StartSession("client", limits, 1); err != nil {
+		t.Errorf("StartSession() after one ended error = %v", err)
+	}
+	if _, err := tr.StartSession("client", limits, 1); err == nil {
+		t.Error("StartSession() ended twice freed two sessions")
+	}
+}
+
+func TestNilSessionAndCharge(t *testing.T) {
+	var s *Session
+	c, err := s.Add(1 << 40)
+	if err != nil || c != nil {
+		t.Errorf("Add() on a nil session = %v, %v", c, err)
+	}
+	c.Keep()
+	c.Refund()
+	s.End()
+}
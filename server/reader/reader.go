@@ -0,0 +1,52 @@
+package reader
+
+import (
+	"crypto/md5"
+	"io"
+	"net"
+
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/common/protocol"
+	"github.com/chili-copy/common/zerocopy"
+	"github.com/chili-copy/server/storage"
+)
+
+const fileSendBufferSize = 64 * 1024
+
+// FileReadHandler sends a range of a file to a client that is downloading
+// it.
+type FileReadHandler struct {
+	Conn     net.Conn
+	File     storage.File
+	ReadOp   *protocol.ReadOp
+	ZeroCopy bool
+	Log      *logger.Logger
+}
+
+// Handle sends the range after a ReadResponseOpType header and returns its
+// checksum, to be sent after it.
+func (fr *FileReadHandler) Handle() ([]byte, error) {
+	offset := int64(fr.ReadOp.GetOffset())
+	length := int64(fr.ReadOp.GetLength())
+	err := common.SendBytesToConn(fr.Conn, protocol.PrepareReadResponseOpHeader(fr.ReadOp.GetLength()))
+	if err != nil {
+		return nil, err
+	}
+	digest := md5.New()
+	if f, ok := fr.File.(storage.OSFile); ok && fr.ZeroCopy {
+		// sendfile never brings the bytes into userspace, so the checksum
+		// takes a separate read, normally served from the page cache.
+		if _, err := io.Copy(digest, io.NewSectionReader(f.File(), offset, length)); err != nil {
+			fr.Log.Error("failed to read file", "path", fr.ReadOp.GetFilePath(), "error", err)
+			return nil, err
+		}
+		_, err = zerocopy.SendFile(fr.Conn, f.File(), offset, length)
+	} else {
+		err = common.StreamToConn(fr.Conn, fr.File, offset, length, make([]byte, fileSendBufferSize), digest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return digest.Sum(nil), nil
+}
@@ -1,52 +1,411 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/server/config"
 	"github.com/chili-copy/server/controller"
-	"runtime"
+	"github.com/chili-copy/server/storage"
 )
 
-const (
-	network = "tcp"
-)
+// staleSocketTimeout bounds connecting to a unix socket found at a listen
+// path, to tell whether a server is still running on it.
+const staleSocketTimeout = time.Second
 
 func main() {
-	port, ConnQSize, workerThreads := getCmdArgs()
+	configPath := bindFlags(flag.CommandLine, config.Default())
+	flag.Parse()
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("Invalid configuration. Error : %s\n", err.Error())
+		os.Exit(1)
+	}
+	logger.Configure(cfg.Log.Level, cfg.Log.Format)
+	settings, err := settingsFrom(cfg)
+	if err != nil {
+		logger.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
 	cc := controller.NewChiliController()
-	cc.MakeAcceptedConnQ(*ConnQSize)
-	cc.CreateAcceptedConnHandlers(*workerThreads)
-	fmt.Printf("starting chili-copy server on port %s\n", port)
-	startChiliServer(cc, network, port)
+	cc.ApplySettings(settings)
+	backend, err := storageFrom(cfg)
+	if err != nil {
+		logger.Error("unusable storage", "backend", cfg.Storage.Backend, "error", err)
+		os.Exit(1)
+	}
+	cc.SetStorage(backend)
+	if cfg.Hooks.PreAccept != "" || cfg.Hooks.PostCommit != "" {
+		// Validate made sure the timeout parses.
+		timeout, _ := time.ParseDuration(cfg.Hooks.Timeout)
+		cc.SetHooks(controller.CommandHooks(cfg.Hooks.PreAccept, cfg.Hooks.PostCommit, timeout))
+	}
+	if cfg.Storage.Root != "" {
+		cc.SetRoot(cfg.Storage.Root)
+	}
+	if cfg.Server.ConnMode == "goroutine" {
+		cc.SetGoroutinePerConn(cfg.Server.MaxDataOps, cfg.Server.MaxControlOps)
+	} else {
+		cc.MakeAcceptedConnQ(cfg.Server.ConnQueueSize)
+		cc.CreateAcceptedConnHandlers(cfg.Server.WorkerCount)
+	}
+	if cfg.Server.MetricsAddress != "" {
+		go startMetricsServer(cc, cfg.Server.MetricsAddress)
+	}
+	if cfg.Server.AdminAddress != "" {
+		ln, err := listenAdmin(cfg.Server.AdminAddress)
+		if err != nil {
+			logger.Error("unable to listen on admin address", "address", cfg.Server.AdminAddress, "error", err)
+			os.Exit(1)
+		}
+		go startAdminServer(cc, ln)
+	}
+	if *configPath != "" {
+		go reloadOnHangup(cc, *configPath, cfg)
+	}
+	var listeners []net.Listener
+	for _, address := range cfg.ListenAddresses() {
+		ln, err := listen(address)
+		if err != nil {
+			logger.Error("unable to start server", "address", address, "error", err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, ln)
+	}
+	ctx := stopOnSignal()
+	stopped := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		logger.Info("starting chili-copy server", "address", ln.Addr())
+		go func(ln net.Listener) {
+			stopped <- cc.Serve(ctx, ln)
+		}(ln)
+	}
+	for range listeners {
+		if err := <-stopped; err != nil {
+			logger.Error("unable to accept connection", "error", err)
+			os.Exit(2)
+		}
+	}
+	logger.Info("stopped chili-copy server")
 }
 
-func getCmdArgs() (string, *int, *int) {
-	var port string
-	flag.StringVar(&port, "port", "5678", "server port")
-	ConnQSize := flag.Int("conn-size", runtime.NumCPU()*10, "connection queue size")
-	workerThreads := flag.Int("worker-count", runtime.NumCPU(), "count of worker threads")
+// listen listens on address, as taken by config.ListenAddresses.
+func listen(address string) (net.Listener, error) {
+	network, addr := common.SplitAddress(address)
+	if network == "unix" {
+		return listenUnix(addr)
+	}
+	return net.Listen(network, addr)
+}
 
-	flag.Parse()
-	port = fmt.Sprintf(":%s", port)
+// listenUnix listens on the unix socket at path, replacing a socket left
+// there by a server that did not stop cleanly. A socket is only taken as
+// left over if connecting to it is refused, so that a running server keeps
+// its socket.
+func listenUnix(path string) (net.Listener, error) {
+	if !strings.HasPrefix(path, "@") {
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			conn, err := net.DialTimeout("unix", path, staleSocketTimeout)
+			if err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("listen unix %s: address already in use", path)
+			}
+			if !isConnRefused(err) {
+				return nil, fmt.Errorf("listen unix %s: unable to tell whether the socket is in use: %v", path, err)
+			}
+			os.Remove(path)
+		}
+	}
+	return net.Listen("unix", path)
+}
 
-	return port, ConnQSize, workerThreads
+// isConnRefused tells whether err is a dial refused for want of a listener.
+func isConnRefused(err error) bool {
+	if oerr, ok := err.(*net.OpError); ok {
+		err = oerr.Err
+	}
+	if serr, ok := err.(*os.SyscallError); ok {
+		err = serr.Err
+	}
+	return err == syscall.ECONNREFUSED
 }
 
-func startChiliServer(cc *controller.ChiliController, network string, port string) {
-	ln, err := net.Listen(network, port)
-	if err != nil {
-		fmt.Printf("Unable to start server on port %s. Failed with error : %s\n", port, err.Error())
+// listFlag is a flag taking a comma separated list, which may also be
+// given several times.
+type listFlag struct {
+	list *[]string
+	set  bool
+}
+
+func (f *listFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ",")
+}
+
+func (f *listFlag) Set(value string) error {
+	if !f.set {
+		*f.list = nil
+		f.set = true
+	}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*f.list = append(*f.list, item)
+		}
+	}
+	return nil
+}
+
+// stopOnSignal returns a context that is done on SIGINT or SIGTERM, after
+// which the server stops accepting and finishes the copies it accepted. A
+// second signal exits at once.
+func stopOnSignal() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		logger.Info("stopping chili-copy server, waiting for accepted connections", "signal", s)
+		cancel()
+		<-sig
 		os.Exit(1)
+	}()
+	return ctx
+}
+
+// bindFlags defines the command line flags on fs, storing their values in
+// cfg, and returns where the -config flag is stored.
+func bindFlags(fs *flag.FlagSet, cfg *config.Config) *string {
+	configPath := fs.String("config", "", "TOML configuration file, overridden by flags given on the command line")
+	fs.StringVar(&cfg.Server.Port, "port", cfg.Server.Port, "server port")
+	fs.Var(&listFlag{list: &cfg.Server.Listen}, "listen", "addresses to listen on instead of -port on all interfaces, comma separated or repeated (eg. tcp://10.0.0.1:5678, tcp6://[::1]:5678, unix:///run/ccp.sock)")
+	fs.IntVar(&cfg.Server.ConnQueueSize, "conn-size", cfg.Server.ConnQueueSize, "connection queue size")
+	fs.IntVar(&cfg.Server.WorkerCount, "worker-count", cfg.Server.WorkerCount, "count of worker threads")
+	fs.StringVar(&cfg.Server.ConnMode, "conn-mode", cfg.Server.ConnMode, "pool to queue connections for the workers, goroutine to serve each on its own")
+	fs.IntVar(&cfg.Server.MaxDataOps, "max-data-ops", cfg.Server.MaxDataOps, "most single copies, parts, reads and relays served at once with -conn-mode goroutine")
+	fs.IntVar(&cfg.Server.MaxControlOps, "max-control-ops", cfg.Server.MaxControlOps, "most inits, completes and stats served at once with -conn-mode goroutine")
+	fs.StringVar(&cfg.Storage.Durability, "durability", cfg.Storage.Durability, "fsync before acknowledging a copy (off, request, always)")
+	fs.BoolVar(&cfg.Storage.ZeroCopy, "zero-copy", cfg.Storage.ZeroCopy, "splice received data from socket to file (linux)")
+	fs.BoolVar(&cfg.Storage.Preallocate, "preallocate", cfg.Storage.Preallocate, "reserve disk space for incoming files with fallocate (linux)")
+	fs.StringVar(&cfg.Storage.Backend, "storage", cfg.Storage.Backend, "where files are stored (local, s3, memory), s3 is set up in the config file")
+	fs.StringVar(&cfg.Storage.Root, "root", cfg.Storage.Root, "directory client paths are relative to, any path if empty")
+	fs.StringVar(&cfg.Storage.ScratchDir, "scratch-dir", cfg.Storage.ScratchDir, "directory for parts of multipart copies")
+	fs.BoolVar(&cfg.Storage.ScratchOnTargetFS, "scratch-on-target-fs", cfg.Storage.ScratchOnTargetFS, "keep parts in a hidden directory next to the target instead of -scratch-dir")
+	fs.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "log level (debug, info, warn, error)")
+	fs.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "log format (text, json)")
+	fs.StringVar(&cfg.Server.MetricsAddress, "metrics-address", cfg.Server.MetricsAddress, "address to serve Prometheus metrics on at /metrics (eg. :9090), disabled if empty")
+	fs.StringVar(&cfg.Server.AdminAddress, "admin-address", cfg.Server.AdminAddress, "loopback address or unix socket path (containing a /) to serve the admin API on, disabled if empty")
+	fs.StringVar(&cfg.Hooks.PreAccept, "pre-accept-hook", cfg.Hooks.PreAccept, "executable run before accepting a copy, which it rejects by exiting non-zero")
+	fs.StringVar(&cfg.Hooks.PostCommit, "post-commit-hook", cfg.Hooks.PostCommit, "executable run in the background after a copy is committed")
+	fs.StringVar(&cfg.Hooks.Timeout, "hook-timeout", cfg.Hooks.Timeout, "how long a hook may run before it is killed")
+	fs.Uint64Var(&cfg.Limits.MaxFileSize, "max-file-size", cfg.Limits.MaxFileSize, "largest file a client may copy (bytes), no limit if 0")
+	fs.StringVar(&cfg.Limits.QueueTimeout, "queue-timeout", cfg.Limits.QueueTimeout, "how long a connection may wait for room in a full queue before the server replies it is busy")
+	fs.StringVar(&cfg.Limits.HeaderTimeout, "header-timeout", cfg.Limits.HeaderTimeout, "how long a connection may take to send the header of its op, no limit if 0s")
+	fs.StringVar(&cfg.Limits.IdleTimeout, "idle-timeout", cfg.Limits.IdleTimeout, "how long an op may move no data, no limit if 0s")
+	fs.StringVar(&cfg.Limits.OpTimeout, "op-timeout", cfg.Limits.OpTimeout, "how long an op may take in all, no limit if 0s")
+	fs.StringVar(&cfg.Limits.SessionTimeout, "session-timeout", cfg.Limits.SessionTimeout, "how long a multipart copy may receive no parts before it is dropped, never if 0s")
+	fs.StringVar(&cfg.Limits.BusyRetryAfter, "busy-retry-after", cfg.Limits.BusyRetryAfter, "how long clients told the server is busy are asked to wait before retrying")
+	return configPath
+}
+
+// loadConfig reads the config file, if any, and then applies the flags that
+// were given on the command line over it, so they win on every reload too.
+func loadConfig(path string) (*config.Config, error) {
+	cfg := config.Default()
+	if path != "" {
+		var err error
+		cfg, err = config.Load(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	bindFlags(fs, cfg)
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if err == nil && f.Name != "config" {
+			err = fs.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// storageFrom makes the storage backend, checking the scratch dir of local
+// storage.
+func storageFrom(cfg *config.Config) (storage.Backend, error) {
+	switch cfg.Storage.Backend {
+	case "s3":
+		s3 := cfg.Storage.S3
+		if s3.AccessKey == "" && s3.SecretKey == "" {
+			s3.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+			s3.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		}
+		return storage.NewS3(storage.S3Config{Endpoint: s3.Endpoint, Region: s3.Region, Bucket: s3.Bucket,
+			AccessKey: s3.AccessKey, SecretKey: s3.SecretKey, PathStyle: s3.PathStyle})
+	case "memory":
+		return storage.NewMemory(), nil
+	}
+	if !cfg.Storage.ScratchOnTargetFS {
+		if err := storage.CheckScratchDir(cfg.Storage.ScratchDir); err != nil {
+			return nil, fmt.Errorf("unusable scratch dir %s: %s", cfg.Storage.ScratchDir, err.Error())
+		}
+	} else if cfg.Storage.Root != "" {
+		// Without a root, targets may be anywhere and each multipart copy
+		// finds out at init.
+		if err := storage.CheckTargetScratch(cfg.Storage.Root); err != nil {
+			return nil, fmt.Errorf("unusable scratch dir on target filesystem under %s: %s", cfg.Storage.Root, err.Error())
+		}
+	}
+	local := storage.NewLocal()
+	local.SetScratchDir(cfg.Storage.ScratchDir)
+	local.SetScratchOnTargetFS(cfg.Storage.ScratchOnTargetFS)
+	return local, nil
+}
+
+func settingsFrom(cfg *config.Config) (controller.Settings, error) {
+	durabilityMode, err := controller.ParseDurabilityMode(cfg.Storage.Durability)
+	if err != nil {
+		return controller.Settings{}, err
+	}
+	rules, err := cfg.ACLRules()
+	if err != nil {
+		return controller.Settings{}, err
+	}
+	quotas, err := cfg.QuotaPolicy()
+	if err != nil {
+		return controller.Settings{}, err
+	}
+	queueTimeout, err := cfg.QueueTimeout()
+	if err != nil {
+		return controller.Settings{}, err
+	}
+	busyRetryAfter, err := cfg.BusyRetryAfter()
+	if err != nil {
+		return controller.Settings{}, err
+	}
+	timeouts, err := cfg.Timeouts()
+	if err != nil {
+		return controller.Settings{}, err
 	}
-	for {
-		conn, err := ln.Accept()
+	peers := make(map[string]controller.Peer, len(cfg.Peers))
+	for _, pc := range cfg.Peers {
+		clients, err := pc.AllowedClients()
 		if err != nil {
-			fmt.Printf("Unable to accept connection. Failed with error : %s\n", err.Error())
-			os.Exit(2)
+			return controller.Settings{}, err
+		}
+		peers[pc.Name] = controller.Peer{Address: pc.Address, Clients: clients, Multiplex: pc.Multiplex,
+			ChunkSize: pc.ChunkSize, Workers: pc.Workers}
+	}
+	return controller.Settings{
+		Durability:     durabilityMode,
+		ZeroCopy:       cfg.Storage.ZeroCopy,
+		Preallocate:    cfg.Storage.Preallocate,
+		MaxFileSize:    cfg.Limits.MaxFileSize,
+		ACL:            rules,
+		Quota:          quotas,
+		QueueTimeout:   queueTimeout,
+		BusyRetryAfter: busyRetryAfter,
+		HeaderTimeout:  timeouts.Header,
+		IdleTimeout:    timeouts.Idle,
+		OpTimeout:      timeouts.Op,
+		SessionTimeout: timeouts.Session,
+		Peers:          peers,
+	}, nil
+}
+
+// reloadOnHangup rereads the config file on every SIGHUP and applies the
+// log and controller settings from it. Copies in flight keep the settings
+// they started with. Changes to listeners, workers, hooks, the storage
+// backend, root and scratch dirs are only logged, as they need a restart.
+func reloadOnHangup(cc *controller.ChiliController, path string, running *config.Config) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		cfg, err := loadConfig(path)
+		if err == nil {
+			var settings controller.Settings
+			settings, err = settingsFrom(cfg)
+			if err == nil {
+				logger.Configure(cfg.Log.Level, cfg.Log.Format)
+				cc.ApplySettings(settings)
+			}
+		}
+		if err != nil {
+			logger.Error("keeping current configuration, reload failed", "config", path, "error", err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg.Server, running.Server) || cfg.Hooks != running.Hooks || cfg.Storage.Backend != running.Storage.Backend ||
+			cfg.Storage.S3 != running.Storage.S3 || cfg.Storage.Root != running.Storage.Root ||
+			cfg.Storage.ScratchDir != running.Storage.ScratchDir ||
+			cfg.Storage.ScratchOnTargetFS != running.Storage.ScratchOnTargetFS {
+			logger.Warn("server, hooks, storage backend, root and scratch settings changed, restart to apply them", "config", path)
+		}
+		logger.Info("reloaded configuration", "config", path)
+	}
+}
+
+func startMetricsServer(cc *controller.ChiliController, address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", cc.MetricsHandler())
+	logger.Info("serving metrics", "address", address)
+	err := http.ListenAndServe(address, mux)
+	logger.Error("unable to serve metrics", "address", address, "error", err)
+	os.Exit(1)
+}
+
+// listenAdmin listens on a unix socket if address is a path, which keeps
+// the admin API to local users allowed by the socket's permissions. Other
+// addresses must be loopback ones, as the API is not authenticated.
+func listenAdmin(address string) (net.Listener, error) {
+	if !strings.Contains(address, "/") {
+		if !isLoopback(address) {
+			return nil, fmt.Errorf("admin address %s is not a loopback address or unix socket", address)
 		}
-		cc.AddConnToQ(conn)
+		return net.Listen("tcp", address)
+	}
+	ln, err := listenUnix(address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(address, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// isLoopback tells whether the host of address is localhost or a loopback
+// IP. An empty host would listen on all interfaces, so it is not.
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
 	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func startAdminServer(cc *controller.ChiliController, ln net.Listener) {
+	logger.Info("serving admin API", "address", ln.Addr())
+	err := http.Serve(ln, cc.AdminHandler())
+	logger.Error("unable to serve admin API", "address", ln.Addr(), "error", err)
+	os.Exit(1)
 }
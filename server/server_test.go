@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/chili-copy/server/config"
+	"github.com/chili-copy/server/controller"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		setup   func(path string) func()
+		wantErr bool
+	}{
+		{"no socket", func(path string) func() { return func() {} }, false},
+		{"stale socket", func(path string) func() {
+			// Binding without listening leaves a socket nothing accepts on.
+			fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := syscall.Bind(fd, &syscall.SockaddrUnix{Name: path}); err != nil {
+				t.Fatal(err)
+			}
+			syscall.Close(fd)
+			return func() {}
+		}, false},
+		{"running server", func(path string) func() {
+			ln, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return func() { ln.Close() }
+		}, true},
+		{"not a socket", func(path string) func() {
+			if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			return func() {}
+		}, true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, string(rune('a'+i))+".sock")
+			defer tt.setup(path)()
+			ln, err := listenUnix(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("listenUnix() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if _, serr := os.Lstat(path); serr != nil {
+					t.Errorf("listenUnix() removed %s it failed to listen on", path)
+				}
+				return
+			}
+			defer ln.Close()
+			conn, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatalf("dialing the new listener: %v", err)
+			}
+			conn.Close()
+		})
+	}
+}
+
+func TestListenAdmin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		address string
+		wantErr bool
+	}{
+		{"ipv4 loopback", "127.0.0.1:0", false},
+		{"localhost", "localhost:0", false},
+		{"unix socket", filepath.Join(dir, "admin.sock"), false},
+		{"all interfaces", ":0", true},
+		{"any ipv4", "0.0.0.0:0", true},
+		{"any ipv6", "[::]:0", true},
+		{"other address", "10.1.2.3:0", true},
+		{"host name", "example.com:0", true},
+		{"no port", "127.0.0.1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := listenAdmin(tt.address)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("listenAdmin(%s) error = %v, want error %v", tt.address, err, tt.wantErr)
+			}
+			if ln != nil {
+				ln.Close()
+			}
+		})
+	}
+}
+
+func TestSettingsFrom(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    func(c *config.Config)
+		wantErr bool
+		check   func(s controller.Settings) bool
+	}{
+		{"defaults", func(c *config.Config) {}, false, func(s controller.Settings) bool {
+			return s.Durability == controller.DurabilityOnRequest && !s.ZeroCopy && !s.Preallocate && s.MaxFileSize == 0 &&
+				s.SessionTimeout == time.Hour
+		}},
+		{"storage and limits", func(c *config.Config) {
+			c.Limits.MaxFileSize = 10
+			c.Storage.Durability = "always"
+			c.Storage.ZeroCopy = true
+			c.Storage.Preallocate = true
+		}, false, func(s controller.Settings) bool {
+			return s.MaxFileSize == 10 && s.Durability == controller.DurabilityAlways && s.ZeroCopy && s.Preallocate
+		}},
+		{"timeouts", func(c *config.Config) {
+			c.Limits.OpTimeout = "5m"
+			c.Limits.SessionTimeout = "0s"
+		}, false, func(s controller.Settings) bool {
+			return s.OpTimeout == 5*time.Minute && s.IdleTimeout == time.Minute && s.SessionTimeout == 0
+		}},
+		{"peers", func(c *config.Config) {
+			c.Peers = []config.PeerConfig{{Name: "p", Address: "10.0.0.2:5678", Workers: 2}}
+		}, false, func(s controller.Settings) bool {
+			return s.Peers["p"].Address == "10.0.0.2:5678" && s.Peers["p"].Workers == 2
+		}},
+		{"unknown durability", func(c *config.Config) { c.Storage.Durability = "sometimes" }, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			tt.edit(cfg)
+			s, err := settingsFrom(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("settingsFrom() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !tt.check(s) {
+				t.Errorf("settingsFrom() = %+v", s)
+			}
+		})
+	}
+}
@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package space
+
+import (
+	"os"
+	"syscall"
+)
+
+func preallocate(f *os.File, size uint64) error {
+	if size == 0 {
+		return nil
+	}
+	if err := syscall.Fallocate(int(f.Fd()), 0, 0, int64(size)); err != nil {
+		return os.NewSyscallError("fallocate", err)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package space
+
+import (
+	"errors"
+	"os"
+)
+
+func preallocate(f *os.File, size uint64) error {
+	return errors.New("preallocation not supported on this platform")
+}
@@ -0,0 +1,115 @@
+// Package space checks that filesystems have room for incoming copies and
+// keeps track of the space promised to copies that are still in progress,
+// so concurrent transfers cannot each be told that the same free space is
+// theirs.
+package space
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/chili-copy/common/logger"
+)
+
+var ErrInsufficientSpace = errors.New("insufficient space")
+
+// Request asks for Bytes of space on the filesystem holding Dir.
+type Request struct {
+	Dir   string
+	Bytes uint64
+}
+
+type Tracker struct {
+	lock     sync.Mutex
+	reserved map[uint64]uint64
+}
+
+// Reservation is space set aside by Tracker.Reserve. It must be released
+// once the data it was made for has been written or dropped.
+type Reservation struct {
+	tracker *Tracker
+	dev     uint64
+	bytes   uint64
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{reserved: make(map[uint64]uint64)}
+}
+
+// Reserve checks that the filesystem holding req.Dir has req.Bytes free on
+// top of what is already reserved there, and reserves them. Filesystems that
+// cannot be inspected are not checked, so the copy fails, if at all, with
+// the real error when it is written.
+func (t *Tracker) Reserve(req Request) (*Reservation, error) {
+	dev, avail, err := stat(req.Dir)
+	if err != nil {
+		logger.Warn("unable to check free space", "dir", req.Dir, "error", err)
+		return &Reservation{}, nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	reserved := t.reserved[dev]
+	if avail < reserved || avail-reserved < req.Bytes {
+		logger.Warn("insufficient space", "dir", req.Dir, "bytes", req.Bytes, "available", avail, "reserved", reserved)
+		return nil, ErrInsufficientSpace
+	}
+	t.reserved[dev] = reserved + req.Bytes
+	return &Reservation{t, dev, req.Bytes}, nil
+}
+
+// ReserveAll makes a reservation for each request, or none if any of them
+// does not fit. Requests on the same filesystem add up.
+func (t *Tracker) ReserveAll(reqs ...Request) ([]*Reservation, error) {
+	var reservations []*Reservation
+	for _, req := range reqs {
+		r, err := t.Reserve(req)
+		if err != nil {
+			for _, reservation := range reservations {
+				reservation.Release()
+			}
+			return nil, err
+		}
+		reservations = append(reservations, r)
+	}
+	return reservations, nil
+}
+
+// SameFilesystem tells whether dirs a and b are on one filesystem, false if
+// either cannot be inspected.
+func SameFilesystem(a string, b string) bool {
+	devA, _, errA := stat(a)
+	devB, _, errB := stat(b)
+	return errA == nil && errB == nil && devA == devB
+}
+
+// Consume gives back n bytes of the reservation once they have been written
+// and so show up as used on the filesystem.
+func (r *Reservation) Consume(n uint64) {
+	if r == nil || r.tracker == nil {
+		return
+	}
+	r.tracker.lock.Lock()
+	defer r.tracker.lock.Unlock()
+	if n > r.bytes {
+		n = r.bytes
+	}
+	r.bytes -= n
+	r.tracker.reserved[r.dev] -= n
+}
+
+// Release gives back whatever is left of the reservation.
+func (r *Reservation) Release() {
+	if r == nil {
+		return
+	}
+	r.Consume(r.bytes)
+}
+
+// Preallocate allocates size bytes for f on disk, so running out of space
+// cannot happen half way through writing it. It returns an error on
+// platforms without fallocate(2), in which case only the in-memory
+// reservation protects the copy.
+func Preallocate(f *os.File, size uint64) error {
+	return preallocate(f, size)
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package space
+
+import (
+	"errors"
+)
+
+func stat(dir string) (uint64, uint64, error) {
+	return 0, 0, errors.New("free space check not supported on this platform")
+}
@@ -0,0 +1,198 @@
+package space
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// tempDirSpace returns a temporary directory, the device holding it and the
+// bytes available there. Amounts in the tests are fractions of those, with
+// room to spare for whatever else writes to the filesystem meanwhile.
+func tempDirSpace(t *testing.T) (string, uint64, uint64) {
+	dir, err := ioutil.TempDir("", "space")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, avail, err := stat(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Skipf("free space check not supported: %v", err)
+	}
+	return dir, dev, avail
+}
+
+// TestReserve runs steps on a tracker, each of which must return its want:
+// "reserve" reserves a fraction of the free space, "consume" consumes a
+// fraction of it from the last reservation and "release" releases that.
+func TestReserve(t *testing.T) {
+	dir, dev, avail := tempDirSpace(t)
+	defer os.RemoveAll(dir)
+	type step struct {
+		op   string
+		frac float64
+		want bool
+	}
+	tests := []struct {
+		name         string
+		steps        []step
+		wantReserved float64
+	}{
+		{"fits", []step{{"reserve", 0.5, true}}, 0.5},
+		{"more than is free", []step{{"reserve", 1.5, false}}, 0},
+		{"reservations add up", []step{{"reserve", 0.5, true}, {"reserve", 0.6, false}, {"reserve", 0.3, true}}, 0.8},
+		{"release gives back", []step{{"reserve", 0.5, true}, {"release", 0, true}, {"reserve", 0.6, true}}, 0.6},
+		{"consume gives back", []step{{"reserve", 0.5, true}, {"consume", 0.4, true}, {"reserve", 0.8, true}}, 0.9},
+		{"consume at most the reservation", []step{{"reserve", 0.2, true}, {"consume", 0.5, true}, {"release", 0, true}},
+			0},
+		{"release once consumed", []step{{"reserve", 0.5, true}, {"consume", 0.3, true}, {"release", 0, true}}, 0},
+		{"release twice", []step{{"reserve", 0.5, true}, {"release", 0, true}, {"release", 0, true}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := NewTracker()
+			var last *Reservation
+			for i, s := range tt.steps {
+				n := uint64(s.frac * float64(avail))
+				got := true
+				switch s.op {
+				case "reserve":
+					r, err := tr.Reserve(Request{dir, n})
+					if got = err == nil; got {
+						last = r
+					} else if err != ErrInsufficientSpace {
+						t.Fatalf("step %d, Reserve() error = %v, want %v", i, err, ErrInsufficientSpace)
+					}
+				case "consume":
+					last.Consume(n)
+				case "release":
+					last.Release()
+				}
+				if got != s.want {
+					t.Fatalf("step %d, %s %.1f = %v, want %v", i, s.op, s.frac, got, s.want)
+				}
+			}
+			// Sums of fractions lose a byte or so to rounding.
+			want := uint64(tt.wantReserved * float64(avail))
+			if got := tr.reserved[dev]; got+2 < want || got > want+2 {
+				t.Errorf("reserved %d bytes, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestReserveAll(t *testing.T) {
+	dir, dev, avail := tempDirSpace(t)
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		fracs   []float64
+		wantErr bool
+	}{
+		{"all fit", []float64{0.3, 0.3}, false},
+		{"same filesystem adds up", []float64{0.5, 0.6}, true},
+		{"last does not fit", []float64{0.1, 0.1, 1.5}, true},
+		{"none", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := NewTracker()
+			var reqs []Request
+			for _, frac := range tt.fracs {
+				reqs = append(reqs, Request{dir, uint64(frac * float64(avail))})
+			}
+			reservations, err := tr.ReserveAll(reqs...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReserveAll() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if tr.reserved[dev] != 0 {
+					t.Errorf("failed ReserveAll() left %d bytes reserved", tr.reserved[dev])
+				}
+				return
+			}
+			if len(reservations) != len(reqs) {
+				t.Fatalf("ReserveAll() made %d reservations, want %d", len(reservations), len(reqs))
+			}
+			for _, r := range reservations {
+				r.Release()
+			}
+			if tr.reserved[dev] != 0 {
+				t.Errorf("%d bytes still reserved once all are released", tr.reserved[dev])
+			}
+		})
+	}
+}
+
+func TestReserveUncheckable(t *testing.T) {
+	tr := NewTracker()
+	r, err := tr.Reserve(Request{filepath.Join(os.TempDir(), "no", "such", "dir"), 1 << 62})
+	if err != nil {
+		t.Fatalf("Reserve() on a directory that cannot be checked error = %v, want none", err)
+	}
+	r.Consume(10)
+	r.Release()
+	var none *Reservation
+	none.Consume(10)
+	none.Release()
+	if len(tr.reserved) != 0 {
+		t.Errorf("reserved %v, want nothing", tr.reserved)
+	}
+}
+
+func TestSameFilesystem(t *testing.T) {
+	dir, _, _ := tempDirSpace(t)
+	defer os.RemoveAll(dir)
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		a, b      string
+		want      bool
+		linuxOnly bool
+	}{
+		{"same dir", dir, dir, true, false},
+		{"sub dir", dir, sub, true, false},
+		{"missing dir", dir, filepath.Join(dir, "missing"), false, false},
+		{"proc", dir, "/proc", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.linuxOnly && runtime.GOOS != "linux" {
+				t.Skip("needs linux")
+			}
+			if got := SameFilesystem(tt.a, tt.b); got != tt.want {
+				t.Errorf("SameFilesystem(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreallocate(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("preallocation is only supported on linux")
+	}
+	dir, _, _ := tempDirSpace(t)
+	defer os.RemoveAll(dir)
+	for _, size := range []uint64{0, 1, 1 << 20} {
+		f, err := ioutil.TempFile(dir, "prealloc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Preallocate(f, size); err != nil {
+			t.Errorf("Preallocate(%d) error = %v", size, err)
+		}
+		fi, err := f.Stat()
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint64(fi.Size()) != size {
+			t.Errorf("Preallocate(%d) left a file of %d bytes", size, fi.Size())
+		}
+	}
+}
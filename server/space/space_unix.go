@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package space
+
+import (
+	"syscall"
+)
+
+// stat returns the device holding dir and the bytes available on it to
+// unprivileged users.
+func stat(dir string) (uint64, uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Dev), uint64(fs.Bavail) * uint64(fs.Bsize), nil
+}
@@ -0,0 +1,434 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/chili-copy/server/space"
+)
+
+const (
+	// DefaultScratchDir is where parts are kept unless SetScratchDir is
+	// called.
+	DefaultScratchDir = "/tmp/"
+	// targetScratchDirName is the hidden directory made next to the target
+	// to hold parts when scratch is placed on the target's filesystem.
+	targetScratchDirName = ".ccp-scratch"
+)
+
+// Local stores files on local disk. Parts of multipart copies are kept in a
+// scratch dir until they are stitched together.
+type Local struct {
+	lock              sync.RWMutex
+	scratchDir        string
+	scratchOnTargetFS bool
+}
+
+func NewLocal() *Local {
+	return &Local{scratchDir: DefaultScratchDir}
+}
+
+// SetScratchDir sets the directory parts of multipart copies are written to
+// before being stitched together.
+func (l *Local) SetScratchDir(dir string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.scratchDir = filepath.Clean(dir) + "/"
+}
+
+// SetScratchOnTargetFS makes multipart copies keep their parts in a hidden
+// directory next to the target instead of the scratch dir, so they are
+// stitched without copying across filesystems.
+func (l *Local) SetScratchOnTargetFS(onTargetFS bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.scratchOnTargetFS = onTargetFS
+}
+
+// ScratchDirFor returns where the parts of a copy to path are kept, and
+// whether that is next to path.
+func (l *Local) ScratchDirFor(path string) (string, bool) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.scratchOnTargetFS {
+		return filepath.Join(filepath.Dir(path), targetScratchDirName) + "/", true
+	}
+	return l.scratchDir, false
+}
+
+// CreateTemp writes to a hidden file next to path, renamed over it on
+// commit.
+func (l *Local) CreateTemp(path string, size uint64) (Temp, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &localTemp{f: f, size: size, target: path}, nil
+}
+
+func (l *Local) CreateMultipart(id string, path string, size uint64) (Multipart, error) {
+	scratchDir, onTargetFS := l.ScratchDirFor(path)
+	lm := &localMultipart{id: id, path: path, size: size, scratchDir: scratchDir, transientScratch: onTargetFS}
+	if err := os.MkdirAll(lm.copyDir(), 0700); err != nil {
+		lm.removeTransientScratch()
+		return nil, err
+	}
+	return lm, nil
+}
+
+func (l *Local) Open(path string) (File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, notExist("open", path)
+	}
+	return &localFile{f, uint64(fi.Size())}, nil
+}
+
+// Stat only finds regular files.
+func (l *Local) Stat(path string) (*FileInfo, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, notExist("stat", path)
+	}
+	return &FileInfo{Path: path, Size: uint64(fi.Size()), ModTime: fi.ModTime()}, nil
+}
+
+func (l *Local) List(dir string) ([]FileInfo, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []FileInfo
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			files = append(files, FileInfo{Path: filepath.Join(dir, fi.Name()), Size: uint64(fi.Size()), ModTime: fi.ModTime()})
+		}
+	}
+	return files, nil
+}
+
+func (l *Local) Delete(path string) error {
+	if _, err := l.Stat(path); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// CheckScratchDir makes sure dir exists and files can be created in it.
+func CheckScratchDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".ccp-check-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// CheckTargetScratch makes sure the hidden directory parts are kept in with
+// scratch on the target's filesystem can be made in dir, and files created
+// in it. It is removed again if it was made for the check.
+func CheckTargetScratch(dir string) error {
+	scratch := filepath.Join(dir, targetScratchDirName)
+	_, statErr := os.Stat(scratch)
+	if err := os.MkdirAll(scratch, 0700); err != nil {
+		return err
+	}
+	if os.IsNotExist(statErr) {
+		defer os.Remove(scratch)
+	}
+	return CheckScratchDir(scratch)
+}
+
+type localFile struct {
+	f    *os.File
+	size uint64
+}
+
+func (lf *localFile) ReadAt(b []byte, off int64) (int, error) {
+	return lf.f.ReadAt(b, off)
+}
+
+func (lf *localFile) Close() error {
+	return lf.f.Close()
+}
+
+func (lf *localFile) Size() uint64 {
+	return lf.size
+}
+
+func (lf *localFile) File() *os.File {
+	return lf.f
+}
+
+// localTemp is a file being written. If target is set, it is a temp file
+// renamed over target on commit, otherwise it is written in place.
+type localTemp struct {
+	f      *os.File
+	size   uint64
+	target string
+}
+
+func (lt *localTemp) WriteAt(b []byte, off int64) (int, error) {
+	return lt.f.WriteAt(b, off)
+}
+
+func (lt *localTemp) File() *os.File {
+	return lt.f
+}
+
+func (lt *localTemp) Preallocate() error {
+	return space.Preallocate(lt.f, lt.size)
+}
+
+func (lt *localTemp) Commit(durable bool) error {
+	if durable {
+		if err := lt.f.Sync(); err != nil {
+			lt.Abort()
+			return err
+		}
+	}
+	if err := lt.f.Close(); err != nil {
+		lt.removeTemp()
+		return err
+	}
+	if lt.target == "" {
+		return nil
+	}
+	if err := os.Rename(lt.f.Name(), lt.target); err != nil {
+		lt.removeTemp()
+		return err
+	}
+	if durable {
+		return syncDir(filepath.Dir(lt.target))
+	}
+	return nil
+}
+
+func (lt *localTemp) Abort() error {
+	lt.f.Close()
+	return os.Remove(lt.f.Name())
+}
+
+func (lt *localTemp) removeTemp() {
+	os.Remove(lt.f.Name())
+}
+
+type localMultipart struct {
+	id         string
+	path       string
+	size       uint64
+	scratchDir string
+	// transientScratch marks a scratch dir made just for copies to one
+	// target directory, removed once no copy is using it.
+	transientScratch bool
+}
+
+func (lm *localMultipart) copyDir() string {
+	return lm.scratchDir + lm.id
+}
+
+// stitchPath is the hidden file next to the target that the parts are put
+// together in, and that is then renamed over the target.
+func (lm *localMultipart) stitchPath() string {
+	return filepath.Join(filepath.Dir(lm.path), "."+filepath.Base(lm.path)+"."+lm.id)
+}
+
+func (lm *localMultipart) partPath(num uint64) string {
+	return lm.copyDir() + "/" + strconv.FormatUint(num, 10)
+}
+
+func (lm *localMultipart) CreatePart(num uint64, size uint64) (Temp, error) {
+	f, err := os.OpenFile(lm.partPath(num), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &localTemp{f: f, size: size}, nil
+}
+
+// Preallocate allocates the whole file on disk up front, next to the target
+// where the parts are put together.
+func (lm *localMultipart) Preallocate() error {
+	fout, err := os.OpenFile(lm.stitchPath(), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+	return space.Preallocate(fout, lm.size)
+}
+
+// Commit writes parts 1 to numParts to the target file and removes the
+// scratch data. The parts are put together next to the target, which is
+// then replaced atomically. When scratch is on the same filesystem as the
+// target, part 1 is moved there and the other parts are appended to it, so
+// that much less is copied. Otherwise every part is copied, reading each
+// part once.
+func (lm *localMultipart) Commit(numParts uint64, durable bool) error {
+	stitched, err := lm.stitchInPlace(numParts, durable)
+	if err != nil {
+		return err
+	}
+	if !stitched {
+		err = lm.stitchByCopy(numParts, durable)
+		if err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(lm.copyDir()); err != nil {
+		return err
+	}
+	lm.removeTransientScratch()
+	return nil
+}
+
+// removeTransientScratch only succeeds once no other copy is using the
+// scratch dir, which keeps per-target scratch dirs from piling up.
+func (lm *localMultipart) removeTransientScratch() {
+	if lm.transientScratch {
+		os.Remove(lm.scratchDir)
+	}
+}
+
+// stitchInPlace returns false, having changed nothing, if part 1 cannot be
+// renamed to the target's directory.
+func (lm *localMultipart) stitchInPlace(numParts uint64, durable bool) (bool, error) {
+	target := lm.path
+	tmpPath := lm.stitchPath()
+	if err := os.Rename(lm.partPath(1), tmpPath); err != nil {
+		return false, nil
+	}
+	fout, err := os.OpenFile(tmpPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		os.Remove(tmpPath)
+		return true, err
+	}
+	defer fout.Close()
+	for num := uint64(2); num <= numParts; num++ {
+		if err := appendPart(fout, lm.partPath(num)); err != nil {
+			os.Remove(tmpPath)
+			return true, err
+		}
+	}
+	if durable {
+		if err := fout.Sync(); err != nil {
+			os.Remove(tmpPath)
+			return true, err
+		}
+	}
+	if err := os.Rename(tmpPath, target); err != nil {
+		os.Remove(tmpPath)
+		return true, err
+	}
+	if durable {
+		return true, syncDir(filepath.Dir(target))
+	}
+	return true, nil
+}
+
+// stitchByCopy writes the file from the start and truncates it afterwards
+// rather than before, so space preallocated for it is kept. The target is
+// left as it was if stitching fails.
+func (lm *localMultipart) stitchByCopy(numParts uint64, durable bool) error {
+	tmpPath := lm.stitchPath()
+	fout, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := lm.copyParts(fout, numParts, durable); err != nil {
+		fout.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := fout.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, lm.path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if durable {
+		return syncDir(filepath.Dir(lm.path))
+	}
+	return nil
+}
+
+func (lm *localMultipart) copyParts(fout *os.File, numParts uint64, durable bool) error {
+	for num := uint64(1); num <= numParts; num++ {
+		if err := appendPart(fout, lm.partPath(num)); err != nil {
+			return err
+		}
+	}
+	offset, err := fout.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if err := fout.Truncate(offset); err != nil {
+		return err
+	}
+	if durable {
+		return fout.Sync()
+	}
+	return nil
+}
+
+// Abort drops whatever parts have been received so far, along with the file
+// preallocated for them, if any.
+func (lm *localMultipart) Abort() error {
+	err := os.RemoveAll(lm.copyDir())
+	lm.removeTransientScratch()
+	os.Remove(lm.stitchPath())
+	return err
+}
+
+func appendPart(fout *os.File, path string) error {
+	fin, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fout, fin)
+	fin.Close()
+	if err != nil {
+		return fmt.Errorf("failed to append part %s: %s", path, err.Error())
+	}
+	return os.Remove(path)
+}
+
+// syncDir flushes the directory entries in path, so a file created or
+// renamed in it survives a power loss.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScratchDirFor(t *testing.T) {
+	tests := []struct {
+		name           string
+		scratchDir     string
+		onTargetFS     bool
+		path           string
+		want           string
+		wantOnTargetFS bool
+	}{
+		{"default", "", false, "/data/file", DefaultScratchDir, false},
+		{"scratch dir", "/scratch", false, "/data/file", "/scratch/", false},
+		{"scratch dir with slash", "/scratch/", false, "/data/file", "/scratch/", false},
+		{"scratch dir cleaned", "/scratch/../other//", false, "/data/file", "/other/", false},
+		{"on target fs", "/scratch", true, "/data/sub/file", "/data/sub/" + targetScratchDirName + "/", true},
+		{"on target fs at root", "", true, "/file", "/" + targetScratchDirName + "/", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLocal()
+			if tt.scratchDir != "" {
+				l.SetScratchDir(tt.scratchDir)
+			}
+			l.SetScratchOnTargetFS(tt.onTargetFS)
+			got, onTargetFS := l.ScratchDirFor(tt.path)
+			if got != tt.want || onTargetFS != tt.wantOnTargetFS {
+				t.Errorf("ScratchDirFor(%s) = %s, %v, want %s, %v", tt.path, got, onTargetFS, tt.want, tt.wantOnTargetFS)
+			}
+		})
+	}
+}
+
+func TestCheckScratch(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	file := filepath.Join(root, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	existing := filepath.Join(root, "existing")
+	if err := os.MkdirAll(filepath.Join(existing, targetScratchDirName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		check   func(dir string) error
+		dir     string
+		wantErr bool
+		// wantScratch is whether the hidden scratch dir is there after.
+		wantScratch bool
+	}{
+		{"scratch dir", CheckScratchDir, root, false, false},
+		{"missing scratch dir", CheckScratchDir, filepath.Join(root, "missing"), true, false},
+		{"scratch dir is a file", CheckScratchDir, file, true, false},
+		{"target dir", CheckTargetScratch, root, false, false},
+		{"target dir with scratch", CheckTargetScratch, existing, false, true},
+		{"target dir is a file", CheckTargetScratch, file, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.check(tt.dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("check(%s) error = %v, want error %v", tt.dir, err, tt.wantErr)
+			}
+			_, err = os.Stat(filepath.Join(tt.dir, targetScratchDirName))
+			if (err == nil) != tt.wantScratch {
+				t.Errorf("scratch dir left in %s: %v, want %v", tt.dir, err == nil, tt.wantScratch)
+			}
+			if tt.dir != root {
+				return
+			}
+			// Only file and existing are in root.
+			if fis, _ := ioutil.ReadDir(root); len(fis) != 2 {
+				t.Errorf("check(%s) left %d entries behind", root, len(fis)-2)
+			}
+		})
+	}
+}
+
+// TestLocalStitchByCopy stitches parts as for scratch on another filesystem,
+// and checks the target is replaced whole or left as it was.
+func TestLocalStitchByCopy(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	parts := [][]byte{content(3000, 1), content(3000, 2), content(1, 3)}
+	want := bytes.Join(parts, nil)
+	old := content(10000, 4)
+	tests := []struct {
+		name        string
+		preallocate bool
+		// sent is how many of the parts are there to stitch.
+		sent int
+		want []byte
+	}{
+		{"over a larger file", false, 3, want},
+		{"preallocated", true, 3, want},
+		{"part missing", false, 2, old},
+		{"preallocated part missing", true, 2, old},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "file")
+			if err := ioutil.WriteFile(path, old, 0644); err != nil {
+				t.Fatal(err)
+			}
+			l := NewLocal()
+			l.SetScratchDir(dir)
+			m, err := l.CreateMultipart("copy", path, uint64(len(want)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lm := m.(*localMultipart)
+			if tt.preallocate {
+				if err := lm.Preallocate(); err != nil {
+					t.Fatalf("Preallocate() error = %v", err)
+				}
+			}
+			for i, part := range parts[:tt.sent] {
+				temp, err := m.CreatePart(uint64(i+1), uint64(len(part)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				writeTemp(t, temp, part)
+				if err := temp.Commit(false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = lm.stitchByCopy(uint64(len(parts)), false)
+			if (err != nil) != (tt.sent < len(parts)) {
+				t.Fatalf("stitchByCopy() error = %v", err)
+			}
+			m.Abort()
+			checkFile(t, l, path, tt.want)
+			if _, err := os.Stat(lm.stitchPath()); !os.IsNotExist(err) {
+				t.Errorf("stitched file left behind")
+			}
+		})
+	}
+}
+
+func TestLocalPreallocatedCommit(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	parts := [][]byte{content(3000, 1), content(3000, 2), content(1, 3)}
+	want := bytes.Join(parts, nil)
+	tests := []struct {
+		name        string
+		existing    int
+		preallocate bool
+	}{
+		{"new file", -1, false},
+		{"preallocated", -1, true},
+		{"over a larger file", 10000, false},
+		{"preallocated over a larger file", 10000, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "file")
+			os.Remove(path)
+			if tt.existing >= 0 {
+				if err := ioutil.WriteFile(path, make([]byte, tt.existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			l := NewLocal()
+			l.SetScratchDir(dir)
+			m, err := l.CreateMultipart("copy", path, uint64(len(want)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.preallocate {
+				if err := m.(Preallocator).Preallocate(); err != nil {
+					t.Fatalf("Preallocate() error = %v", err)
+				}
+			}
+			for i, part := range parts {
+				temp, err := m.CreatePart(uint64(i+1), uint64(len(part)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				writeTemp(t, temp, part)
+				if err := temp.Commit(false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := m.Commit(uint64(len(parts)), false); err != nil {
+				t.Fatalf("Commit() error = %v", err)
+			}
+			checkFile(t, l, path, want)
+			if _, err := os.Stat(filepath.Join(dir, "copy")); !os.IsNotExist(err) {
+				t.Errorf("scratch data left behind")
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory stores files in memory, for tests and servers embedded in them.
+type Memory struct {
+	lock  sync.RWMutex
+	files map[string]*memFile
+}
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{files: make(map[string]*memFile)}
+}
+
+func (m *Memory) put(path string, data []byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.files[path] = &memFile{data, time.Now()}
+}
+
+func (m *Memory) CreateTemp(path string, size uint64) (Temp, error) {
+	return &memTemp{commit: func(data []byte) error {
+		m.put(path, data)
+		return nil
+	}}, nil
+}
+
+func (m *Memory) CreateMultipart(id string, path string, size uint64) (Multipart, error) {
+	return &memMultipart{m: m, path: path, parts: make(map[uint64][]byte)}, nil
+}
+
+func (m *Memory) Open(path string) (File, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	mf, ok := m.files[path]
+	if !ok {
+		return nil, notExist("open", path)
+	}
+	return &memReader{bytes.NewReader(mf.data)}, nil
+}
+
+func (m *Memory) Stat(path string) (*FileInfo, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	mf, ok := m.files[path]
+	if !ok {
+		return nil, notExist("stat", path)
+	}
+	return &FileInfo{Path: path, Size: uint64(len(mf.data)), ModTime: mf.modTime}, nil
+}
+
+func (m *Memory) List(dir string) ([]FileInfo, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	dir = filepath.Clean(dir)
+	var files []FileInfo
+	for path, mf := range m.files {
+		if filepath.Dir(path) == dir {
+			files = append(files, FileInfo{Path: path, Size: uint64(len(mf.data)), ModTime: mf.modTime})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+func (m *Memory) Delete(path string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.files[path]; !ok {
+		return notExist("delete", path)
+	}
+	delete(m.files, path)
+	return nil
+}
+
+// memTemp grows its buffer as it is written and passes it to commit.
+type memTemp struct {
+	buf    []byte
+	commit func([]byte) error
+}
+
+func (mt *memTemp) WriteAt(b []byte, off int64) (int, error) {
+	if end := int(off) + len(b); end > len(mt.buf) {
+		mt.buf = append(mt.buf, make([]byte, end-len(mt.buf))...)
+	}
+	return copy(mt.buf[off:], b), nil
+}
+
+func (mt *memTemp) Commit(durable bool) error {
+	return mt.commit(mt.buf)
+}
+
+func (mt *memTemp) Abort() error {
+	mt.buf = nil
+	return nil
+}
+
+type memMultipart struct {
+	m     *Memory
+	path  string
+	lock  sync.Mutex
+	parts map[uint64][]byte
+}
+
+func (mm *memMultipart) CreatePart(num uint64, size uint64) (Temp, error) {
+	return &memTemp{commit: func(data []byte) error {
+		mm.lock.Lock()
+		defer mm.lock.Unlock()
+		if mm.parts == nil {
+			return errors.New("copy is already committed or aborted")
+		}
+		mm.parts[num] = data
+		return nil
+	}}, nil
+}
+
+func (mm *memMultipart) Commit(numParts uint64, durable bool) error {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	var data []byte
+	for num := uint64(1); num <= numParts; num++ {
+		part, ok := mm.parts[num]
+		if !ok {
+			return errors.New("missing part")
+		}
+		data = append(data, part...)
+	}
+	mm.parts = nil
+	mm.m.put(mm.path, data)
+	return nil
+}
+
+func (mm *memMultipart) Abort() error {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	mm.parts = nil
+	return nil
+}
+
+type memReader struct {
+	*bytes.Reader
+}
+
+func (mr *memReader) Close() error {
+	return nil
+}
+
+func (mr *memReader) Size() uint64 {
+	return uint64(mr.Reader.Size())
+}
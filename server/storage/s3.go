@@ -0,0 +1,441 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type S3Config struct {
+	// Endpoint is the URL of the service, eg. http://127.0.0.1:9000 for a
+	// local stand-in. Default is AWS in Region.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle puts the bucket in the URL path instead of the host name,
+	// as most stand-ins need.
+	PathStyle bool
+}
+
+// S3 stores files as objects of a bucket in an S3-compatible object store,
+// keyed by their path without the leading slash. Multipart copies use the
+// store's own multipart uploads, so parts other than the last must be at
+// least as large as the store requires, 5MB for AWS.
+//
+// Data is streamed to the store as it is received, so temps must be written
+// in order.
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// S3Error is an error response from the object store.
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: %s (%d): %s", e.Code, e.StatusCode, e.Message)
+}
+
+// Temporary reports whether the store may accept the request later, as
+// when it is overloaded or unavailable.
+func (e *S3Error) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+var errOutOfOrder = errors.New("s3: temps must be written in order")
+
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3: bucket is empty")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3: endpoint %s is not a URL", cfg.Endpoint)
+	}
+	return &S3{cfg: cfg, endpoint: endpoint, client: &http.Client{}}, nil
+}
+
+func objectKey(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+func (s *S3) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	escapedPath := strings.TrimSuffix(u.EscapedPath(), "/")
+	if s.cfg.PathStyle {
+		escapedPath += "/" + awsEscape(s.cfg.Bucket, false)
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+	escapedPath += "/" + awsEscape(key, true)
+	u.Path, _ = url.PathUnescape(escapedPath)
+	u.RawPath = escapedPath
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// do sends a request for key, signed with payloadHash as the hash of body,
+// and turns error responses into *S3Error.
+func (s *S3) do(method string, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key, query).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil && size > 0 {
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = size
+	}
+	s.sign(req, payloadHash, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		serr := &S3Error{StatusCode: resp.StatusCode}
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if xml.Unmarshal(b, serr) != nil || serr.Code == "" {
+			serr.Code = http.StatusText(resp.StatusCode)
+		}
+		return nil, serr
+	}
+	return resp, nil
+}
+
+// doXML sends a request with an XML body, if any, and decodes the XML
+// response into out. Some errors come with a 200 status, in the body.
+func (s *S3) doXML(method string, key string, query url.Values, in interface{}, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = xml.Marshal(in); err != nil {
+			return err
+		}
+	}
+	resp, err := s.do(method, key, query, nil, bytes.NewReader(body), int64(len(body)), hashHex(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	serr := &S3Error{StatusCode: resp.StatusCode}
+	if xml.Unmarshal(b, &struct {
+		XMLName xml.Name `xml:"Error"`
+		*S3Error
+	}{S3Error: serr}) == nil {
+		return serr
+	}
+	if out == nil {
+		return nil
+	}
+	return xml.Unmarshal(b, out)
+}
+
+func isNotFound(err error) bool {
+	serr, ok := err.(*S3Error)
+	return ok && serr.StatusCode == http.StatusNotFound
+}
+
+func (s *S3) CreateTemp(p string, size uint64) (Temp, error) {
+	return s.startPut(objectKey(p), nil, size, nil), nil
+}
+
+func (s *S3) CreateMultipart(id string, p string, size uint64) (Multipart, error) {
+	key := objectKey(p)
+	var res struct {
+		UploadId string `xml:"UploadId"`
+	}
+	if err := s.doXML(http.MethodPost, key, url.Values{"uploads": {""}}, nil, &res); err != nil {
+		return nil, err
+	}
+	return &s3Multipart{s: s, key: key, uploadId: res.UploadId, etags: make(map[uint64]string)}, nil
+}
+
+// PartLimits are those of S3 multipart uploads.
+func (s *S3) PartLimits() PartLimits {
+	return PartLimits{MinSize: 5 << 20, MaxSize: 5 << 30, MaxParts: 10000}
+}
+
+func (s *S3) Open(p string) (File, error) {
+	fi, err := s.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{s: s, key: objectKey(p), size: fi.Size}, nil
+}
+
+func (s *S3) Stat(p string) (*FileInfo, error) {
+	resp, err := s.do(http.MethodHead, objectKey(p), nil, nil, nil, 0, emptyPayloadHash)
+	if isNotFound(err) {
+		return nil, notExist("stat", p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &FileInfo{Path: p, Size: uint64(resp.ContentLength), ModTime: modTime}, nil
+}
+
+func (s *S3) List(dir string) ([]FileInfo, error) {
+	prefix := objectKey(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+	var files []FileInfo
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+	for {
+		var res struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         uint64    `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := s.doXML(http.MethodGet, "", query, nil, &res); err != nil {
+			return nil, err
+		}
+		for _, c := range res.Contents {
+			files = append(files, FileInfo{Path: "/" + c.Key, Size: c.Size, ModTime: c.LastModified})
+		}
+		if !res.IsTruncated {
+			return files, nil
+		}
+		query.Set("continuation-token", res.NextContinuationToken)
+	}
+}
+
+// Delete stats the object first, as deleting a missing object succeeds.
+func (s *S3) Delete(p string) error {
+	if _, err := s.Stat(p); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, objectKey(p), nil, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// startPut sends a PUT of size bytes for key, whose body is what is then
+// written to the returned temp. onCommit is given the response once it
+// succeeds.
+func (s *S3) startPut(key string, query url.Values, size uint64, onCommit func(*http.Response)) *s3Temp {
+	pr, pw := io.Pipe()
+	st := &s3Temp{pw: pw, size: int64(size), done: make(chan error, 1)}
+	st.start = func() {
+		go func() {
+			resp, err := s.do(http.MethodPut, key, query, nil, pr, int64(size), unsignedPayload)
+			if err == nil {
+				if onCommit != nil {
+					onCommit(resp)
+				}
+				resp.Body.Close()
+			}
+			// Unblock writes if the store answered before reading it all.
+			pr.CloseWithError(err)
+			st.done <- err
+		}()
+	}
+	// An empty body would be stored at once, so it is only sent on commit.
+	if size > 0 {
+		st.start()
+	}
+	return st
+}
+
+// s3Temp streams what is written to it into a PUT request. The last byte is
+// held back until Commit, as the store keeps the object once it has the
+// whole body.
+type s3Temp struct {
+	pw      *io.PipeWriter
+	size    int64
+	written int64
+	last    []byte
+	start   func()
+	done    chan error
+}
+
+func (st *s3Temp) WriteAt(b []byte, off int64) (int, error) {
+	if off != st.written {
+		return 0, errOutOfOrder
+	}
+	held := 0
+	if len(b) > 0 && st.written+int64(len(b)) == st.size {
+		held = 1
+		st.last = []byte{b[len(b)-1]}
+	}
+	n, err := st.pw.Write(b[:len(b)-held])
+	if err == nil {
+		n += held
+	}
+	st.written += int64(n)
+	return n, err
+}
+
+// Commit waits for the store to acknowledge the object, which it only does
+// once it is durably stored.
+func (st *s3Temp) Commit(durable bool) error {
+	if st.size == 0 {
+		st.start()
+	}
+	if st.last != nil {
+		st.pw.Write(st.last)
+	}
+	st.pw.Close()
+	return <-st.done
+}
+
+func (st *s3Temp) Abort() error {
+	if st.size == 0 {
+		return nil
+	}
+	st.pw.CloseWithError(errors.New("s3: upload aborted"))
+	<-st.done
+	return nil
+}
+
+type s3Multipart struct {
+	s        *S3
+	key      string
+	uploadId string
+	lock     sync.Mutex
+	etags    map[uint64]string
+}
+
+func (sm *s3Multipart) CreatePart(num uint64, size uint64) (Temp, error) {
+	query := url.Values{"partNumber": {strconv.FormatUint(num, 10)}, "uploadId": {sm.uploadId}}
+	return sm.s.startPut(sm.key, query, size, func(resp *http.Response) {
+		sm.lock.Lock()
+		defer sm.lock.Unlock()
+		sm.etags[num] = resp.Header.Get("ETag")
+	}), nil
+}
+
+type completedPart struct {
+	PartNumber uint64 `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (sm *s3Multipart) Commit(numParts uint64, durable bool) error {
+	sm.lock.Lock()
+	parts := make([]completedPart, 0, numParts)
+	for num := uint64(1); num <= numParts; num++ {
+		etag, ok := sm.etags[num]
+		if !ok {
+			sm.lock.Unlock()
+			return fmt.Errorf("s3: part %d was not uploaded", num)
+		}
+		parts = append(parts, completedPart{num, etag})
+	}
+	sm.lock.Unlock()
+	complete := struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts}
+	return sm.s.doXML(http.MethodPost, sm.key, url.Values{"uploadId": {sm.uploadId}}, complete, nil)
+}
+
+func (sm *s3Multipart) Abort() error {
+	resp, err := sm.s.do(http.MethodDelete, sm.key, url.Values{"uploadId": {sm.uploadId}}, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3File reads an object with ranged GETs. Reads that follow on from the
+// previous one carry on with its response instead of sending another.
+type s3File struct {
+	s    *S3
+	key  string
+	size uint64
+	lock sync.Mutex
+	body io.ReadCloser
+	pos  int64
+}
+
+func (sf *s3File) ReadAt(b []byte, off int64) (int, error) {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	if off >= int64(sf.size) {
+		return 0, io.EOF
+	}
+	if sf.body == nil || sf.pos != off {
+		sf.closeBody()
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, sf.size-1)}}
+		resp, err := sf.s.do(http.MethodGet, sf.key, nil, header, nil, 0, emptyPayloadHash)
+		if err != nil {
+			return 0, err
+		}
+		sf.body, sf.pos = resp.Body, off
+	}
+	want := len(b)
+	if rest := int64(sf.size) - off; int64(want) > rest {
+		want = int(rest)
+	}
+	n, err := io.ReadFull(sf.body, b[:want])
+	sf.pos += int64(n)
+	if err != nil {
+		sf.closeBody()
+		return n, err
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (sf *s3File) closeBody() {
+	if sf.body != nil {
+		sf.body.Close()
+		sf.body = nil
+	}
+}
+
+func (sf *s3File) Close() error {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	sf.closeBody()
+	return nil
+}
+
+func (sf *s3File) Size() uint64 {
+	return sf.size
+}
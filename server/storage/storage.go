@@ -0,0 +1,87 @@
+// Package storage holds the files copied to the server. Local keeps them on
+// disk, Memory in memory for tests and S3 in an S3-compatible object store.
+package storage
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// Backend stores files by path. Paths are absolute and already cleaned.
+type Backend interface {
+	// CreateTemp starts a file of size bytes for path. It is written with
+	// WriteAt and only replaces path once committed.
+	CreateTemp(path string, size uint64) (Temp, error)
+	// CreateMultipart starts a file of size bytes for path that is sent in
+	// numbered parts. id is unique to the copy.
+	CreateMultipart(id string, path string, size uint64) (Multipart, error)
+	Open(path string) (File, error)
+	Stat(path string) (*FileInfo, error)
+	// List returns the files directly in dir.
+	List(dir string) ([]FileInfo, error)
+	Delete(path string) error
+}
+
+type Temp interface {
+	// WriteAt may need writes to come in order, as for a stream.
+	io.WriterAt
+	// Commit makes what was written visible. If durable, it returns once
+	// the data would survive a power loss.
+	Commit(durable bool) error
+	// Abort drops what was written.
+	Abort() error
+}
+
+type Multipart interface {
+	// CreatePart starts part num, numbered from 1. Committing it replaces
+	// any part num committed before.
+	CreatePart(num uint64, size uint64) (Temp, error)
+	// Commit puts parts 1 to numParts together at the path.
+	Commit(numParts uint64, durable bool) error
+	// Abort drops the parts and anything made at the path for the copy.
+	Abort() error
+}
+
+type File interface {
+	io.ReaderAt
+	io.Closer
+	Size() uint64
+}
+
+type FileInfo struct {
+	Path    string
+	Size    uint64
+	ModTime time.Time
+}
+
+// Preallocator is implemented by temps and multiparts that can allocate
+// the space for the whole file up front.
+type Preallocator interface {
+	Preallocate() error
+}
+
+// OSFile is implemented by temps and files on local disk, which data can
+// be spliced into and sent from with sendfile.
+type OSFile interface {
+	File() *os.File
+}
+
+// PartLimits bound the parts of multipart files. Zero values are not
+// limited.
+type PartLimits struct {
+	// MinSize applies to every part but the last.
+	MinSize  uint64
+	MaxSize  uint64
+	MaxParts uint64
+}
+
+// PartLimiter is implemented by backends that limit parts.
+type PartLimiter interface {
+	PartLimits() PartLimits
+}
+
+// notExist is returned for missing paths, so that os.IsNotExist holds.
+func notExist(op string, path string) error {
+	return &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+}
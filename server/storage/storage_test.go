@@ -0,0 +1,403 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// The tests below hold every Backend to the contract of the interface,
+// with S3 talking to a stand-in for the object store.
+
+type backendCase struct {
+	name string
+	// setup returns the backend, the directory files are kept in and a
+	// func that cleans up after it.
+	setup func(t *testing.T) (Backend, string, func())
+}
+
+var backendCases = []backendCase{
+	{"local", func(t *testing.T) (Backend, string, func()) {
+		root, scratch := tempDir(t), tempDir(t)
+		local := NewLocal()
+		local.SetScratchDir(scratch)
+		return local, root, func() {
+			os.RemoveAll(root)
+			os.RemoveAll(scratch)
+		}
+	}},
+	{"local-scratch-on-target-fs", func(t *testing.T) (Backend, string, func()) {
+		root := tempDir(t)
+		local := NewLocal()
+		local.SetScratchOnTargetFS(true)
+		return local, root, func() { os.RemoveAll(root) }
+	}},
+	{"memory", func(t *testing.T) (Backend, string, func()) {
+		return NewMemory(), "/data", func() {}
+	}},
+	{"s3", func(t *testing.T) (Backend, string, func()) {
+		srv := httptest.NewServer(newFakeS3("bucket", 2))
+		s3, err := NewS3(S3Config{Endpoint: srv.URL, Bucket: "bucket", AccessKey: "key", SecretKey: "secret",
+			PathStyle: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s3, "/data", srv.Close
+	}},
+}
+
+func forEachBackend(t *testing.T, test func(t *testing.T, b Backend, dir string)) {
+	for _, bc := range backendCases {
+		bc := bc
+		t.Run(bc.name, func(t *testing.T) {
+			b, dir, cleanup := bc.setup(t)
+			defer cleanup()
+			test(t, b, dir)
+		})
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// writeTemp writes data to temp in pieces, in order.
+func writeTemp(t *testing.T, temp Temp, data []byte) {
+	for off := 0; off < len(data); off += 1000 {
+		end := off + 1000
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := temp.WriteAt(data[off:end], int64(off)); err != nil {
+			t.Fatalf("WriteAt(%d) error = %v", off, err)
+		}
+	}
+}
+
+func putFile(t *testing.T, b Backend, path string, data []byte) {
+	temp, err := b.CreateTemp(path, uint64(len(data)))
+	if err != nil {
+		t.Fatalf("CreateTemp() error = %v", err)
+	}
+	writeTemp(t, temp, data)
+	if err := temp.Commit(false); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+}
+
+// checkFile checks that path holds data, through Stat and Open.
+func checkFile(t *testing.T, b Backend, path string, data []byte) {
+	t.Helper()
+	fi, err := b.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat(%s) error = %v", path, err)
+	}
+	if fi.Path != path || fi.Size != uint64(len(data)) {
+		t.Errorf("Stat(%s) = %s of %d bytes, want %d bytes", path, fi.Path, fi.Size, len(data))
+	}
+	f, err := b.Open(path)
+	if err != nil {
+		t.Fatalf("Open(%s) error = %v", path, err)
+	}
+	defer f.Close()
+	if f.Size() != uint64(len(data)) {
+		t.Errorf("Size() = %d, want %d", f.Size(), len(data))
+	}
+	got, err := ioutil.ReadAll(io.NewSectionReader(f, 0, int64(f.Size())))
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("%s holds %q, want %q", path, abbrev(got), abbrev(data))
+	}
+}
+
+func checkNotExist(t *testing.T, b Backend, path string) {
+	t.Helper()
+	if _, err := b.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Stat(%s) error = %v, want one that is not exist", path, err)
+	}
+	if _, err := b.Open(path); !os.IsNotExist(err) {
+		t.Errorf("Open(%s) error = %v, want one that is not exist", path, err)
+	}
+}
+
+func abbrev(b []byte) []byte {
+	if len(b) > 20 {
+		return b[:20]
+	}
+	return b
+}
+
+func content(n int, seed byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = seed + byte(i%251)
+	}
+	return b
+}
+
+func TestBackendTemp(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []byte
+		data     []byte
+		commit   bool
+	}{
+		{"commit new file", nil, content(2500, 1), true},
+		{"commit empty file", nil, nil, true},
+		{"commit over file", content(4000, 7), content(1500, 2), true},
+		{"abort new file", nil, content(2500, 3), false},
+		{"abort keeps file", content(4000, 7), content(1500, 4), false},
+	}
+	forEachBackend(t, func(t *testing.T, b Backend, dir string) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				path := filepath.Join(dir, "file")
+				b.Delete(path)
+				if tt.existing != nil {
+					putFile(t, b, path, tt.existing)
+				}
+				temp, err := b.CreateTemp(path, uint64(len(tt.data)))
+				if err != nil {
+					t.Fatalf("CreateTemp() error = %v", err)
+				}
+				writeTemp(t, temp, tt.data)
+				if tt.existing == nil {
+					checkNotExist(t, b, path)
+				} else {
+					checkFile(t, b, path, tt.existing)
+				}
+				if tt.commit {
+					if err := temp.Commit(true); err != nil {
+						t.Fatalf("Commit() error = %v", err)
+					}
+					checkFile(t, b, path, tt.data)
+					return
+				}
+				temp.Abort()
+				if tt.existing == nil {
+					checkNotExist(t, b, path)
+				} else {
+					checkFile(t, b, path, tt.existing)
+				}
+			})
+		}
+	})
+}
+
+func TestBackendMultipart(t *testing.T) {
+	parts := [][]byte{content(3000, 1), content(3000, 2), content(1200, 3)}
+	whole := bytes.Join(parts, nil)
+	tests := []struct {
+		name string
+		// send is the order parts are sent in, by number. A part sent
+		// twice carries different data the first time.
+		send     []uint64
+		abort    []uint64 // parts written and then aborted
+		numParts uint64
+		abortAll bool
+		wantErr  bool
+	}{
+		{"in order", []uint64{1, 2, 3}, nil, 3, false, false},
+		{"out of order", []uint64{3, 1, 2}, nil, 3, false, false},
+		{"part sent again", []uint64{1, 2, 2, 3}, nil, 3, false, false},
+		{"aborted part sent again", []uint64{1, 2, 3}, []uint64{2}, 3, false, false},
+		{"missing part", []uint64{1, 3}, nil, 3, false, true},
+		{"abort", []uint64{1, 2, 3}, nil, 3, true, false},
+	}
+	forEachBackend(t, func(t *testing.T, b Backend, dir string) {
+		for i, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				path := filepath.Join(dir, "multi")
+				b.Delete(path)
+				mp, err := b.CreateMultipart(string(rune('a'+i))+"-copy", path, uint64(len(whole)))
+				if err != nil {
+					t.Fatalf("CreateMultipart() error = %v", err)
+				}
+				for _, num := range tt.abort {
+					part, err := mp.CreatePart(num, uint64(len(parts[num-1])))
+					if err != nil {
+						t.Fatalf("CreatePart(%d) error = %v", num, err)
+					}
+					writeTemp(t, part, content(len(parts[num-1]), 99))
+					part.Abort()
+				}
+				sent := make(map[uint64]bool)
+				for _, num := range tt.send {
+					data := parts[num-1]
+					if !sent[num] && countOf(tt.send, num) > 1 {
+						data = content(len(data), 77)
+					}
+					sent[num] = true
+					part, err := mp.CreatePart(num, uint64(len(data)))
+					if err != nil {
+						t.Fatalf("CreatePart(%d) error = %v", num, err)
+					}
+					writeTemp(t, part, data)
+					if err := part.Commit(false); err != nil {
+						t.Fatalf("part %d Commit() error = %v", num, err)
+					}
+				}
+				checkNotExist(t, b, path)
+				if tt.abortAll {
+					if err := mp.Abort(); err != nil {
+						t.Fatalf("Abort() error = %v", err)
+					}
+					checkNotExist(t, b, path)
+					return
+				}
+				err = mp.Commit(tt.numParts, true)
+				if tt.wantErr {
+					if err == nil {
+						t.Fatal("Commit() of a copy with a missing part succeeded")
+					}
+					mp.Abort()
+					checkNotExist(t, b, path)
+					return
+				}
+				if err != nil {
+					t.Fatalf("Commit() error = %v", err)
+				}
+				checkFile(t, b, path, whole)
+			})
+		}
+	})
+}
+
+func countOf(nums []uint64, num uint64) int {
+	n := 0
+	for _, m := range nums {
+		if m == num {
+			n++
+		}
+	}
+	return n
+}
+
+func TestBackendOpenReadAt(t *testing.T) {
+	data := content(5000, 5)
+	tests := []struct {
+		name    string
+		offset  int64
+		length  int
+		wantN   int
+		wantEOF bool
+	}{
+		{"start", 0, 100, 100, false},
+		{"follows on", 100, 400, 400, false},
+		{"backwards", 10, 20, 20, false},
+		{"to the end", 4900, 100, 100, false},
+		{"past the end", 4950, 100, 50, true},
+		{"at the end", 5000, 10, 0, true},
+	}
+	forEachBackend(t, func(t *testing.T, b Backend, dir string) {
+		path := filepath.Join(dir, "read")
+		putFile(t, b, path, data)
+		f, err := b.Open(path)
+		if err != nil {
+			t.Fatalf("Open() error = %v", err)
+		}
+		defer f.Close()
+		// One file is read throughout, as reads that follow on may reuse
+		// the previous one's response.
+		for _, tt := range tests {
+			buf := make([]byte, tt.length)
+			n, err := f.ReadAt(buf, tt.offset)
+			if n != tt.wantN || (err == io.EOF) != tt.wantEOF || (err != nil && err != io.EOF) {
+				t.Errorf("%s: ReadAt(%d bytes at %d) = %d, %v, want %d, EOF %v", tt.name, tt.length, tt.offset,
+					n, err, tt.wantN, tt.wantEOF)
+				continue
+			}
+			if !bytes.Equal(buf[:n], data[tt.offset:tt.offset+int64(n)]) {
+				t.Errorf("%s: ReadAt(%d bytes at %d) read the wrong bytes", tt.name, tt.length, tt.offset)
+			}
+		}
+	})
+}
+
+func TestBackendNotExist(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b Backend, dir string) {
+		path := filepath.Join(dir, "missing")
+		checkNotExist(t, b, path)
+		if err := b.Delete(path); !os.IsNotExist(err) {
+			t.Errorf("Delete() error = %v, want one that is not exist", err)
+		}
+	})
+}
+
+func TestBackendListAndDelete(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b Backend, dir string) {
+		sizes := map[string]int{"a": 10, "b": 20, "c": 30, "sub/d": 5}
+		sub := filepath.Join(dir, "sub")
+		if _, ok := b.(*Local); ok {
+			if err := os.Mkdir(sub, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for name, size := range sizes {
+			putFile(t, b, filepath.Join(dir, name), content(size, 0))
+		}
+
+		tests := []struct {
+			name    string
+			dir     string
+			deleted string
+			want    []string
+		}{
+			{"files directly in dir", dir, "", []string{"a", "b", "c"}},
+			{"subdir", sub, "", []string{"d"}},
+			{"after delete", dir, "b", []string{"a", "c"}},
+		}
+		for _, tt := range tests {
+			if tt.deleted != "" {
+				path := filepath.Join(dir, tt.deleted)
+				if err := b.Delete(path); err != nil {
+					t.Fatalf("Delete(%s) error = %v", path, err)
+				}
+				checkNotExist(t, b, path)
+			}
+			files, err := b.List(tt.dir)
+			if err != nil {
+				t.Fatalf("%s: List() error = %v", tt.name, err)
+			}
+			var got []string
+			for _, fi := range files {
+				got = append(got, fi.Path)
+				rel, _ := filepath.Rel(dir, fi.Path)
+				if fi.Size != uint64(sizes[rel]) {
+					t.Errorf("%s: %s listed with %d bytes, want %d", tt.name, fi.Path, fi.Size, sizes[rel])
+				}
+			}
+			sort.Strings(got)
+			var want []string
+			for _, name := range tt.want {
+				want = append(want, filepath.Join(tt.dir, name))
+			}
+			if !equalStrings(got, want) {
+				t.Errorf("%s: List(%s) = %v, want %v", tt.name, tt.dir, got, want)
+			}
+		}
+	})
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,128 +1,334 @@
 package writer
 
 import (
-	"crypto/md5"
 	"fmt"
 	"hash"
 	"io"
 	"net"
 	"os"
-	"strconv"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/logger"
 	"github.com/chili-copy/common/protocol"
+	"github.com/chili-copy/common/zerocopy"
+	"github.com/chili-copy/server/quota"
+	"github.com/chili-copy/server/space"
+	"github.com/chili-copy/server/storage"
 )
 
 const fileReadBufferSize = 4096
 
 type SingleCopyHandler struct {
-	Conn   net.Conn
-	fd     *os.File
-	Md5    hash.Hash
-	CopyOp *protocol.SingleCopyOp
+	Conn        net.Conn
+	Temp        storage.Temp
+	Md5         hash.Hash
+	CopyOp      *protocol.SingleCopyOp
+	Durable     bool
+	ZeroCopy    bool
+	Preallocate bool
+	Log         *logger.Logger
+	Started     time.Time
+	received    uint64
 }
 
 type MultiPartCopyHandler struct {
 	CopyOp           *protocol.MultiPartCopyOp
 	TotalPartsCopied uint64
-	ScratchDir       string
+	Upload           storage.Multipart
+	// InPlace marks parts kept on the target's filesystem, which are
+	// stitched by moving them into place, so their space comes out of the
+	// target's reservation.
+	InPlace            bool
+	ScratchReservation *space.Reservation
+	TargetReservation  *space.Reservation
+	Quota              *quota.Session // counts the copy against its client's limits
+	partDigestsLock    sync.Mutex
+	partDigests        map[uint64][]byte
+	partSizes          map[uint64]uint64
+	Log                *logger.Logger
+	Remote             string
+	Started            time.Time
+	// partsLock orders parts against stitching and aborting: parts only
+	// start while the copy is initiated or in progress, it is only stitched
+	// with no part being written, and parts being written when it is
+	// aborted are dropped once they end.
+	partsLock     sync.Mutex
+	partsInFlight int
+	abortPending  bool
+	// lastActive is when a part last started or ended, in unix nanoseconds,
+	// 0 if none did yet.
+	lastActive int64
 }
 
 func (mpc *MultiPartCopyHandler) IncreaseTotalPartsCopiedByOne() {
 	atomic.AddUint64(&mpc.TotalPartsCopied, 1)
 }
 
-func (mpc *MultiPartCopyHandler) StitchChunks() ([]byte, error) {
-	hash := md5.New()
-	fout, err := os.OpenFile(mpc.CopyOp.GetFilePath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		fmt.Printf("Failed to open file. Error : %s\n", err.Error())
-		return nil, err
+// RecordPart remembers the digest the server computed for a received part
+// and its size. A part sent again replaces the earlier one.
+func (mpc *MultiPartCopyHandler) RecordPart(partNum uint64, digest []byte, size uint64) {
+	mpc.partDigestsLock.Lock()
+	defer mpc.partDigestsLock.Unlock()
+	if mpc.partDigests == nil {
+		mpc.partDigests = make(map[uint64][]byte)
+		mpc.partSizes = make(map[uint64]uint64)
 	}
-	defer fout.Close()
-	err = fout.Truncate(0)
-	if err != nil {
-		fmt.Printf("Failed to truncate file. Error : %s", err.Error())
-		return nil, err
+	if _, ok := mpc.partDigests[partNum]; !ok {
+		mpc.IncreaseTotalPartsCopiedByOne()
 	}
-	for num := uint64(1); num <= mpc.TotalPartsCopied; num++ {
-		path := mpc.ScratchDir + mpc.CopyOp.GetCopyId().String() + "/" + strconv.FormatUint(num, 10)
-		fin, err := os.Open(path)
-		if err != nil {
-			fmt.Println("Error in MultiPartCopyHandler opening chunk ", err.Error())
-			return nil, err
-		}
-		defer fin.Close()
-		_, err = io.Copy(fout, fin)
-		if err != nil {
-			fmt.Println("error in Write ", err.Error())
-			return nil, err
-		}
-		fin, err = os.Open(path)
-		if err != nil {
-			fmt.Println("Error in MultiPartCopyHandler opening chunk ", err.Error())
-			return nil, err
+	mpc.partDigests[partNum] = digest
+	mpc.partSizes[partNum] = size
+}
+
+// ReceivedBytes is the total size of the parts received so far.
+func (mpc *MultiPartCopyHandler) ReceivedBytes() uint64 {
+	mpc.partDigestsLock.Lock()
+	defer mpc.partDigestsLock.Unlock()
+	total := uint64(0)
+	for _, size := range mpc.partSizes {
+		total += size
+	}
+	return total
+}
+
+// Touch marks the copy as active, so it does not expire.
+func (mpc *MultiPartCopyHandler) Touch() {
+	atomic.StoreInt64(&mpc.lastActive, time.Now().UnixNano())
+}
+
+// Idle is how long ago a part last started or ended, or the copy started if
+// no part did. It is 0 while parts are being written.
+func (mpc *MultiPartCopyHandler) Idle() time.Duration {
+	mpc.partsLock.Lock()
+	inFlight := mpc.partsInFlight
+	mpc.partsLock.Unlock()
+	if inFlight > 0 {
+		return 0
+	}
+	last := atomic.LoadInt64(&mpc.lastActive)
+	if last == 0 {
+		return time.Since(mpc.Started)
+	}
+	return time.Since(time.Unix(0, last))
+}
+
+// CombinedChecksum builds the multipart checksum from the digests of parts
+// 1 to numParts, failing if any of them has not been received.
+func (mpc *MultiPartCopyHandler) CombinedChecksum(numParts uint64) ([]byte, error) {
+	mpc.partDigestsLock.Lock()
+	defer mpc.partDigestsLock.Unlock()
+	digests := make([][]byte, 0, numParts)
+	for num := uint64(1); num <= numParts; num++ {
+		digest, ok := mpc.partDigests[num]
+		if !ok {
+			return nil, fmt.Errorf("part %d of copyId %s not received", num, mpc.CopyOp.GetCopyId().String())
 		}
-		defer fin.Close()
-		_, err = io.Copy(hash, fin)
-		if err != nil {
-			fmt.Println("error in Copy Hash ", err.Error())
-			return nil, err
+		digests = append(digests, digest)
+	}
+	return common.CombinePartDigests(digests), nil
+}
+
+// BeginPart counts a part as being written, unless the copy is no longer
+// initiated or in progress. EndPart must be called once it is written.
+func (mpc *MultiPartCopyHandler) BeginPart() (protocol.MultiPartOpState, bool) {
+	mpc.partsLock.Lock()
+	defer mpc.partsLock.Unlock()
+	state := mpc.CopyOp.GetState()
+	if state != protocol.INITIATED && state != protocol.INPROGRESS {
+		return state, false
+	}
+	mpc.partsInFlight++
+	return state, true
+}
+
+// EndPart ends a part begun with BeginPart, dropping the parts if the copy
+// was aborted while it was written.
+func (mpc *MultiPartCopyHandler) EndPart() {
+	mpc.partsLock.Lock()
+	mpc.partsInFlight--
+	drop := mpc.partsInFlight == 0 && mpc.abortPending
+	if drop {
+		mpc.abortPending = false
+	}
+	mpc.partsLock.Unlock()
+	if drop {
+		mpc.dropParts()
+	}
+}
+
+// BeginStitch moves the copy to STITCHING if it is initiated or in progress
+// and no part is being written, so that only one request stitches it.
+func (mpc *MultiPartCopyHandler) BeginStitch() bool {
+	mpc.partsLock.Lock()
+	defer mpc.partsLock.Unlock()
+	if mpc.partsInFlight > 0 {
+		return false
+	}
+	return mpc.CopyOp.CompareAndSwapState(protocol.INPROGRESS, protocol.STITCHING) ||
+		mpc.CopyOp.CompareAndSwapState(protocol.INITIATED, protocol.STITCHING)
+}
+
+// BeginAbort moves the copy to ABORTED unless it is being stitched or was
+// aborted already. Parts no longer start afterwards.
+func (mpc *MultiPartCopyHandler) BeginAbort() bool {
+	mpc.partsLock.Lock()
+	defer mpc.partsLock.Unlock()
+	return mpc.CopyOp.CompareAndSwapState(protocol.INITIATED, protocol.ABORTED) ||
+		mpc.CopyOp.CompareAndSwapState(protocol.INPROGRESS, protocol.ABORTED)
+}
+
+// PreallocateTarget allocates the whole target file up front, if the
+// storage can. The target's share of the space reservation is then no
+// longer needed. It returns space.ErrInsufficientSpace if the disk is too
+// full for the file.
+func (mpc *MultiPartCopyHandler) PreallocateTarget() error {
+	p, ok := mpc.Upload.(storage.Preallocator)
+	if !ok {
+		return nil
+	}
+	if err := p.Preallocate(); err != nil {
+		mpc.Log.Warn("failed to preallocate file", "path", mpc.CopyOp.GetFilePath(), "error", err)
+		if isNoSpace(err) {
+			return space.ErrInsufficientSpace
 		}
-		fin.Close()
-		if err := os.Remove(path); err != nil {
-			fmt.Println("Error removing chunk")
-			return nil, err
+		return err
+	}
+	mpc.TargetReservation.Release()
+	return nil
+}
+
+// StitchChunks puts parts 1 to numParts together at the target path.
+func (mpc *MultiPartCopyHandler) StitchChunks(numParts uint64, durable bool) error {
+	if err := mpc.Upload.Commit(numParts, durable); err != nil {
+		mpc.Log.Error("failed to stitch parts", "error", err)
+		return err
+	}
+	return nil
+}
+
+// Abort drops whatever parts have been received so far, once the parts
+// being written end.
+func (mpc *MultiPartCopyHandler) Abort() {
+	mpc.partsLock.Lock()
+	if mpc.partsInFlight > 0 {
+		mpc.abortPending = true
+		mpc.partsLock.Unlock()
+		return
+	}
+	mpc.partsLock.Unlock()
+	mpc.dropParts()
+}
+
+func (mpc *MultiPartCopyHandler) dropParts() {
+	if mpc.Upload != nil {
+		if err := mpc.Upload.Abort(); err != nil {
+			mpc.Log.Warn("failed to drop parts", "error", err)
 		}
 	}
-	if err := os.Remove(mpc.ScratchDir + mpc.CopyOp.GetCopyId().String()); err != nil {
-		fmt.Println("Error removing tmp dir")
-		return nil, err
+	mpc.ReleaseSpace()
+	mpc.Quota.End()
+}
+
+// ConsumeReservation gives back n bytes of reserved space once a part of
+// that size has been written to scratch.
+func (mpc *MultiPartCopyHandler) ConsumeReservation(n uint64) {
+	if mpc.InPlace {
+		mpc.TargetReservation.Consume(n)
+		return
 	}
-	return hash.Sum(nil), nil
+	mpc.ScratchReservation.Consume(n)
+}
+
+func (mpc *MultiPartCopyHandler) ReleaseSpace() {
+	mpc.ScratchReservation.Release()
+	mpc.TargetReservation.Release()
 }
 
+// Handle writes the content to the temp and commits it, or aborts it if
+// anything fails.
 func (sc *SingleCopyHandler) Handle() ([]byte, error) {
-	b := make([]byte, fileReadBufferSize)
-	f, err := os.OpenFile(sc.CopyOp.GetFilePath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if sc.Preallocate {
+		if p, ok := sc.Temp.(storage.Preallocator); ok {
+			if err := p.Preallocate(); err != nil {
+				sc.Log.Warn("failed to preallocate file", "path", sc.CopyOp.GetFilePath(), "error", err)
+				if isNoSpace(err) {
+					sc.Temp.Abort()
+					return nil, space.ErrInsufficientSpace
+				}
+			}
+		}
+	}
+	var err error
+	if f, ok := sc.Temp.(storage.OSFile); ok && sc.ZeroCopy {
+		err = sc.spliceAndHash(f.File())
+	} else {
+		err = sc.readAndAppend()
+	}
 	if err != nil {
-		fmt.Printf("error in SingleCopyHandler Handle() : %s\n", err.Error())
+		sc.Temp.Abort()
 		return nil, err
 	}
-	sc.fd = f
-	defer sc.fd.Close()
-	err = f.Truncate(0)
-	if err != nil {
-		fmt.Printf("Failed to truncate file. Error : %s\n", err.Error())
+	if err := sc.Temp.Commit(sc.Durable); err != nil {
+		sc.Log.Error("failed to commit file", "path", sc.CopyOp.GetFilePath(), "error", err)
 		return nil, err
 	}
+	return sc.Md5.Sum(nil), nil
+}
+
+func (sc *SingleCopyHandler) readAndAppend() error {
+	b := make([]byte, fileReadBufferSize)
 	toBeRead := sc.CopyOp.GetContentLength()
 	for toBeRead > 0 {
 		len, err := sc.Conn.Read(b)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		err = sc.createOrAppendFile(b[:len])
+		err = sc.writeAndHash(b[:len])
 		if err != nil {
-			return nil, err
+			return err
 		}
 		toBeRead = toBeRead - uint64(len)
+		atomic.AddUint64(&sc.received, uint64(len))
 	}
+	return nil
+}
 
-	return sc.Md5.Sum(nil), nil
+// ReceivedBytes is how much of the content has been written so far. With
+// zero copy it only moves once all of it has been spliced.
+func (sc *SingleCopyHandler) ReceivedBytes() uint64 {
+	return atomic.LoadUint64(&sc.received)
 }
 
-func (sc *SingleCopyHandler) CreateDir(path string) {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		os.Mkdir(path, os.ModePerm)
+// spliceAndHash moves the content from the socket to the file without
+// passing it through userspace, then computes the checksum by reading the
+// file back, which is normally served from the page cache.
+func (sc *SingleCopyHandler) spliceAndHash(f *os.File) error {
+	n, err := zerocopy.SpliceToFile(f, sc.Conn, int64(sc.CopyOp.GetContentLength()))
+	if err != nil {
+		sc.Log.Error("failed to splice into file", "path", sc.CopyOp.GetFilePath(), "error", err)
+		return err
 	}
+	atomic.AddUint64(&sc.received, uint64(n))
+	_, err = io.Copy(sc.Md5, io.NewSectionReader(f, 0, n))
+	return err
 }
 
-func (sc *SingleCopyHandler) createOrAppendFile(b []byte) error {
-	len, err := sc.fd.Write(b)
+func (sc *SingleCopyHandler) writeAndHash(b []byte) error {
+	len, err := sc.Temp.WriteAt(b, int64(atomic.LoadUint64(&sc.received)))
 	if err != nil {
 		return err
 	}
 	sc.Md5.Write(b[:len])
 	return nil
 }
+
+func isNoSpace(err error) bool {
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return err == syscall.ENOSPC
+}
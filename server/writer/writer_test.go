@@ -0,0 +1,247 @@
+package writer
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chili-copy/common"
+	"github.com/chili-copy/common/logger"
+	"github.com/chili-copy/common/protocol"
+	"github.com/chili-copy/server/storage"
+)
+
+// countingUpload is a multipart upload that counts how often it is aborted.
+type countingUpload struct {
+	storage.Multipart
+	aborts int
+}
+
+func (u *countingUpload) Abort() error {
+	u.aborts++
+	return nil
+}
+
+func newTestCopy(state protocol.MultiPartOpState) (*MultiPartCopyHandler, *countingUpload) {
+	mpo := protocol.NewMultiPartCopyOp(protocol.PrepareMultiPartInitRequestOpHeader("/file", 100))
+	mpo.SetState(state)
+	upload := &countingUpload{}
+	return &MultiPartCopyHandler{CopyOp: mpo, Upload: upload, Log: logger.With(), Started: time.Now()}, upload
+}
+
+// TestPartState runs steps on a copy, each of which must return its want:
+// "part" begins a part, "end" ends one, "stitch" and "abort" begin those,
+// and "drop" drops the parts, as a copy being aborted does.
+func TestPartState(t *testing.T) {
+	type step struct {
+		op   string
+		want bool
+	}
+	tests := []struct {
+		name      string
+		state     protocol.MultiPartOpState
+		steps     []step
+		wantState protocol.MultiPartOpState
+		wantDrops int
+	}{
+		{"parts while initiated", protocol.INITIATED,
+			[]step{{"part", true}, {"part", true}, {"end", true}, {"end", true}}, protocol.INITIATED, 0},
+		{"part while in progress", protocol.INPROGRESS, []step{{"part", true}, {"end", true}}, protocol.INPROGRESS, 0},
+		{"part before init ends", protocol.INITIALIZING, []step{{"part", false}}, protocol.INITIALIZING, 0},
+		{"part while stitching", protocol.INPROGRESS, []step{{"stitch", true}, {"part", false}}, protocol.STITCHING, 0},
+		{"part once aborted", protocol.INPROGRESS, []step{{"abort", true}, {"part", false}}, protocol.ABORTED, 0},
+		{"part once completed", protocol.COMPLETED, []step{{"part", false}}, protocol.COMPLETED, 0},
+		{"stitch waits for parts", protocol.INPROGRESS,
+			[]step{{"part", true}, {"stitch", false}, {"end", true}, {"stitch", true}}, protocol.STITCHING, 0},
+		{"stitch once", protocol.INITIATED, []step{{"stitch", true}, {"stitch", false}}, protocol.STITCHING, 0},
+		{"no abort while stitching", protocol.INPROGRESS, []step{{"stitch", true}, {"abort", false}},
+			protocol.STITCHING, 0},
+		{"abort once", protocol.INITIATED, []step{{"abort", true}, {"abort", false}}, protocol.ABORTED, 0},
+		{"drop at once", protocol.INPROGRESS, []step{{"abort", true}, {"drop", true}}, protocol.ABORTED, 1},
+		{"drop once parts end", protocol.INPROGRESS,
+			[]step{{"part", true}, {"part", true}, {"abort", true}, {"drop", true}, {"end", true}, {"end", true}},
+			protocol.ABORTED, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mph, upload := newTestCopy(tt.state)
+			inFlight := 0
+			for i, s := range tt.steps {
+				got := true
+				switch s.op {
+				case "part":
+					if _, got = mph.BeginPart(); got {
+						inFlight++
+					}
+				case "end":
+					mph.EndPart()
+					inFlight--
+				case "stitch":
+					got = mph.BeginStitch()
+				case "abort":
+					got = mph.BeginAbort()
+				case "drop":
+					mph.Abort()
+				}
+				if got != s.want {
+					t.Fatalf("step %d, %s = %v, want %v", i, s.op, got, s.want)
+				}
+				if upload.aborts > 0 && inFlight > 0 {
+					t.Fatalf("parts dropped at step %d, with parts being written", i)
+				}
+			}
+			if state := mph.CopyOp.GetState(); state != tt.wantState {
+				t.Errorf("state = %s, want %s", state, tt.wantState)
+			}
+			if upload.aborts != tt.wantDrops {
+				t.Errorf("parts dropped %d times, want %d", upload.aborts, tt.wantDrops)
+			}
+		})
+	}
+}
+
+func TestIdle(t *testing.T) {
+	mph, _ := newTestCopy(protocol.INPROGRESS)
+	mph.Started = time.Now().Add(-time.Hour)
+	if idle := mph.Idle(); idle < time.Hour {
+		t.Errorf("Idle() with no parts = %s, want since the copy started", idle)
+	}
+	mph.BeginPart()
+	if idle := mph.Idle(); idle != 0 {
+		t.Errorf("Idle() with a part being written = %s, want 0", idle)
+	}
+	mph.Touch()
+	mph.EndPart()
+	if idle := mph.Idle(); idle <= 0 || idle > time.Minute {
+		t.Errorf("Idle() after a part = %s, want since it ended", idle)
+	}
+}
+
+func TestCombinedChecksum(t *testing.T) {
+	type part struct {
+		num  uint64
+		data string
+	}
+	digest := func(s string) []byte {
+		sum := md5.Sum([]byte(s))
+		return sum[:]
+	}
+	tests := []struct {
+		name      string
+		parts     []part
+		numParts  uint64
+		want      []string
+		wantErr   bool
+		wantBytes uint64
+	}{
+		{"in order", []part{{1, "one"}, {2, "two"}, {3, "three"}}, 3, []string{"one", "two", "three"}, false, 11},
+		{"out of order", []part{{3, "three"}, {1, "one"}, {2, "two"}}, 3, []string{"one", "two", "three"}, false, 11},
+		{"resent part replaces", []part{{1, "one"}, {2, "tw"}, {2, "two"}}, 2, []string{"one", "two"}, false, 6},
+		{"missing part", []part{{1, "one"}, {3, "three"}}, 3, nil, true, 8},
+		{"fewer parts than received", []part{{1, "one"}, {2, "two"}}, 1, []string{"one"}, false, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mph := &MultiPartCopyHandler{CopyOp: protocol.NewMultiPartCopyOp(protocol.PrepareMultiPartInitRequestOpHeader("/file", 100))}
+			for _, p := range tt.parts {
+				mph.RecordPart(p.num, digest(p.data), uint64(len(p.data)))
+			}
+			got, err := mph.CombinedChecksum(tt.numParts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CombinedChecksum() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				var digests [][]byte
+				for _, data := range tt.want {
+					digests = append(digests, digest(data))
+				}
+				if want := common.CombinePartDigests(digests); !bytes.Equal(got, want) {
+					t.Errorf("CombinedChecksum() = %x, want %x", got, want)
+				}
+			}
+			if n := mph.ReceivedBytes(); n != tt.wantBytes {
+				t.Errorf("ReceivedBytes() = %d, want %d", n, tt.wantBytes)
+			}
+			distinct := make(map[uint64]bool)
+			for _, p := range tt.parts {
+				distinct[p.num] = true
+			}
+			if mph.TotalPartsCopied != uint64(len(distinct)) {
+				t.Errorf("TotalPartsCopied = %d, want %d", mph.TotalPartsCopied, len(distinct))
+			}
+		})
+	}
+}
+
+func TestSingleCopyHandle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := bytes.Repeat([]byte("chili"), 50000)
+	tests := []struct {
+		name     string
+		size     int
+		sent     int
+		zeroCopy bool
+		wantErr  bool
+	}{
+		{"whole file", len(data), len(data), false, false},
+		{"whole file zero copy", len(data), len(data), true, false},
+		{"empty file", 0, 0, false, false},
+		{"short data", len(data), len(data) / 2, false, true},
+		{"short data zero copy", len(data), len(data) / 2, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Zero copy needs the temp to be a file, so the copies are
+			// made to local storage.
+			store := storage.NewLocal()
+			path := filepath.Join(dir, "file")
+			os.Remove(path)
+			temp, err := store.CreateTemp(path, uint64(tt.size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, server := net.Pipe()
+			go func() {
+				client.Write(data[:tt.sent])
+				client.Close()
+			}()
+			sc := &SingleCopyHandler{
+				Conn:     server,
+				Temp:     temp,
+				Md5:      md5.New(),
+				CopyOp:   protocol.NewSingleCopyOp(protocol.PrepareSingleCopyRequestOpHeader(path, uint64(tt.size), 0)),
+				ZeroCopy: tt.zeroCopy,
+				Log:      logger.With(),
+			}
+			sum, err := sc.Handle()
+			server.Close()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Handle() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if _, err := store.Stat(path); err == nil {
+					t.Error("file was committed though the copy failed")
+				}
+				return
+			}
+			if want := md5.Sum(data[:tt.size]); !bytes.Equal(sum, want[:]) {
+				t.Errorf("Handle() = %x, want %x", sum, want)
+			}
+			if n := sc.ReceivedBytes(); n != uint64(tt.size) {
+				t.Errorf("ReceivedBytes() = %d, want %d", n, tt.size)
+			}
+			if b, _ := ioutil.ReadFile(path); !bytes.Equal(b, data[:tt.size]) {
+				t.Errorf("copied %d bytes that differ from the %d sent", len(b), tt.size)
+			}
+		})
+	}
+}